@@ -201,6 +201,12 @@ func (b *Backend) HardwareAuthenticate() error {
 		return fmt.Errorf("%s", h.RFgB("pin2 does not match, invalid ext authentication"))
 	}
 
+	// Derive the key wrapping key, private key material on disk is unreadable
+	// until this point
+	if err := crypto.LoadMasterKey([]byte(hmK), []byte(hmI)); err != nil {
+		return err
+	}
+
 	return nil
 }
 
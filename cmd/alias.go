@@ -0,0 +1,211 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jedib0t/go-pretty/table"
+	"github.com/spf13/cobra"
+
+	h "github.com/block27/core/helpers"
+	"github.com/block27/core/services/audit"
+	"github.com/block27/core/services/dsa/alias"
+)
+
+var (
+	// Alias flags ...
+	aliasName  string
+	aliasCurve string
+
+	// Rotate flags ...
+	rotateAlias string
+	rotateDue   bool
+)
+
+func init() {
+	// Alias flags ...
+	aliasCreateCmd.Flags().StringVarP(&aliasName, "name", "n", "", "name required")
+	aliasCreateCmd.Flags().StringVarP(&aliasCurve, "curve", "c", "prime256v1", "default: prime256v1")
+	aliasCreateCmd.MarkFlagRequired("name")
+
+	aliasGetCmd.Flags().StringVarP(&aliasName, "name", "n", "", "name required")
+	aliasGetCmd.MarkFlagRequired("name")
+
+	// Rotate flags ...
+	dsaRotateCmd.Flags().StringVarP(&rotateAlias, "alias", "a", "", "alias to rotate")
+	dsaRotateCmd.Flags().BoolVar(&rotateDue, "due", false, "rotate every alias past its config rotation period")
+}
+
+// printAliases renders the aliases and their versions as a table
+func printAliases(aliases []*alias.Alias) {
+	tw := table.NewWriter()
+	tw.SetOutputMirror(os.Stdout)
+	tw.AppendHeader(table.Row{"Alias", "Version", "Key", "Created", "Primary"})
+
+	for _, a := range aliases {
+		for _, v := range a.Versions {
+			primary := ""
+			if v.Number == a.Primary {
+				primary = "*"
+			}
+
+			tw.AppendRow(table.Row{a.Name, v.Number, v.GID, v.CreatedAt.Format(time.RFC3339), primary})
+		}
+	}
+
+	tw.SetStyle(table.StyleColoredBright)
+	tw.Render()
+}
+
+var aliasCmd = &cobra.Command{
+	Use:   "alias",
+	Short: "Named, versioned keys",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return fmt.Errorf(fmt.Sprintf("%s", h.RFgB("requires an argument")))
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {},
+}
+
+var aliasCreateCmd = &cobra.Command{
+	Use:         "create",
+	Short:       "Create an alias with a new version 1 key",
+	Annotations: daemonCommand,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Alias[CREATE]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if Daemon != nil {
+			remoteAliasCreate()
+			return
+		}
+
+		op := audited(audit.OpCreate, "")
+		defer op.done()
+
+		a, err := alias.Create(*B.C, B.D, aliasName, aliasCurve)
+		if err != nil {
+			panic(err)
+		}
+
+		op.Key, op.Detail = a.Version(a.Primary).GID, fmt.Sprintf("alias %s v%d", a.Name, a.Primary)
+
+		printAliases([]*alias.Alias{a})
+	},
+}
+
+var aliasGetCmd = &cobra.Command{
+	Use:         "get",
+	Short:       "Show an alias and its versions",
+	Annotations: daemonCommand,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Alias[GET]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if Daemon != nil {
+			remoteAliasGet()
+			return
+		}
+
+		a, err := alias.Must(B.D, aliasName)
+		if err != nil {
+			panic(err)
+		}
+
+		printAliases([]*alias.Alias{a})
+	},
+}
+
+var aliasListCmd = &cobra.Command{
+	Use:         "list",
+	Short:       "List all aliases",
+	Annotations: daemonCommand,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Alias[LIST]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if Daemon != nil {
+			remoteAliasList()
+			return
+		}
+
+		aliases, err := alias.List(B.D)
+		if err != nil {
+			panic(err)
+		}
+
+		if len(aliases) == 0 {
+			B.L.Printf("No aliases available")
+		} else {
+			printAliases(aliases)
+		}
+	},
+}
+
+var dsaRotateCmd = &cobra.Command{
+	Use:         "rotate",
+	Short:       "Create a new primary version of an alias",
+	Annotations: daemonCommand,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		if (rotateAlias == "") == !rotateDue {
+			panic(fmt.Errorf("%s", h.RFgB("pass exactly one of --alias or --due")))
+		}
+
+		B.L.Printf("%s", h.CFgB("=== Keys[ROTATE]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if Daemon != nil {
+			remoteRotate()
+			return
+		}
+
+		names := []string{rotateAlias}
+
+		if rotateDue {
+			due, err := alias.Due(*B.C, B.D, time.Now())
+			if err != nil {
+				panic(err)
+			}
+
+			names = names[:0]
+			for _, a := range due {
+				names = append(names, a.Name)
+			}
+
+			if len(names) == 0 {
+				B.L.Printf("No aliases due for rotation")
+				return
+			}
+		}
+
+		var rotated []*alias.Alias
+
+		for _, name := range names {
+			a := rotate(name)
+
+			B.L.Printf("===> %s now v%d", h.WFgB(a.Name), a.Primary)
+			rotated = append(rotated, a)
+		}
+
+		printAliases(rotated)
+	},
+}
+
+// rotate rotates a single alias, audited on its own
+func rotate(name string) *alias.Alias {
+	op := audited(audit.OpLifecycle, "")
+	defer op.done()
+
+	a, err := alias.Rotate(*B.C, B.D, name)
+	if err != nil {
+		panic(err)
+	}
+
+	op.Key, op.Detail = a.Version(a.Primary).GID, fmt.Sprintf("alias %s rotated to v%d", a.Name, a.Primary)
+
+	return a
+}
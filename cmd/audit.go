@@ -0,0 +1,227 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jedib0t/go-pretty/table"
+	"github.com/spf13/cobra"
+
+	h "github.com/block27/core/helpers"
+	"github.com/block27/core/services/audit"
+	"github.com/block27/core/services/auth"
+	"github.com/block27/core/services/dsa/ecdsa"
+	"github.com/block27/core/services/dsa/policy"
+)
+
+var (
+	// Setup flags ...
+	auditSetupName  string
+	auditSetupCurve string
+
+	// Show flags ...
+	auditKey   string
+	auditOp    string
+	auditSince string
+	auditUntil string
+)
+
+func init() {
+	// Setup flags ...
+	auditSetupCmd.Flags().StringVarP(&auditSetupName, "name", "n", "audit", "name of the checkpoint signing key")
+	auditSetupCmd.Flags().StringVarP(&auditSetupCurve, "curve", "c", "prime256v1", "default: prime256v1")
+
+	// Show flags ...
+	auditShowCmd.Flags().StringVarP(&auditKey, "key", "k", "", "key name/slug/fingerprint/gid")
+	auditShowCmd.Flags().StringVarP(&auditOp, "op", "o", "", fmt.Sprintf("operation: [%s, %s, %s, %s, %s, %s, %s, %s]",
+		audit.OpCreate, audit.OpSign, audit.OpVerify, audit.OpExport, audit.OpImport, audit.OpLifecycle, audit.OpAuth, audit.OpLimit))
+	auditShowCmd.Flags().StringVar(&auditSince, "since", "", "entries from, 2006-01-02 or RFC 3339")
+	auditShowCmd.Flags().StringVar(&auditUntil, "until", "", "entries before, 2006-01-02 or RFC 3339")
+}
+
+// operation is an audit entry filled in while a command runs, see audited
+type operation struct {
+	audit.Entry
+}
+
+// audited starts the audit entry of a command, recorded by a deferred done
+// once the command returns or panics
+func audited(op string, key string) *operation {
+	o := &operation{Entry: audit.Entry{Op: op, Key: key}}
+	if Session != nil {
+		o.Actor = Session.Name
+	}
+
+	return o
+}
+
+// done records the operation, as failed with the reason if the command is
+// panicking. An operation that cannot be recorded fails the command.
+func (o *operation) done() {
+	r := recover()
+	if r != nil {
+		o.Result = audit.ResultFailed
+
+		if o.Detail == "" {
+			o.Detail = fmt.Sprint(r)
+		} else {
+			o.Detail = fmt.Sprintf("%s: %v", o.Detail, r)
+		}
+	}
+
+	if _, err := audit.NewLog(*B.C, B.D).Append(o.Entry); err != nil && r == nil {
+		r = fmt.Errorf("%s %v", h.RFgB("audit log unavailable:"), err)
+	}
+
+	if r != nil {
+		panic(r)
+	}
+}
+
+// printEntries renders audit entries as a table
+func printEntries(entries []audit.Entry) {
+	tw := table.NewWriter()
+	tw.SetOutputMirror(os.Stdout)
+	tw.AppendHeader(table.Row{"Seq", "Time", "Op", "Key", "Actor", "Result", "Detail"})
+
+	for _, e := range entries {
+		result := h.GFgB(e.Result)
+		if e.Result != audit.ResultOK {
+			result = h.RFgB(e.Result)
+		}
+
+		tw.AppendRow(table.Row{e.Seq, e.Time.Format(time.RFC3339), e.Op, e.Key, e.Actor, result, e.Detail})
+	}
+
+	tw.SetStyle(table.StyleColoredBright)
+	tw.Render()
+}
+
+var auditCmd = &cobra.Command{
+	Use:         "audit",
+	Short:       "Hash-chained, signed log of every key operation",
+	Annotations: map[string]string{rolesAnnotation: auth.RoleAuditor + "," + auth.RoleOfficer},
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return fmt.Errorf(fmt.Sprintf("%s", h.RFgB("requires an argument")))
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {},
+}
+
+var auditSetupCmd = &cobra.Command{
+	Use:   "setup",
+	Short: "Create the key audit checkpoints are signed with",
+	Long: `Creates the device key the head of the audit log is signed with every
+audit.checkpoint_interval entries. Running it again rotates the key, older
+checkpoints keep verifying under the key that signed them.`,
+	Annotations: map[string]string{rolesAnnotation: auth.RoleOfficer},
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Audit[SETUP]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		op := audited(audit.OpCreate, "")
+		defer op.done()
+
+		key, err := audit.Setup(*B.C, B.D, auditSetupName, auditSetupCurve)
+		if err != nil {
+			panic(err)
+		}
+
+		op.Key, op.Detail = key.FilePointer(), "audit checkpoint key"
+
+		ecdsa.PrintKeyTW(key.Struct())
+	},
+}
+
+var auditCheckpointCmd = &cobra.Command{
+	Use:   "checkpoint",
+	Short: "Sign the head of the audit log now",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Audit[CHECKPOINT]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		cp, err := audit.NewLog(*B.C, B.D).Checkpoint()
+		if err != nil {
+			panic(err)
+		}
+
+		B.L.Printf("===> entry %s signed by %s", h.GFgB(cp.Seq), h.WFgB(cp.Signer))
+	},
+}
+
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check the audit log for edits and truncation",
+	Long: `Recomputes the hash chain of the whole audit log and checks every
+checkpoint signature. Edited, reordered or deleted entries break the chain,
+entries cut from the end are missing below the log's sequence number or a
+checkpoint. Entries after the last checkpoint are only as trustworthy as the
+database they are stored in.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Audit[VERIFY]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		r, err := audit.NewLog(*B.C, B.D).Verify()
+		if err != nil {
+			panic(err)
+		}
+
+		for _, p := range r.Problems {
+			B.L.Printf("===> entry %s %s", h.WFgB(p.Seq), h.RFgB(p.Detail))
+		}
+
+		B.L.Printf("===> %s entries, %s checkpoints, signed up to entry %s of %s",
+			h.GFgB(r.Entries), h.GFgB(r.Checkpoints), h.WFgB(r.Signed), h.WFgB(r.Head))
+
+		if len(r.Problems) != 0 {
+			panic(fmt.Errorf("%s", h.RFgB("the audit log failed verification")))
+		}
+
+		if r.Signed < r.Head {
+			B.L.Printf("===> %s", h.YFgB(fmt.Sprintf("%d entries are not covered by a checkpoint yet", r.Head-r.Signed)))
+		}
+	},
+}
+
+var auditShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "List audit entries by key, operation and time",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Audit[SHOW]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		since, err := policy.ParseTime(auditSince)
+		if err != nil {
+			panic(err)
+		}
+
+		until, err := policy.ParseTime(auditUntil)
+		if err != nil {
+			panic(err)
+		}
+
+		// Keys no longer in the store are matched by GID
+		key := auditKey
+		if key != "" {
+			if k, err := ecdsa.ResolveECDSA(*B.C, key); err == nil {
+				key = k.FilePointer()
+			}
+		}
+
+		entries, err := audit.NewLog(*B.C, B.D).Entries(audit.Filter{
+			Key:   key,
+			Op:    auditOp,
+			Since: since,
+			Until: until,
+		})
+		if err != nil {
+			panic(err)
+		}
+
+		printEntries(entries)
+	},
+}
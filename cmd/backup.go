@@ -0,0 +1,192 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jedib0t/go-pretty/table"
+	"github.com/spf13/cobra"
+
+	h "github.com/block27/core/helpers"
+	"github.com/block27/core/services/audit"
+	"github.com/block27/core/services/auth"
+	"github.com/block27/core/services/backup"
+	"github.com/block27/core/services/dsa/ecdsa"
+)
+
+var (
+	// Create flags ...
+	backupOut    string
+	backupSigner string
+
+	// Restore flags ...
+	backupIn       string
+	backupConflict string
+	backupPin      string
+)
+
+func init() {
+	// Create flags ...
+	backupCreateCmd.Flags().StringVarP(&backupOut, "out", "o", "", "archive path required")
+	backupCreateCmd.Flags().StringVarP(&backupSigner, "signer", "s", "", "key signing the manifest, name/slug/fingerprint/gid required")
+	backupCreateCmd.MarkFlagRequired("out")
+	backupCreateCmd.MarkFlagRequired("signer")
+
+	// Restore flags ...
+	backupRestoreCmd.Flags().StringVarP(&backupIn, "in", "i", "", "archive path required")
+	backupRestoreCmd.Flags().StringVar(&backupConflict, "on-conflict", backup.PolicyFail,
+		fmt.Sprintf("conflict policy: [%s, %s, %s]", backup.PolicyFail, backup.PolicySkip, backup.PolicyOverwrite))
+	backupRestoreCmd.Flags().StringVar(&backupPin, "signer-fingerprint", "", "require the manifest signed by this SHA256 fingerprint")
+	backupRestoreCmd.MarkFlagRequired("in")
+}
+
+// printPlan renders the changes of a restore as a table
+func printPlan(p *backup.Plan) {
+	tw := table.NewWriter()
+	tw.SetOutputMirror(os.Stdout)
+	tw.AppendHeader(table.Row{"Item", "Name", "Action", "Detail"})
+
+	for _, ch := range p.Changes {
+		action := ch.Action
+		switch ch.Action {
+		case backup.ActionConflict:
+			action = h.RFgB(action)
+		case backup.ActionCreate, backup.ActionReplace:
+			action = h.GFgB(action)
+		}
+
+		tw.AppendRow(table.Row{ch.Item, ch.Name, action, ch.Detail})
+	}
+
+	tw.SetStyle(table.StyleColoredBright)
+	tw.Render()
+}
+
+var backupCmd = &cobra.Command{
+	Use:         "backup",
+	Short:       "Encrypted backup and restore of the key store",
+	Annotations: map[string]string{rolesAnnotation: auth.RoleOfficer},
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return fmt.Errorf(fmt.Sprintf("%s", h.RFgB("requires an argument")))
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {},
+}
+
+var backupCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Write an encrypted archive of every key, the database and config",
+	Long: `Writes a single archive holding every key record, a consistent snapshot
+of the database and the config file, encrypted and authenticated under a key
+derived from the hardware master key. A manifest listing the fingerprint of
+every key is signed with --signer.
+
+Key records stay wrapped under the master key, so the archive restores on
+this device or on a new one provisioned with the same master key: the
+hardware master key and iv must be transferred to the new device before
+restore, which refuses archives naming another master key.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Backup[CREATE]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		op := audited(audit.OpExport, backupSigner)
+		defer op.done()
+
+		signer, err := ecdsa.ResolveECDSA(*B.C, backupSigner)
+		if err != nil {
+			panic(err)
+		}
+
+		op.Key = signer.FilePointer()
+
+		requireQuorum(auth.ActionExport, backupTarget)
+
+		f, err := os.OpenFile(backupOut, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+
+		m, err := backup.Create(*B.C, B.D, signer, f)
+		if err != nil {
+			os.Remove(backupOut)
+			panic(err)
+		}
+
+		if err := f.Sync(); err != nil {
+			panic(err)
+		}
+
+		for _, k := range m.Keys {
+			B.L.Printf("===> %s %s %s", h.WFgB(k.GID), k.Name, h.CFgB(k.FingerprintSHA))
+		}
+
+		op.Detail = fmt.Sprintf("backup of %d keys to %s", len(m.Keys), backupOut)
+
+		B.L.Printf("===> %s keys backed up to %s, manifest signed by %s, master key %s",
+			h.GFgB(len(m.Keys)), h.WFgB(backupOut), h.CFgB(m.Signer.FingerprintSHA), h.WFgB(m.MasterKey))
+	},
+}
+
+var backupRestoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore an archive written by backup create",
+	Long: `Decrypts an archive, checks the manifest signature and the digest of
+every member, then restores the key records, database entries and config
+file, all of them or none. Items that differ from the device's are resolved
+by --on-conflict, nothing is written while a conflict remains. --dry-run
+previews the changes.
+
+The device must hold the master key the archive was written under, a new
+device is provisioned with the originating device's master key first.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Backup[RESTORE]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		f, err := os.Open(backupIn)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+
+		a, err := backup.Open(f, backupPin)
+		if err != nil {
+			panic(err)
+		}
+
+		B.L.Printf("===> archive of %s keys from %s, %s, signed by %s, master key %s",
+			h.GFgB(len(a.Manifest.Keys)), h.WFgB(a.Manifest.Serial),
+			a.Manifest.CreatedAt.Format("2006-01-02 15:04:05"), h.CFgB(a.Manifest.Signer.FingerprintSHA),
+			h.WFgB(a.Manifest.MasterKey))
+
+		p, err := a.Plan(*B.C, B.D, backupConflict)
+		if err != nil {
+			panic(err)
+		}
+
+		printPlan(p)
+
+		if DryRun {
+			return
+		}
+
+		op := audited(audit.OpImport, a.Manifest.Signer.GID)
+		defer op.done()
+
+		requireQuorum(auth.ActionRestore, archiveTarget(backupIn))
+
+		op.Detail = fmt.Sprintf("restore of %s from %s: %d created, %d replaced", backupIn, a.Manifest.Serial,
+			p.Count(backup.ActionCreate), p.Count(backup.ActionReplace))
+
+		if err := p.Apply(*B.C, B.D); err != nil {
+			panic(err)
+		}
+
+		B.L.Printf("===> %s created, %s replaced, %s skipped, %s unchanged",
+			h.GFgB(p.Count(backup.ActionCreate)), h.GFgB(p.Count(backup.ActionReplace)),
+			h.YFgB(p.Count(backup.ActionSkip)), h.WFgB(p.Count(backup.ActionUnchanged)))
+	},
+}
@@ -0,0 +1,578 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jedib0t/go-pretty/table"
+	"github.com/spf13/cobra"
+
+	h "github.com/block27/core/helpers"
+	api "github.com/block27/core/services/dsa"
+	"github.com/block27/core/services/dsa/alias"
+	"github.com/block27/core/services/dsa/ecdsa"
+	"github.com/block27/core/services/dsa/policy"
+	"github.com/block27/core/services/dsa/signature"
+	"github.com/block27/core/services/hsmd"
+	"github.com/block27/core/services/rest"
+)
+
+// daemonAnnotation marks the commands that run through hsmd while it holds
+// the datastore, every other command refuses to run then
+const daemonAnnotation = "daemon"
+
+// daemonCommand is the annotation of commands hsmd can run
+var daemonCommand = map[string]string{daemonAnnotation: "true"}
+
+// daemonLogin opens a session with hsmd for the command, with the same
+// credentials authenticate checks
+func daemonLogin(cmd *cobra.Command) {
+	if cmd.Annotations[daemonAnnotation] != "true" {
+		panic(fmt.Errorf("%s is not available while hsmd is running on %s, stop it first",
+			h.RFgB(cmd.CommandPath()), hsmd.Socket(*B.C)))
+	}
+
+	if _, err := Daemon.Login(UsrOperator, []byte(UsrPin)); err != nil {
+		panic(fmt.Errorf("%s %v", h.RFgB(cmd.CommandPath()+":"), err))
+	}
+}
+
+// remotePolicy reads the policy flags of create
+func remotePolicy() (*rest.Policy, error) {
+	notBefore, err := policy.ParseTime(createNotBefore)
+	if err != nil {
+		return nil, err
+	}
+
+	notAfter, err := policy.ParseTime(createNotAfter)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &rest.Policy{Operations: createOps, MaxSignatures: createMaxSignatures, Hashes: createHashes}
+
+	if !notBefore.IsZero() {
+		p.NotBefore = &notBefore
+	}
+
+	if !notAfter.IsZero() {
+		p.NotAfter = &notAfter
+	}
+
+	return p, nil
+}
+
+func remoteCreate() {
+	p, err := remotePolicy()
+	if err != nil {
+		panic(err)
+	}
+
+	key, err := Daemon.CreateKey(rest.CreateKeyRequest{Name: createName, Curve: createCurve, Policy: p})
+	if err != nil {
+		panic(err)
+	}
+
+	printRemoteKeys([]rest.Key{*key})
+}
+
+func remoteGet() {
+	key, err := Daemon.GetKey(getIdentifier)
+	if err != nil {
+		panic(err)
+	}
+
+	printRemoteKeys([]rest.Key{*key})
+}
+
+func remoteList() {
+	q := url.Values{}
+
+	for name, v := range map[string]string{
+		"name":           listName,
+		"slug":           listSlug,
+		"curve":          listCurve,
+		"status":         listStatus,
+		"label":          listLabel,
+		"fingerprint":    listFingerprint,
+		"created_after":  listCreatedAfter,
+		"created_before": listCreatedBefore,
+		"sort":           listSort,
+	} {
+		if v != "" {
+			q.Set(name, v)
+		}
+	}
+
+	q["tag"] = listTags
+
+	if listDesc {
+		q.Set("order", "desc")
+	}
+
+	// The daemon pages every list, all is its largest page
+	limit := listLimit
+	if limit == 0 {
+		limit = (*B.C).GetInt("api.max_page_size")
+	}
+
+	q.Set("offset", strconv.Itoa(listOffset))
+	q.Set("limit", strconv.Itoa(limit))
+
+	page, err := Daemon.ListKeys(q)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(page.Keys) == 0 {
+		B.L.Printf("No keys available")
+	} else {
+		printRemoteKeys(page.Keys)
+		B.L.Printf("Showing %d-%d of %d", listOffset+1, listOffset+len(page.Keys), page.Total)
+	}
+}
+
+func remoteArchive() {
+	key, err := Daemon.ArchiveKey(lifecycleIdentifier, "archived")
+	if err != nil {
+		panic(err)
+	}
+
+	B.L.Printf("===> %s -> %s", h.WFgB(key.GID), h.GFgB(key.Status))
+}
+
+// remoteSetStatus applies a lifecycle transition through the daemon, the
+// approvals of --approver and --approval go along when destroying
+func remoteSetStatus(status string, reason string) {
+	key, err := Daemon.GetKey(lifecycleIdentifier)
+	if err != nil {
+		panic(err)
+	}
+
+	req := rest.StatusRequest{Status: status, Reason: reason}
+
+	if status == api.StatusDestroyed {
+		req.Approvals = remoteApprovals()
+	}
+
+	changed, err := Daemon.SetKeyStatus(key.GID, req)
+	if err != nil {
+		panic(err)
+	}
+
+	B.L.Printf("===> %s %s -> %s", h.WFgB(changed.GID), key.Status, h.GFgB(changed.Status))
+}
+
+// remoteApprovals reads the approvals requireQuorum would count, the daemon
+// checks them
+func remoteApprovals() *rest.Approvals {
+	a := &rest.Approvals{}
+
+	for _, name := range UsrApprovers {
+		a.Officers = append(a.Officers, rest.Officer{Name: name, Pin: string(promptPin(name))})
+	}
+
+	for _, path := range UsrApprovals {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			panic(err)
+		}
+
+		if !json.Valid(data) {
+			panic(fmt.Errorf("approval token %s: invalid JSON", path))
+		}
+
+		a.Tokens = append(a.Tokens, json.RawMessage(data))
+	}
+
+	return a
+}
+
+func remoteLabel() {
+	key, err := Daemon.LabelKey(annotateIdentifier, rest.LabelRequest{Add: labelAdd, Remove: labelRemove})
+	if err != nil {
+		panic(err)
+	}
+
+	printRemoteKeys([]rest.Key{*key})
+}
+
+func remoteTag() {
+	set, err := ecdsa.ParseTags(tagSet)
+	if err != nil {
+		panic(err)
+	}
+
+	key, err := Daemon.TagKey(annotateIdentifier, rest.TagRequest{Set: set, Unset: tagUnset})
+	if err != nil {
+		panic(err)
+	}
+
+	printRemoteKeys([]rest.Key{*key})
+}
+
+func remoteReindex() {
+	r, err := Daemon.Reindex()
+	if err != nil {
+		panic(err)
+	}
+
+	B.L.Printf("===> %s keys indexed", h.GFgB(r.Keys))
+}
+
+// remoteBatch reads the items here and has the daemon sign them, with its
+// own batch.workers
+func remoteBatch() {
+	items, err := readBatch(batchFilePath)
+	if err != nil {
+		panic(err)
+	}
+
+	res, err := Daemon.Batch(rest.BatchRequest{
+		Identifier: batchIdentifier,
+		Alias:      batchAlias,
+		Mode:       payloadMode(batchMode),
+		Items:      items,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	if res.Version > 0 {
+		B.L.Printf("=== Alias(%s) v%d", h.RFgB(batchAlias), res.Version)
+	}
+
+	writeBatch(res.Results)
+}
+
+func remoteAliasCreate() {
+	a, err := Daemon.CreateAlias(rest.CreateAliasRequest{Name: aliasName, Curve: aliasCurve})
+	if err != nil {
+		panic(err)
+	}
+
+	printAliases([]*alias.Alias{a})
+}
+
+func remoteAliasGet() {
+	a, err := Daemon.GetAlias(aliasName)
+	if err != nil {
+		panic(err)
+	}
+
+	printAliases([]*alias.Alias{a})
+}
+
+func remoteAliasList() {
+	l, err := Daemon.ListAliases()
+	if err != nil {
+		panic(err)
+	}
+
+	if len(l.Aliases) == 0 {
+		B.L.Printf("No aliases available")
+	} else {
+		printAliases(l.Aliases)
+	}
+}
+
+// remoteRotate rotates --alias, or every alias past its rotation period
+// by the config here
+func remoteRotate() {
+	names := []string{rotateAlias}
+
+	if rotateDue {
+		l, err := Daemon.ListAliases()
+		if err != nil {
+			panic(err)
+		}
+
+		names = names[:0]
+		for _, a := range l.Aliases {
+			due, err := a.Due(*B.C, time.Now())
+			if err != nil {
+				panic(err)
+			}
+
+			if due {
+				names = append(names, a.Name)
+			}
+		}
+
+		if len(names) == 0 {
+			B.L.Printf("No aliases due for rotation")
+			return
+		}
+	}
+
+	var rotated []*alias.Alias
+
+	for _, name := range names {
+		a, err := Daemon.RotateAlias(name)
+		if err != nil {
+			panic(err)
+		}
+
+		B.L.Printf("===> %s now v%d", h.WFgB(a.Name), a.Primary)
+		rotated = append(rotated, a)
+	}
+
+	printAliases(rotated)
+}
+
+func remoteExportPub() {
+	pub, err := Daemon.PublicKey(getIdentifier)
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println(pub.PEM)
+}
+
+// remoteHash resolves the digest to use with a key the way keyHash does
+func remoteHash(key *rest.Key, alg string) (string, error) {
+	bits, err := ecdsa.CurveBits(key.Curve)
+	if err != nil {
+		return "", err
+	}
+
+	return curveHash(bits, policy.Policy{Hashes: key.Policy.Hashes}, alg)
+}
+
+// remoteSign digests the file here and has the daemon sign the digest, the
+// signature and its sidecar are written as sign writes them. An alias signs
+// with the primary version the daemon holds.
+func remoteSign() {
+	meta := &signature.Metadata{Alias: signAlias}
+	id := signIdentifier
+
+	if signAlias != "" {
+		a, err := Daemon.GetAlias(signAlias)
+		if err != nil {
+			panic(err)
+		}
+
+		meta.Version, id = a.Primary, a.Version(a.Primary).GID
+	}
+
+	key, err := Daemon.GetKey(id)
+	if err != nil {
+		panic(err)
+	}
+
+	alg, err := remoteHash(key, signHash)
+	if err != nil {
+		panic(err)
+	}
+
+	digest, err := digestFile(signFilePath, alg)
+	if err != nil {
+		panic(err)
+	}
+
+	s, err := Daemon.Sign(key.GID, rest.SignRequest{
+		Digest: hex.EncodeToString(digest),
+		Hash:   alg,
+		Mode:   payloadMode(signMode),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	derD, err := base64.StdEncoding.DecodeString(s.Signature)
+	if err != nil {
+		panic(err)
+	}
+
+	derF, err := signatureFile(key.GID)
+	if err != nil {
+		panic(err)
+	}
+
+	meta.Key, meta.Hash, meta.Mode, meta.CreatedAt = key.GID, s.Hash, s.Mode, time.Now()
+	if err := signature.Write(derF, derD, meta); err != nil {
+		panic(err)
+	}
+
+	B.L.Printf("%s%s%s%s", h.WFgB(fmt.Sprintf("=== %s(", strings.ToUpper(alg))),
+		h.RFgB(signFilePath), h.WFgB(") = "),
+		h.GFgB(hex.EncodeToString(digest)))
+
+	if meta.Alias != "" {
+		B.L.Printf("=== Alias(%s) v%d", h.RFgB(meta.Alias), meta.Version)
+	}
+
+	B.L.Printf("%s%s%s", h.WFgB("=== Signature("), h.RFgB(derF), h.WFgB(")"))
+}
+
+// remoteVerify has the daemon check a signature over the file's digest,
+// against the candidates verify would try
+func remoteVerify() {
+	derD, err := ioutil.ReadFile(verifySignaturePath)
+	if err != nil {
+		panic(err)
+	}
+
+	meta, err := signature.LoadMetadata(verifySignaturePath)
+	if err != nil {
+		panic(err)
+	}
+
+	if meta == nil {
+		meta = &signature.Metadata{}
+	}
+
+	if verifyHash == "" {
+		verifyHash = meta.Hash
+	}
+
+	if verifyMode == "" {
+		verifyMode = meta.Mode
+	}
+
+	keys, labels := remoteCandidates(meta)
+	digests := map[string][]byte{}
+
+	for i, key := range keys {
+		alg, err := remoteHash(key, verifyHash)
+		if err != nil {
+			panic(err)
+		}
+
+		digest, ok := digests[alg]
+		if !ok {
+			if digest, err = digestFile(verifyFilePath, alg); err != nil {
+				panic(err)
+			}
+
+			digests[alg] = digest
+			B.L.Printf("%s: %x", strings.ToUpper(alg), digest)
+		}
+
+		v, err := Daemon.Verify(key.GID, rest.VerifyRequest{
+			Digest:    hex.EncodeToString(digest),
+			Hash:      alg,
+			Mode:      payloadMode(verifyMode),
+			Signature: base64.StdEncoding.EncodeToString(derD),
+		})
+		if err != nil {
+			panic(err)
+		}
+
+		if !v.Valid {
+			continue
+		}
+
+		if key.Status == api.StatusCompromised {
+			B.L.Printf("===> %s", h.RFgB("WARNING: key is compromised, do not trust new signatures"))
+		}
+
+		B.L.Printf("===> %s %s", h.GFgB("Verified OK"), labels[i])
+		return
+	}
+
+	B.L.Printf("===> %s", h.RFgB("Verification Failure"))
+}
+
+// remoteCandidates returns the keys the daemon holds that verifyCandidates
+// would return, by their public fields
+func remoteCandidates(meta *signature.Metadata) ([]*rest.Key, []string) {
+	if err := oneOf(verifyIdentifier, verifyAlias); err != nil {
+		panic(err)
+	}
+
+	if verifyIdentifier != "" {
+		key, err := Daemon.GetKey(verifyIdentifier)
+		if err != nil {
+			panic(err)
+		}
+
+		if !api.CanVerify(key.Status) {
+			panic(fmt.Errorf("%s key is %s", h.RFgB("verification refused:"), key.Status))
+		}
+
+		return []*rest.Key{key}, []string{key.GID}
+	}
+
+	a, err := Daemon.GetAlias(verifyAlias)
+	if err != nil {
+		panic(err)
+	}
+
+	var versions []int
+	if meta.Alias == a.Name && meta.Version > 0 {
+		versions = []int{meta.Version}
+	} else {
+		for i := len(a.Versions) - 1; i >= 0; i-- {
+			versions = append(versions, a.Versions[i].Number)
+		}
+	}
+
+	var keys []*rest.Key
+	var labels []string
+
+	for _, n := range versions {
+		v := a.Version(n)
+		if v.GID == "" {
+			panic(fmt.Errorf("%s %s v%d", h.RFgB("unknown alias version:"), a.Name, n))
+		}
+
+		key, err := Daemon.GetKey(v.GID)
+		if err != nil {
+			panic(err)
+		}
+
+		if !api.CanVerify(key.Status) || !(policy.Policy{Operations: key.Policy.Operations}).Allows(policy.OpVerify) {
+			continue
+		}
+
+		keys = append(keys, key)
+		labels = append(labels, fmt.Sprintf("%s v%d", a.Name, n))
+	}
+
+	if len(keys) == 0 {
+		panic(fmt.Errorf("%s no verifiable version of %s", h.RFgB("verification refused:"), a.Name))
+	}
+
+	return keys, labels
+}
+
+// printRemoteKeys prints keys as the daemon shows them, without private
+// material
+func printRemoteKeys(keys []rest.Key) {
+	for ndx, k := range keys {
+		tw := table.NewWriter()
+
+		var tags []string
+		for name, val := range k.Tags {
+			tags = append(tags, fmt.Sprintf("%s=%s", name, val))
+		}
+
+		sort.Strings(tags)
+
+		tw.SetTitle(fmt.Sprintf("Asymmetric Key (%d) %s", ndx, k.GID))
+		tw.AppendRows([]table.Row{
+			{"Name", k.Name},
+			{"Slug", k.Slug},
+			{"Curve", k.Curve},
+			{"Status", k.Status},
+			{"Labels", strings.Join(k.Labels, ", ")},
+			{"Tags", strings.Join(tags, ", ")},
+			{"Signatures", k.Signatures},
+			{"Created", k.CreatedAt},
+			{"MD5", k.FingerprintMD5},
+			{"SHA256", k.FingerprintSHA},
+		})
+		tw.SetStyle(table.StyleColoredDark)
+
+		fmt.Println(tw.Render())
+	}
+}
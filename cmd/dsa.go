@@ -1,40 +1,101 @@
 package cmd
 
 import (
+	"bufio"
+	"encoding/asn1"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
 
+	"github.com/block27/core/crypto"
 	h "github.com/block27/core/helpers"
+	"github.com/block27/core/services/audit"
+	"github.com/block27/core/services/auth"
+	api "github.com/block27/core/services/dsa"
+	"github.com/block27/core/services/dsa/alias"
 	"github.com/block27/core/services/dsa/ecdsa"
+	"github.com/block27/core/services/dsa/policy"
 	"github.com/block27/core/services/dsa/signature"
 )
 
+// progressThreshold is the file size from which digests report progress
+const progressThreshold = 64 << 20
+
 var (
 	// Global flags ...
 	dsaType string
 
 	// Create flags ...
-	createName  string
-	createCurve string
+	createName          string
+	createCurve         string
+	createOps           []string
+	createNotBefore     string
+	createNotAfter      string
+	createMaxSignatures int
+	createHashes        []string
 
 	// List flags ...
-	// ... none at the moment  ...
+	listName          string
+	listSlug          string
+	listCurve         string
+	listStatus        string
+	listLabel         string
+	listTags          []string
+	listFingerprint   string
+	listCreatedAfter  string
+	listCreatedBefore string
+	listSort          string
+	listDesc          bool
+	listOffset        int
+	listLimit         int
+
+	// Label/Tag flags ...
+	annotateIdentifier string
+	labelAdd           []string
+	labelRemove        []string
+	tagSet             []string
+	tagUnset           []string
 
 	// Get flags ...
 	getIdentifier string
 
 	// Sign flags
 	signIdentifier string
+	signAlias      string
 	signFilePath   string
+	signHash       string
+	signMode       string
+	signOut        string
 
 	// Verify flags
 	verifyIdentifier    string
+	verifyAlias         string
 	verifyFilePath      string
 	verifySignaturePath string
+	verifyHash          string
+	verifyMode          string
+
+	// Batch flags
+	batchIdentifier string
+	batchAlias      string
+	batchFilePath   string
+	batchOutPath    string
+	batchMode       string
+	batchWorkers    int
+
+	// Lifecycle flags
+	lifecycleIdentifier string
+	revokeReason        string
+	destroyConfirm      bool
 
 	// ImportPub flags
 	importPubName  string
@@ -45,7 +106,13 @@ var (
 func init() {
 	// Create flags ...
 	dsaCreateCmd.Flags().StringVarP(&createName, "name", "n", "", "name required")
-	dsaCreateCmd.Flags().StringVarP(&createCurve, "curve", "c", "prime256v1", "default: prime256v1")
+	dsaCreateCmd.Flags().StringVarP(&createCurve, "curve", "c", "prime256v1", "curve or RSA size, e.g. rsa2048, default: prime256v1")
+	dsaCreateCmd.Flags().StringSliceVar(&createOps, "ops", nil, fmt.Sprintf(
+		"allowed operations: [%s] default: all", strings.Join(policy.Operations(), ", ")))
+	dsaCreateCmd.Flags().StringVar(&createNotBefore, "not-before", "", "no signing before, 2006-01-02 or RFC 3339")
+	dsaCreateCmd.Flags().StringVar(&createNotAfter, "not-after", "", "no signing after, 2006-01-02 or RFC 3339")
+	dsaCreateCmd.Flags().IntVar(&createMaxSignatures, "max-signatures", 0, "signature limit, default: unlimited")
+	dsaCreateCmd.Flags().StringSliceVar(&createHashes, "hashes", nil, "allowed digests, default: any")
 	dsaCreateCmd.MarkFlagRequired("name")
 
 	// Get flags ...
@@ -53,22 +120,72 @@ func init() {
 	dsaGetCmd.MarkFlagRequired("identifier")
 
 	// List flags ...
-	// ...
+	dsaListCmd.Flags().StringVarP(&listName, "name", "n", "", "name contains")
+	dsaListCmd.Flags().StringVar(&listSlug, "slug", "", "exact slug")
+	dsaListCmd.Flags().StringVarP(&listCurve, "curve", "c", "", "curve, e.g. prime256v1")
+	dsaListCmd.Flags().StringVar(&listStatus, "status", "", "status, e.g. active")
+	dsaListCmd.Flags().StringVarP(&listLabel, "label", "l", "", "has label")
+	dsaListCmd.Flags().StringSliceVar(&listTags, "tag", nil, "has tag, key=value or key")
+	dsaListCmd.Flags().StringVar(&listFingerprint, "fingerprint", "", "SHA256 or MD5 fingerprint prefix")
+	dsaListCmd.Flags().StringVar(&listCreatedAfter, "created-after", "", "2006-01-02 or RFC 3339")
+	dsaListCmd.Flags().StringVar(&listCreatedBefore, "created-before", "", "2006-01-02 or RFC 3339")
+	dsaListCmd.Flags().StringVar(&listSort, "sort", ecdsa.SortCreated, fmt.Sprintf("sort: [%s, %s, %s, %s]",
+		ecdsa.SortCreated, ecdsa.SortName, ecdsa.SortStatus, ecdsa.SortCurve))
+	dsaListCmd.Flags().BoolVar(&listDesc, "desc", false, "reverse the sort order")
+	dsaListCmd.Flags().IntVar(&listOffset, "offset", 0, "skip the first matches")
+	dsaListCmd.Flags().IntVar(&listLimit, "limit", 0, "page size, default: all")
+
+	// Label/Tag flags ...
+	dsaLabelCmd.Flags().StringVarP(&annotateIdentifier, "identifier", "i", "", "identifier required")
+	dsaLabelCmd.Flags().StringSliceVar(&labelAdd, "add", nil, "labels to add")
+	dsaLabelCmd.Flags().StringSliceVar(&labelRemove, "remove", nil, "labels to remove")
+	dsaLabelCmd.MarkFlagRequired("identifier")
+
+	dsaTagCmd.Flags().StringVarP(&annotateIdentifier, "identifier", "i", "", "identifier required")
+	dsaTagCmd.Flags().StringSliceVar(&tagSet, "set", nil, "tags to set, key=value")
+	dsaTagCmd.Flags().StringSliceVar(&tagUnset, "unset", nil, "tag keys to remove")
+	dsaTagCmd.MarkFlagRequired("identifier")
 
 	// Sign flags ...
-	dsaSignCmd.Flags().StringVarP(&signIdentifier, "identifier", "i", "", "identifier required")
+	dsaSignCmd.Flags().StringVarP(&signIdentifier, "identifier", "i", "", "identifier, or --alias")
+	dsaSignCmd.Flags().StringVarP(&signAlias, "alias", "a", "", "alias, signs with its primary version")
 	dsaSignCmd.Flags().StringVarP(&signFilePath, "file", "f", "", "file required")
-	dsaSignCmd.MarkFlagRequired("identifier")
+	dsaSignCmd.Flags().StringVar(&signHash, "hash", "", hashUsage())
+	dsaSignCmd.Flags().StringVar(&signMode, "mode", "", modeUsage())
+	dsaSignCmd.Flags().StringVarP(&signOut, "out", "o", "", "signature path, default: paths.signatures/<gid>/signature-<unix>.der")
 	dsaSignCmd.MarkFlagRequired("file")
 
 	// Verify flags ...
-	dsaVerifyCmd.Flags().StringVarP(&verifyIdentifier, "identifier", "i", "", "identifier required")
+	dsaVerifyCmd.Flags().StringVarP(&verifyIdentifier, "identifier", "i", "", "identifier, or --alias")
+	dsaVerifyCmd.Flags().StringVarP(&verifyAlias, "alias", "a", "", "alias, accepts any non destroyed version")
 	dsaVerifyCmd.Flags().StringVarP(&verifyFilePath, "file", "f", "", "file required")
 	dsaVerifyCmd.Flags().StringVarP(&verifySignaturePath, "signature", "s", "", "signature required")
-	dsaVerifyCmd.MarkFlagRequired("identifier")
+	dsaVerifyCmd.Flags().StringVar(&verifyHash, "hash", "", hashUsage())
+	dsaVerifyCmd.Flags().StringVar(&verifyMode, "mode", "", modeUsage())
 	dsaVerifyCmd.MarkFlagRequired("file")
 	dsaVerifyCmd.MarkFlagRequired("signature")
 
+	// Batch flags ...
+	dsaBatchCmd.Flags().StringVarP(&batchIdentifier, "identifier", "i", "", "identifier, or --alias")
+	dsaBatchCmd.Flags().StringVarP(&batchAlias, "alias", "a", "", "alias, signs with its primary version")
+	dsaBatchCmd.Flags().StringVarP(&batchFilePath, "file", "f", "", "JSONL of {id, digest, hash} required, - for stdin")
+	dsaBatchCmd.Flags().StringVarP(&batchOutPath, "out", "o", "", "JSONL results, default: stdout")
+	dsaBatchCmd.Flags().StringVar(&batchMode, "mode", "", modeUsage())
+	dsaBatchCmd.Flags().IntVarP(&batchWorkers, "workers", "w", 0, "concurrent signers, default: config batch.workers")
+	dsaBatchCmd.MarkFlagRequired("file")
+
+	// Lifecycle flags ...
+	for _, c := range []*cobra.Command{dsaArchiveCmd, dsaActivateCmd, dsaRevokeCmd, dsaDestroyCmd} {
+		c.Flags().StringVarP(&lifecycleIdentifier, "identifier", "i", "", "identifier required")
+		c.MarkFlagRequired("identifier")
+	}
+
+	dsaRevokeCmd.Flags().StringVar(&revokeReason, "reason", "", fmt.Sprintf(
+		"reason required: [%s, %s, %s]", api.ReasonCompromised, api.ReasonSuperseded, api.ReasonCeased))
+	dsaRevokeCmd.MarkFlagRequired("reason")
+
+	dsaDestroyCmd.Flags().BoolVar(&destroyConfirm, "yes", false, "confirm erasing the private key")
+
 	// ExportPub flags ...
 	dsaExportPubCmd.Flags().StringVarP(&getIdentifier, "identifier", "i", "", "identifier required")
 	dsaExportPubCmd.MarkFlagRequired("identifier")
@@ -87,8 +204,171 @@ func invalidKeyType() string {
 	return fmt.Sprintf("Invalid keyType passed (%s), usage: [ecdsa, eddsa, rsa]\n", dsaType)
 }
 
+func hashUsage() string {
+	return fmt.Sprintf("digest: [%s] default: matches key curve",
+		strings.Join(crypto.Digests(), ", "))
+}
+
+func modeUsage() string {
+	return fmt.Sprintf("payload: [%s (raw digest), %s (hex digest)] default: config signature.mode",
+		signature.ModeOpenSSL, signature.ModeLegacy)
+}
+
+// describeSignature prints the {R,S} of an ECDSA signature, or the bytes of
+// any other
+func describeSignature(der []byte) string {
+	var rs signature.Signature
+	if rest, err := asn1.Unmarshal(der, &rs); err == nil && len(rest) == 0 && rs.R != nil && rs.S != nil {
+		return fmt.Sprintf("r[%d]=0x%x \n\t\ts[%d]=0x%x",
+			len(rs.R.Text(10)), rs.R, len(rs.S.Text(10)), rs.S)
+	}
+
+	return fmt.Sprintf("[%d]=0x%x", len(der), der)
+}
+
+// payloadMode resolves the payload mode, falling back to the configured default
+func payloadMode(mode string) string {
+	if mode == "" {
+		return (*B.C).GetString("signature.mode")
+	}
+
+	return mode
+}
+
+// signatureFile resolves where sign writes the signature of the key
+func signatureFile(gid string) (string, error) {
+	return signature.File((*B.C).GetString("paths.signatures"), signOut, gid, time.Now())
+}
+
+// keyHash resolves the digest to use with a key, defaulting to the one that
+// matches the strength of its curve, or the first one its policy allows, and
+// refusing weaker explicit choices
+func keyHash(key ecdsa.KeyAPI, alg string) (string, error) {
+	bits, err := key.BitSize()
+	if err != nil {
+		return "", err
+	}
+
+	return curveHash(bits, key.Struct().Policy, alg)
+}
+
+// curveHash is keyHash given the curve size and policy of the key
+func curveHash(bits int, p policy.Policy, alg string) (string, error) {
+	if alg == "" {
+		alg = crypto.HashForCurve(bits)
+
+		if !p.AllowsHash(alg) {
+			alg = p.Hashes[0]
+		}
+	}
+
+	if err := crypto.CheckHashStrength(alg, bits); err != nil {
+		return "", err
+	}
+
+	return alg, nil
+}
+
+// digestFile streams the file through the selected digest so that inputs of
+// any size can be signed, drawing a progress line for long inputs
+func digestFile(path string, alg string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s", h.RFgB("invalid or missing file: "), path)
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader = f
+	if stat.Size() >= progressThreshold {
+		r = h.NewProgressReader(f, stat.Size(),
+			fmt.Sprintf("=== %s", strings.ToUpper(alg)), os.Stdout)
+	}
+
+	return crypto.DigestReader(r, alg)
+}
+
+// readBatch parses a JSONL file of batch items, blank lines are skipped
+func readBatch(path string) ([]ecdsa.BatchItem, error) {
+	var r io.Reader = os.Stdin
+
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s", h.RFgB("invalid or missing file: "), path)
+		}
+		defer f.Close()
+
+		r = f
+	}
+
+	var items []ecdsa.BatchItem
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var item ecdsa.BatchItem
+		if err := json.Unmarshal([]byte(text), &item); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", h.RFgB("invalid batch item"), line, err)
+		}
+
+		items = append(items, item)
+	}
+
+	return items, scanner.Err()
+}
+
+// oneOf checks that exactly one of identifier and alias was passed
+func oneOf(identifier string, name string) error {
+	if (identifier == "") == (name == "") {
+		return fmt.Errorf("%s", h.RFgB("pass exactly one of --identifier or --alias"))
+	}
+
+	return nil
+}
+
+// setKeyStatus loads the key, applies the lifecycle transition and prints it
+func setKeyStatus(status string, reason string) {
+	if Daemon != nil {
+		remoteSetStatus(status, reason)
+		return
+	}
+
+	op := audited(audit.OpLifecycle, lifecycleIdentifier)
+	defer op.done()
+
+	key, err := ecdsa.ResolveECDSA(*B.C, lifecycleIdentifier)
+	if err != nil {
+		panic(err)
+	}
+
+	from := key.Struct().Status
+	op.Key, op.Detail = key.FilePointer(), fmt.Sprintf("%s -> %s: %s", from, status, reason)
+
+	if status == api.StatusDestroyed {
+		requireQuorum(auth.ActionDestroy, key.FilePointer())
+	}
+
+	if err := key.SetStatus(*B.C, status, reason); err != nil {
+		panic(err)
+	}
+
+	B.L.Printf("===> %s %s -> %s", h.WFgB(key.FilePointer()), from, h.GFgB(status))
+}
+
 var dsaCmd = &cobra.Command{
-	Use: "dsa",
+	Use:         "dsa",
+	Annotations: map[string]string{rolesAnnotation: auth.RoleUser},
+	Long: "Keys are identified (-i) by GID, name, slug, SHA256 or MD5 " +
+		"fingerprint, or a unique GID prefix of at least 4 characters",
 	Args: func(cmd *cobra.Command, args []string) error {
 		if len(args) < 1 {
 			return fmt.Errorf(fmt.Sprintf("%s", h.RFgB("requires an argument")))
@@ -100,29 +380,61 @@ var dsaCmd = &cobra.Command{
 }
 
 var dsaCreateCmd = &cobra.Command{
-	Use:   "create",
-	Short: "Create a new key pair",
+	Use:         "create",
+	Short:       "Create a new key pair",
+	Annotations: daemonCommand,
 	PreRun: func(cmd *cobra.Command, args []string) {
 		B.L.Printf("%s", h.CFgB("=== Keys[CREATE]"))
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		key, e := ecdsa.NewECDSA(*B.C, createName, createCurve)
+		if Daemon != nil {
+			remoteCreate()
+			return
+		}
+
+		op := audited(audit.OpCreate, "")
+		defer op.done()
+
+		notBefore, err := policy.ParseTime(createNotBefore)
+		if err != nil {
+			panic(err)
+		}
+
+		notAfter, err := policy.ParseTime(createNotAfter)
+		if err != nil {
+			panic(err)
+		}
+
+		p, err := policy.New(createOps, notBefore, notAfter, createMaxSignatures, createHashes)
+		if err != nil {
+			panic(err)
+		}
+
+		key, e := ecdsa.NewECDSAWithPolicy(*B.C, createName, createCurve, p)
 		if e != nil {
 			panic(e)
 		}
 
+		op.Key, op.Detail = key.FilePointer(), fmt.Sprintf("%s %s", createName, createCurve)
+
 		ecdsa.PrintKeyTW(key.Struct())
 	},
 }
 
 var dsaGetCmd = &cobra.Command{
-	Use:   "get",
-	Short: "Get key by identifier",
+	Use:         "get",
+	Short:       "Get key by identifier",
+	Annotations: daemonCommand,
 	PreRun: func(cmd *cobra.Command, args []string) {
 		B.L.Printf("%s", h.CFgB("=== Keys[GET]"))
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		key, e := ecdsa.GetECDSA(*B.C, getIdentifier)
+		if Daemon != nil {
+			remoteGet()
+			return
+		}
+
+		key, e := ecdsa.ResolveECDSA(*B.C, getIdentifier)
 		if e != nil {
 			panic(e)
 		}
@@ -132,13 +444,48 @@ var dsaGetCmd = &cobra.Command{
 }
 
 var dsaListCmd = &cobra.Command{
-	Use:   "list",
-	Short: "List all keys",
+	Use:         "list",
+	Short:       "List all keys",
+	Annotations: daemonCommand,
 	PreRun: func(cmd *cobra.Command, args []string) {
 		B.L.Printf("%s", h.CFgB("=== Keys[LIST]"))
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		keys, err := ecdsa.ListECDSA(*B.C)
+		if Daemon != nil {
+			remoteList()
+			return
+		}
+
+		tags, err := ecdsa.ParseTags(listTags)
+		if err != nil {
+			panic(err)
+		}
+
+		after, err := policy.ParseTime(listCreatedAfter)
+		if err != nil {
+			panic(err)
+		}
+
+		before, err := policy.ParseTime(listCreatedBefore)
+		if err != nil {
+			panic(err)
+		}
+
+		keys, total, err := ecdsa.ListECDSAWith(*B.C, ecdsa.ListOptions{
+			Name:          listName,
+			Slug:          listSlug,
+			Curve:         listCurve,
+			Status:        listStatus,
+			Label:         listLabel,
+			Tags:          tags,
+			Fingerprint:   listFingerprint,
+			CreatedAfter:  after,
+			CreatedBefore: before,
+			Sort:          listSort,
+			Desc:          listDesc,
+			Offset:        listOffset,
+			Limit:         listLimit,
+		})
 		if err != nil {
 			panic(err)
 		}
@@ -147,21 +494,111 @@ var dsaListCmd = &cobra.Command{
 			B.L.Printf("No keys available")
 		} else {
 			ecdsa.PrintKeysTW(keys)
+			B.L.Printf("Showing %d-%d of %d", listOffset+1, listOffset+len(keys), total)
+		}
+	},
+}
+
+var dsaReindexCmd = &cobra.Command{
+	Use:         "reindex",
+	Short:       "Rebuild the key lookup index",
+	Annotations: daemonCommand,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Keys[REINDEX]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if Daemon != nil {
+			remoteReindex()
+			return
+		}
+
+		n, err := ecdsa.RebuildIndex(*B.C)
+		if err != nil {
+			panic(err)
 		}
+
+		B.L.Printf("===> %s keys indexed", h.GFgB(n))
+	},
+}
+
+var dsaLabelCmd = &cobra.Command{
+	Use:         "label",
+	Short:       "Add or remove key labels",
+	Annotations: daemonCommand,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Keys[LABEL]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if Daemon != nil {
+			remoteLabel()
+			return
+		}
+
+		key, err := ecdsa.ResolveECDSA(*B.C, annotateIdentifier)
+		if err != nil {
+			panic(err)
+		}
+
+		if err := key.Label(*B.C, labelAdd, labelRemove); err != nil {
+			panic(err)
+		}
+
+		ecdsa.PrintKeyTW(key.Struct())
+	},
+}
+
+var dsaTagCmd = &cobra.Command{
+	Use:         "tag",
+	Short:       "Set or remove key tags",
+	Annotations: daemonCommand,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Keys[TAG]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if Daemon != nil {
+			remoteTag()
+			return
+		}
+
+		key, err := ecdsa.ResolveECDSA(*B.C, annotateIdentifier)
+		if err != nil {
+			panic(err)
+		}
+
+		set, err := ecdsa.ParseTags(tagSet)
+		if err != nil {
+			panic(err)
+		}
+
+		if err := key.Tag(*B.C, set, tagUnset); err != nil {
+			panic(err)
+		}
+
+		ecdsa.PrintKeyTW(key.Struct())
 	},
 }
 
 var dsaSignCmd = &cobra.Command{
-	Use:   "sign",
-	Short: "Sign data with Key",
+	Use:         "sign",
+	Short:       "Sign data with Key",
+	Annotations: daemonCommand,
 	PreRun: func(cmd *cobra.Command, args []string) {
 		if dsaType == "" {
 			panic(dsaTypePanic())
 		}
 
+		if err := oneOf(signIdentifier, signAlias); err != nil {
+			panic(err)
+		}
+
 		B.L.Printf("%s", h.CFgB("=== Keys[SIGN]"))
 	},
 	Run: func(cmd *cobra.Command, args []string) {
+		if Daemon != nil {
+			remoteSign()
+			return
+		}
+
 		// var key interface{}
 		//
 		// switch dsaType {
@@ -187,51 +624,91 @@ var dsaSignCmd = &cobra.Command{
 		// 	B.L.Errorf(invalidKeyType())
 		// }
 
-		key, err := ecdsa.GetECDSA(*B.C, signIdentifier)
+		op := audited(audit.OpSign, signIdentifier+signAlias)
+		defer op.done()
+
+		meta := &signature.Metadata{Alias: signAlias}
+
+		var key ecdsa.KeyAPI
+		var err error
+
+		if signAlias != "" {
+			key, meta.Version, err = alias.PrimaryKey(*B.C, B.D, signAlias)
+		} else {
+			key, err = ecdsa.ResolveECDSA(*B.C, signIdentifier)
+		}
+
 		if err != nil {
 			panic(err)
 		}
 
-		// Read the file ready be signed / this should probably be hashed
-		// if size > key bit size anyways.
-		file, derr := h.NewFile(signFilePath)
+		op.Key = key.FilePointer()
+
+		alg, err := keyHash(key, signHash)
+		if err != nil {
+			panic(err)
+		}
+
+		if err := key.Authorize(policy.OpSign, alg); err != nil {
+			panic(err)
+		}
+
+		// Stream the file through the digest, never holding it in memory
+		digest, derr := digestFile(signFilePath, alg)
 		if derr != nil {
 			panic(derr)
 		}
-		// Sign the data with the private key used internally
-		sig, serr := key.Sign([]byte(file.GetSHA256()))
+
+		mode := payloadMode(signMode)
+
+		// Sign the digest with the private key used internally, ASN.1 DER for
+		// ECDSA keys and PKCS #1 v1.5 for RSA keys
+		derD, serr := ecdsa.SignDigest(key, ecdsa.BatchItem{
+			Digest: hex.EncodeToString(digest),
+			Hash:   alg,
+		}, mode)
 		if serr != nil {
 			panic(serr)
 		}
 
-		// Tell the sig receiver to asn1/der, this used for verification later
-		derD, err := sig.SigToDER()
+		derF, err := signatureFile(key.FilePointer())
 		if err != nil {
 			panic(err)
 		}
 
-		// Now write a signarture.der file to hold the signature
-		derF := fmt.Sprintf("/var/data/keys/%s/%s/signature-%d.der", dsaType, key.FilePointer(),
-			int32(time.Now().Unix()))
-		if _, err := h.WriteBinary(derF, derD); err != nil {
+		// Record what produced the signature so verify can pick the version
+		meta.Key = key.FilePointer()
+		meta.Hash = alg
+		meta.Mode = mode
+		meta.CreatedAt = time.Now()
+
+		// Now write a signarture.der file to hold the signature, and its sidecar
+		if err := signature.Write(derF, derD, meta); err != nil {
 			panic(err)
 		}
 
-		B.L.Printf("%s%s%s%s", h.WFgB("=== SHA("),
+		op.Detail = fmt.Sprintf("%s %s(%s)", derF, strings.ToUpper(alg), hex.EncodeToString(digest))
+
+		B.L.Printf("%s%s%s%s", h.WFgB(fmt.Sprintf("=== %s(", strings.ToUpper(alg))),
 			h.RFgB(signFilePath), h.WFgB(") = "),
-			h.GFgB(file.GetSHA256()))
+			h.GFgB(hex.EncodeToString(digest)))
 
-		B.L.Printf("%s%s%s\n\t\tr[%d]=0x%x \n\t\ts[%d]=0x%x",
+		if meta.Alias != "" {
+			B.L.Printf("=== Alias(%s) v%d", h.RFgB(meta.Alias), meta.Version)
+		}
+
+		B.L.Printf("%s%s%s\n\t\t%s",
 			h.WFgB("=== Signature("),
 			h.RFgB(derF),
 			h.WFgB(")"),
-			len(sig.R.Text(10)), sig.R, len(sig.S.Text(10)), sig.S)
+			describeSignature(derD))
 	},
 }
 
 var dsaVerifyCmd = &cobra.Command{
-	Use:   "verify",
-	Short: "Verify signed data",
+	Use:         "verify",
+	Short:       "Verify signed data",
+	Annotations: daemonCommand,
 	PreRun: func(cmd *cobra.Command, args []string) {
 		if dsaType == "" {
 			panic(dsaTypePanic())
@@ -240,52 +717,335 @@ var dsaVerifyCmd = &cobra.Command{
 		B.L.Printf("%s", h.CFgB("=== Keys[VERIFY]"))
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		key, err := ecdsa.GetECDSA(*B.C, verifyIdentifier)
+		if Daemon != nil {
+			remoteVerify()
+			return
+		}
+
+		op := audited(audit.OpVerify, verifyIdentifier+verifyAlias)
+		defer op.done()
+
+		// Read the signature file, DER {R,S} or an RSA signature
+		sig, err := ioutil.ReadFile(verifySignaturePath)
 		if err != nil {
 			panic(err)
 		}
 
-		// Read the file ready be signed / this should probably be hashed
-		// if size > key bit size anyways.
-		file, derr := h.NewFile(verifyFilePath)
-		if derr != nil {
-			panic(derr)
+		// The sidecar, when present, supplies the hash, mode and version used
+		meta, err := signature.LoadMetadata(verifySignaturePath)
+		if err != nil {
+			panic(err)
 		}
 
-		// Read the signature file and convert to an ecdsaSigner
-		sig, derr := signature.LoadSignature(verifySignaturePath)
-		if derr != nil {
-			panic(derr)
+		if meta == nil {
+			meta = &signature.Metadata{}
+		}
+
+		if verifyHash == "" {
+			verifyHash = meta.Hash
+		}
+
+		if verifyMode == "" {
+			verifyMode = meta.Mode
+		}
+
+		keys, labels := verifyCandidates(meta)
+		digests := map[string][]byte{}
+
+		for i, key := range keys {
+			alg, err := keyHash(key, verifyHash)
+			if err != nil {
+				panic(err)
+			}
+
+			// Stream the file through the same digest used when signing
+			digest, ok := digests[alg]
+			if !ok {
+				if digest, err = digestFile(verifyFilePath, alg); err != nil {
+					panic(err)
+				}
+
+				digests[alg] = digest
+				B.L.Printf("%s: %x", strings.ToUpper(alg), digest)
+			}
+
+			ok, verr := ecdsa.VerifyDigest(key, ecdsa.BatchItem{
+				Digest: hex.EncodeToString(digest),
+				Hash:   alg,
+			}, payloadMode(verifyMode), sig)
+			if verr != nil {
+				panic(verr)
+			}
+
+			if !ok {
+				continue
+			}
+
+			if key.Struct().Status == api.StatusCompromised {
+				B.L.Printf("===> %s", h.RFgB("WARNING: key is compromised, do not trust new signatures"))
+			}
+
+			B.L.Printf("===> %s %s", h.GFgB("Verified OK"), labels[i])
+			op.Key, op.Detail = key.FilePointer(), fmt.Sprintf("%s verified", verifySignaturePath)
+			return
+		}
+
+		op.Result, op.Detail = audit.ResultFailed, fmt.Sprintf("%s does not verify", verifySignaturePath)
+
+		B.L.Printf("===> %s", h.RFgB("Verification Failure"))
+	},
+}
+
+// verifyCandidates returns the keys a signature may have been produced by:
+// the identifier given, the alias version recorded in the sidecar, or else
+// every version of the alias, newest first. Destroyed keys are refused.
+func verifyCandidates(meta *signature.Metadata) ([]ecdsa.KeyAPI, []string) {
+	if err := oneOf(verifyIdentifier, verifyAlias); err != nil {
+		panic(err)
+	}
+
+	if verifyIdentifier != "" {
+		key, err := ecdsa.ResolveECDSA(*B.C, verifyIdentifier)
+		if err != nil {
+			panic(err)
+		}
+
+		if status := key.Struct().Status; !api.CanVerify(status) {
+			panic(fmt.Errorf("%s key is %s", h.RFgB("verification refused:"), status))
+		}
+
+		if err := key.Authorize(policy.OpVerify, ""); err != nil {
+			panic(err)
+		}
+
+		return []ecdsa.KeyAPI{key}, []string{key.FilePointer()}
+	}
+
+	a, err := alias.Must(B.D, verifyAlias)
+	if err != nil {
+		panic(err)
+	}
+
+	var versions []int
+	if meta.Alias == a.Name && meta.Version > 0 {
+		versions = []int{meta.Version}
+	} else {
+		for i := len(a.Versions) - 1; i >= 0; i-- {
+			versions = append(versions, a.Versions[i].Number)
+		}
+	}
+
+	var keys []ecdsa.KeyAPI
+	var labels []string
+
+	for _, n := range versions {
+		key, err := a.Key(*B.C, n)
+		if err != nil {
+			panic(err)
+		}
+
+		if !api.CanVerify(key.Struct().Status) || key.Authorize(policy.OpVerify, "") != nil {
+			continue
+		}
+
+		keys = append(keys, key)
+		labels = append(labels, fmt.Sprintf("%s v%d", a.Name, n))
+	}
+
+	if len(keys) == 0 {
+		panic(fmt.Errorf("%s no verifiable version of %s", h.RFgB("verification refused:"), a.Name))
+	}
+
+	return keys, labels
+}
+
+var dsaBatchCmd = &cobra.Command{
+	Use:         "batch",
+	Short:       "Sign many digests with one key",
+	Annotations: daemonCommand,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		if dsaType == "" {
+			panic(dsaTypePanic())
+		}
+
+		if err := oneOf(batchIdentifier, batchAlias); err != nil {
+			panic(err)
+		}
+
+		B.L.Printf("%s", h.CFgB("=== Keys[BATCH]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if Daemon != nil {
+			remoteBatch()
+			return
 		}
 
-		B.L.Println("SHA1: ", file.GetSHA1())
-		B.L.Println("SHA256: ", file.GetSHA256())
+		op := audited(audit.OpSign, batchIdentifier+batchAlias)
+		defer op.done()
 
-		var val string
-		res := key.Verify([]byte(file.GetSHA256()), sig)
+		var key ecdsa.KeyAPI
+		var version int
+		var err error
 
-		if res {
-			val = h.GFgB("Verified OK")
+		if batchAlias != "" {
+			key, version, err = alias.PrimaryKey(*B.C, B.D, batchAlias)
 		} else {
-			val = h.RFgB("Verification Failure")
+			key, err = ecdsa.ResolveECDSA(*B.C, batchIdentifier)
+		}
+
+		if err != nil {
+			panic(err)
+		}
+
+		op.Key = key.FilePointer()
+
+		if version > 0 {
+			B.L.Printf("=== Alias(%s) v%d", h.RFgB(batchAlias), version)
+		}
+
+		items, err := readBatch(batchFilePath)
+		if err != nil {
+			panic(err)
+		}
+
+		workers := batchWorkers
+		if workers == 0 {
+			workers = (*B.C).GetInt("batch.workers")
+		}
+
+		results, err := ecdsa.SignBatch(key, items, payloadMode(batchMode), workers)
+		if err != nil {
+			panic(err)
 		}
 
-		B.L.Printf("===> %s", val)
+		failed := writeBatch(results)
+
+		op.Detail = fmt.Sprintf("batch %s: %d signed, %d failed", batchFilePath, len(results)-failed, failed)
+	},
+}
+
+// writeBatch writes the results as JSONL to --out or stdout, prints the
+// tally and returns the count of failures
+func writeBatch(results []ecdsa.BatchResult) int {
+	var out io.Writer = os.Stdout
+	if batchOutPath != "" {
+		f, err := os.Create(batchOutPath)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+
+		out = f
+	}
+
+	failed := 0
+	enc := json.NewEncoder(out)
+
+	for _, res := range results {
+		if res.Error != "" {
+			failed++
+		}
+
+		if err := enc.Encode(res); err != nil {
+			panic(err)
+		}
+	}
+
+	B.L.Printf("===> %s signed, %s failed",
+		h.GFgB(len(results)-failed), h.RFgB(failed))
+
+	return failed
+}
+
+var dsaArchiveCmd = &cobra.Command{
+	Use:         "archive",
+	Short:       "Deactivate a key, it may still verify",
+	Annotations: daemonCommand,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Keys[ARCHIVE]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if Daemon != nil {
+			remoteArchive()
+			return
+		}
+
+		setKeyStatus(api.StatusArchived, "archived")
+	},
+}
+
+var dsaActivateCmd = &cobra.Command{
+	Use:         "activate",
+	Short:       "Reactivate an archived key",
+	Annotations: daemonCommand,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Keys[ACTIVATE]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		setKeyStatus(api.StatusActive, "activated")
+	},
+}
+
+var dsaRevokeCmd = &cobra.Command{
+	Use:         "revoke",
+	Short:       "Revoke a key, compromised keys can never sign again",
+	Annotations: daemonCommand,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Keys[REVOKE]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		status, err := api.RevokeStatus(revokeReason)
+		if err != nil {
+			panic(err)
+		}
+
+		setKeyStatus(status, revokeReason)
+	},
+}
+
+var dsaDestroyCmd = &cobra.Command{
+	Use:         "destroy",
+	Short:       "Erase the private key, keeping the public record",
+	Annotations: daemonCommand,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		if !destroyConfirm {
+			panic(fmt.Errorf("%s", h.RFgB("destroy is irreversible, pass --yes to confirm")))
+		}
+
+		B.L.Printf("%s", h.CFgB("=== Keys[DESTROY]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		setKeyStatus(api.StatusDestroyed, "destroyed")
 	},
 }
 
 var dsaExportPubCmd = &cobra.Command{
-	Use:   "exportPub",
-	Short: "Export a public key",
+	Use:         "exportPub",
+	Short:       "Export a public key",
+	Annotations: daemonCommand,
 	PreRun: func(cmd *cobra.Command, args []string) {
 		B.L.Printf("%s", h.CFgB("=== Keys[EXPORT:PUB]"))
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		key, e := ecdsa.GetECDSA(*B.C, getIdentifier)
+		if Daemon != nil {
+			remoteExportPub()
+			return
+		}
+
+		op := audited(audit.OpExport, getIdentifier)
+		defer op.done()
+
+		key, e := ecdsa.ResolveECDSA(*B.C, getIdentifier)
 		if e != nil {
 			panic(e)
 		}
 
+		op.Key, op.Detail = key.FilePointer(), "public key"
+
+		if err := key.Authorize(policy.OpExport, ""); err != nil {
+			panic(err)
+		}
+
 		pubKey, err := base64.StdEncoding.DecodeString(key.Struct().PublicKeyB64)
 		if err != nil {
 			panic(err)
@@ -302,6 +1062,9 @@ var dsaImportPubCmd = &cobra.Command{
 		B.L.Printf("%s", h.CFgB("=== Keys[IMPORT:PUB]"))
 	},
 	Run: func(cmd *cobra.Command, args []string) {
+		op := audited(audit.OpImport, "")
+		defer op.done()
+
 		pub, err := h.NewFile(importPubFile)
 		if err != nil {
 			panic(err)
@@ -312,6 +1075,8 @@ var dsaImportPubCmd = &cobra.Command{
 			panic(err)
 		}
 
+		op.Key, op.Detail = key.FilePointer(), fmt.Sprintf("public key %s", importPubFile)
+
 		ecdsa.PrintKeyTW(key.Struct())
 	},
 }
@@ -0,0 +1,337 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jedib0t/go-pretty/table"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+
+	h "github.com/block27/core/helpers"
+	"github.com/block27/core/services/audit"
+	"github.com/block27/core/services/auth"
+	"github.com/block27/core/services/dsa/ecdsa"
+)
+
+// backupTarget is the target approvals of backup create are scoped to
+const backupTarget = "backup"
+
+// masterTarget is the target approvals of store rotate-master are scoped to
+const masterTarget = "master"
+
+var (
+	// Operator flags ...
+	operatorName string
+	operatorRole string
+
+	// Approve flags ...
+	approveAction     string
+	approveTarget     string
+	approveTargetFile string
+	approveExpires    string
+	approveOut        string
+)
+
+func init() {
+	operatorAddCmd.Flags().StringVarP(&operatorName, "name", "n", "", "operator name required")
+	operatorAddCmd.Flags().StringVarP(&operatorRole, "role", "r", "", fmt.Sprintf("role: [%s] required",
+		strings.Join(auth.Roles, ", ")))
+	operatorAddCmd.Flags().StringVar(&pinNew, "new-pin", "", "PIN of the operator required")
+	operatorAddCmd.MarkFlagRequired("name")
+	operatorAddCmd.MarkFlagRequired("role")
+	operatorAddCmd.MarkFlagRequired("new-pin")
+
+	operatorRemoveCmd.Flags().StringVarP(&operatorName, "name", "n", "", "operator name required")
+	operatorRemoveCmd.MarkFlagRequired("name")
+
+	operatorResetCmd.Flags().StringVarP(&operatorName, "name", "n", "", "operator name required")
+	operatorResetCmd.Flags().StringVar(&pinNew, "new-pin", "", "PIN to set required")
+	operatorResetCmd.MarkFlagRequired("name")
+	operatorResetCmd.MarkFlagRequired("new-pin")
+
+	quorumApproveCmd.Flags().StringVarP(&approveAction, "action", "a", "", fmt.Sprintf("action: [%s] required",
+		strings.Join(auth.Actions, ", ")))
+	quorumApproveCmd.Flags().StringVarP(&approveTarget, "target", "t", "",
+		fmt.Sprintf("key name/slug/fingerprint/gid, %s for backup create or %s for store rotate-master",
+			backupTarget, masterTarget))
+	quorumApproveCmd.Flags().StringVarP(&approveTargetFile, "target-file", "f", "", "archive to be restored")
+	quorumApproveCmd.Flags().StringVarP(&approveExpires, "expires", "e", "24h", "validity, Go duration")
+	quorumApproveCmd.Flags().StringVarP(&approveOut, "out", "o", "", "token path, default stdout")
+	quorumApproveCmd.MarkFlagRequired("action")
+}
+
+// stdin is shared by every PIN prompt, so piped PINs are read a line each
+var stdin = bufio.NewReader(os.Stdin)
+
+// promptPin asks for an approver's PIN, without echo on a terminal
+func promptPin(name string) []byte {
+	fmt.Fprintf(os.Stderr, "PIN for %s: ", h.WFgB(name))
+
+	if fd := int(os.Stdin.Fd()); terminal.IsTerminal(fd) {
+		secret, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+
+		if err != nil {
+			panic(err)
+		}
+
+		return secret
+	}
+
+	line, err := stdin.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		panic(fmt.Errorf("reading the PIN for %s: %v", name, err))
+	}
+
+	return []byte(strings.TrimRight(line, "\r\n"))
+}
+
+// archiveTarget is the target approvals of restoring an archive are scoped
+// to, so they cannot be spent on another one
+func archiveTarget(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		panic(err)
+	}
+
+	return "sha256:" + hex.EncodeToString(sum.Sum(nil))
+}
+
+// requireQuorum fails the command unless quorum.<action> distinct security
+// officers approve action on target, through --approver or --approval.
+// Until operators are enrolled there is no one to approve and it passes.
+func requireQuorum(action string, target string) {
+	if Session == nil {
+		return
+	}
+
+	op := audited(audit.OpAuth, target)
+	op.Detail = fmt.Sprintf("quorum %s", action)
+	defer op.done()
+
+	q, err := auth.NewQuorum(*B.C, B.D, action, target)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, name := range UsrApprovers {
+		if err := q.Approve(name, promptPin(name)); err != nil {
+			panic(fmt.Errorf("approval by %s: %v", name, err))
+		}
+	}
+
+	for _, path := range UsrApprovals {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			panic(err)
+		}
+
+		var a auth.Approval
+		if err := json.Unmarshal(data, &a); err != nil {
+			panic(fmt.Errorf("approval token %s: %v", path, err))
+		}
+
+		if err := q.Token(&a); err != nil {
+			panic(fmt.Errorf("approval token %s: %v", path, err))
+		}
+	}
+
+	if err := q.Commit(); err != nil {
+		panic(err)
+	}
+
+	op.Detail = fmt.Sprintf("quorum %s approved by %s", action, strings.Join(q.Approvers(), ", "))
+
+	B.L.Printf("===> %s of %s approved by %s", action, h.WFgB(target), h.GFgB(strings.Join(q.Approvers(), ", ")))
+}
+
+var operatorCmd = &cobra.Command{
+	Use:   "operator",
+	Short: "Operators, their roles and PINs",
+	Long: `Operators each hold one role: security officers manage operators, the
+store and backups and approve dangerous actions, crypto users work with keys,
+auditors read the audit log. Once the first operator, a security officer, is
+enrolled, commands need --operator and that operator's --pin instead of the
+device PIN.`,
+	Annotations: map[string]string{rolesAnnotation: auth.RoleOfficer},
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return fmt.Errorf(fmt.Sprintf("%s", h.RFgB("requires an argument")))
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {},
+}
+
+var operatorAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Enrol an operator",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Operator[ADD]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		op := audited(audit.OpAuth, "")
+		op.Detail = fmt.Sprintf("operator add %s as %s", operatorName, operatorRole)
+		defer op.done()
+
+		o, err := auth.NewOperators(*B.C, B.D).Add(operatorName, operatorRole, []byte(pinNew))
+		if err != nil {
+			panic(err)
+		}
+
+		op.Key = o.Key
+
+		B.L.Printf("===> %s enrolled as %s, approvals signed by %s", h.GFgB(o.Name), h.WFgB(o.Role), h.CFgB(o.Key))
+	},
+}
+
+var operatorRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "Unenrol an operator and destroy their approval key",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Operator[REMOVE]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		op := audited(audit.OpAuth, "")
+		op.Detail = fmt.Sprintf("operator remove %s", operatorName)
+		defer op.done()
+
+		if err := auth.NewOperators(*B.C, B.D).Remove(operatorName); err != nil {
+			panic(err)
+		}
+
+		B.L.Printf("===> %s removed", h.GFgB(operatorName))
+	},
+}
+
+var operatorResetCmd = &cobra.Command{
+	Use:   "reset",
+	Short: "Set an operator's PIN, unlocking it",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Operator[RESET]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		op := audited(audit.OpAuth, "")
+		op.Detail = fmt.Sprintf("operator reset %s", operatorName)
+		defer op.done()
+
+		if err := auth.NewOperators(*B.C, B.D).Reset(operatorName, []byte(pinNew)); err != nil {
+			panic(err)
+		}
+
+		B.L.Printf("===> PIN of %s reset", h.GFgB(operatorName))
+	},
+}
+
+var operatorListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List operators",
+	Run: func(cmd *cobra.Command, args []string) {
+		ops, err := auth.NewOperators(*B.C, B.D).List()
+		if err != nil {
+			panic(err)
+		}
+
+		tw := table.NewWriter()
+		tw.SetOutputMirror(os.Stdout)
+		tw.AppendHeader(table.Row{"Name", "Role", "Approval Key", "Created"})
+
+		for _, o := range ops {
+			tw.AppendRow(table.Row{o.Name, o.Role, o.Key, o.CreatedAt.Format("2006-01-02 15:04:05")})
+		}
+
+		tw.SetStyle(table.StyleColoredBright)
+		tw.Render()
+	},
+}
+
+var quorumCmd = &cobra.Command{
+	Use:   "quorum",
+	Short: "Approvals for actions needing several security officers",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return fmt.Errorf(fmt.Sprintf("%s", h.RFgB("requires an argument")))
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {},
+}
+
+var quorumApproveCmd = &cobra.Command{
+	Use:   "approve",
+	Short: "Sign an approval token for one action on one target",
+	Long: `Signs a token approving --action on a key, the backup, the master key
+or, with --target-file, the archive to be restored, using the approval key of the
+security officer given by --operator and --pin. The command being approved
+counts it with --approval. Each token counts once, until --expires.`,
+	Annotations: map[string]string{authAnnotation: authSelf},
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Quorum[APPROVE]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		op := audited(audit.OpAuth, "")
+		op.Actor, op.Detail = UsrOperator, fmt.Sprintf("quorum approve %s", approveAction)
+		defer op.done()
+
+		ttl, err := time.ParseDuration(approveExpires)
+		if err != nil {
+			panic(err)
+		}
+
+		target := approveTarget
+		switch {
+		case approveTargetFile != "":
+			target = archiveTarget(approveTargetFile)
+		case target == "":
+			panic(fmt.Errorf("%s", h.RFgB("--target or --target-file is required")))
+		case target != backupTarget && target != masterTarget:
+			key, err := ecdsa.ResolveECDSA(*B.C, target)
+			if err != nil {
+				panic(err)
+			}
+
+			target = key.FilePointer()
+		}
+
+		op.Key = target
+
+		a, err := auth.NewOperators(*B.C, B.D).Approve(UsrOperator, []byte(UsrPin), approveAction, target, ttl)
+		if err != nil {
+			panic(err)
+		}
+
+		data, err := json.MarshalIndent(a, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		if approveOut == "" {
+			fmt.Println(string(data))
+			return
+		}
+
+		if err := ioutil.WriteFile(approveOut, data, 0600); err != nil {
+			panic(err)
+		}
+
+		B.L.Printf("===> %s of %s approved by %s until %s, token %s", approveAction, h.WFgB(target),
+			h.GFgB(a.Operator), a.ExpiresAt.Format("2006-01-02 15:04:05"), h.CFgB(approveOut))
+	},
+}
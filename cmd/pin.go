@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	h "github.com/block27/core/helpers"
+	"github.com/block27/core/services/audit"
+	"github.com/block27/core/services/auth"
+)
+
+// authAnnotation marks commands checking credentials of their own rather
+// than --pin, see authenticate
+const (
+	authAnnotation = "auth"
+	authSelf       = "self"
+)
+
+// rolesAnnotation lists, comma separated, the operator roles allowed to run
+// a command and its subcommands
+const rolesAnnotation = "roles"
+
+var (
+	// New PIN/PUK flags ...
+	pinNew string
+	pukNew string
+)
+
+func init() {
+	pinInitCmd.Flags().StringVar(&pinNew, "new-pin", "", "PIN to set required")
+	pinInitCmd.Flags().StringVar(&pukNew, "new-puk", "", "PUK to set required")
+	pinInitCmd.MarkFlagRequired("new-pin")
+	pinInitCmd.MarkFlagRequired("new-puk")
+
+	pinChangeCmd.Flags().StringVar(&pinNew, "new-pin", "", "PIN to set required")
+	pinChangeCmd.MarkFlagRequired("new-pin")
+
+	pinUnblockCmd.Flags().StringVar(&UsrPuk, "puk", "", "PUK required")
+	pinUnblockCmd.Flags().StringVar(&pinNew, "new-pin", "", "PIN to set required")
+	pinUnblockCmd.MarkFlagRequired("puk")
+	pinUnblockCmd.MarkFlagRequired("new-pin")
+}
+
+var pinCmd = &cobra.Command{
+	Use:   "pin",
+	Short: "PIN and PUK management",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return fmt.Errorf(fmt.Sprintf("%s", h.RFgB("requires an argument")))
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {},
+}
+
+var pinInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Set the first PIN and PUK",
+	Long: `Sets the PIN every command is authorised with and the PUK that unblocks
+it. Both are stored as bcrypt hashes. The PIN locks after auth.pin_retries
+failures in a row, the PUK blocks for good after auth.puk_retries.
+
+The hashes and counters are MACed under the master key with a version
+raised on every write, editing them or putting back an earlier record is
+refused. Putting back an earlier copy of the whole database still resets
+the counters, it has to be kept where only the owner can write it.`,
+	Annotations: map[string]string{authAnnotation: authSelf},
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Pin[INIT]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		op := audited(audit.OpAuth, "")
+		op.Detail = "pin init"
+		defer op.done()
+
+		if err := auth.NewPin(*B.C, B.D).Init([]byte(pinNew), []byte(pukNew)); err != nil {
+			panic(err)
+		}
+
+		B.L.Printf("===> %s", h.GFgB("PIN and PUK set"))
+	},
+}
+
+var pinChangeCmd = &cobra.Command{
+	Use:         "change",
+	Short:       "Replace the PIN given with --pin, --operator's if set",
+	Annotations: map[string]string{authAnnotation: authSelf},
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Pin[CHANGE]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		op := audited(audit.OpAuth, "")
+		op.Detail = "pin change"
+		defer op.done()
+
+		if UsrOperator != "" {
+			op.Actor = UsrOperator
+			if err := auth.NewOperators(*B.C, B.D).Change(UsrOperator, []byte(UsrPin), []byte(pinNew)); err != nil {
+				panic(err)
+			}
+		} else if err := auth.NewPin(*B.C, B.D).Change([]byte(UsrPin), []byte(pinNew)); err != nil {
+			panic(err)
+		}
+
+		B.L.Printf("===> %s", h.GFgB("PIN changed"))
+	},
+}
+
+var pinUnblockCmd = &cobra.Command{
+	Use:         "unblock",
+	Short:       "Set a new PIN with the PUK, unlocking it",
+	Annotations: map[string]string{authAnnotation: authSelf},
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Pin[UNBLOCK]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		op := audited(audit.OpAuth, "")
+		op.Detail = "pin unblock"
+		defer op.done()
+
+		if err := auth.NewPin(*B.C, B.D).Unblock([]byte(UsrPuk), []byte(pinNew)); err != nil {
+			panic(err)
+		}
+
+		B.L.Printf("===> %s", h.GFgB("PIN unblocked"))
+	},
+}
+
+var pinStatusCmd = &cobra.Command{
+	Use:         "status",
+	Short:       "Show the failures counted against the PIN and PUK",
+	Annotations: map[string]string{authAnnotation: authSelf},
+	Run: func(cmd *cobra.Command, args []string) {
+		s, err := auth.NewPin(*B.C, B.D).Status()
+		if UsrOperator != "" {
+			s, err = auth.NewOperators(*B.C, B.D).Status(UsrOperator)
+		}
+
+		if err != nil {
+			panic(err)
+		}
+
+		if !s.Initialized {
+			B.L.Printf("===> %s", h.YFgB(auth.ErrNotInitialized.Error()))
+			return
+		}
+
+		if UsrOperator != "" {
+			B.L.Printf("===> PIN of %s %s of %s failures", h.WFgB(UsrOperator), h.YFgB(s.PinTries), h.WFgB(s.PinRetries))
+			return
+		}
+
+		B.L.Printf("===> PIN %s of %s failures, PUK %s of %s failures",
+			h.YFgB(s.PinTries), h.WFgB(s.PinRetries), h.YFgB(s.PukTries), h.WFgB(s.PukRetries))
+	},
+}
@@ -2,9 +2,13 @@ package cmd
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/block27/core/backend"
 	h "github.com/block27/core/helpers"
+	"github.com/block27/core/services/audit"
+	"github.com/block27/core/services/auth"
+	"github.com/block27/core/services/hsmd"
 	"github.com/spf13/cobra"
 )
 
@@ -18,12 +22,32 @@ var (
 	// UsrPuk used to reset the pin
 	UsrPuk string
 
+	// UsrOperator names the operator --pin belongs to, once any is enrolled
+	UsrOperator string
+
+	// UsrApprovers are security officers approving in this session, each
+	// prompted for their PIN
+	UsrApprovers []string
+
+	// UsrApprovals are paths of signed approval tokens
+	UsrApprovals []string
+
+	// Session is the operator authenticated, nil until operators are enrolled
+	Session *auth.Operator
+
 	// B - main backend interface that holds all functionality
 	B *backend.Backend
 
+	// Daemon is the running hsmd, which holds the datastore. Commands then
+	// go through it and B carries the configuration and logger only.
+	Daemon hsmd.ClientAPI
+
 	rootCmd = &cobra.Command{
 		Use:   "cli",
 		Short: fmt.Sprintf("%s: ECDSA/RSA key generation, signing, AES encrypt/decrypt, and secure backup", h.GFgB("Sigma CLI")),
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			authenticate(cmd)
+		},
 		Run: func(cmd *cobra.Command, args []string) {
 			B.Welcome()
 		},
@@ -37,6 +61,14 @@ func Execute(b *backend.Backend) error {
 	return rootCmd.Execute()
 }
 
+// ExecuteDaemon executes the root command through a running hsmd
+func ExecuteDaemon(b *backend.Backend, d hsmd.ClientAPI) error {
+	B, Daemon = b, d
+	defer Daemon.Logout()
+
+	return rootCmd.Execute()
+}
+
 func init() {
 	cobra.OnInitialize(preConfig)
 
@@ -44,22 +76,100 @@ func init() {
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(dsaCmd)
 	rootCmd.AddCommand(infoCmd)
+	rootCmd.AddCommand(tsaCmd)
+	rootCmd.AddCommand(storeCmd)
+	rootCmd.AddCommand(backupCmd)
+	rootCmd.AddCommand(auditCmd)
+	rootCmd.AddCommand(pinCmd)
+	rootCmd.AddCommand(operatorCmd)
+	rootCmd.AddCommand(quorumCmd)
+	rootCmd.AddCommand(tlsCmd)
+	rootCmd.AddCommand(tokenCmd)
 
 	// flags
 	rootCmd.PersistentFlags().BoolVarP(&DryRun, "dry-run", "d", false,
 		"dry, no commits to real data")
 	rootCmd.PersistentFlags().StringVarP(&UsrPin, "pin", "p", "",
 		"pin, for session authentication")
+	rootCmd.PersistentFlags().StringVar(&UsrOperator, "operator", "",
+		"operator, required once operators are enrolled")
+	rootCmd.PersistentFlags().StringSliceVar(&UsrApprovers, "approver", []string{},
+		"security officer approving in this session, prompted for their PIN")
+	rootCmd.PersistentFlags().StringSliceVar(&UsrApprovals, "approval", []string{},
+		"path of a signed approval token, see `quorum approve`")
 
 	// dsa
 	dsaCmd.AddCommand(dsaCreateCmd)
 	dsaCmd.AddCommand(dsaGetCmd)
 	dsaCmd.AddCommand(dsaListCmd)
+	dsaCmd.AddCommand(dsaReindexCmd)
+	dsaCmd.AddCommand(dsaLabelCmd)
+	dsaCmd.AddCommand(dsaTagCmd)
 	dsaCmd.AddCommand(dsaSignCmd)
 	dsaCmd.AddCommand(dsaVerifyCmd)
+	dsaCmd.AddCommand(dsaBatchCmd)
+	dsaCmd.AddCommand(dsaArchiveCmd)
+	dsaCmd.AddCommand(dsaActivateCmd)
+	dsaCmd.AddCommand(dsaRevokeCmd)
+	dsaCmd.AddCommand(dsaDestroyCmd)
+	dsaCmd.AddCommand(dsaRotateCmd)
+	dsaCmd.AddCommand(aliasCmd)
+
+	// export/import
 	dsaCmd.AddCommand(dsaExportPubCmd)
 	dsaCmd.AddCommand(dsaImportPubCmd)
 
+	// alias
+	aliasCmd.AddCommand(aliasCreateCmd)
+	aliasCmd.AddCommand(aliasGetCmd)
+	aliasCmd.AddCommand(aliasListCmd)
+
+	// tsa
+	tsaCmd.AddCommand(tsaSetupCmd)
+	tsaCmd.AddCommand(tsaStampCmd)
+	tsaCmd.AddCommand(tsaReplyCmd)
+	tsaCmd.AddCommand(tsaCertCmd)
+
+	// store
+	storeCmd.AddCommand(storeEncryptCmd)
+	storeCmd.AddCommand(storeMigrateCmd)
+	storeCmd.AddCommand(storeVerifyCmd)
+	storeCmd.AddCommand(storeRotateMasterCmd)
+
+	// backup
+	backupCmd.AddCommand(backupCreateCmd)
+	backupCmd.AddCommand(backupRestoreCmd)
+
+	// audit
+	auditCmd.AddCommand(auditSetupCmd)
+	auditCmd.AddCommand(auditCheckpointCmd)
+	auditCmd.AddCommand(auditVerifyCmd)
+	auditCmd.AddCommand(auditShowCmd)
+
+	// pin
+	pinCmd.AddCommand(pinInitCmd)
+	pinCmd.AddCommand(pinChangeCmd)
+	pinCmd.AddCommand(pinUnblockCmd)
+	pinCmd.AddCommand(pinStatusCmd)
+
+	// operator
+	operatorCmd.AddCommand(operatorAddCmd)
+	operatorCmd.AddCommand(operatorRemoveCmd)
+	operatorCmd.AddCommand(operatorListCmd)
+	operatorCmd.AddCommand(operatorResetCmd)
+
+	// quorum
+	quorumCmd.AddCommand(quorumApproveCmd)
+
+	// tls
+	tlsCmd.AddCommand(tlsSetupCmd)
+	tlsCmd.AddCommand(tlsRequestCmd)
+
+	// token
+	tokenCmd.AddCommand(tokenCreateCmd)
+	tokenCmd.AddCommand(tokenListCmd)
+	tokenCmd.AddCommand(tokenRevokeCmd)
+
 	// root Flags
 	dsaCmd.PersistentFlags().StringVarP(&dsaType, "type", "t", "",
 		"type of key: [ecdsa, eddsa, rsa.....]")
@@ -72,10 +182,47 @@ func preConfig() {
 	if DryRun {
 		fmt.Printf("%s", h.YFgB("*** --dry-run enabled, no data will be saved ***\n"))
 	}
+}
 
-	if UsrPin == "" || UsrPin != "000000" {
-		panic("invalid pin")
+// authenticate checks --pin before a command runs, unless the command is
+// annotated to check credentials itself. Until operators are enrolled it
+// is the device PIN; after, --operator's PIN, and the operator must hold a
+// role the command allows. Every attempt is audited. While hsmd runs the
+// credentials open a session with it instead.
+func authenticate(cmd *cobra.Command) {
+	if Daemon != nil {
+		daemonLogin(cmd)
+		return
 	}
+
+	if cmd.Annotations[authAnnotation] == authSelf {
+		return
+	}
+
+	op := audited(audit.OpAuth, "")
+	op.Detail = "pin"
+	defer op.done()
+
+	if UsrOperator != "" {
+		op.Actor, op.Detail = UsrOperator, "operator pin"
+	}
+
+	var err error
+	if Session, err = auth.Authenticate(*B.C, B.D, UsrOperator, []byte(UsrPin), allowedRoles(cmd)...); err != nil {
+		panic(fmt.Errorf("%s %v", h.RFgB(cmd.CommandPath()+":"), err))
+	}
+}
+
+// allowedRoles returns the roles the command or its closest annotated
+// parent allows, nil for any
+func allowedRoles(cmd *cobra.Command) []string {
+	for c := cmd; c != nil; c = c.Parent() {
+		if roles, ok := c.Annotations[rolesAnnotation]; ok {
+			return strings.Split(roles, ",")
+		}
+	}
+
+	return nil
 }
 
 func postConfig() {
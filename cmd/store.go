@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/spf13/cobra"
+
+	"github.com/block27/core/crypto"
+	h "github.com/block27/core/helpers"
+	"github.com/block27/core/services/auth"
+	"github.com/block27/core/services/dsa/ecdsa"
+)
+
+var (
+	// Rotate master flags ...
+	storeMasterKey string
+	storeMasterIv  string
+)
+
+func init() {
+	storeRotateMasterCmd.Flags().StringVar(&storeMasterKey, "key-file", "", "file holding the new master key required")
+	storeRotateMasterCmd.Flags().StringVar(&storeMasterIv, "iv-file", "", "file holding the new master iv required")
+	storeRotateMasterCmd.MarkFlagRequired("key-file")
+	storeRotateMasterCmd.MarkFlagRequired("iv-file")
+}
+
+var storeCmd = &cobra.Command{
+	Use:         "store",
+	Short:       "Key store maintenance",
+	Annotations: map[string]string{rolesAnnotation: auth.RoleOfficer},
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return fmt.Errorf(fmt.Sprintf("%s", h.RFgB("requires an argument")))
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {},
+}
+
+var storeEncryptCmd = &cobra.Command{
+	Use:   "encrypt",
+	Short: "Wrap plaintext private keys under the hardware master key",
+	Long: `Encrypts, in place, the private key material of keys created before
+encryption at rest. Keys already encrypted are left untouched, so the
+command is safe to re-run. Records of an older format are refused, store
+migrate upgrades and encrypts them.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Store[ENCRYPT]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		migrated, err := ecdsa.EncryptStore(*B.C)
+		for _, gid := range migrated {
+			B.L.Printf("===> %s encrypted", h.WFgB(gid))
+		}
+
+		if err != nil {
+			panic(err)
+		}
+
+		B.L.Printf("===> %s keys encrypted", h.GFgB(len(migrated)))
+	},
+}
+
+var storeMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Upgrade key records to the current schema version",
+	Long: `Rewrites every key record stored in an older format, such as the
+original gob encoding, in the current versioned format. Keys still kept as
+directories under paths.keys are moved into the keystore, and records
+written before integrity protection are sealed with a MAC. Private key
+material still in plaintext is encrypted on the way. Records that cannot
+be read are listed and left untouched.
+
+Sealing is a one-time step: once it has run, or on a store that never held
+unsealed records, the store is marked sealed and unsealed records are
+refused rather than sealed, whoever put them there.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Store[MIGRATE]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		migrated, failures, err := ecdsa.MigrateStore(*B.C)
+		for _, gid := range migrated {
+			B.L.Printf("===> %s migrated", h.WFgB(gid))
+		}
+
+		for _, f := range failures {
+			B.L.Printf("===> %s %v", h.RFgB("failed"), f)
+		}
+
+		if err != nil {
+			panic(err)
+		}
+
+		B.L.Printf("===> %s keys migrated, %s failed", h.GFgB(len(migrated)), h.RFgB(len(failures)))
+
+		if len(failures) != 0 {
+			panic(fmt.Errorf("%s", h.RFgB("some key records could not be migrated")))
+		}
+	},
+}
+
+var storeVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check every key record and index for tampering",
+	Long: `Checks the MAC of every key record, which is keyed from the hardware
+master key and covers all of a key's material and its version, so records
+edited or swapped on disk are reported as tampered, and earlier copies of a
+record put back in place as replayed. Index entries without a record are
+reported as missing, records no lookup can reach as orphaned. Nothing is
+changed, see store migrate and dsa reindex.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Store[VERIFY]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		checked, findings, err := ecdsa.VerifyStore(*B.C)
+		if err != nil {
+			panic(err)
+		}
+
+		for _, f := range findings {
+			B.L.Printf("===> %s %s %s", h.WFgB(f.GID), h.RFgB(f.Problem), f.Detail)
+		}
+
+		B.L.Printf("===> %s records checked, %s problems", h.GFgB(checked), h.RFgB(len(findings)))
+
+		if len(findings) != 0 {
+			panic(fmt.Errorf("%s", h.RFgB("the key store failed verification")))
+		}
+	},
+}
+
+var storeRotateMasterCmd = &cobra.Command{
+	Use:   "rotate-master",
+	Short: "Re-seal the store under a new hardware master key",
+	Long: `Unwraps every private key under the master key loaded and wraps it again
+under the one in --key-file and --iv-file, then rewrites the key records,
+the store state, the credentials, operators and API tokens with MACs from
+the new key. Nothing is changed unless every record reads, and a failure
+part way puts back what was written. Needs quorum.rotate_master approvals
+of the master target.
+
+Install the new key and iv on the device and at the host paths before the
+next start, nothing loads under the old one any more. Backups made before
+can no longer be restored.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Store[ROTATE-MASTER]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		key, err := ioutil.ReadFile(storeMasterKey)
+		if err != nil {
+			panic(err)
+		}
+
+		iv, err := ioutil.ReadFile(storeMasterIv)
+		if err != nil {
+			panic(err)
+		}
+
+		keys, n, err := ecdsa.Reseal(*B.C)
+		if err != nil {
+			panic(err)
+		}
+
+		credentials, err := auth.Reseal(B.D)
+		if err != nil {
+			panic(err)
+		}
+
+		requireQuorum(auth.ActionRotateMaster, masterTarget)
+
+		if err := crypto.RotateMasterKey(key, iv, keys, credentials); err != nil {
+			panic(err)
+		}
+
+		id, err := crypto.MasterKeyID()
+		if err != nil {
+			panic(err)
+		}
+
+		B.L.Printf("===> %s keys and the credentials resealed under master key %s", h.GFgB(n), h.WFgB(id))
+	},
+}
@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	gocrypto "crypto"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	h "github.com/block27/core/helpers"
+	"github.com/block27/core/services/audit"
+	"github.com/block27/core/services/auth"
+	"github.com/block27/core/services/mtls"
+)
+
+var (
+	// Setup flags ...
+	tlsSetupName  string
+	tlsSetupCurve string
+	tlsSetupDays  int
+
+	// Shared flags ...
+	tlsCN    string
+	tlsHosts []string
+	tlsOut   string
+)
+
+func init() {
+	// Setup flags ...
+	tlsSetupCmd.Flags().StringVarP(&tlsSetupName, "name", "n", "api-tls", "name of the server key")
+	tlsSetupCmd.Flags().StringVarP(&tlsSetupCurve, "curve", "c", "prime256v1", "default: prime256v1")
+	tlsSetupCmd.Flags().IntVar(&tlsSetupDays, "days", 365, "validity of the self-signed certificate")
+
+	for _, c := range []*cobra.Command{tlsSetupCmd, tlsRequestCmd} {
+		c.Flags().StringVar(&tlsCN, "cn", "Block27 HSM API", "certificate common name")
+		c.Flags().StringSliceVar(&tlsHosts, "host", []string{"localhost", "127.0.0.1"}, "DNS name or IP the API is reached at")
+		c.Flags().StringVarP(&tlsOut, "out", "o", "", "output .csr path, default: stdout")
+	}
+}
+
+var tlsCmd = &cobra.Command{
+	Use:         "tls",
+	Short:       "TLS server key and certificate of the API",
+	Annotations: map[string]string{rolesAnnotation: auth.RoleOfficer},
+	Long: "The API serves TLS with a server key held in the keystore and " +
+		"requires client certificates issued by api.tls.client_ca. Install " +
+		"the certificate the CA issues for the request at api.tls.cert, then " +
+		"send the API SIGHUP to reload it.",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return fmt.Errorf(fmt.Sprintf("%s", h.RFgB("requires an argument")))
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {},
+}
+
+var tlsSetupCmd = &cobra.Command{
+	Use:   "setup",
+	Short: "Create the server key, a self-signed certificate and a signing request",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== TLS[SETUP]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		op := audited(audit.OpCreate, "")
+		defer op.done()
+
+		key, err := mtls.Setup(*B.C, B.D, tlsSetupName, tlsSetupCurve)
+		if err != nil {
+			panic(err)
+		}
+
+		op.Key, op.Detail = key.FilePointer(), fmt.Sprintf("tls server key %s", tlsSetupName)
+
+		s, err := mtls.Signer(*B.C, B.D)
+		if err != nil {
+			panic(err)
+		}
+
+		// Serves until the CA has signed the request
+		cert, err := mtls.SelfSign(s, tlsCN, tlsHosts, time.Duration(tlsSetupDays)*24*time.Hour)
+		if err != nil {
+			panic(err)
+		}
+
+		path := (*B.C).GetString("api.tls.cert")
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			panic(err)
+		}
+
+		if err := ioutil.WriteFile(path, mtls.EncodeCertificate(cert), 0644); err != nil {
+			panic(err)
+		}
+
+		B.L.Printf("%s%s%s", h.WFgB("=== Certificate("), h.RFgB(path), h.WFgB(") self-signed"))
+
+		writeRequest(s)
+	},
+}
+
+var tlsRequestCmd = &cobra.Command{
+	Use:   "csr",
+	Short: "Create a signing request for the server key, e.g. to renew",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== TLS[CSR]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		s, err := mtls.Signer(*B.C, B.D)
+		if err != nil {
+			panic(err)
+		}
+
+		writeRequest(s)
+	},
+}
+
+// writeRequest writes a signing request for the server key to --out
+func writeRequest(s gocrypto.Signer) {
+	csr, err := mtls.CreateRequest(s, tlsCN, tlsHosts)
+	if err != nil {
+		panic(err)
+	}
+
+	if tlsOut == "" {
+		fmt.Print(string(csr))
+		return
+	}
+
+	if err := ioutil.WriteFile(tlsOut, csr, 0644); err != nil {
+		panic(err)
+	}
+
+	B.L.Printf("%s%s%s", h.WFgB("=== Request("), h.RFgB(tlsOut), h.WFgB(")"))
+}
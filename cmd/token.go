@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jedib0t/go-pretty/table"
+	"github.com/spf13/cobra"
+
+	h "github.com/block27/core/helpers"
+	"github.com/block27/core/services/audit"
+	"github.com/block27/core/services/auth"
+	"github.com/block27/core/services/rest"
+)
+
+var (
+	// Token flags ...
+	tokenName    string
+	tokenKeys    []string
+	tokenOps     []string
+	tokenExpires string
+	tokenID      string
+)
+
+func init() {
+	tokenCreateCmd.Flags().StringVarP(&tokenName, "name", "n", "", "token name required")
+	tokenCreateCmd.Flags().StringSliceVarP(&tokenKeys, "key", "k", nil, "key name/slug/fingerprint/gid or alias, default: any")
+	tokenCreateCmd.Flags().StringSliceVar(&tokenOps, "op", nil, fmt.Sprintf("operation: [%s] required",
+		strings.Join(rest.Permissions, ", ")))
+	tokenCreateCmd.Flags().StringVarP(&tokenExpires, "expires", "e", "720h", "validity, Go duration")
+	tokenCreateCmd.MarkFlagRequired("name")
+	tokenCreateCmd.MarkFlagRequired("op")
+
+	tokenRevokeCmd.Flags().StringVar(&tokenID, "id", "", "token id required")
+	tokenRevokeCmd.MarkFlagRequired("id")
+}
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "API tokens for automation",
+	Long: `API tokens let automation call the API without a client certificate,
+sending "Authorization: Bearer <token>". Each is limited to its operations on
+its keys, until it expires or is revoked. Only a bcrypt hash of the token is
+stored, it is shown once, when created. Security officers can also revoke
+one through the API, POST /api/v1/tokens/{id}/revoke.`,
+	Annotations: map[string]string{rolesAnnotation: auth.RoleOfficer},
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return fmt.Errorf(fmt.Sprintf("%s", h.RFgB("requires an argument")))
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {},
+}
+
+var tokenCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Mint an API token",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Token[CREATE]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		op := audited(audit.OpAuth, "")
+		op.Detail = fmt.Sprintf("token create %s for %s on %v", tokenName, strings.Join(tokenOps, ","), tokenKeys)
+		defer op.done()
+
+		ttl, err := time.ParseDuration(tokenExpires)
+		if err != nil {
+			panic(err)
+		}
+
+		createdBy := "device"
+		if Session != nil {
+			createdBy = Session.Name
+		}
+
+		t, secret, err := auth.NewTokens(*B.C, B.D).Mint(tokenName, tokenKeys, tokenOps, ttl, createdBy)
+		if err != nil {
+			panic(err)
+		}
+
+		op.Detail = fmt.Sprintf("token create %s (%s) for %s on %v", t.Name, t.ID, strings.Join(t.Operations, ","), t.Keys)
+
+		B.L.Printf("===> %s (%s) until %s, it is not shown again", h.GFgB(t.Name), h.WFgB(t.ID),
+			t.ExpiresAt.Format("2006-01-02 15:04:05"))
+
+		fmt.Println(secret)
+	},
+}
+
+var tokenListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List API tokens",
+	Run: func(cmd *cobra.Command, args []string) {
+		toks, err := auth.NewTokens(*B.C, B.D).List()
+		if err != nil {
+			panic(err)
+		}
+
+		tw := table.NewWriter()
+		tw.SetOutputMirror(os.Stdout)
+		tw.AppendHeader(table.Row{"ID", "Name", "Keys", "Operations", "Created By", "Expires", "State"})
+
+		now := time.Now()
+
+		for _, t := range toks {
+			keys := strings.Join(t.Keys, ", ")
+			if keys == "" {
+				keys = "*"
+			}
+
+			state := "active"
+			switch {
+			case t.RevokedAt != nil:
+				state = "revoked"
+			case !t.Active(now):
+				state = "expired"
+			}
+
+			tw.AppendRow(table.Row{t.ID, t.Name, keys, strings.Join(t.Operations, ", "), t.CreatedBy,
+				t.ExpiresAt.Format("2006-01-02 15:04:05"), state})
+		}
+
+		tw.SetStyle(table.StyleColoredBright)
+		tw.Render()
+	},
+}
+
+var tokenRevokeCmd = &cobra.Command{
+	Use:   "revoke",
+	Short: "Revoke an API token",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== Token[REVOKE]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		op := audited(audit.OpAuth, "")
+		op.Detail = fmt.Sprintf("token revoke %s", tokenID)
+		defer op.done()
+
+		t, err := auth.NewTokens(*B.C, B.D).Revoke(tokenID)
+		if err != nil {
+			panic(err)
+		}
+
+		B.L.Printf("===> %s (%s) revoked", h.GFgB(t.Name), h.WFgB(t.ID))
+	},
+}
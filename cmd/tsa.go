@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/spf13/cobra"
+
+	"github.com/block27/core/crypto"
+	h "github.com/block27/core/helpers"
+	"github.com/block27/core/services/audit"
+	"github.com/block27/core/services/auth"
+	"github.com/block27/core/services/tsa"
+)
+
+var (
+	// Setup flags ...
+	tsaSetupName  string
+	tsaSetupCurve string
+	tsaSetupCN    string
+
+	// Stamp flags ...
+	tsaStampFile   string
+	tsaStampHash   string
+	tsaStampPolicy string
+	tsaStampCert   bool
+	tsaStampOut    string
+
+	// Reply flags ...
+	tsaReplyQuery string
+	tsaReplyOut   string
+)
+
+func init() {
+	// Setup flags ...
+	tsaSetupCmd.Flags().StringVarP(&tsaSetupName, "name", "n", "tsa", "name of the TSA signing key")
+	tsaSetupCmd.Flags().StringVarP(&tsaSetupCurve, "curve", "c", "prime256v1", "default: prime256v1")
+	tsaSetupCmd.Flags().StringVar(&tsaSetupCN, "cn", "Block27 Time-Stamping Authority", "certificate common name")
+
+	// Stamp flags ...
+	tsaStampCmd.Flags().StringVarP(&tsaStampFile, "file", "f", "", "file required")
+	tsaStampCmd.Flags().StringVar(&tsaStampHash, "hash", crypto.SHA256, "message imprint digest")
+	tsaStampCmd.Flags().StringVar(&tsaStampPolicy, "policy", "", "policy OID, default: config tsa.policy")
+	tsaStampCmd.Flags().BoolVar(&tsaStampCert, "cert", true, "embed the TSA certificate in the token")
+	tsaStampCmd.Flags().StringVarP(&tsaStampOut, "out", "o", "", "output .tsr path, default: <file>.tsr")
+	tsaStampCmd.MarkFlagRequired("file")
+
+	// Reply flags ...
+	tsaReplyCmd.Flags().StringVarP(&tsaReplyQuery, "query", "q", "", "DER TimeStampReq (.tsq) required")
+	tsaReplyCmd.Flags().StringVarP(&tsaReplyOut, "out", "o", "", "output .tsr path required")
+	tsaReplyCmd.MarkFlagRequired("query")
+	tsaReplyCmd.MarkFlagRequired("out")
+}
+
+var tsaCmd = &cobra.Command{
+	Use:         "tsa",
+	Short:       "RFC 3161 time-stamping authority",
+	Annotations: map[string]string{rolesAnnotation: auth.RoleUser},
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return fmt.Errorf(fmt.Sprintf("%s", h.RFgB("requires an argument")))
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {},
+}
+
+var tsaSetupCmd = &cobra.Command{
+	Use:   "setup",
+	Short: "Create the TSA signing key and certificate",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== TSA[SETUP]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		op := audited(audit.OpCreate, "")
+		defer op.done()
+
+		a, err := tsa.Setup(*B.C, B.D, tsaSetupName, tsaSetupCurve, tsaSetupCN)
+		if err != nil {
+			panic(err)
+		}
+
+		op.Detail = fmt.Sprintf("tsa key %s, certificate %s", tsaSetupName, a.Certificate().Subject.CommonName)
+
+		printTSACert(a)
+	},
+}
+
+var tsaStampCmd = &cobra.Command{
+	Use:   "stamp",
+	Short: "Time-stamp a file",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== TSA[STAMP]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		op := audited(audit.OpSign, "")
+		defer op.done()
+
+		a, err := tsa.Load(*B.C, B.D)
+		if err != nil {
+			panic(err)
+		}
+
+		var policy asn1.ObjectIdentifier
+		if tsaStampPolicy != "" {
+			if policy, err = tsa.ParseOID(tsaStampPolicy); err != nil {
+				panic(err)
+			}
+		}
+
+		digest, err := digestFile(tsaStampFile, tsaStampHash)
+		if err != nil {
+			panic(err)
+		}
+
+		req, _, err := tsa.NewRequest(digest, tsaStampHash, policy, tsaStampCert)
+		if err != nil {
+			panic(err)
+		}
+
+		resp, err := a.Respond(req)
+		if err != nil {
+			panic(err)
+		}
+
+		out := tsaStampOut
+		if out == "" {
+			out = fmt.Sprintf("%s.tsr", tsaStampFile)
+		}
+
+		op.Detail = fmt.Sprintf("time-stamp %s", out)
+
+		printTSAResponse(resp, out)
+	},
+}
+
+var tsaReplyCmd = &cobra.Command{
+	Use:   "reply",
+	Short: "Answer a TimeStampReq, e.g. from `openssl ts -query`",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		B.L.Printf("%s", h.CFgB("=== TSA[REPLY]"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		op := audited(audit.OpSign, "")
+		defer op.done()
+
+		a, err := tsa.Load(*B.C, B.D)
+		if err != nil {
+			panic(err)
+		}
+
+		req, err := ioutil.ReadFile(tsaReplyQuery)
+		if err != nil {
+			panic(err)
+		}
+
+		resp, err := a.Respond(req)
+		if err != nil {
+			panic(err)
+		}
+
+		op.Detail = fmt.Sprintf("time-stamp %s", tsaReplyOut)
+
+		printTSAResponse(resp, tsaReplyOut)
+	},
+}
+
+var tsaCertCmd = &cobra.Command{
+	Use:   "cert",
+	Short: "Print the TSA certificate",
+	Run: func(cmd *cobra.Command, args []string) {
+		a, err := tsa.Load(*B.C, B.D)
+		if err != nil {
+			panic(err)
+		}
+
+		printTSACert(a)
+	},
+}
+
+func printTSACert(a tsa.TimestampAPI) {
+	fmt.Print(string(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: a.Certificate().Raw,
+	})))
+}
+
+// printTSAResponse writes the reply to disk and logs what was granted
+func printTSAResponse(resp []byte, out string) {
+	if _, err := h.WriteBinary(out, resp); err != nil {
+		panic(err)
+	}
+
+	tok, err := tsa.ParseResponse(resp)
+	if err != nil {
+		panic(err)
+	}
+
+	if tok.Status != tsa.StatusGranted && tok.Status != tsa.StatusGrantedWithMods {
+		B.L.Printf("===> %s %v", h.RFgB("Rejected"), tok.StatusString)
+		return
+	}
+
+	B.L.Printf("%s%s%s", h.WFgB("=== Token("), h.RFgB(out), h.WFgB(")"))
+	B.L.Printf("\tserial=%s time=%s policy=%s",
+		tok.Info.SerialNumber, tok.GenTime().Format("2006-01-02T15:04:05Z"), tok.Info.Policy)
+}
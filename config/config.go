@@ -95,6 +95,87 @@ func defaults(config Reader) {
 
 	config.SetDefault("paths.base", basePath)
 	config.SetDefault("paths.keys", hostKeysPath)
+
+	// Where dsa sign writes signatures without --out, a directory per key
+	config.SetDefault("paths.signatures", fmt.Sprintf("%s/signatures", basePath))
+
+	// Key record storage, {bbolt, fs, memory}
+	config.SetDefault("keystore.backend", "bbolt")
+
+	// Signature payload mode for dsa sign/verify, {legacy, openssl}
+	config.SetDefault("signature.mode", "legacy")
+
+	// Batch signing, concurrent signers and the largest batch accepted
+	config.SetDefault("batch.workers", 4)
+	config.SetDefault("batch.max_items", 10000)
+
+	// Alias rotation schedule, Go durations or days e.g. 90d, empty disables.
+	// rotation.aliases overrides rotation.period per alias name
+	config.SetDefault("rotation.period", "")
+	config.SetDefault("rotation.aliases", map[string]string{})
+
+	// RFC 3161 time-stamping authority, policy OIDs in dotted form. There is
+	// no default policy, the TSA refuses to start until one is configured
+	config.SetDefault("tsa.policy", "")
+	config.SetDefault("tsa.policies", []string{})
+	config.SetDefault("tsa.validity_years", 10)
+
+	// Failures in a row before the PIN locks, and the PUK blocks for good
+	config.SetDefault("auth.pin_retries", 3)
+	config.SetDefault("auth.puk_retries", 10)
+
+	// Longest lifetime an API token can be minted with
+	config.SetDefault("auth.token_max_ttl", "8760h")
+
+	// Distinct security officers approving each dangerous action, once any
+	// operator is enrolled
+	config.SetDefault("quorum.export", 2)
+	config.SetDefault("quorum.destroy", 2)
+	config.SetDefault("quorum.restore", 2)
+	config.SetDefault("quorum.rotate_master", 2)
+
+	// Audit log, entries between signed checkpoints, 0 disables them
+	config.SetDefault("audit.checkpoint_interval", 100)
+
+	// REST API key listing, page size when none is asked for and the largest
+	config.SetDefault("api.page_size", 50)
+	config.SetDefault("api.max_page_size", 500)
+
+	// TLS for the API: the server certificate chain issued for the key of
+	// `tls setup`, the CA client certificates must chain to and the client
+	// subjects mapped to roles and keys, see mtls.Clients
+	config.SetDefault("api.tls.cert", fmt.Sprintf("%s/api/server.pem", basePath))
+	config.SetDefault("api.tls.client_ca", fmt.Sprintf("%s/api/client-ca.pem", basePath))
+	config.SetDefault("api.tls.clients", []interface{}{})
+
+	// API rate limits, a token bucket refilling rate a minute up to burst and
+	// a quota a UTC day, for each client and for the signatures of each key.
+	// 0 disables either, see ratelimit.NewLimiter for overrides.
+	config.SetDefault("api.limits.client.rate", 600)
+	config.SetDefault("api.limits.client.burst", 60)
+	config.SetDefault("api.limits.client.daily", 0)
+	config.SetDefault("api.limits.key.rate", 300)
+	config.SetDefault("api.limits.key.burst", 100)
+	config.SetDefault("api.limits.key.daily", 0)
+	config.SetDefault("api.limits.overrides", []interface{}{})
+
+	// Address the API listens on, an IP and port, and the client addresses
+	// allowed to reach each route group: admin creating and archiving keys,
+	// crypto the rest. Entries are CIDRs, IPs or "local" for networks that
+	// are not globally routable; an empty allow list allows any address and
+	// deny wins. SIGHUP reloads the lists.
+	config.SetDefault("api.address", "0.0.0.0:7777")
+	config.SetDefault("api.access.admin.allow", []string{})
+	config.SetDefault("api.access.admin.deny", []string{})
+	config.SetDefault("api.access.crypto.allow", []string{})
+	config.SetDefault("api.access.crypto.deny", []string{})
+
+	// Local daemon, its Unix socket, the mode and owners allowed on it (empty
+	// allows any user the mode lets in) and how long a login lasts
+	config.SetDefault("hsmd.socket", fmt.Sprintf("%s/hsmd.sock", basePath))
+	config.SetDefault("hsmd.socket_mode", "0660")
+	config.SetDefault("hsmd.allowed_uids", []string{})
+	config.SetDefault("hsmd.session_ttl", "15m")
 }
 
 // GetEnv - pull values or set defaults.
@@ -0,0 +1,169 @@
+package crypto
+
+import (
+	gocrypto "crypto"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	// SHA256 digest, default for curves up to 256 bits
+	SHA256 = "sha256"
+
+	// SHA384 digest, default for secp384r1
+	SHA384 = "sha384"
+
+	// SHA512 digest, default for secp521r1
+	SHA512 = "sha512"
+
+	// SHA3_256 Keccak based digest with a 256 bit output
+	SHA3_256 = "sha3-256"
+
+	// SHA3_384 Keccak based digest with a 384 bit output
+	SHA3_384 = "sha3-384"
+
+	// SHA3_512 Keccak based digest with a 512 bit output
+	SHA3_512 = "sha3-512"
+
+	// BLAKE2b256 BLAKE2b digest with a 256 bit output
+	BLAKE2b256 = "blake2b-256"
+
+	// BLAKE2b384 BLAKE2b digest with a 384 bit output
+	BLAKE2b384 = "blake2b-384"
+
+	// BLAKE2b512 BLAKE2b digest with a 512 bit output
+	BLAKE2b512 = "blake2b-512"
+)
+
+// digests maps every supported algorithm name to its constructor
+var digests = map[string]func() hash.Hash{
+	SHA256:   sha256.New,
+	SHA384:   sha512.New384,
+	SHA512:   sha512.New,
+	SHA3_256: sha3.New256,
+	SHA3_384: sha3.New384,
+	SHA3_512: sha3.New512,
+	BLAKE2b256: func() hash.Hash {
+		h, _ := blake2b.New256(nil)
+		return h
+	},
+	BLAKE2b384: func() hash.Hash {
+		h, _ := blake2b.New384(nil)
+		return h
+	},
+	BLAKE2b512: func() hash.Hash {
+		h, _ := blake2b.New512(nil)
+		return h
+	},
+}
+
+// hashIDs are the digests with a standard library crypto.Hash the RSA
+// PKCS #1 v1.5 encoding knows how to name
+var hashIDs = map[string]gocrypto.Hash{
+	SHA256: gocrypto.SHA256,
+	SHA384: gocrypto.SHA384,
+	SHA512: gocrypto.SHA512,
+}
+
+// Digests returns the sorted names of all supported digest algorithms
+func Digests() []string {
+	var names []string
+
+	for k := range digests {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// NewHash returns a fresh hash.Hash for the algorithm name passed
+func NewHash(alg string) (hash.Hash, error) {
+	fn, ok := digests[alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported digest algorithm: %s", alg)
+	}
+
+	return fn(), nil
+}
+
+// HashID returns the crypto.Hash of the algorithm name, for the digests an
+// RSA signature can be made over
+func HashID(alg string) (gocrypto.Hash, error) {
+	h, ok := hashIDs[alg]
+	if !ok {
+		return 0, fmt.Errorf("digest %s cannot be used with RSA keys, usage: [%s, %s, %s]",
+			alg, SHA256, SHA384, SHA512)
+	}
+
+	return h, nil
+}
+
+// HashName is the reverse of HashID
+func HashName(h gocrypto.Hash) (string, error) {
+	for alg, id := range hashIDs {
+		if id == h {
+			return alg, nil
+		}
+	}
+
+	return "", fmt.Errorf("unsupported digest: %v", h)
+}
+
+// HashForCurve returns the default digest whose output size matches the
+// strength of a curve with the given bit size, as per SP 800-57 table 3.
+func HashForCurve(bitSize int) string {
+	switch {
+	case bitSize <= 256:
+		return SHA256
+	case bitSize <= 384:
+		return SHA384
+	default:
+		return SHA512
+	}
+}
+
+// CheckHashStrength ensures the digest selected does not weaken a signature
+// made by a curve of the given bit size. Curves above 512 bits (secp521r1) are
+// capped at the largest digest available.
+func CheckHashStrength(alg string, bitSize int) error {
+	h, err := NewHash(alg)
+	if err != nil {
+		return err
+	}
+
+	need := bitSize
+	if need > 512 {
+		need = 512
+	}
+
+	if h.Size()*8 < need {
+		return fmt.Errorf("digest %s (%d bits) is weaker than the %d bit curve",
+			alg, h.Size()*8, bitSize)
+	}
+
+	return nil
+}
+
+// DigestReader streams everything from r through the selected digest and
+// returns the sum. Memory usage is constant regardless of the input size.
+func DigestReader(r io.Reader, alg string) ([]byte, error) {
+	h, err := NewHash(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,80 @@
+package crypto
+
+import (
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+)
+
+var digestTests = []struct {
+	alg    string
+	digest string
+}{
+	{SHA256, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"},
+	{SHA384, "59e1748777448c69de6b800d7a33bbfb9ff1b463e44354c3553bcdb9c666fa90125a3c79f90397bdf5f6a13de828684f"},
+	{SHA512, "9b71d224bd62f3785d96d46ad3ea3d73319bfbc2890caadae2dff72519673ca72323c3d99ba5c11d7c7acc6e14b8c5da0c4663475c2e5c3adef46f73bcdec043"},
+	{SHA3_256, "3338be694f50c5f338814986cdf0686453a888b84f424d792af4b9202398f392"},
+	{BLAKE2b256, "324dcf027dd4a30a932c441f365a25e86b173defa4b8e58948253471b81b72cf"},
+	{BLAKE2b512, "e4cfa39a3d37be31c59609e807970799caa68a19bfaa15135f165085e01d41a65ba1e1b146aeb6bd0092b49eac214c103ccfa3a365954bbbe52f74a2b3620c94"},
+}
+
+func TestDigestReader(t *testing.T) {
+	for _, tt := range digestTests {
+		sum, err := DigestReader(strings.NewReader("hello"), tt.alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hex.EncodeToString(sum) != tt.digest {
+			t.Errorf("%s produced unexpected digest %x", tt.alg, sum)
+		}
+	}
+
+	if _, err := DigestReader(strings.NewReader("hello"), "md5"); err == nil {
+		t.Fatal("unsupported digest did not fail")
+	}
+}
+
+func TestDigestReaderFile(t *testing.T) {
+	f, err := os.Open("../data/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	sum, err := DigestReader(f, SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hex.EncodeToString(sum) != digestTests[0].digest {
+		t.Fatalf("unexpected digest %x", sum)
+	}
+}
+
+func TestHashForCurve(t *testing.T) {
+	for bits, alg := range map[int]string{224: SHA256, 256: SHA256, 384: SHA384, 521: SHA512} {
+		if HashForCurve(bits) != alg {
+			t.Errorf("curve %d expected %s", bits, alg)
+		}
+	}
+}
+
+func TestCheckHashStrength(t *testing.T) {
+	if err := CheckHashStrength(SHA256, 256); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CheckHashStrength(SHA512, 521); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CheckHashStrength(SHA256, 384); err == nil {
+		t.Fatal("sha256 accepted for a 384 bit curve")
+	}
+
+	if err := CheckHashStrength("junk", 256); err == nil {
+		t.Fatal("unsupported digest accepted")
+	}
+}
@@ -0,0 +1,249 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/awnumar/memguard"
+	"github.com/block27/core/services/aes/gcm"
+	"golang.org/x/crypto/hkdf"
+)
+
+// HKDF info strings bind each derived key to a single purpose, so the same
+// master key can safely derive keys for others later on
+const (
+	wrapInfo   = "block27/core private key wrapping v1"
+	backupInfo = "block27/core backup archive v1"
+	macInfo    = "block27/core key record integrity v1"
+	idInfo     = "block27/core master key identifier v1"
+)
+
+// ErrMasterKeyLocked is returned by every function of this file needing a
+// derived key before LoadMasterKey
+var ErrMasterKeyLocked = errors.New("master key not loaded, hardware authentication required")
+
+var (
+	wrapMu    sync.RWMutex
+	wrapKey   *memguard.Enclave
+	backupKey *memguard.Enclave
+	macKey    *memguard.Enclave
+	masterID  string
+)
+
+// LoadMasterKey derives the key wrapping, backup and record integrity keys
+// from the hardware master key/iv with HKDF-SHA256 and keeps them sealed in enclaves for the
+// life of the process. The master key itself is never retained.
+func LoadMasterKey(key []byte, iv []byte) error {
+	if len(key) == 0 || len(iv) == 0 {
+		return errors.New("master key and iv cannot be empty")
+	}
+
+	wrap, err := deriveKey(key, iv, wrapInfo)
+	if err != nil {
+		return err
+	}
+
+	backup, err := deriveKey(key, iv, backupInfo)
+	if err != nil {
+		return err
+	}
+
+	mac, err := deriveKey(key, iv, macInfo)
+	if err != nil {
+		return err
+	}
+
+	id := make([]byte, 8)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, iv, []byte(idInfo)), id); err != nil {
+		return err
+	}
+
+	wrapMu.Lock()
+	defer wrapMu.Unlock()
+
+	wrapKey, backupKey, macKey, masterID = wrap, backup, mac, hex.EncodeToString(id)
+
+	return nil
+}
+
+func deriveKey(key []byte, iv []byte, info string) (*memguard.Enclave, error) {
+	b := memguard.NewBufferFromReader(hkdf.New(sha256.New, key, iv, []byte(info)), 32)
+	if b.Size() != 32 {
+		b.Destroy()
+		return nil, fmt.Errorf("failed to derive the %s key", info)
+	}
+
+	return b.Seal(), nil
+}
+
+// Resealer is data sealed under the master key, read under the one loaded
+// when it was returned. Seal writes it back under the one loaded then,
+// Restore puts back what Seal replaced.
+type Resealer interface {
+	Seal() error
+	Restore() error
+}
+
+// RotateMasterKey loads key and iv in place of the master key and seals rs
+// under it, in order. When one fails, those sealed are restored in reverse
+// order and the previous master key is loaded back.
+func RotateMasterKey(key []byte, iv []byte, rs ...Resealer) error {
+	wrapMu.RLock()
+	wrap, backup, mac, id := wrapKey, backupKey, macKey, masterID
+	wrapMu.RUnlock()
+
+	if wrap == nil {
+		return ErrMasterKeyLocked
+	}
+
+	if err := LoadMasterKey(key, iv); err != nil {
+		return err
+	}
+
+	restore := func(sealed int) {
+		for i := sealed; i >= 0; i-- {
+			rs[i].Restore()
+		}
+
+		wrapMu.Lock()
+		defer wrapMu.Unlock()
+
+		wrapKey, backupKey, macKey, masterID = wrap, backup, mac, id
+	}
+
+	if next, _ := MasterKeyID(); next == id {
+		restore(-1)
+		return errors.New("the new master key is the one already loaded")
+	}
+
+	for i, r := range rs {
+		if err := r.Seal(); err != nil {
+			restore(i)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MasterKeyLoaded reports whether Wrap/Unwrap are usable
+func MasterKeyLoaded() bool {
+	wrapMu.RLock()
+	defer wrapMu.RUnlock()
+
+	return wrapKey != nil
+}
+
+// MasterKeyID identifies the loaded master key without revealing anything
+// of it, so two devices can tell whether they hold the same one
+func MasterKeyID() (string, error) {
+	wrapMu.RLock()
+	defer wrapMu.RUnlock()
+
+	if masterID == "" {
+		return "", ErrMasterKeyLocked
+	}
+
+	return masterID, nil
+}
+
+// Wrap encrypts private key material with AES-256-GCM under the key derived
+// by LoadMasterKey
+func Wrap(plaintext []byte) ([]byte, error) {
+	var out []byte
+
+	err := withKey(&wrapKey, func(k *[32]byte) (err error) {
+		out, err = gcm.Encrypt(plaintext, k)
+		return err
+	})
+
+	return out, err
+}
+
+// Unwrap reverses Wrap, failing if the data was altered or wrapped under a
+// different master key
+func Unwrap(ciphertext []byte) ([]byte, error) {
+	var out []byte
+
+	err := withKey(&wrapKey, func(k *[32]byte) (err error) {
+		out, err = gcm.Decrypt(ciphertext, k)
+		return err
+	})
+
+	return out, err
+}
+
+// SealBackup encrypts a backup archive with AES-256-GCM under its own key
+// derived from the master key, so only a device holding the same master key
+// can read it back
+func SealBackup(plaintext []byte) ([]byte, error) {
+	var out []byte
+
+	err := withKey(&backupKey, func(k *[32]byte) (err error) {
+		out, err = gcm.Encrypt(plaintext, k)
+		return err
+	})
+
+	return out, err
+}
+
+// OpenBackup reverses SealBackup, failing if the archive was altered
+func OpenBackup(ciphertext []byte) ([]byte, error) {
+	var out []byte
+
+	err := withKey(&backupKey, func(k *[32]byte) (err error) {
+		out, err = gcm.Decrypt(ciphertext, k)
+		return err
+	})
+
+	return out, err
+}
+
+// RecordMAC authenticates a key record with GenerateHMAC under a key
+// derived from the master key, so records cannot be edited or forged
+// without the hardware
+func RecordMAC(data []byte) ([]byte, error) {
+	var out []byte
+
+	err := withKey(&macKey, func(k *[32]byte) error {
+		out = GenerateHMAC(data, k)
+		return nil
+	})
+
+	return out, err
+}
+
+// CheckRecordMAC reports whether mac was produced by RecordMAC for data
+func CheckRecordMAC(data []byte, mac []byte) (bool, error) {
+	ok := false
+
+	err := withKey(&macKey, func(k *[32]byte) error {
+		ok = CheckHMAC(data, mac, k)
+		return nil
+	})
+
+	return ok, err
+}
+
+// withKey opens a derived key's enclave just long enough to run fn
+func withKey(key **memguard.Enclave, fn func(k *[32]byte) error) error {
+	wrapMu.RLock()
+	e := *key
+	wrapMu.RUnlock()
+
+	if e == nil {
+		return ErrMasterKeyLocked
+	}
+
+	b, err := e.Open()
+	if err != nil {
+		return err
+	}
+	defer b.Destroy()
+
+	return fn(b.ByteArray32())
+}
@@ -0,0 +1,200 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestWrapUnwrap(t *testing.T) {
+	wrapMu.Lock()
+	wrapKey = nil
+	wrapMu.Unlock()
+
+	if _, err := Wrap([]byte("secret")); err != ErrMasterKeyLocked {
+		t.Fatalf("expected ErrMasterKeyLocked, got %v", err)
+	}
+
+	if err := LoadMasterKey([]byte("hn8adjw4t6aa9fe57h4jku6p6mf8c2pw"), []byte("q5nb45yf83cna97z")); err != nil {
+		t.Fatal(err)
+	}
+
+	if !MasterKeyLoaded() {
+		t.Fatal("master key not loaded")
+	}
+
+	wrapped, err := Wrap([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(wrapped, []byte("secret")) {
+		t.Fatal("plaintext visible in wrapped output")
+	}
+
+	plain, err := Unwrap(wrapped)
+	if err != nil || string(plain) != "secret" {
+		t.Fatalf("unwrap: %q %v", plain, err)
+	}
+
+	wrapped[len(wrapped)-1] ^= 0xff
+	if _, err := Unwrap(wrapped); err == nil {
+		t.Fatal("tampered data unwrapped")
+	}
+
+	// A different master key derives a different wrapping key
+	wrapped[len(wrapped)-1] ^= 0xff
+	if err := LoadMasterKey([]byte("vghghvytgm69rr47shz42qt4br2uqpbq"), []byte("wvu5dkxun3zyg448")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Unwrap(wrapped); err == nil {
+		t.Fatal("unwrapped under the wrong master key")
+	}
+}
+
+func TestSealBackup(t *testing.T) {
+	if err := LoadMasterKey([]byte("hn8adjw4t6aa9fe57h4jku6p6mf8c2pw"), []byte("q5nb45yf83cna97z")); err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := SealBackup([]byte("archive"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain, err := OpenBackup(sealed)
+	if err != nil || string(plain) != "archive" {
+		t.Fatalf("open: %q %v", plain, err)
+	}
+
+	// Backups and wrapped keys use different derived keys
+	if _, err := Unwrap(sealed); err == nil {
+		t.Fatal("backup opened with the key wrapping key")
+	}
+}
+
+func TestRecordMAC(t *testing.T) {
+	if err := LoadMasterKey([]byte("hn8adjw4t6aa9fe57h4jku6p6mf8c2pw"), []byte("q5nb45yf83cna97z")); err != nil {
+		t.Fatal(err)
+	}
+
+	mac, err := RecordMAC([]byte("record"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := CheckRecordMAC([]byte("record"), mac); !ok || err != nil {
+		t.Fatalf("check: %v %v", ok, err)
+	}
+
+	if ok, _ := CheckRecordMAC([]byte("recorD"), mac); ok {
+		t.Fatal("altered record passed")
+	}
+
+	// Another master key derives another integrity key
+	if err := LoadMasterKey([]byte("vghghvytgm69rr47shz42qt4br2uqpbq"), []byte("wvu5dkxun3zyg448")); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _ := CheckRecordMAC([]byte("record"), mac); ok {
+		t.Fatal("record passed under the wrong master key")
+	}
+}
+
+func TestMasterKeyID(t *testing.T) {
+	if err := LoadMasterKey([]byte("hn8adjw4t6aa9fe57h4jku6p6mf8c2pw"), []byte("q5nb45yf83cna97z")); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := MasterKeyID()
+	if err != nil || len(id) != 16 {
+		t.Fatalf("id: %q %v", id, err)
+	}
+
+	if err := LoadMasterKey([]byte("vzbd4jw3w5m7p2cq8t4xn6rk9ys5hb2e"), []byte("q5nb45yf83cna97z")); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := MasterKeyID()
+	if err != nil || other == id {
+		t.Fatal("different master keys share an identifier")
+	}
+}
+
+// macResealer reseals one MAC, failing when told to
+type macResealer struct {
+	data []byte
+	mac  []byte
+	prev []byte
+	fail bool
+}
+
+func (m *macResealer) Seal() error {
+	if m.fail {
+		return errors.New("seal failed")
+	}
+
+	mac, err := RecordMAC(m.data)
+	if err != nil {
+		return err
+	}
+
+	m.prev, m.mac = m.mac, mac
+
+	return nil
+}
+
+func (m *macResealer) Restore() error {
+	if m.prev != nil {
+		m.mac = m.prev
+	}
+
+	return nil
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	if err := LoadMasterKey([]byte("hn8adjw4t6aa9fe57h4jku6p6mf8c2pw"), []byte("q5nb45yf83cna97z")); err != nil {
+		t.Fatal(err)
+	}
+
+	id, _ := MasterKeyID()
+
+	mac, err := RecordMAC([]byte("record"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failure puts back what was sealed and the previous master key
+	ok, failing := &macResealer{data: []byte("record"), mac: mac}, &macResealer{fail: true}
+
+	if err := RotateMasterKey([]byte("vzbd4jw3w5m7p2cq8t4xn6rk9ys5hb2e"), []byte("q5nb45yf83cna97z"), ok, failing); err == nil {
+		t.Fatal("failed rotation reported success")
+	}
+
+	if current, _ := MasterKeyID(); current != id {
+		t.Fatal("previous master key not loaded back")
+	}
+
+	if valid, _ := CheckRecordMAC(ok.data, ok.mac); !valid {
+		t.Fatal("resealed data not restored")
+	}
+
+	// Rotating to the key loaded is refused
+	if err := RotateMasterKey([]byte("hn8adjw4t6aa9fe57h4jku6p6mf8c2pw"), []byte("q5nb45yf83cna97z"), ok); err == nil {
+		t.Fatal("rotated to the same master key")
+	}
+
+	ok.prev = nil
+	if err := RotateMasterKey([]byte("vzbd4jw3w5m7p2cq8t4xn6rk9ys5hb2e"), []byte("q5nb45yf83cna97z"), ok); err != nil {
+		t.Fatal(err)
+	}
+
+	if current, _ := MasterKeyID(); current == id {
+		t.Fatal("new master key not loaded")
+	}
+
+	if valid, _ := CheckRecordMAC(ok.data, ok.mac); !valid {
+		t.Fatal("data not sealed under the new master key")
+	}
+}
@@ -91,9 +91,10 @@ func (f *file) readBinary(filename string) ([]byte, error) {
 	size := stats.Size()
 	bytes := make([]byte, size)
 
+	// A single Read may return fewer bytes than requested, ReadFull keeps
+	// reading until the whole file is consumed
 	bufr := bufio.NewReader(file)
-	_, err = bufr.Read(bytes)
-	if err != nil {
+	if _, err = io.ReadFull(bufr, bytes); err != nil {
 		return nil, err
 	}
 
@@ -169,9 +170,10 @@ func ReadBinary(filename string) ([]byte, error) {
 	size := stats.Size()
 	bytes := make([]byte, size)
 
+	// A single Read may return fewer bytes than requested, ReadFull keeps
+	// reading until the whole file is consumed
 	bufr := bufio.NewReader(file)
-	_, err = bufr.Read(bytes)
-	if err != nil {
+	if _, err = io.ReadFull(bufr, bytes); err != nil {
 		return nil, err
 	}
 
@@ -54,3 +54,14 @@ func TestReadFileNot(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestReadBinaryFull(t *testing.T) {
+	data, err := ReadBinary("../data/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(data) != 655360 {
+		t.Fatalf("short read, got %d bytes", len(data))
+	}
+}
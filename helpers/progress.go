@@ -0,0 +1,75 @@
+package helpers
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// progressInterval throttles how often a ProgressReader redraws its line
+const progressInterval = 250 * time.Millisecond
+
+// progressReader wraps an io.Reader of known size and reports how much of it
+// has been consumed, used when streaming large files through digests
+type progressReader struct {
+	r     io.Reader
+	out   io.Writer
+	label string
+
+	total int64
+	read  int64
+	last  time.Time
+}
+
+// NewProgressReader returns an io.Reader that passes reads through to r while
+// drawing a single updating progress line to out
+func NewProgressReader(r io.Reader, total int64, label string, out io.Writer) io.Reader {
+	return &progressReader{
+		r:     r,
+		out:   out,
+		label: label,
+		total: total,
+	}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+
+	if err == io.EOF {
+		p.draw()
+		fmt.Fprintf(p.out, "\n")
+	} else if time.Since(p.last) >= progressInterval {
+		p.draw()
+		p.last = time.Now()
+	}
+
+	return n, err
+}
+
+func (p *progressReader) draw() {
+	pct := 100.0
+	if p.total > 0 {
+		pct = float64(p.read) / float64(p.total) * 100
+	}
+
+	fmt.Fprintf(p.out, "\r%s %6.2f%% (%s / %s)", p.label, pct,
+		ByteSize(p.read), ByteSize(p.total))
+}
+
+// ByteSize formats a byte count into a human readable IEC string
+func ByteSize(b int64) string {
+	const unit = 1024
+
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,41 @@
+package helpers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestProgressReader(t *testing.T) {
+	var out bytes.Buffer
+
+	r := NewProgressReader(strings.NewReader("hello"), 5, "=== TEST", &out)
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "hello" {
+		t.Fatalf("unexpected passthrough data: %s", data)
+	}
+
+	if !strings.Contains(out.String(), "100.00%") {
+		t.Fatalf("progress did not complete: %q", out.String())
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	if ByteSize(512) != "512 B" {
+		t.Fail()
+	}
+
+	if ByteSize(1536) != "1.5 KiB" {
+		t.Fail()
+	}
+
+	if ByteSize(3<<30) != "3.0 GiB" {
+		t.Fail()
+	}
+}
@@ -1,18 +1,33 @@
 package main
 
 import (
-	"encoding/json"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	// jwt "github.com/dgrijalva/jwt-go"
 	"github.com/block27/core/backend"
-	"github.com/block27/core/services/dsa/ecdsa"
+	"github.com/block27/core/config"
+	"github.com/block27/core/services/access"
+	"github.com/block27/core/services/audit"
+	"github.com/block27/core/services/auth"
+	"github.com/block27/core/services/mtls"
+	"github.com/block27/core/services/ratelimit"
+	"github.com/block27/core/services/rest"
+	"github.com/block27/core/services/tsa"
+	"github.com/block27/core/utils"
 )
 
 var (
 	// B - main backend interface that holds all functionality
 	B *backend.Backend
+
+	// T - time-stamping authority, nil when `tsa setup` has not been run
+	T tsa.TimestampAPI
 )
 
 func fatal(err error) {
@@ -26,26 +41,6 @@ func hardwareAuthentication() error {
 	return B.HardwareAuthenticate()
 }
 
-func dsaList(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	keys, err := ecdsa.ListECDSA(*B.C)
-	if err != nil {
-		panic(err)
-	}
-
-	if len(keys) == 0 {
-		w.Write(nil)
-	}
-
-	jData, err := json.Marshal(keys)
-	if err != nil {
-		panic(err)
-	}
-
-	w.Write(jData)
-}
-
 func main() {
 	var e error
 
@@ -63,8 +58,80 @@ func main() {
 		panic(err)
 	}
 
-	http.HandleFunc("/api/v1/dsa/list", dsaList)
+	// The TSA endpoint is optional, it answers 503 until `tsa setup` is run
+	if T, e = tsa.Load(*B.C, B.D); e != nil {
+		B.L.Printf("TSA disabled: %v", e)
+	}
+
+	// Only a raw IP and port, the address is not resolved
+	addr := (*B.C).GetString("api.address")
+	if err := utils.EnsureAddrIPPort(addr); err != nil {
+		panic(fmt.Errorf("api.address: %v", err))
+	}
+
+	// Client addresses are checked before any credential, at the listener
+	// and for each route group
+	A, err := access.NewList(*B.C)
+	if err != nil {
+		panic(err)
+	}
+
+	// TLS is required, the server key never leaves the keystore. Clients
+	// present a certificate or an API token of `token create`
+	S, err := mtls.Load(*B.C, B.D)
+	if err != nil {
+		panic(err)
+	}
+
+	clients, err := mtls.Clients(*B.C)
+	if err != nil {
+		panic(err)
+	}
+
+	// Budgets of clients and keys, kept in the database across restarts
+	L, err := ratelimit.NewLimiter(*B.C, B.D)
+	if err != nil {
+		panic(err)
+	}
+
+	api := ratelimit.Handler(rest.NewServer(B, T), L, audit.NewLog(*B.C, B.D))
+
+	// SIGHUP reloads the access lists, the server certificate and client CA
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			if c, err := config.LoadConfig(config.Defaults); err != nil {
+				B.L.Errorf("access reload: %v", err)
+			} else if err := A.Reload(c); err != nil {
+				B.L.Errorf("access reload: %v", err)
+			} else {
+				B.L.Printf("access lists reloaded")
+			}
+
+			if err := S.Reload(); err != nil {
+				B.L.Errorf("TLS reload: %v", err)
+				continue
+			}
+
+			B.L.Printf("TLS reloaded, certificate %s until %s",
+				S.Certificate().Subject, S.Certificate().NotAfter.Format("2006-01-02"))
+		}
+	}()
+
+	srv := &http.Server{
+		Addr:      addr,
+		Handler:   access.Handler(mtls.Handler(api, clients, auth.NewTokens(*B.C, B.D)), A),
+		TLSConfig: S.Config(),
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
 
-	B.L.Println("Listening 0.0.0.0:7777")
-	fatal(http.ListenAndServe(":7777", nil))
+	// Addresses no access list allows are closed before the handshake
+	B.L.Printf("Listening %s (TLS)", addr)
+	fatal(srv.ServeTLS(access.Listener(ln, A), "", ""))
 }
@@ -1,15 +1,32 @@
 package main
 
 import (
+	"fmt"
+
 	m "github.com/awnumar/memguard"
 	"github.com/block27/core/backend"
 	c "github.com/block27/core/cmd"
+	"github.com/block27/core/config"
+	"github.com/block27/core/services/audit"
+	"github.com/block27/core/services/hsmd"
 )
 
 func main() {
 	// Memguard enclave
 	m.CatchInterrupt()
 
+	// A running hsmd holds the datastore and the unlocked keys, commands go
+	// through it instead
+	conf, err := config.LoadConfig(config.Defaults)
+	if err != nil {
+		panic(err)
+	}
+
+	if socket := hsmd.Socket(conf); hsmd.Running(socket) {
+		c.ExecuteDaemon(&backend.Backend{C: &conf, L: config.LoadLogger(conf)}, hsmd.NewClient(socket))
+		return
+	}
+
 	// Initalize a new client, the base entrpy point to the application code
 	b, _ := backend.NewBackend()
 
@@ -17,7 +34,19 @@ func main() {
 	defer b.D.Close()
 
 	// Get and check credentials, speed is subjective to the serial comm
-	if err := b.HardwareAuthenticate(); err != nil {
+	err = b.HardwareAuthenticate()
+
+	// Every attempt is audited, successful or not
+	entry := audit.Entry{Op: audit.OpAuth, Detail: "hardware"}
+	if err != nil {
+		entry.Result, entry.Detail = audit.ResultFailed, fmt.Sprintf("hardware: %v", err)
+	}
+
+	if _, aerr := audit.NewLog(*b.C, b.D).Append(entry); aerr != nil && err == nil {
+		err = aerr
+	}
+
+	if err != nil {
 		panic(err)
 	}
 
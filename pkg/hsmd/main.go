@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	m "github.com/awnumar/memguard"
+	"github.com/block27/core/backend"
+	"github.com/block27/core/services/audit"
+	"github.com/block27/core/services/hsmd"
+	"github.com/block27/core/services/tsa"
+)
+
+func main() {
+	// Initalize a new client, the base entrpy point to the application code
+	b, err := backend.NewBackend()
+	if err != nil {
+		panic(err)
+	}
+
+	// Defer the database connection
+	defer b.D.Close()
+
+	// Authenticate once, the master key then stays in memguard enclaves
+	// for as long as the daemon runs
+	err = b.HardwareAuthenticate()
+
+	// Every attempt is audited, successful or not
+	entry := audit.Entry{Op: audit.OpAuth, Actor: "hsmd", Detail: "hardware"}
+	if err != nil {
+		entry.Result, entry.Detail = audit.ResultFailed, fmt.Sprintf("hardware: %v", err)
+	}
+
+	if _, aerr := audit.NewLog(*b.C, b.D).Append(entry); aerr != nil && err == nil {
+		err = aerr
+	}
+
+	if err != nil {
+		panic(err)
+	}
+
+	defer m.Purge()
+
+	// The TSA routes are optional, they answer 503 until `tsa setup` is run
+	t, err := tsa.Load(*b.C, b.D)
+	if err != nil {
+		b.L.Printf("TSA disabled: %v", err)
+	}
+
+	srv, err := hsmd.NewServer(b, t)
+	if err != nil {
+		panic(err)
+	}
+
+	l, err := hsmd.Listen(*b.C)
+	if err != nil {
+		panic(err)
+	}
+
+	// Drain requests in flight on SIGINT/SIGTERM, the socket is removed
+	// once the listener closes
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		<-stop
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := srv.Shutdown(ctx); err != nil {
+			b.L.Errorf("hsmd: shutdown: %v", err)
+		}
+	}()
+
+	b.L.Printf("Listening %s", hsmd.Socket(*b.C))
+
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		b.L.Errorf("hsmd: %v", err)
+	}
+}
@@ -0,0 +1,715 @@
+// Command pkcs11 is a PKCS#11 module serving the keys of a running hsmd, for
+// tools that speak cryptoki rather than the API. Build it as a shared
+// library and load it as any other module:
+//
+//	go build -buildmode=c-shared -o bin/libhsmd-pkcs11.so ./pkg/pkcs11
+//	pkcs11-tool --module bin/libhsmd-pkcs11.so --login --list-objects
+//
+// The module has a single slot, 0, whose token is the daemon on
+// $HSMD_SOCKET, else on hsmd.socket. The PIN is the daemon's login,
+// "<operator>:<pin>" once operators are enrolled. Keys on curves sign and
+// verify with CKM_ECDSA, over a digest of any length, and
+// CKM_ECDSA_SHA256/384/512 and are created with CKM_EC_KEY_PAIR_GEN.
+//
+// RSA keys of 2048, 3072 and 4096 bits sign and verify with
+// CKM_SHA256/384/512_RSA_PKCS and with CKM_RSA_PKCS over the DigestInfo of a
+// SHA-256, SHA-384 or SHA-512 digest, and are created with
+// CKM_RSA_PKCS_KEY_PAIR_GEN and the exponent 65537. PSS is not offered.
+package main
+
+// #include <string.h>
+// #include "cryptoki.h"
+import "C"
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"unsafe"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/services/hsmd"
+	"github.com/block27/core/services/pkcs11"
+)
+
+// Cryptoki flags and values of the module's own structures
+const (
+	ckfOSLockingOK      = 0x002
+	ckfTokenPresent     = 0x001
+	ckfHWSlot           = 0x004
+	ckfLoginRequired    = 0x004
+	ckfUserPinInit      = 0x008
+	ckfTokenInitialized = 0x400
+
+	unavailable = ^C.CK_ULONG(0)
+)
+
+var (
+	mu  sync.Mutex
+	tok pkcs11.TokenAPI
+)
+
+func main() {}
+
+// socket is where the daemon listens, $HSMD_SOCKET first
+func socket() (string, error) {
+	if s := os.Getenv("HSMD_SOCKET"); s != "" {
+		return s, nil
+	}
+
+	c, err := config.LoadConfig(config.Defaults)
+	if err != nil {
+		return "", err
+	}
+
+	return hsmd.Socket(c), nil
+}
+
+// token returns the module's token once initialized
+func token() (pkcs11.TokenAPI, C.CK_RV) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if tok == nil {
+		return nil, pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED
+	}
+
+	return tok, pkcs11.CKR_OK
+}
+
+func rv(err error) C.CK_RV {
+	return C.CK_RV(pkcs11.Code(err))
+}
+
+//export C_Initialize
+func C_Initialize(pInitArgs C.CK_VOID_PTR) C.CK_RV {
+	if pInitArgs != nil {
+		args := (*C.CK_C_INITIALIZE_ARGS)(pInitArgs)
+		if args.pReserved != nil {
+			return pkcs11.CKR_ARGUMENTS_BAD
+		}
+
+		// Locking is the module's own, callers' mutexes are not used
+		if args.CreateMutex != nil && args.flags&ckfOSLockingOK == 0 {
+			return pkcs11.CKR_CANT_LOCK
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if tok != nil {
+		return pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED
+	}
+
+	s, err := socket()
+	if err != nil {
+		return pkcs11.CKR_GENERAL_ERROR
+	}
+
+	tok = pkcs11.NewToken(hsmd.NewClient(s))
+
+	return pkcs11.CKR_OK
+}
+
+//export C_Finalize
+func C_Finalize(pReserved C.CK_VOID_PTR) C.CK_RV {
+	if pReserved != nil {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if tok == nil {
+		return pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED
+	}
+
+	tok.CloseAllSessions()
+	tok = nil
+
+	return pkcs11.CKR_OK
+}
+
+//export C_GetInfo
+func C_GetInfo(pInfo C.CK_INFO_PTR) C.CK_RV {
+	if _, r := token(); r != pkcs11.CKR_OK {
+		return r
+	}
+
+	if pInfo == nil {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+
+	*pInfo = C.CK_INFO{}
+	pInfo.cryptokiVersion = C.CK_VERSION{major: 2, minor: 40}
+	pad(unsafe.Pointer(&pInfo.manufacturerID), len(pInfo.manufacturerID), "block27")
+	pad(unsafe.Pointer(&pInfo.libraryDescription), len(pInfo.libraryDescription), "hsmd PKCS#11 module")
+	pInfo.libraryVersion = C.CK_VERSION{major: 0, minor: 1}
+
+	return pkcs11.CKR_OK
+}
+
+//export C_GetSlotList
+func C_GetSlotList(tokenPresent C.CK_BBOOL, pSlotList C.CK_SLOT_ID_PTR, pulCount C.CK_ULONG_PTR) C.CK_RV {
+	if _, r := token(); r != pkcs11.CKR_OK {
+		return r
+	}
+
+	if pulCount == nil {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+
+	if pSlotList != nil {
+		if *pulCount < 1 {
+			*pulCount = 1
+			return pkcs11.CKR_BUFFER_TOO_SMALL
+		}
+
+		*pSlotList = 0
+	}
+
+	*pulCount = 1
+
+	return pkcs11.CKR_OK
+}
+
+//export C_GetSlotInfo
+func C_GetSlotInfo(slotID C.CK_SLOT_ID, pInfo C.CK_SLOT_INFO_PTR) C.CK_RV {
+	if r := slot(slotID); r != pkcs11.CKR_OK {
+		return r
+	}
+
+	if pInfo == nil {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+
+	*pInfo = C.CK_SLOT_INFO{}
+	pad(unsafe.Pointer(&pInfo.slotDescription), len(pInfo.slotDescription), "hsmd")
+	pad(unsafe.Pointer(&pInfo.manufacturerID), len(pInfo.manufacturerID), "block27")
+	pInfo.flags = ckfTokenPresent | ckfHWSlot
+
+	return pkcs11.CKR_OK
+}
+
+//export C_GetTokenInfo
+func C_GetTokenInfo(slotID C.CK_SLOT_ID, pInfo C.CK_TOKEN_INFO_PTR) C.CK_RV {
+	if r := slot(slotID); r != pkcs11.CKR_OK {
+		return r
+	}
+
+	if pInfo == nil {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+
+	t, _ := token()
+	total, rw := t.Sessions()
+
+	*pInfo = C.CK_TOKEN_INFO{}
+	pad(unsafe.Pointer(&pInfo.label), len(pInfo.label), "hsmd")
+	pad(unsafe.Pointer(&pInfo.manufacturerID), len(pInfo.manufacturerID), "block27")
+	pad(unsafe.Pointer(&pInfo.model), len(pInfo.model), "hsmd")
+	pad(unsafe.Pointer(&pInfo.serialNumber), len(pInfo.serialNumber), "0")
+	pad(unsafe.Pointer(&pInfo.utcTime), len(pInfo.utcTime), "")
+	pInfo.flags = ckfLoginRequired | ckfUserPinInit | ckfTokenInitialized
+
+	pInfo.ulMaxSessionCount, pInfo.ulMaxRwSessionCount = 0, 0
+	pInfo.ulSessionCount, pInfo.ulRwSessionCount = C.CK_ULONG(total), C.CK_ULONG(rw)
+	pInfo.ulMaxPinLen, pInfo.ulMinPinLen = 255, 1
+
+	pInfo.ulTotalPublicMemory, pInfo.ulFreePublicMemory = unavailable, unavailable
+	pInfo.ulTotalPrivateMemory, pInfo.ulFreePrivateMemory = unavailable, unavailable
+
+	return pkcs11.CKR_OK
+}
+
+//export C_GetMechanismList
+func C_GetMechanismList(slotID C.CK_SLOT_ID, pMechanismList C.CK_MECHANISM_TYPE_PTR, pulCount C.CK_ULONG_PTR) C.CK_RV {
+	if r := slot(slotID); r != pkcs11.CKR_OK {
+		return r
+	}
+
+	if pulCount == nil {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+
+	var types []uint
+	for m := range pkcs11.Mechanisms {
+		types = append(types, m)
+	}
+
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	if pMechanismList != nil {
+		if int(*pulCount) < len(types) {
+			*pulCount = C.CK_ULONG(len(types))
+			return pkcs11.CKR_BUFFER_TOO_SMALL
+		}
+
+		out := (*[1 << 20]C.CK_MECHANISM_TYPE)(unsafe.Pointer(pMechanismList))[:len(types):len(types)]
+		for i, m := range types {
+			out[i] = C.CK_MECHANISM_TYPE(m)
+		}
+	}
+
+	*pulCount = C.CK_ULONG(len(types))
+
+	return pkcs11.CKR_OK
+}
+
+//export C_GetMechanismInfo
+func C_GetMechanismInfo(slotID C.CK_SLOT_ID, typ C.CK_MECHANISM_TYPE, pInfo C.CK_MECHANISM_INFO_PTR) C.CK_RV {
+	if r := slot(slotID); r != pkcs11.CKR_OK {
+		return r
+	}
+
+	if pInfo == nil {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+
+	m, ok := pkcs11.Mechanisms[uint(typ)]
+	if !ok {
+		return pkcs11.CKR_MECHANISM_INVALID
+	}
+
+	pInfo.ulMinKeySize = C.CK_ULONG(m.MinKeySize)
+	pInfo.ulMaxKeySize = C.CK_ULONG(m.MaxKeySize)
+	pInfo.flags = C.CK_FLAGS(m.Flags)
+
+	return pkcs11.CKR_OK
+}
+
+//export C_OpenSession
+func C_OpenSession(slotID C.CK_SLOT_ID, flags C.CK_FLAGS, pApplication C.CK_VOID_PTR, notify C.CK_NOTIFY, phSession C.CK_SESSION_HANDLE_PTR) C.CK_RV {
+	if r := slot(slotID); r != pkcs11.CKR_OK {
+		return r
+	}
+
+	if phSession == nil {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+
+	t, _ := token()
+
+	h, err := t.OpenSession(uint(flags))
+	if err != nil {
+		return rv(err)
+	}
+
+	*phSession = C.CK_SESSION_HANDLE(h)
+
+	return pkcs11.CKR_OK
+}
+
+//export C_CloseSession
+func C_CloseSession(hSession C.CK_SESSION_HANDLE) C.CK_RV {
+	t, r := token()
+	if r != pkcs11.CKR_OK {
+		return r
+	}
+
+	return rv(t.CloseSession(uint(hSession)))
+}
+
+//export C_CloseAllSessions
+func C_CloseAllSessions(slotID C.CK_SLOT_ID) C.CK_RV {
+	if r := slot(slotID); r != pkcs11.CKR_OK {
+		return r
+	}
+
+	t, _ := token()
+
+	return rv(t.CloseAllSessions())
+}
+
+//export C_GetSessionInfo
+func C_GetSessionInfo(hSession C.CK_SESSION_HANDLE, pInfo C.CK_SESSION_INFO_PTR) C.CK_RV {
+	t, r := token()
+	if r != pkcs11.CKR_OK {
+		return r
+	}
+
+	if pInfo == nil {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+
+	info, err := t.SessionInfo(uint(hSession))
+	if err != nil {
+		return rv(err)
+	}
+
+	*pInfo = C.CK_SESSION_INFO{
+		slotID: 0,
+		state:  C.CK_STATE(info.State),
+		flags:  C.CK_FLAGS(info.Flags),
+	}
+
+	return pkcs11.CKR_OK
+}
+
+//export C_Login
+func C_Login(hSession C.CK_SESSION_HANDLE, userType C.CK_USER_TYPE, pPin C.CK_UTF8CHAR_PTR, ulPinLen C.CK_ULONG) C.CK_RV {
+	t, r := token()
+	if r != pkcs11.CKR_OK {
+		return r
+	}
+
+	if pPin == nil {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+
+	pin := C.GoBytes(unsafe.Pointer(pPin), C.int(ulPinLen))
+
+	return rv(t.Login(uint(hSession), uint(userType), pin))
+}
+
+//export C_Logout
+func C_Logout(hSession C.CK_SESSION_HANDLE) C.CK_RV {
+	t, r := token()
+	if r != pkcs11.CKR_OK {
+		return r
+	}
+
+	return rv(t.Logout(uint(hSession)))
+}
+
+//export C_GetAttributeValue
+func C_GetAttributeValue(hSession C.CK_SESSION_HANDLE, hObject C.CK_OBJECT_HANDLE, pTemplate C.CK_ATTRIBUTE_PTR, ulCount C.CK_ULONG) C.CK_RV {
+	t, r := token()
+	if r != pkcs11.CKR_OK {
+		return r
+	}
+
+	if pTemplate == nil && ulCount > 0 {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+
+	attrs := attributes(pTemplate, ulCount)
+
+	types := make([]uint, len(attrs))
+	for i, a := range attrs {
+		types[i] = uint(a._type)
+	}
+
+	values, err := t.Attributes(uint(hSession), uint(hObject), types)
+	if err != nil && pkcs11.Code(err) != pkcs11.CKR_ATTRIBUTE_TYPE_INVALID {
+		return rv(err)
+	}
+
+	// Every attribute is answered, the last failure is returned
+	r = rv(err)
+	for i := range attrs {
+		a, v := &attrs[i], values[i]
+
+		switch {
+		case v == nil:
+			a.ulValueLen = unavailable
+		case a.pValue == nil:
+			a.ulValueLen = C.CK_ULONG(len(v))
+		case int(a.ulValueLen) < len(v):
+			a.ulValueLen = unavailable
+			r = pkcs11.CKR_BUFFER_TOO_SMALL
+		default:
+			if len(v) > 0 {
+				C.memcpy(unsafe.Pointer(a.pValue), unsafe.Pointer(&v[0]), C.size_t(len(v)))
+			}
+
+			a.ulValueLen = C.CK_ULONG(len(v))
+		}
+	}
+
+	return r
+}
+
+//export C_FindObjectsInit
+func C_FindObjectsInit(hSession C.CK_SESSION_HANDLE, pTemplate C.CK_ATTRIBUTE_PTR, ulCount C.CK_ULONG) C.CK_RV {
+	t, r := token()
+	if r != pkcs11.CKR_OK {
+		return r
+	}
+
+	if pTemplate == nil && ulCount > 0 {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+
+	return rv(t.FindObjectsInit(uint(hSession), template(pTemplate, ulCount)))
+}
+
+//export C_FindObjects
+func C_FindObjects(hSession C.CK_SESSION_HANDLE, phObject C.CK_OBJECT_HANDLE_PTR, ulMaxObjectCount C.CK_ULONG, pulObjectCount C.CK_ULONG_PTR) C.CK_RV {
+	t, r := token()
+	if r != pkcs11.CKR_OK {
+		return r
+	}
+
+	if (phObject == nil && ulMaxObjectCount > 0) || pulObjectCount == nil {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+
+	found, err := t.FindObjects(uint(hSession), int(ulMaxObjectCount))
+	if err != nil {
+		return rv(err)
+	}
+
+	if len(found) > 0 {
+		out := (*[1 << 28]C.CK_OBJECT_HANDLE)(unsafe.Pointer(phObject))[:len(found):len(found)]
+		for i, h := range found {
+			out[i] = C.CK_OBJECT_HANDLE(h)
+		}
+	}
+
+	*pulObjectCount = C.CK_ULONG(len(found))
+
+	return pkcs11.CKR_OK
+}
+
+//export C_FindObjectsFinal
+func C_FindObjectsFinal(hSession C.CK_SESSION_HANDLE) C.CK_RV {
+	t, r := token()
+	if r != pkcs11.CKR_OK {
+		return r
+	}
+
+	return rv(t.FindObjectsFinal(uint(hSession)))
+}
+
+//export C_SignInit
+func C_SignInit(hSession C.CK_SESSION_HANDLE, pMechanism C.CK_MECHANISM_PTR, hKey C.CK_OBJECT_HANDLE) C.CK_RV {
+	t, r := token()
+	if r != pkcs11.CKR_OK {
+		return r
+	}
+
+	if pMechanism == nil {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+
+	return rv(t.SignInit(uint(hSession), uint(pMechanism.mechanism), uint(hKey)))
+}
+
+//export C_Sign
+func C_Sign(hSession C.CK_SESSION_HANDLE, pData C.CK_BYTE_PTR, ulDataLen C.CK_ULONG, pSignature C.CK_BYTE_PTR, pulSignatureLen C.CK_ULONG_PTR) C.CK_RV {
+	t, r := token()
+	if r != pkcs11.CKR_OK {
+		return r
+	}
+
+	if (pData == nil && ulDataLen > 0) || pulSignatureLen == nil {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+
+	if r := signatureLength(t, hSession, pSignature, pulSignatureLen); r != pkcs11.CKR_OK || pSignature == nil {
+		return r
+	}
+
+	signature, err := t.Sign(uint(hSession), C.GoBytes(unsafe.Pointer(pData), C.int(ulDataLen)))
+	if err != nil {
+		return rv(err)
+	}
+
+	return output(signature, pSignature, pulSignatureLen)
+}
+
+//export C_SignUpdate
+func C_SignUpdate(hSession C.CK_SESSION_HANDLE, pPart C.CK_BYTE_PTR, ulPartLen C.CK_ULONG) C.CK_RV {
+	t, r := token()
+	if r != pkcs11.CKR_OK {
+		return r
+	}
+
+	if pPart == nil && ulPartLen > 0 {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+
+	return rv(t.SignUpdate(uint(hSession), C.GoBytes(unsafe.Pointer(pPart), C.int(ulPartLen))))
+}
+
+//export C_SignFinal
+func C_SignFinal(hSession C.CK_SESSION_HANDLE, pSignature C.CK_BYTE_PTR, pulSignatureLen C.CK_ULONG_PTR) C.CK_RV {
+	t, r := token()
+	if r != pkcs11.CKR_OK {
+		return r
+	}
+
+	if pulSignatureLen == nil {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+
+	if r := signatureLength(t, hSession, pSignature, pulSignatureLen); r != pkcs11.CKR_OK || pSignature == nil {
+		return r
+	}
+
+	signature, err := t.SignFinal(uint(hSession))
+	if err != nil {
+		return rv(err)
+	}
+
+	return output(signature, pSignature, pulSignatureLen)
+}
+
+//export C_VerifyInit
+func C_VerifyInit(hSession C.CK_SESSION_HANDLE, pMechanism C.CK_MECHANISM_PTR, hKey C.CK_OBJECT_HANDLE) C.CK_RV {
+	t, r := token()
+	if r != pkcs11.CKR_OK {
+		return r
+	}
+
+	if pMechanism == nil {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+
+	return rv(t.VerifyInit(uint(hSession), uint(pMechanism.mechanism), uint(hKey)))
+}
+
+//export C_Verify
+func C_Verify(hSession C.CK_SESSION_HANDLE, pData C.CK_BYTE_PTR, ulDataLen C.CK_ULONG, pSignature C.CK_BYTE_PTR, ulSignatureLen C.CK_ULONG) C.CK_RV {
+	t, r := token()
+	if r != pkcs11.CKR_OK {
+		return r
+	}
+
+	if (pData == nil && ulDataLen > 0) || pSignature == nil {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+
+	return rv(t.Verify(uint(hSession),
+		C.GoBytes(unsafe.Pointer(pData), C.int(ulDataLen)),
+		C.GoBytes(unsafe.Pointer(pSignature), C.int(ulSignatureLen))))
+}
+
+//export C_VerifyUpdate
+func C_VerifyUpdate(hSession C.CK_SESSION_HANDLE, pPart C.CK_BYTE_PTR, ulPartLen C.CK_ULONG) C.CK_RV {
+	t, r := token()
+	if r != pkcs11.CKR_OK {
+		return r
+	}
+
+	if pPart == nil && ulPartLen > 0 {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+
+	return rv(t.VerifyUpdate(uint(hSession), C.GoBytes(unsafe.Pointer(pPart), C.int(ulPartLen))))
+}
+
+//export C_VerifyFinal
+func C_VerifyFinal(hSession C.CK_SESSION_HANDLE, pSignature C.CK_BYTE_PTR, ulSignatureLen C.CK_ULONG) C.CK_RV {
+	t, r := token()
+	if r != pkcs11.CKR_OK {
+		return r
+	}
+
+	if pSignature == nil {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+
+	return rv(t.VerifyFinal(uint(hSession), C.GoBytes(unsafe.Pointer(pSignature), C.int(ulSignatureLen))))
+}
+
+//export C_GenerateKeyPair
+func C_GenerateKeyPair(hSession C.CK_SESSION_HANDLE, pMechanism C.CK_MECHANISM_PTR,
+	pPublicKeyTemplate C.CK_ATTRIBUTE_PTR, ulPublicKeyAttributeCount C.CK_ULONG,
+	pPrivateKeyTemplate C.CK_ATTRIBUTE_PTR, ulPrivateKeyAttributeCount C.CK_ULONG,
+	phPublicKey C.CK_OBJECT_HANDLE_PTR, phPrivateKey C.CK_OBJECT_HANDLE_PTR) C.CK_RV {
+	t, r := token()
+	if r != pkcs11.CKR_OK {
+		return r
+	}
+
+	if pMechanism == nil || phPublicKey == nil || phPrivateKey == nil ||
+		(pPublicKeyTemplate == nil && ulPublicKeyAttributeCount > 0) ||
+		(pPrivateKeyTemplate == nil && ulPrivateKeyAttributeCount > 0) {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+
+	pub, pri, err := t.GenerateKeyPair(uint(hSession), uint(pMechanism.mechanism),
+		template(pPublicKeyTemplate, ulPublicKeyAttributeCount),
+		template(pPrivateKeyTemplate, ulPrivateKeyAttributeCount))
+	if err != nil {
+		return rv(err)
+	}
+
+	*phPublicKey, *phPrivateKey = C.CK_OBJECT_HANDLE(pub), C.CK_OBJECT_HANDLE(pri)
+
+	return pkcs11.CKR_OK
+}
+
+// slot checks the module is initialized and id is its slot
+func slot(id C.CK_SLOT_ID) C.CK_RV {
+	if _, r := token(); r != pkcs11.CKR_OK {
+		return r
+	}
+
+	if id != 0 {
+		return pkcs11.CKR_SLOT_ID_INVALID
+	}
+
+	return pkcs11.CKR_OK
+}
+
+// attributes views a C template in place
+func attributes(p C.CK_ATTRIBUTE_PTR, n C.CK_ULONG) []C.CK_ATTRIBUTE {
+	if p == nil || n == 0 {
+		return nil
+	}
+
+	return (*[1 << 20]C.CK_ATTRIBUTE)(unsafe.Pointer(p))[:n:n]
+}
+
+// template copies a C template
+func template(p C.CK_ATTRIBUTE_PTR, n C.CK_ULONG) []pkcs11.Attribute {
+	var out []pkcs11.Attribute
+
+	for _, a := range attributes(p, n) {
+		var v []byte
+		if a.pValue != nil {
+			v = C.GoBytes(unsafe.Pointer(a.pValue), C.int(a.ulValueLen))
+		}
+
+		out = append(out, pkcs11.Attribute{Type: uint(a._type), Value: v})
+	}
+
+	return out
+}
+
+// signatureLength answers a caller asking for the length or whose buffer
+// is too small, leaving the operation active as cryptoki expects
+func signatureLength(t pkcs11.TokenAPI, h C.CK_SESSION_HANDLE, p C.CK_BYTE_PTR, pn C.CK_ULONG_PTR) C.CK_RV {
+	n, err := t.SignatureLength(uint(h))
+	if err != nil {
+		return rv(err)
+	}
+
+	if p == nil {
+		*pn = C.CK_ULONG(n)
+		return pkcs11.CKR_OK
+	}
+
+	if int(*pn) < n {
+		*pn = C.CK_ULONG(n)
+		return pkcs11.CKR_BUFFER_TOO_SMALL
+	}
+
+	return pkcs11.CKR_OK
+}
+
+// output copies b to a caller's buffer already checked large enough
+func output(b []byte, p C.CK_BYTE_PTR, pn C.CK_ULONG_PTR) C.CK_RV {
+	if len(b) > 0 {
+		C.memcpy(unsafe.Pointer(p), unsafe.Pointer(&b[0]), C.size_t(len(b)))
+	}
+
+	*pn = C.CK_ULONG(len(b))
+
+	return pkcs11.CKR_OK
+}
+
+// pad fills a fixed length field with s, blank padded as cryptoki expects
+func pad(p unsafe.Pointer, n int, s string) {
+	b := (*[1 << 10]byte)(p)[:n:n]
+
+	for i := range b {
+		b[i] = ' '
+	}
+
+	copy(b, s)
+}
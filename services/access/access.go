@@ -0,0 +1,207 @@
+package access
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/services/rest"
+	"github.com/block27/core/utils"
+)
+
+// Groups lists every route group of the API, see rest.Group
+var Groups = []string{rest.GroupAdmin, rest.GroupCrypto}
+
+// Local names the networks of utils.LocalNetworks in a list
+const Local = "local"
+
+// rules are the networks of one group, deny wins over allow and an empty
+// allow list allows any address
+type rules struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// ListAPI decides which client addresses may reach each route group, from
+// api.access.<group>.allow and api.access.<group>.deny
+type ListAPI interface {
+	// Allowed reports whether ip may reach the group's routes
+	Allowed(group string, ip net.IP) bool
+
+	// Reachable reports whether ip may reach the routes of any group
+	Reachable(ip net.IP) bool
+
+	// Reload reads the lists again, keeping the current ones if any entry
+	// is invalid
+	Reload(c config.Reader) error
+}
+
+type list struct {
+	mu     sync.RWMutex
+	groups map[string]rules
+}
+
+// NewList returns the ListAPI of the lists in c
+func NewList(c config.Reader) (ListAPI, error) {
+	l := &list{}
+	if err := l.Reload(c); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *list) Allowed(group string, ip net.IP) bool {
+	l.mu.RLock()
+	r := l.groups[group]
+	l.mu.RUnlock()
+
+	if contains(r.deny, ip) {
+		return false
+	}
+
+	return len(r.allow) == 0 || contains(r.allow, ip)
+}
+
+func (l *list) Reachable(ip net.IP) bool {
+	for _, g := range Groups {
+		if l.Allowed(g, ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l *list) Reload(c config.Reader) error {
+	groups := map[string]rules{}
+
+	for _, g := range Groups {
+		allow, err := parse(c, fmt.Sprintf("api.access.%s.allow", g))
+		if err != nil {
+			return err
+		}
+
+		deny, err := parse(c, fmt.Sprintf("api.access.%s.deny", g))
+		if err != nil {
+			return err
+		}
+
+		groups[g] = rules{allow: allow, deny: deny}
+	}
+
+	l.mu.Lock()
+	l.groups = groups
+	l.mu.Unlock()
+
+	return nil
+}
+
+// Listener accepts the connections of addresses the list allows for some
+// route group, closing the others before the TLS handshake
+func Listener(ln net.Listener, l ListAPI) net.Listener {
+	return &listener{Listener: ln, l: l}
+}
+
+type listener struct {
+	net.Listener
+	l ListAPI
+}
+
+func (ln *listener) Accept() (net.Conn, error) {
+	for {
+		c, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if ip := addrIP(c.RemoteAddr()); ip != nil && ln.l.Reachable(ip) {
+			return c, nil
+		}
+
+		c.Close()
+	}
+}
+
+// addrIP returns the IP of a connection's address, nil when it has none
+func addrIP(addr net.Addr) net.IP {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
+
+// Handler serves h to client addresses the list allows for the route
+// group, before any authentication. Addresses no group allows are already
+// turned away by Listener.
+func Handler(h http.Handler, l ListAPI) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+
+		group := rest.Group(r)
+
+		if ip := net.ParseIP(host); ip == nil || !l.Allowed(group, ip) {
+			rest.WriteError(w, rest.NewError(http.StatusForbidden, rest.CodeForbidden, "%s may not reach %s routes", host, group))
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// parse reads a list of CIDRs, IPs and Local
+func parse(c config.Reader, key string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, entry := range c.GetStringSlice(key) {
+		entry = strings.TrimSpace(entry)
+
+		switch {
+		case entry == Local:
+			nets = append(nets, utils.LocalNetworks()...)
+		case strings.Contains(entry, "/"):
+			_, n, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+
+			nets = append(nets, n)
+		default:
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%s: invalid address: %q", key, entry)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+	}
+
+	return nets, nil
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,150 @@
+package access
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/services/rest"
+)
+
+// listsReader holds only the access lists
+type listsReader struct {
+	config.Reader
+	lists map[string][]string
+}
+
+func (l listsReader) GetStringSlice(key string) []string {
+	return l.lists[key]
+}
+
+func TestList(t *testing.T) {
+	l, err := NewList(listsReader{lists: map[string][]string{
+		"api.access.admin.allow":  {Local},
+		"api.access.admin.deny":   {"10.9.0.0/16", "192.168.1.7"},
+		"api.access.crypto.allow": {},
+		"api.access.crypto.deny":  {"203.0.113.0/24", "2001:db8::1"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := func(group string, ip string) bool {
+		return l.Allowed(group, net.ParseIP(ip))
+	}
+
+	// Admin routes only from local networks, deny winning
+	assert.True(t, allowed(rest.GroupAdmin, "127.0.0.1"))
+	assert.True(t, allowed(rest.GroupAdmin, "10.1.2.3"))
+	assert.True(t, allowed(rest.GroupAdmin, "::1"))
+	assert.False(t, allowed(rest.GroupAdmin, "10.9.1.1"))
+	assert.False(t, allowed(rest.GroupAdmin, "192.168.1.7"))
+	assert.True(t, allowed(rest.GroupAdmin, "192.168.1.8"))
+	assert.False(t, allowed(rest.GroupAdmin, "8.8.8.8"))
+
+	// Crypto routes from anywhere not denied
+	assert.True(t, allowed(rest.GroupCrypto, "8.8.8.8"))
+	assert.False(t, allowed(rest.GroupCrypto, "203.0.113.9"))
+	assert.False(t, allowed(rest.GroupCrypto, "2001:db8::1"))
+	assert.True(t, allowed(rest.GroupCrypto, "2001:db8::2"))
+
+	// Invalid lists keep the current ones
+	for _, entry := range []string{"10.0.0.0/33", "example.com", "remote"} {
+		err := l.Reload(listsReader{lists: map[string][]string{"api.access.crypto.deny": {entry}}})
+		assert.NotNil(t, err, entry)
+	}
+
+	assert.False(t, allowed(rest.GroupAdmin, "8.8.8.8"))
+
+	// Addresses some group allows are reachable
+	assert.True(t, l.Reachable(net.ParseIP("8.8.8.8")))
+	assert.False(t, l.Reachable(net.ParseIP("203.0.113.9")))
+
+	assert.Nil(t, l.Reload(listsReader{lists: map[string][]string{"api.access.admin.deny": {"0.0.0.0/0"}}}))
+	assert.False(t, allowed(rest.GroupAdmin, "127.0.0.1"))
+	assert.True(t, allowed(rest.GroupCrypto, "203.0.113.9"))
+}
+
+func TestHandler(t *testing.T) {
+	l, err := NewList(listsReader{lists: map[string][]string{
+		"api.access.admin.allow": {"127.0.0.1"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}), l)
+
+	call := func(method string, path string, remote string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = remote
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	assert.Equal(t, rest.GroupAdmin, rest.Group(httptest.NewRequest("POST", rest.Prefix+"/keys", nil)))
+	assert.Equal(t, rest.GroupAdmin, rest.Group(httptest.NewRequest("POST", rest.Prefix+"/keys/signer/archive", nil)))
+	assert.Equal(t, rest.GroupCrypto, rest.Group(httptest.NewRequest("GET", rest.Prefix+"/keys", nil)))
+	assert.Equal(t, rest.GroupCrypto, rest.Group(httptest.NewRequest("POST", rest.Prefix+"/keys/signer/sign", nil)))
+	assert.Equal(t, rest.GroupAdmin, rest.Group(httptest.NewRequest("POST", rest.Prefix+"/tokens/abc/revoke", nil)))
+	assert.Equal(t, rest.GroupAdmin, rest.Group(httptest.NewRequest("POST", rest.Prefix+"/keys/signer/status", nil)))
+	assert.Equal(t, rest.GroupAdmin, rest.Group(httptest.NewRequest("POST", rest.Prefix+"/dsa/reindex", nil)))
+	assert.Equal(t, rest.GroupAdmin, rest.Group(httptest.NewRequest("POST", rest.Prefix+"/aliases/release/rotate", nil)))
+	assert.Equal(t, rest.GroupCrypto, rest.Group(httptest.NewRequest("GET", rest.Prefix+"/aliases/release", nil)))
+
+	assert.Equal(t, http.StatusNoContent, call("POST", rest.Prefix+"/keys", "127.0.0.1:4000"))
+	assert.Equal(t, http.StatusForbidden, call("POST", rest.Prefix+"/keys", "10.0.0.2:4000"))
+	assert.Equal(t, http.StatusNoContent, call("POST", rest.Prefix+"/keys/signer/sign", "10.0.0.2:4000"))
+	assert.Equal(t, http.StatusForbidden, call("GET", rest.Prefix+"/health", "not an address"))
+}
+
+func TestListener(t *testing.T) {
+	l, err := NewList(listsReader{lists: map[string][]string{
+		"api.access.admin.deny":  {"127.0.0.1"},
+		"api.access.crypto.deny": {"127.0.0.1"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if c, err := Listener(ln, l).Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+
+	// Closed before anything is read, the handshake never starts
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = c.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	select {
+	case <-accepted:
+		t.Fatal("denied address accepted")
+	default:
+	}
+}
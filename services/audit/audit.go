@@ -0,0 +1,471 @@
+package audit
+
+import (
+	"bytes"
+	goecdsa "crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/user"
+	"time"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/helpers"
+	"github.com/block27/core/services/bbolt"
+	"github.com/block27/core/services/dsa/ecdsa"
+	enc "github.com/block27/core/services/dsa/ecdsa/encodings"
+	sig "github.com/block27/core/services/dsa/signature"
+)
+
+// Buckets holding the log, every name starts with "audit"
+const (
+	// entriesBucket holds one JSON Entry per sequence number, its bucket
+	// sequence is the number of entries ever appended
+	entriesBucket = "audit"
+
+	// checkpointsBucket holds one JSON Checkpoint per covered sequence number
+	checkpointsBucket = "audit.checkpoints"
+
+	// metaBucket holds the GID of the checkpoint signing key
+	metaBucket = "audit.meta"
+)
+
+var keyPointer = []byte("key")
+
+// Operations recorded
+const (
+	OpCreate    = "create"
+	OpSign      = "sign"
+	OpVerify    = "verify"
+	OpExport    = "export"
+	OpImport    = "import"
+	OpLifecycle = "lifecycle"
+	OpAuth      = "auth"
+	OpLimit     = "limit"
+)
+
+// Results of an operation
+const (
+	ResultOK     = "ok"
+	ResultFailed = "failed"
+)
+
+// ErrNotConfigured is returned by Checkpoint before Setup
+var ErrNotConfigured = errors.New("audit signing key is not configured, run `audit setup`")
+
+// Entry is one operation in the log. Hash covers every other field, Prev
+// included, chaining each entry to its predecessor.
+type Entry struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Op     string    `json:"op"`
+	Key    string    `json:"key,omitempty"`
+	Actor  string    `json:"actor,omitempty"`
+	Result string    `json:"result"`
+	Detail string    `json:"detail,omitempty"`
+	Prev   []byte    `json:"prev"`
+	Hash   []byte    `json:"hash"`
+}
+
+// Checkpoint is a signature by the device's audit key over the hash of an
+// entry, and so over every entry before it
+type Checkpoint struct {
+	Seq       uint64    `json:"seq"`
+	Hash      []byte    `json:"hash"`
+	Time      time.Time `json:"time"`
+	Signer    string    `json:"signer"`
+	Signature []byte    `json:"signature"`
+}
+
+// Filter selects entries for Entries, zero fields match everything
+type Filter struct {
+	Key   string
+	Op    string
+	Since time.Time
+	Until time.Time
+}
+
+// Problem is an inconsistency found by Verify at an entry
+type Problem struct {
+	Seq    uint64
+	Detail string
+}
+
+// Report is the outcome of Verify
+type Report struct {
+	// Entries is the number of entries in the log
+	Entries int
+
+	// Checkpoints is the number of checkpoints with a valid signature
+	Checkpoints int
+
+	// Signed is the last entry covered by a valid checkpoint. Entries after
+	// it could be truncated or rewritten without Verify noticing.
+	Signed uint64
+
+	// Head is the sequence number of the last entry
+	Head uint64
+
+	Problems []Problem
+}
+
+// LogAPI is the append-only audit log of the device
+type LogAPI interface {
+	Append(e Entry) (*Entry, error)
+	Entries(f Filter) ([]Entry, error)
+	Checkpoint() (*Checkpoint, error)
+	Verify() (*Report, error)
+}
+
+type log struct {
+	c config.Reader
+	d bbolt.Datastore
+}
+
+// NewLog returns the audit log kept in the datastore
+func NewLog(c config.Reader, d bbolt.Datastore) LogAPI {
+	return &log{c: c, d: d}
+}
+
+// Setup creates the key checkpoints are signed with. Running it again
+// rotates the key, earlier checkpoints keep verifying under the old one.
+func Setup(c config.Reader, d bbolt.Datastore, name string, curve string) (ecdsa.KeyAPI, error) {
+	key, err := ecdsa.NewECDSA(c, name, curve)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.Put(metaBucket, keyPointer, []byte(key.FilePointer())); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Append adds an entry after the current head, filling in its sequence
+// number, time and hashes, and the operating system user as actor unless
+// set. Every audit.checkpoint_interval entries the head is checkpointed,
+// once Setup has run.
+func (l *log) Append(e Entry) (*Entry, error) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	if e.Actor == "" {
+		e.Actor = actor()
+	}
+
+	if e.Result == "" {
+		e.Result = ResultOK
+	}
+
+	e.Time = e.Time.UTC()
+
+	if err := l.d.Write(func(tx bbolt.Tx) error {
+		e.Seq = tx.Sequence(entriesBucket) + 1
+		e.Prev = nil
+
+		if e.Seq > 1 {
+			prev, err := decodeEntry(tx.Get(entriesBucket, seqKey(e.Seq-1)))
+			if err != nil {
+				return fmt.Errorf("%s %d: %v, run `audit verify`",
+					helpers.RFgB("audit log head is unreadable at"), e.Seq-1, err)
+			}
+
+			e.Prev = prev.Hash
+		}
+
+		e.Hash = e.digest()
+
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.SetSequence(entriesBucket, e.Seq); err != nil {
+			return err
+		}
+
+		return tx.Put(entriesBucket, seqKey(e.Seq), data)
+	}); err != nil {
+		return nil, err
+	}
+
+	if every := l.c.GetInt("audit.checkpoint_interval"); every > 0 && e.Seq%uint64(every) == 0 {
+		if _, err := l.Checkpoint(); err != nil && err != ErrNotConfigured {
+			return &e, err
+		}
+	}
+
+	return &e, nil
+}
+
+// Entries returns the entries matching the filter, oldest first
+func (l *log) Entries(f Filter) ([]Entry, error) {
+	var entries []Entry
+
+	err := l.d.ForEach(entriesBucket, func(k, v []byte) error {
+		e, err := decodeEntry(v)
+		if err != nil {
+			return err
+		}
+
+		if f.matches(e) {
+			entries = append(entries, *e)
+		}
+
+		return nil
+	})
+
+	return entries, err
+}
+
+// Checkpoint signs the current head of the log
+func (l *log) Checkpoint() (*Checkpoint, error) {
+	gid, err := l.d.Get(metaBucket, keyPointer)
+	if err != nil {
+		return nil, err
+	}
+
+	if gid == nil {
+		return nil, ErrNotConfigured
+	}
+
+	var head *Entry
+
+	if err := l.d.Read(func(tx bbolt.Tx) error {
+		seq := tx.Sequence(entriesBucket)
+		if seq == 0 {
+			return fmt.Errorf("%s", helpers.RFgB("audit log is empty, nothing to checkpoint"))
+		}
+
+		head, err = decodeEntry(tx.Get(entriesBucket, seqKey(seq)))
+
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GetECDSA(l.c, string(gid))
+	if err != nil {
+		return nil, err
+	}
+
+	cp := &Checkpoint{
+		Seq:    head.Seq,
+		Hash:   head.Hash,
+		Time:   time.Now().UTC(),
+		Signer: key.FilePointer(),
+	}
+
+	s, err := key.Sign(cp.digest())
+	if err != nil {
+		return nil, err
+	}
+
+	if cp.Signature, err = s.SigToDER(); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return nil, err
+	}
+
+	return cp, l.d.Put(checkpointsBucket, seqKey(cp.Seq), data)
+}
+
+// Verify walks the whole log checking every entry's hash and link to its
+// predecessor, and every checkpoint's signature against the entry it
+// covers. Edits show as broken hashes or links, truncation as entries
+// missing below the log's sequence or below a checkpoint.
+func (l *log) Verify() (*Report, error) {
+	r := &Report{}
+	hashes := map[uint64][]byte{}
+
+	var checkpoints []Checkpoint
+
+	if err := l.d.Read(func(tx bbolt.Tx) error {
+		var prev []byte
+
+		if err := tx.ForEach(entriesBucket, func(k, v []byte) error {
+			seq := binary.BigEndian.Uint64(k)
+
+			e, err := decodeEntry(v)
+			if err != nil {
+				r.problem(seq, fmt.Sprintf("unreadable: %v", err))
+				prev = nil
+				r.Head = seq
+				return nil
+			}
+
+			r.Entries++
+
+			switch {
+			case e.Seq != seq:
+				r.problem(seq, fmt.Sprintf("stored as entry %d, was moved", e.Seq))
+			case seq != r.Head+1:
+				r.problem(seq, fmt.Sprintf("entries %d to %d are missing", r.Head+1, seq-1))
+			case !bytes.Equal(e.Prev, prev):
+				r.problem(seq, fmt.Sprintf("does not chain to entry %d", seq-1))
+			}
+
+			if !bytes.Equal(e.Hash, e.digest()) {
+				r.problem(seq, "was edited, its hash does not match")
+			}
+
+			hashes[seq] = e.Hash
+			prev, r.Head = e.Hash, seq
+
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		if appended := tx.Sequence(entriesBucket); appended > r.Head {
+			r.problem(appended, fmt.Sprintf("log truncated, entries %d to %d are missing", r.Head+1, appended))
+		}
+
+		return tx.ForEach(checkpointsBucket, func(k, v []byte) error {
+			var cp Checkpoint
+			if err := json.Unmarshal(v, &cp); err != nil {
+				r.problem(binary.BigEndian.Uint64(k), fmt.Sprintf("checkpoint unreadable: %v", err))
+				return nil
+			}
+
+			checkpoints = append(checkpoints, cp)
+
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	// Signers are loaded from the keystore outside the read transaction
+	for _, cp := range checkpoints {
+		hash, ok := hashes[cp.Seq]
+
+		switch {
+		case !ok:
+			r.problem(cp.Seq, "checkpointed entry is missing, log truncated")
+		case !bytes.Equal(hash, cp.Hash):
+			r.problem(cp.Seq, "entry differs from its checkpoint")
+		default:
+			if err := l.verifyCheckpoint(cp); err != nil {
+				r.problem(cp.Seq, fmt.Sprintf("checkpoint signature: %v", err))
+				continue
+			}
+
+			r.Checkpoints++
+			if cp.Seq > r.Signed {
+				r.Signed = cp.Seq
+			}
+		}
+	}
+
+	return r, nil
+}
+
+// verifyCheckpoint checks the signature with the signer's public key, which
+// keeps verifying whatever the key's status
+func (l *log) verifyCheckpoint(cp Checkpoint) error {
+	key, err := ecdsa.GetECDSA(l.c, cp.Signer)
+	if err != nil {
+		return err
+	}
+
+	pemKey, err := base64.StdEncoding.DecodeString(key.Struct().PublicKeyB64)
+	if err != nil {
+		return err
+	}
+
+	pub, err := enc.ImportPublicKeyfromPEM(pemKey)
+	if err != nil {
+		return err
+	}
+
+	var rs sig.Signature
+	if _, err := asn1.Unmarshal(cp.Signature, &rs); err != nil || rs.R == nil || rs.S == nil {
+		return fmt.Errorf("invalid signature encoding")
+	}
+
+	if !goecdsa.Verify(pub, cp.digest(), rs.R, rs.S) {
+		return fmt.Errorf("does not verify under %s", cp.Signer)
+	}
+
+	return nil
+}
+
+// actor names the operating system user running the process
+func actor() string {
+	u, err := user.Current()
+	if err != nil {
+		return "unknown"
+	}
+
+	return u.Username
+}
+
+func (r *Report) problem(seq uint64, detail string) {
+	r.Problems = append(r.Problems, Problem{Seq: seq, Detail: detail})
+}
+
+// digest is the hash of the entry without its own hash
+func (e Entry) digest() []byte {
+	e.Hash = nil
+
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+
+	return sum[:]
+}
+
+// digest is what the checkpoint signature covers
+func (cp Checkpoint) digest() []byte {
+	cp.Signature = nil
+
+	data, _ := json.Marshal(cp)
+	sum := sha256.Sum256(data)
+
+	return sum[:]
+}
+
+func (f Filter) matches(e *Entry) bool {
+	switch {
+	case f.Key != "" && e.Key != f.Key:
+		return false
+	case f.Op != "" && e.Op != f.Op:
+		return false
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	}
+
+	return true
+}
+
+func decodeEntry(data []byte) (*Entry, error) {
+	if data == nil {
+		return nil, fmt.Errorf("entry is missing")
+	}
+
+	var e Entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+// seqKey orders entries by sequence number in bbolt
+func seqKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+
+	return key
+}
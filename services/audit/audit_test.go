@@ -0,0 +1,273 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/services/bbolt"
+	api "github.com/block27/core/services/dsa"
+	"github.com/block27/core/services/keystore"
+	"github.com/block27/core/test"
+)
+
+var Config config.Reader
+
+func init() {
+	os.Setenv("ENVIRONMENT", "test")
+
+	c, err := config.LoadConfig(config.Defaults)
+	if err != nil {
+		panic(err)
+	}
+
+	if c.GetString("environment") != "test" {
+		panic(fmt.Errorf("test [environment] is not in [test] mode"))
+	}
+
+	// Stands in for HardwareAuthenticate, which needs the device attached
+	if err := crypto.LoadMasterKey([]byte(test.MasterKey), []byte(test.MasterIv)); err != nil {
+		panic(err)
+	}
+
+	Config = c
+}
+
+// deviceReader keeps the keystore under a directory of its own and sets
+// the checkpoint interval
+type deviceReader struct {
+	config.Reader
+	keys     string
+	interval int
+}
+
+func (d deviceReader) GetString(key string) string {
+	switch key {
+	case "keystore.backend":
+		return keystore.FS
+	case "paths.keys":
+		return d.keys
+	}
+
+	return d.Reader.GetString(key)
+}
+
+func (d deviceReader) GetInt(key string) int {
+	if key == "audit.checkpoint_interval" {
+		return d.interval
+	}
+
+	return d.Reader.GetInt(key)
+}
+
+func newTestLog(t *testing.T, interval int) (LogAPI, deviceReader, bbolt.Datastore, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := bbolt.NewDB(filepath.Join(dir, "botldb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := deviceReader{Reader: Config, keys: filepath.Join(dir, "keys"), interval: interval}
+
+	return NewLog(c, d), c, d, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func uniqueName(base string) string {
+	return fmt.Sprintf("%s-%s", base, api.GenerateUUID().String()[:8])
+}
+
+// rewrite replaces a stored entry, optionally re-hashing it and every later
+// entry the way an attacker with write access to the database could
+func rewrite(t *testing.T, d bbolt.Datastore, seq uint64, fn func(e *Entry), rehash bool) {
+	t.Helper()
+
+	if err := d.Write(func(tx bbolt.Tx) error {
+		var prev []byte
+
+		for n := seq; ; n++ {
+			e, err := decodeEntry(tx.Get(entriesBucket, seqKey(n)))
+			if err != nil {
+				return nil
+			}
+
+			if n == seq {
+				fn(e)
+			} else if !rehash {
+				return nil
+			} else {
+				e.Prev = prev
+			}
+
+			if rehash {
+				e.Hash = e.digest()
+			}
+
+			prev = e.Hash
+
+			data, _ := json.Marshal(e)
+			if err := tx.Put(entriesBucket, seqKey(n), data); err != nil {
+				return err
+			}
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appendN(t *testing.T, l LogAPI, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		if _, err := l.Append(Entry{Op: OpSign, Key: fmt.Sprintf("key-%d", i%2)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAppendVerify(t *testing.T) {
+	l, _, _, done := newTestLog(t, 0)
+	defer done()
+
+	r, err := l.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 0, r.Entries)
+	assert.Empty(t, r.Problems)
+
+	appendN(t, l, 5)
+
+	r, err = l.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 5, r.Entries)
+	assert.Equal(t, uint64(5), r.Head)
+	assert.Equal(t, uint64(0), r.Signed)
+	assert.Empty(t, r.Problems)
+
+	_, err = l.Checkpoint()
+	assert.Equal(t, ErrNotConfigured, err)
+}
+
+func TestEntries(t *testing.T) {
+	l, _, _, done := newTestLog(t, 0)
+	defer done()
+
+	appendN(t, l, 4)
+
+	if _, err := l.Append(Entry{Op: OpAuth, Result: ResultFailed, Time: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := l.Entries(Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 5, len(all))
+	assert.Equal(t, uint64(1), all[0].Seq)
+	assert.NotEmpty(t, all[0].Actor)
+	assert.Equal(t, ResultOK, all[0].Result)
+	assert.Equal(t, all[0].Hash, all[1].Prev)
+
+	byKey, _ := l.Entries(Filter{Key: "key-1"})
+	assert.Equal(t, 2, len(byKey))
+
+	byOp, _ := l.Entries(Filter{Op: OpAuth})
+	assert.Equal(t, 1, len(byOp))
+	assert.Equal(t, ResultFailed, byOp[0].Result)
+
+	later, _ := l.Entries(Filter{Since: time.Now().Add(time.Minute)})
+	assert.Equal(t, 1, len(later))
+
+	earlier, _ := l.Entries(Filter{Until: time.Now().Add(time.Minute)})
+	assert.Equal(t, 4, len(earlier))
+}
+
+func TestTampering(t *testing.T) {
+	l, c, d, done := newTestLog(t, 3)
+	defer done()
+
+	if _, err := Setup(c, d, uniqueName("audit"), "prime256v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every third entry is checkpointed
+	appendN(t, l, 7)
+
+	r, err := l.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Empty(t, r.Problems)
+	assert.Equal(t, 2, r.Checkpoints)
+	assert.Equal(t, uint64(6), r.Signed)
+
+	problems := func() []Problem {
+		r, err := l.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return r.Problems
+	}
+
+	// An edited entry no longer matches its hash
+	var original Entry
+	rewrite(t, d, 2, func(e *Entry) { original = *e; e.Detail = "edited" }, false)
+	assert.Equal(t, uint64(2), problems()[0].Seq)
+
+	// Re-hashing the chain after the edit still breaks the checkpoints
+	rewrite(t, d, 2, func(e *Entry) { e.Detail = "edited" }, true)
+	assert.NotEmpty(t, problems())
+
+	rewrite(t, d, 2, func(e *Entry) { *e = original }, true)
+	assert.Empty(t, problems())
+
+	// Entries cut from the end or the middle are missing
+	if err := d.Write(func(tx bbolt.Tx) error {
+		return tx.Delete(entriesBucket, seqKey(7))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, uint64(7), problems()[0].Seq)
+
+	if err := d.Write(func(tx bbolt.Tx) error {
+		tx.Delete(entriesBucket, seqKey(6))
+		return tx.SetSequence(entriesBucket, 5)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, uint64(6), problems()[0].Seq)
+
+	if err := d.Write(func(tx bbolt.Tx) error {
+		return tx.Delete(entriesBucket, seqKey(3))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, len(problems()) >= 2)
+}
@@ -0,0 +1,346 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/services/bbolt"
+	api "github.com/block27/core/services/dsa"
+	"github.com/block27/core/services/dsa/ecdsa"
+)
+
+// operatorsBucket holds one sealed Operator per name
+const operatorsBucket = "auth.operators"
+
+// Roles an operator holds, exactly one each
+const (
+	// RoleOfficer manages operators, the store and backups, and approves
+	// dangerous actions
+	RoleOfficer = "security-officer"
+
+	// RoleUser creates keys and signs with them
+	RoleUser = "crypto-user"
+
+	// RoleAuditor reads and verifies the audit log
+	RoleAuditor = "auditor"
+)
+
+// Roles lists every role
+var Roles = []string{RoleOfficer, RoleUser, RoleAuditor}
+
+// approvalCurve is the curve of the keys operators sign approvals with
+const approvalCurve = "prime256v1"
+
+var operatorName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,31}$`)
+
+var (
+	// ErrNoOperator is returned for names no operator is enrolled under
+	ErrNoOperator = errors.New("no such operator")
+
+	// ErrFirstOfficer is returned when the first operator enrolled is not a
+	// security officer, or the last officer would be removed
+	ErrFirstOfficer = fmt.Errorf("at least one %s must stay enrolled", RoleOfficer)
+)
+
+// Operator is a person holding a role on the device. Key is the GID of the
+// ECDSA key their approvals are signed with.
+type Operator struct {
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	Key       string    `json:"key"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Has reports whether the operator holds one of roles
+func (o *Operator) Has(roles ...string) bool {
+	for _, r := range roles {
+		if o.Role == r {
+			return true
+		}
+	}
+
+	return false
+}
+
+// OperatorsAPI enrols operators, each with a PIN of their own locking after
+// auth.pin_retries failures. Once any operator is enrolled the device PIN
+// no longer authorises commands.
+type OperatorsAPI interface {
+	Add(name string, role string, pin []byte) (*Operator, error)
+	Remove(name string) error
+	Get(name string) (*Operator, error)
+	List() ([]*Operator, error)
+	Enrolled() (bool, error)
+	Login(name string, pin []byte) (*Operator, error)
+	Change(name string, pin []byte, newPin []byte) error
+	Reset(name string, newPin []byte) error
+	Approve(name string, pin []byte, action string, target string, ttl time.Duration) (*Approval, error)
+	Status(name string) (*Status, error)
+}
+
+type operators struct {
+	c config.Reader
+	d bbolt.Datastore
+}
+
+// NewOperators returns the operators kept in the datastore
+func NewOperators(c config.Reader, d bbolt.Datastore) OperatorsAPI {
+	return &operators{c: c, d: d}
+}
+
+// Add enrols an operator with a fresh approval key. The first operator
+// must be a security officer, so someone can always manage the rest.
+func (o *operators) Add(name string, role string, newPin []byte) (*Operator, error) {
+	if !operatorName.MatchString(name) {
+		return nil, fmt.Errorf("operator name must be 1 to 32 of [a-z0-9._-]")
+	}
+
+	op := &Operator{Name: name, Role: role, CreatedAt: time.Now().UTC()}
+	if !op.Has(Roles...) {
+		return nil, fmt.Errorf("unknown role %s, expected one of %v", role, Roles)
+	}
+
+	if err := checkLength("PIN", newPin, minPin); err != nil {
+		return nil, err
+	}
+
+	hash, err := hashPassword(newPin)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := o.Get(name); err != ErrNoOperator {
+		if err == nil {
+			err = fmt.Errorf("operator %s already exists", name)
+		}
+
+		return nil, err
+	}
+
+	// Names of destroyed keys stay taken, so a re-enrolled operator gets a
+	// key of their own
+	key, err := ecdsa.NewECDSA(o.c, fmt.Sprintf("operator-%s-%s", name, api.GenerateUUID().String()[:8]), approvalCurve)
+	if err != nil {
+		return nil, err
+	}
+
+	op.Key = key.FilePointer()
+
+	if err := o.d.Write(func(tx bbolt.Tx) error {
+		if tx.Get(operatorsBucket, []byte(name)) != nil {
+			return fmt.Errorf("operator %s already exists", name)
+		}
+
+		officers := 0
+		if err := tx.ForEach(operatorsBucket, func(k, v []byte) error {
+			var other Operator
+			if err := open(tx, operatorsBucket, k, &other); err != nil {
+				return err
+			}
+
+			if other.Role == RoleOfficer {
+				officers++
+			}
+
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		if officers == 0 && role != RoleOfficer {
+			return ErrFirstOfficer
+		}
+
+		if err := seal(tx, operatorsBucket, []byte(name), op); err != nil {
+			return err
+		}
+
+		return put(tx, pinKey(name), &credentials{Pin: hash})
+	}); err != nil {
+		key.SetStatus(o.c, api.StatusDestroyed, "operator not enrolled")
+		return nil, err
+	}
+
+	return op, nil
+}
+
+// Remove unenrols an operator and destroys their approval key, so tokens
+// they signed stop counting. The last security officer cannot be removed
+// while others remain.
+func (o *operators) Remove(name string) error {
+	var op Operator
+
+	if err := o.d.Write(func(tx bbolt.Tx) error {
+		if err := o.open(tx, name, &op); err != nil {
+			return err
+		}
+
+		officers, others := 0, 0
+		if err := tx.ForEach(operatorsBucket, func(k, v []byte) error {
+			var other Operator
+			if err := open(tx, operatorsBucket, k, &other); err != nil {
+				return err
+			}
+
+			switch {
+			case other.Name == name:
+			case other.Role == RoleOfficer:
+				officers++
+			default:
+				others++
+			}
+
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		if op.Role == RoleOfficer && officers == 0 && others > 0 {
+			return ErrFirstOfficer
+		}
+
+		if err := drop(tx, operatorsBucket, []byte(name)); err != nil {
+			return err
+		}
+
+		return drop(tx, bucket, pinKey(name))
+	}); err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GetECDSA(o.c, op.Key)
+	if err != nil {
+		return err
+	}
+
+	if key.Struct().Status == api.StatusDestroyed {
+		return nil
+	}
+
+	return key.SetStatus(o.c, api.StatusDestroyed, fmt.Sprintf("operator %s removed", name))
+}
+
+// Get returns an operator, ErrNoOperator if none is enrolled under name
+func (o *operators) Get(name string) (*Operator, error) {
+	var op Operator
+
+	if err := o.d.Read(func(tx bbolt.Tx) error {
+		return o.open(tx, name, &op)
+	}); err != nil {
+		return nil, err
+	}
+
+	return &op, nil
+}
+
+// List returns every operator by name
+func (o *operators) List() ([]*Operator, error) {
+	var ops []*Operator
+
+	err := o.d.Read(func(tx bbolt.Tx) error {
+		return tx.ForEach(operatorsBucket, func(k, v []byte) error {
+			var op Operator
+			if err := open(tx, operatorsBucket, k, &op); err != nil {
+				return err
+			}
+
+			ops = append(ops, &op)
+
+			return nil
+		})
+	})
+
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Name < ops[j].Name })
+
+	return ops, err
+}
+
+// Enrolled reports whether any operator is enrolled
+func (o *operators) Enrolled() (bool, error) {
+	ops, err := o.List()
+	return len(ops) > 0, err
+}
+
+// Login checks an operator's PIN
+func (o *operators) Login(name string, secret []byte) (*Operator, error) {
+	op, err := o.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := o.pin(name).Verify(secret); err != nil {
+		return nil, err
+	}
+
+	return op, nil
+}
+
+// Change replaces an operator's PIN after checking the current one
+func (o *operators) Change(name string, secret []byte, newPin []byte) error {
+	if _, err := o.Get(name); err != nil {
+		return err
+	}
+
+	return o.pin(name).Change(secret, newPin)
+}
+
+// Reset sets an operator's PIN and clears its failures. Operators have no
+// PUK, a security officer resets a locked PIN instead.
+func (o *operators) Reset(name string, newPin []byte) error {
+	if err := checkLength("PIN", newPin, minPin); err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(newPin)
+	if err != nil {
+		return err
+	}
+
+	return o.d.Write(func(tx bbolt.Tx) error {
+		var op Operator
+		if err := o.open(tx, name, &op); err != nil {
+			return err
+		}
+
+		return put(tx, pinKey(name), &credentials{Pin: hash})
+	})
+}
+
+// Status returns the failures counted against an operator's PIN
+func (o *operators) Status(name string) (*Status, error) {
+	if _, err := o.Get(name); err != nil {
+		return nil, err
+	}
+
+	s, err := o.pin(name).Status()
+	if err != nil {
+		return nil, err
+	}
+
+	s.PukRetries = 0
+
+	return s, nil
+}
+
+// pin returns the PIN of an operator, stored beside the device credentials
+func (o *operators) pin(name string) PinAPI {
+	return &pin{c: o.c, d: o.d, key: pinKey(name)}
+}
+
+// open reads an operator, ErrNoOperator when missing
+func (o *operators) open(tx bbolt.Tx, name string, op *Operator) error {
+	err := open(tx, operatorsBucket, []byte(name), op)
+	if err == ErrNotInitialized {
+		return ErrNoOperator
+	}
+
+	return err
+}
+
+func pinKey(name string) []byte {
+	return []byte("operator/" + name)
+}
@@ -0,0 +1,287 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/services/bbolt"
+	"github.com/block27/core/services/keystore"
+	"github.com/block27/core/test"
+)
+
+// deviceReader keeps the keystore under a directory of its own
+type deviceReader struct {
+	retriesReader
+	keys string
+}
+
+func (d deviceReader) GetString(key string) string {
+	switch key {
+	case "keystore.backend":
+		return keystore.FS
+	case "paths.keys":
+		return d.keys
+	}
+
+	return d.retriesReader.GetString(key)
+}
+
+func newTestOperators(t *testing.T) (OperatorsAPI, deviceReader, bbolt.Datastore, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := bbolt.NewDB(filepath.Join(dir, "botldb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := deviceReader{retriesReader: retriesReader{Config}, keys: filepath.Join(dir, "keys")}
+
+	return NewOperators(c, d), c, d, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestOperators(t *testing.T) {
+	o, _, _, done := newTestOperators(t)
+	defer done()
+
+	enrolled, err := o.Enrolled()
+	assert.Nil(t, err)
+	assert.False(t, enrolled)
+
+	// The first operator must be able to manage the others
+	_, err = o.Add("carol", RoleUser, []byte("123456"))
+	assert.Equal(t, ErrFirstOfficer, err)
+
+	if _, err := o.Add("alice", RoleOfficer, []byte("123456")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := o.Add("carol", RoleUser, []byte("654321")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = o.Add("carol", RoleAuditor, []byte("654321"))
+	assert.NotNil(t, err)
+	_, err = o.Add("dave", "root", []byte("654321"))
+	assert.NotNil(t, err)
+
+	ops, err := o.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 2, len(ops))
+	assert.Equal(t, "alice", ops[0].Name)
+	assert.NotEmpty(t, ops[0].Key)
+
+	op, err := o.Login("carol", []byte("654321"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, op.Has(RoleUser, RoleAuditor))
+	assert.False(t, op.Has(RoleOfficer))
+
+	// Operators lock like the device PIN, an officer resets them
+	_, err = o.Login("carol", []byte("000000"))
+	assert.Equal(t, &WrongSecret{Secret: "PIN", Remaining: 1}, err)
+	_, err = o.Login("carol", []byte("000000"))
+	assert.Equal(t, ErrLocked, err)
+
+	if err := o.Reset("carol", []byte("246810")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = o.Login("carol", []byte("246810"))
+	assert.Nil(t, err)
+
+	_, err = o.Login("bob", []byte("123456"))
+	assert.Equal(t, ErrNoOperator, err)
+
+	// The last officer stays while others remain
+	assert.Equal(t, ErrFirstOfficer, o.Remove("alice"))
+	assert.Nil(t, o.Remove("carol"))
+	assert.Nil(t, o.Remove("alice"))
+
+	// A removed operator can be enrolled again
+	_, err = o.Add("alice", RoleOfficer, []byte("123456"))
+	assert.Nil(t, err)
+}
+
+func TestQuorum(t *testing.T) {
+	o, c, d, done := newTestOperators(t)
+	defer done()
+
+	for _, name := range []string{"alice", "bob", "carol"} {
+		role := RoleOfficer
+		if name == "carol" {
+			role = RoleUser
+		}
+
+		if _, err := o.Add(name, role, []byte("123456")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q, err := NewQuorum(c, d, ActionDestroy, "key-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 2, q.Required())
+
+	// Crypto users cannot approve, nor can an officer twice
+	assert.NotNil(t, q.Approve("carol", []byte("123456")))
+	assert.Nil(t, q.Approve("alice", []byte("123456")))
+	assert.NotNil(t, q.Approve("alice", []byte("123456")))
+	assert.False(t, q.Satisfied())
+	assert.NotNil(t, q.Commit())
+
+	_, err = o.Approve("carol", []byte("123456"), ActionDestroy, "key-1", time.Hour)
+	assert.NotNil(t, err)
+
+	token, err := o.Approve("bob", []byte("123456"), ActionDestroy, "key-1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens are scoped to one action on one target
+	other, _ := NewQuorum(c, d, ActionDestroy, "key-2")
+	assert.NotNil(t, other.Token(token))
+
+	// An edited token no longer verifies
+	forged := *token
+	forged.ExpiresAt = forged.ExpiresAt.Add(time.Hour)
+	assert.NotNil(t, q.Token(&forged))
+
+	assert.Nil(t, q.Token(token))
+	assert.True(t, q.Satisfied())
+	assert.Equal(t, []string{"alice", "bob"}, q.Approvers())
+	assert.Nil(t, q.Commit())
+
+	// A token counts once
+	again, _ := NewQuorum(c, d, ActionDestroy, "key-1")
+	assert.Equal(t, ErrSpent, again.Token(token))
+
+	expired, err := o.Approve("bob", []byte("123456"), ActionDestroy, "key-1", time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond)
+	assert.Equal(t, ErrExpired, again.Token(expired))
+
+	// Removing an officer revokes their tokens
+	pending, err := o.Approve("bob", []byte("123456"), ActionDestroy, "key-1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.Remove("bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NotNil(t, again.Token(pending))
+}
+
+func TestQuorumRotateMaster(t *testing.T) {
+	o, c, d, done := newTestOperators(t)
+	defer done()
+
+	for _, name := range []string{"alice", "bob"} {
+		if _, err := o.Add(name, RoleOfficer, []byte("123456")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q, err := NewQuorum(c, d, ActionRotateMaster, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotating the master key is refused without approvals, and with one
+	assert.Equal(t, 2, q.Required())
+	assert.NotNil(t, q.Commit())
+
+	assert.Nil(t, q.Approve("alice", []byte("123456")))
+	assert.NotNil(t, q.Commit())
+
+	assert.Nil(t, q.Approve("bob", []byte("123456")))
+	assert.Nil(t, q.Commit())
+}
+
+func TestReseal(t *testing.T) {
+	o, _, d, done := newTestOperators(t)
+	defer done()
+
+	if _, err := o.Add("alice", RoleOfficer, []byte("123456")); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Reseal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer crypto.LoadMasterKey([]byte(test.MasterKey), []byte(test.MasterIv))
+
+	if err := crypto.RotateMasterKey([]byte("vzbd4jw3w5m7p2cq8t4xn6rk9ys5hb2e"), []byte(test.MasterIv), r); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything reads under the new master key, nothing under the old one
+	if _, err := o.Login("alice", []byte("123456")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := crypto.LoadMasterKey([]byte(test.MasterKey), []byte(test.MasterIv)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = o.Get("alice")
+	assert.Equal(t, ErrTampered, err)
+}
+
+func TestAuthenticate(t *testing.T) {
+	o, c, d, done := newTestOperators(t)
+	defer done()
+
+	if err := NewPin(c, d).Init([]byte("123456"), []byte("12345678")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The device PIN until operators are enrolled
+	op, err := Authenticate(c, d, "", []byte("123456"), RoleUser)
+	assert.Nil(t, err)
+	assert.Nil(t, op)
+
+	_, err = Authenticate(c, d, "alice", []byte("123456"))
+	assert.Equal(t, ErrNoOperators, err)
+
+	if _, err := o.Add("alice", RoleOfficer, []byte("654321")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Authenticate(c, d, "", []byte("123456"))
+	assert.Equal(t, ErrOperatorRequired, err)
+
+	op, err = Authenticate(c, d, "alice", []byte("654321"), RoleOfficer, RoleAuditor)
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", op.Name)
+
+	_, err = Authenticate(c, d, "alice", []byte("654321"), RoleUser)
+	assert.IsType(t, &Forbidden{}, err)
+}
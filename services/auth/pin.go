@@ -0,0 +1,367 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/services/bbolt"
+)
+
+// bucket holding the sealed credentials record
+const bucket = "auth"
+
+var credentialsPointer = []byte("credentials")
+
+// hashPassword hashes PINs and PUKs, tests swap in a cheaper bcrypt cost
+var hashPassword = crypto.HashPassword
+
+// Length limits, bcrypt reads at most 72 bytes
+const (
+	minPin = 6
+	minPuk = 8
+	maxLen = 64
+)
+
+var (
+	// ErrNotInitialized is returned before Init has set a PIN and PUK
+	ErrNotInitialized = errors.New("no PIN is set, run `pin init`")
+
+	// ErrInitialized is returned by Init once a PIN is set
+	ErrInitialized = errors.New("a PIN is already set, use `pin change`")
+
+	// ErrLocked is returned for the PIN once its retries are used up, the
+	// PUK unlocks it
+	ErrLocked = errors.New("PIN is locked after too many failures, run `pin unblock` with the PUK")
+
+	// ErrBlocked is returned once the PUK retries are used up too. Nothing
+	// unlocks the device any more.
+	ErrBlocked = errors.New("PUK is blocked after too many failures, the device can no longer be unlocked")
+
+	// ErrTampered is returned for a credentials record that was not written
+	// by this device
+	ErrTampered = errors.New("credentials record failed its integrity check")
+)
+
+// WrongSecret is a failed PIN or PUK check, with the tries left before it
+// locks
+type WrongSecret struct {
+	Secret    string
+	Remaining int
+}
+
+func (w *WrongSecret) Error() string {
+	return fmt.Sprintf("wrong %s, %d tries left", w.Secret, w.Remaining)
+}
+
+// Status is the retry state of the PIN and PUK
+type Status struct {
+	Initialized bool
+	PinTries    int
+	PinRetries  int
+	PukTries    int
+	PukRetries  int
+}
+
+// PinAPI checks the user PIN, locking it after auth.pin_retries failures in
+// a row, and the PUK that resets a locked PIN, blocked for good after
+// auth.puk_retries failures
+type PinAPI interface {
+	Init(pin []byte, puk []byte) error
+	Verify(pin []byte) error
+	Change(pin []byte, newPin []byte) error
+	Unblock(puk []byte, newPin []byte) error
+	Status() (*Status, error)
+}
+
+// credentials are the bcrypt hashes of the PIN and PUK and the failures of
+// each since its last success
+type credentials struct {
+	Pin      []byte `json:"pin"`
+	Puk      []byte `json:"puk"`
+	PinTries int    `json:"pin_tries"`
+	PukTries int    `json:"puk_tries"`
+}
+
+// sealed is the stored form of credentials and operators, MACed under the
+// master key so counters, hashes and roles cannot be edited in the
+// database. The MAC covers a version raised on every write and checked
+// against versions, so an earlier record put back to reset the counters
+// is refused.
+type sealed struct {
+	Credentials json.RawMessage `json:"credentials"`
+	Version     uint64          `json:"version,omitempty"`
+	MAC         []byte          `json:"mac"`
+}
+
+type pin struct {
+	c config.Reader
+	d bbolt.Datastore
+
+	// key the credentials are stored under
+	key []byte
+}
+
+// NewPin returns the device PIN and PUK kept in the datastore
+func NewPin(c config.Reader, d bbolt.Datastore) PinAPI {
+	return &pin{c: c, d: d, key: credentialsPointer}
+}
+
+// Init sets the first PIN and PUK
+func (p *pin) Init(newPin []byte, newPuk []byte) error {
+	if err := checkLength("PIN", newPin, minPin); err != nil {
+		return err
+	}
+
+	if err := checkLength("PUK", newPuk, minPuk); err != nil {
+		return err
+	}
+
+	pinHash, err := hashPassword(newPin)
+	if err != nil {
+		return err
+	}
+
+	pukHash, err := hashPassword(newPuk)
+	if err != nil {
+		return err
+	}
+
+	return p.d.Write(func(tx bbolt.Tx) error {
+		if tx.Get(bucket, p.key) != nil {
+			return ErrInitialized
+		}
+
+		return put(tx, p.key, &credentials{Pin: pinHash, Puk: pukHash})
+	})
+}
+
+// Verify checks the PIN
+func (p *pin) Verify(secret []byte) error {
+	return p.check(false, secret, nil)
+}
+
+// Change replaces the PIN after checking the current one
+func (p *pin) Change(secret []byte, newPin []byte) error {
+	if err := checkLength("PIN", newPin, minPin); err != nil {
+		return err
+	}
+
+	return p.check(false, secret, newPin)
+}
+
+// Unblock sets a new PIN and clears its failures after checking the PUK
+func (p *pin) Unblock(puk []byte, newPin []byte) error {
+	if err := checkLength("PIN", newPin, minPin); err != nil {
+		return err
+	}
+
+	return p.check(true, puk, newPin)
+}
+
+// Status returns the failures counted so far
+func (p *pin) Status() (*Status, error) {
+	s := &Status{
+		PinRetries: p.c.GetInt("auth.pin_retries"),
+		PukRetries: p.c.GetInt("auth.puk_retries"),
+	}
+
+	err := p.d.Read(func(tx bbolt.Tx) error {
+		cr, err := get(tx, p.key)
+		if err == ErrNotInitialized {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		s.Initialized, s.PinTries, s.PukTries = true, cr.PinTries, cr.PukTries
+
+		return nil
+	})
+
+	return s, err
+}
+
+// check compares a PIN, or the PUK, with its hash and sets newPin if it
+// matches. The failure is counted and persisted before the comparison, so
+// killing the process mid-check cannot earn a free try; a match clears it.
+func (p *pin) check(usePuk bool, secret []byte, newPin []byte) error {
+	name, retries, locked := "PIN", p.c.GetInt("auth.pin_retries"), ErrLocked
+	if usePuk {
+		name, retries, locked = "PUK", p.c.GetInt("auth.puk_retries"), ErrBlocked
+	}
+
+	var hash []byte
+	var tries int
+
+	if err := p.d.Write(func(tx bbolt.Tx) error {
+		cr, err := get(tx, p.key)
+		if err != nil {
+			return err
+		}
+
+		if usePuk && cr.Puk == nil {
+			return fmt.Errorf("no PUK is set for these credentials")
+		}
+
+		if cr.PukTries >= p.c.GetInt("auth.puk_retries") {
+			return ErrBlocked
+		}
+
+		counter := &cr.PinTries
+		hash = cr.Pin
+		if usePuk {
+			counter, hash = &cr.PukTries, cr.Puk
+		}
+
+		if *counter >= retries {
+			return locked
+		}
+
+		*counter++
+		tries = *counter
+
+		return put(tx, p.key, cr)
+	}); err != nil {
+		return err
+	}
+
+	// bcrypt compares in constant time
+	if crypto.CheckPasswordHash(hash, secret) != nil {
+		if tries >= retries {
+			return locked
+		}
+
+		return &WrongSecret{Secret: name, Remaining: retries - tries}
+	}
+
+	var newHash []byte
+	if newPin != nil {
+		var err error
+		if newHash, err = hashPassword(newPin); err != nil {
+			return err
+		}
+	}
+
+	return p.d.Write(func(tx bbolt.Tx) error {
+		cr, err := get(tx, p.key)
+		if err != nil {
+			return err
+		}
+
+		if usePuk {
+			cr.PukTries = 0
+		}
+
+		cr.PinTries = 0
+		if newHash != nil {
+			cr.Pin = newHash
+		}
+
+		return put(tx, p.key, cr)
+	})
+}
+
+func checkLength(name string, secret []byte, min int) error {
+	if n := utf8.RuneCount(secret); n < min || len(secret) > maxLen {
+		return fmt.Errorf("%s must be %d to %d characters", name, min, maxLen)
+	}
+
+	return nil
+}
+
+// macInput binds a record's MAC to the bucket and key it is stored under and
+// its version, so records cannot be swapped between operators or passed off
+// as another version
+func macInput(bucket string, key []byte, version uint64, data []byte) []byte {
+	return append([]byte(fmt.Sprintf("%s\x00%s\x00%d\x00", bucket, key, version)), data...)
+}
+
+func get(tx bbolt.Tx, key []byte) (*credentials, error) {
+	var cr credentials
+	if err := open(tx, bucket, key, &cr); err != nil {
+		return nil, err
+	}
+
+	return &cr, nil
+}
+
+func put(tx bbolt.Tx, key []byte, cr *credentials) error {
+	return seal(tx, bucket, key, cr)
+}
+
+// open reads a record sealed under key, ErrNotInitialized when missing and
+// ErrReplayed when older than the last one written
+func open(tx bbolt.Tx, bucket string, key []byte, v interface{}) error {
+	raw := tx.Get(bucket, key)
+	if raw == nil {
+		return ErrNotInitialized
+	}
+
+	var s sealed
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return ErrTampered
+	}
+
+	ok, err := crypto.CheckRecordMAC(macInput(bucket, key, s.Version, s.Credentials), s.MAC)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrTampered
+	}
+
+	vs, found, err := loadVersions(tx)
+	if err != nil {
+		return err
+	}
+
+	if err := vs.check(found, bucket, key, s.Version); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(s.Credentials, v); err != nil {
+		return ErrTampered
+	}
+
+	return nil
+}
+
+// seal writes v under key at its next version, with a MAC from the master
+// key
+func seal(tx bbolt.Tx, bucket string, key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	vs, _, err := loadVersions(tx)
+	if err != nil {
+		return err
+	}
+
+	id := versionID(bucket, key)
+	vs[id]++
+
+	mac, err := crypto.RecordMAC(macInput(bucket, key, vs[id], data))
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(sealed{Credentials: data, Version: vs[id], MAC: mac})
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Put(bucket, key, raw); err != nil {
+		return err
+	}
+
+	return vs.save(tx)
+}
@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/services/bbolt"
+	"github.com/block27/core/test"
+)
+
+var Config config.Reader
+
+func init() {
+	os.Setenv("ENVIRONMENT", "test")
+
+	c, err := config.LoadConfig(config.Defaults)
+	if err != nil {
+		panic(err)
+	}
+
+	if c.GetString("environment") != "test" {
+		panic(fmt.Errorf("test [environment] is not in [test] mode"))
+	}
+
+	// Stands in for HardwareAuthenticate, which needs the device attached
+	if err := crypto.LoadMasterKey([]byte(test.MasterKey), []byte(test.MasterIv)); err != nil {
+		panic(err)
+	}
+
+	Config = c
+
+	hashPassword = func(password []byte) ([]byte, error) {
+		return bcrypt.GenerateFromPassword(password, bcrypt.MinCost)
+	}
+}
+
+// retriesReader lowers the retry limits
+type retriesReader struct {
+	config.Reader
+}
+
+func (r retriesReader) GetInt(key string) int {
+	switch key {
+	case "auth.pin_retries":
+		return 2
+	case "auth.puk_retries":
+		return 1
+	}
+
+	return r.Reader.GetInt(key)
+}
+
+func newTestPin(t *testing.T) (PinAPI, bbolt.Datastore, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := bbolt.NewDB(filepath.Join(dir, "botldb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewPin(retriesReader{Config}, d), d, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPinLockout(t *testing.T) {
+	p, _, done := newTestPin(t)
+	defer done()
+
+	assert.Equal(t, ErrNotInitialized, p.Verify([]byte("123456")))
+	assert.NotNil(t, p.Init([]byte("123"), []byte("12345678")))
+
+	if err := p.Init([]byte("123456"), []byte("12345678")); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, ErrInitialized, p.Init([]byte("654321"), []byte("87654321")))
+
+	// A success clears earlier failures
+	err := p.Verify([]byte("000000"))
+	assert.Equal(t, &WrongSecret{Secret: "PIN", Remaining: 1}, err)
+	assert.Nil(t, p.Verify([]byte("123456")))
+
+	s, err := p.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 0, s.PinTries)
+
+	// Locked after the retries run out, even for the right PIN
+	assert.NotNil(t, p.Verify([]byte("000000")))
+	assert.Equal(t, ErrLocked, p.Verify([]byte("000000")))
+	assert.Equal(t, ErrLocked, p.Verify([]byte("123456")))
+
+	if err := p.Unblock([]byte("12345678"), []byte("246810")); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, p.Verify([]byte("246810")))
+
+	if err := p.Change([]byte("246810"), []byte("135791")); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, p.Verify([]byte("135791")))
+
+	// A wrong PUK blocks the device for good
+	assert.Equal(t, ErrBlocked, p.Unblock([]byte("00000000"), []byte("111111")))
+	assert.Equal(t, ErrBlocked, p.Verify([]byte("135791")))
+}
+
+func TestPinTampered(t *testing.T) {
+	p, d, done := newTestPin(t)
+	defer done()
+
+	if err := p.Init([]byte("123456"), []byte("12345678")); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NotNil(t, p.Verify([]byte("000000")))
+
+	// Winding the counter back by editing the record is caught
+	if err := d.Write(func(tx bbolt.Tx) error {
+		var s sealed
+		if err := json.Unmarshal(tx.Get(bucket, credentialsPointer), &s); err != nil {
+			return err
+		}
+
+		s.Credentials = bytes.Replace(s.Credentials, []byte(`"pin_tries":1`), []byte(`"pin_tries":0`), 1)
+
+		raw, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+
+		return tx.Put(bucket, credentialsPointer, raw)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, ErrTampered, p.Verify([]byte("123456")))
+}
+
+func TestPinReplayed(t *testing.T) {
+	p, d, done := newTestPin(t)
+	defer done()
+
+	if err := p.Init([]byte("123456"), []byte("12345678")); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := d.Get(bucket, credentialsPointer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NotNil(t, p.Verify([]byte("000000")))
+	assert.Equal(t, ErrLocked, p.Verify([]byte("000000")))
+
+	// Putting back the record of before the failures does not reset them
+	if err := d.Put(bucket, credentialsPointer, before); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, ErrReplayed, p.Verify([]byte("123456")))
+
+	// Nor does it with the versions removed as well
+	if err := d.Write(func(tx bbolt.Tx) error {
+		return tx.Delete(versionsBucket, versionsKey)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, ErrReplayed, p.Verify([]byte("123456")))
+}
@@ -0,0 +1,314 @@
+package auth
+
+import (
+	goecdsa "crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/services/bbolt"
+	"github.com/block27/core/services/dsa/ecdsa"
+	enc "github.com/block27/core/services/dsa/ecdsa/encodings"
+	sig "github.com/block27/core/services/dsa/signature"
+)
+
+// approvalsBucket holds the nonce of every approval token spent, with its
+// expiry so spent tokens can be forgotten once they could not count anyway
+const approvalsBucket = "auth.approvals"
+
+// Actions needing a quorum of security officers, each requires
+// quorum.<action> approvals. Export covers private key material leaving
+// the store, public keys are served without one.
+const (
+	ActionExport       = "export"
+	ActionDestroy      = "destroy"
+	ActionRestore      = "restore"
+	ActionRotateMaster = "rotate-master"
+)
+
+// Actions lists every action needing a quorum
+var Actions = []string{ActionExport, ActionDestroy, ActionRestore, ActionRotateMaster}
+
+var (
+	// ErrSpent is returned for approval tokens already counted once
+	ErrSpent = errors.New("approval token was already used")
+
+	// ErrExpired is returned for approval tokens past their expiry
+	ErrExpired = errors.New("approval token has expired")
+)
+
+// Approval is a security officer's consent to one action on one target,
+// signed with their approval key and good until ExpiresAt
+type Approval struct {
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	Operator  string    `json:"operator"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Nonce     []byte    `json:"nonce"`
+	Signature []byte    `json:"signature,omitempty"`
+}
+
+// digest is the SHA256 of the approval without its signature
+func (a Approval) digest() []byte {
+	a.Signature = nil
+
+	data, _ := json.Marshal(a)
+	sum := sha256.Sum256(data)
+
+	return sum[:]
+}
+
+// Approve signs an approval token after checking the officer's PIN
+func (o *operators) Approve(name string, secret []byte, action string, target string, ttl time.Duration) (*Approval, error) {
+	if err := checkAction(action); err != nil {
+		return nil, err
+	}
+
+	if ttl <= 0 {
+		return nil, fmt.Errorf("approval expiry must be positive")
+	}
+
+	op, err := o.Login(name, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if !op.Has(RoleOfficer) {
+		return nil, fmt.Errorf("operator %s is not a %s and cannot approve", name, RoleOfficer)
+	}
+
+	key, err := ecdsa.GetECDSA(o.c, op.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	a := &Approval{
+		Action:    action,
+		Target:    target,
+		Operator:  op.Name,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(ttl),
+		Nonce:     make([]byte, 16),
+	}
+
+	if _, err := rand.Read(a.Nonce); err != nil {
+		return nil, err
+	}
+
+	s, err := key.Sign(a.digest())
+	if err != nil {
+		return nil, err
+	}
+
+	if a.Signature, err = s.SigToDER(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// QuorumAPI collects the approvals of distinct security officers for one
+// action on one target, interactively with their PINs or as signed tokens.
+// Commit spends the tokens once enough approvals are collected.
+type QuorumAPI interface {
+	Required() int
+	Approvers() []string
+	Satisfied() bool
+	Approve(name string, pin []byte) error
+	Token(a *Approval) error
+	Commit() error
+}
+
+type quorum struct {
+	c config.Reader
+	d bbolt.Datastore
+
+	action string
+	target string
+
+	approvers []string
+	tokens    []*Approval
+}
+
+// NewQuorum starts collecting approvals for action on target
+func NewQuorum(c config.Reader, d bbolt.Datastore, action string, target string) (QuorumAPI, error) {
+	if err := checkAction(action); err != nil {
+		return nil, err
+	}
+
+	return &quorum{c: c, d: d, action: action, target: target}, nil
+}
+
+// Required returns the approvals needed, from quorum.<action>
+func (q *quorum) Required() int {
+	return q.c.GetInt("quorum." + strings.Replace(q.action, "-", "_", -1))
+}
+
+// Approvers returns the officers counted so far
+func (q *quorum) Approvers() []string {
+	return q.approvers
+}
+
+// Satisfied reports whether enough officers approved
+func (q *quorum) Satisfied() bool {
+	return len(q.approvers) >= q.Required()
+}
+
+// Approve counts an officer present in this session, checking their PIN
+func (q *quorum) Approve(name string, secret []byte) error {
+	op, err := NewOperators(q.c, q.d).Login(name, secret)
+	if err != nil {
+		return err
+	}
+
+	return q.count(op)
+}
+
+// Token counts a signed approval token, checking its signature, expiry and
+// scope and that it was not spent before
+func (q *quorum) Token(a *Approval) error {
+	if a.Action != q.action || a.Target != q.target {
+		return fmt.Errorf("approval token is for %s of %s, not %s of %s", a.Action, a.Target, q.action, q.target)
+	}
+
+	if time.Now().After(a.ExpiresAt) {
+		return ErrExpired
+	}
+
+	op, err := NewOperators(q.c, q.d).Get(a.Operator)
+	if err != nil {
+		return fmt.Errorf("approval token by %s: %v", a.Operator, err)
+	}
+
+	if err := verifyApproval(q.c, op, a); err != nil {
+		return err
+	}
+
+	spent, err := q.d.Get(approvalsBucket, a.Nonce)
+	if err != nil {
+		return err
+	}
+
+	if spent != nil {
+		return ErrSpent
+	}
+
+	if err := q.count(op); err != nil {
+		return err
+	}
+
+	q.tokens = append(q.tokens, a)
+
+	return nil
+}
+
+// Commit spends the tokens counted, failing unless the quorum is met or a
+// token was spent meanwhile
+func (q *quorum) Commit() error {
+	if !q.Satisfied() {
+		return fmt.Errorf("%s of %s needs %d approvals by distinct %ss, %d given",
+			q.action, q.target, q.Required(), RoleOfficer, len(q.approvers))
+	}
+
+	now := time.Now()
+
+	return q.d.Write(func(tx bbolt.Tx) error {
+		for _, a := range q.tokens {
+			if tx.Get(approvalsBucket, a.Nonce) != nil {
+				return ErrSpent
+			}
+
+			expiry, _ := a.ExpiresAt.MarshalText()
+			if err := tx.Put(approvalsBucket, a.Nonce, expiry); err != nil {
+				return err
+			}
+		}
+
+		var expired [][]byte
+		if err := tx.ForEach(approvalsBucket, func(k, v []byte) error {
+			var t time.Time
+			if t.UnmarshalText(v) == nil && now.After(t) {
+				expired = append(expired, append([]byte{}, k...))
+			}
+
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			if err := tx.Delete(approvalsBucket, k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// count adds an officer, once however many ways they approve
+func (q *quorum) count(op *Operator) error {
+	if !op.Has(RoleOfficer) {
+		return fmt.Errorf("operator %s is not a %s and cannot approve", op.Name, RoleOfficer)
+	}
+
+	for _, name := range q.approvers {
+		if name == op.Name {
+			return fmt.Errorf("operator %s already approved %s of %s", op.Name, q.action, q.target)
+		}
+	}
+
+	q.approvers = append(q.approvers, op.Name)
+
+	return nil
+}
+
+// verifyApproval checks the token signature with the operator's public key,
+// which keeps verifying whatever the key's status; removing the operator
+// is what revokes their tokens
+func verifyApproval(c config.Reader, op *Operator, a *Approval) error {
+	key, err := ecdsa.GetECDSA(c, op.Key)
+	if err != nil {
+		return err
+	}
+
+	pemKey, err := base64.StdEncoding.DecodeString(key.Struct().PublicKeyB64)
+	if err != nil {
+		return err
+	}
+
+	pub, err := enc.ImportPublicKeyfromPEM(pemKey)
+	if err != nil {
+		return err
+	}
+
+	var rs sig.Signature
+	if _, err := asn1.Unmarshal(a.Signature, &rs); err != nil || rs.R == nil || rs.S == nil {
+		return fmt.Errorf("approval token has an invalid signature encoding")
+	}
+
+	if !goecdsa.Verify(pub, a.digest(), rs.R, rs.S) {
+		return fmt.Errorf("approval token does not verify under the key of %s", op.Name)
+	}
+
+	return nil
+}
+
+func checkAction(action string) error {
+	for _, a := range Actions {
+		if a == action {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown action %s, expected one of %v", action, Actions)
+}
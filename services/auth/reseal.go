@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/services/bbolt"
+)
+
+// sealedBuckets hold every record written by seal
+var sealedBuckets = []string{bucket, operatorsBucket, tokensBucket}
+
+// resealedRecord is a sealed record as read by Reseal
+type resealedRecord struct {
+	bucket  string
+	key     []byte
+	version uint64
+	data    []byte
+	raw     []byte
+}
+
+// resealer rewrites the sealed records under the master key
+type resealer struct {
+	d bbolt.Datastore
+
+	records []resealedRecord
+
+	// versions as read and as stored, nil when none were
+	versions versions
+	raw      []byte
+}
+
+// Reseal reads the credentials, operators and tokens under the master key
+// loaded, for crypto.RotateMasterKey to seal under the next one. A record
+// that fails its check is refused, it could never be read again.
+func Reseal(d bbolt.Datastore) (crypto.Resealer, error) {
+	r := &resealer{d: d}
+
+	err := d.Read(func(tx bbolt.Tx) error {
+		vs, found, err := loadVersions(tx)
+		if err != nil {
+			return err
+		}
+
+		if found {
+			r.versions, r.raw = vs, tx.Get(versionsBucket, versionsKey)
+		}
+
+		for _, b := range sealedBuckets {
+			if err := tx.ForEach(b, func(k, v []byte) error {
+				var data json.RawMessage
+				if err := open(tx, b, k, &data); err != nil {
+					return fmt.Errorf("%s %s: %v", b, k, err)
+				}
+
+				var s sealed
+				if err := json.Unmarshal(v, &s); err != nil {
+					return ErrTampered
+				}
+
+				r.records = append(r.records, resealedRecord{
+					bucket:  b,
+					key:     append([]byte{}, k...),
+					version: s.Version,
+					data:    s.Credentials,
+					raw:     append([]byte{}, v...),
+				})
+
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return r, err
+}
+
+// Seal writes every record at the version it was read at, and the versions,
+// with MACs from the master key loaded, in one transaction
+func (r *resealer) Seal() error {
+	return r.d.Write(func(tx bbolt.Tx) error {
+		for _, rec := range r.records {
+			mac, err := crypto.RecordMAC(macInput(rec.bucket, rec.key, rec.version, rec.data))
+			if err != nil {
+				return err
+			}
+
+			raw, err := json.Marshal(sealed{Credentials: rec.data, Version: rec.version, MAC: mac})
+			if err != nil {
+				return err
+			}
+
+			if err := tx.Put(rec.bucket, rec.key, raw); err != nil {
+				return err
+			}
+		}
+
+		if r.raw == nil {
+			return nil
+		}
+
+		return r.versions.save(tx)
+	})
+}
+
+// Restore puts back the records and versions as they were read
+func (r *resealer) Restore() error {
+	return r.d.Write(func(tx bbolt.Tx) error {
+		for _, rec := range r.records {
+			if err := tx.Put(rec.bucket, rec.key, rec.raw); err != nil {
+				return err
+			}
+		}
+
+		if r.raw == nil {
+			return nil
+		}
+
+		return tx.Put(versionsBucket, versionsKey, r.raw)
+	})
+}
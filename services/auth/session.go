@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/services/bbolt"
+)
+
+var (
+	// ErrOperatorRequired is returned for the device PIN once operators are
+	// enrolled
+	ErrOperatorRequired = errors.New("an operator is required once operators are enrolled")
+
+	// ErrNoOperators is returned for an operator before any is enrolled
+	ErrNoOperators = errors.New("no operators are enrolled, authenticate with the device PIN")
+)
+
+// Forbidden is an operator authenticated but lacking the role needed
+type Forbidden struct {
+	Operator *Operator
+	Roles    []string
+}
+
+func (f *Forbidden) Error() string {
+	return fmt.Sprintf("operator %s is a %s, one of %v is needed", f.Operator.Name, f.Operator.Role, f.Roles)
+}
+
+// Authenticate checks the credentials of a session. Until operators are
+// enrolled it is the device PIN and operator must be empty, the operator
+// returned is then nil. After, it is the operator's PIN, and the operator
+// must hold one of roles unless none are given.
+func Authenticate(c config.Reader, d bbolt.Datastore, operator string, pin []byte, roles ...string) (*Operator, error) {
+	ops := NewOperators(c, d)
+
+	enrolled, err := ops.Enrolled()
+	if err != nil {
+		return nil, err
+	}
+
+	if !enrolled {
+		if operator != "" {
+			return nil, ErrNoOperators
+		}
+
+		return nil, NewPin(c, d).Verify(pin)
+	}
+
+	if operator == "" {
+		return nil, ErrOperatorRequired
+	}
+
+	op, err := ops.Login(operator, pin)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(roles) > 0 && !op.Has(roles...) {
+		return op, &Forbidden{Operator: op, Roles: roles}
+	}
+
+	return op, nil
+}
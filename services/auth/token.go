@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/services/bbolt"
+	"github.com/block27/core/services/rest"
+)
+
+// tokensBucket holds one sealed Token per ID
+const tokensBucket = "auth.tokens"
+
+// tokenPrefix starts every token, so they are easy to spot in logs and
+// secret scanners
+const tokenPrefix = "hsm"
+
+var (
+	// ErrNoToken is returned for IDs no token was minted under
+	ErrNoToken = errors.New("no such token")
+
+	// ErrInvalidToken is returned for a token that is malformed, unknown or
+	// whose secret does not match
+	ErrInvalidToken = errors.New("invalid token")
+
+	// ErrTokenExpired is returned for a token past its expiry
+	ErrTokenExpired = errors.New("token expired")
+
+	// ErrTokenRevoked is returned for a revoked token
+	ErrTokenRevoked = errors.New("token revoked")
+)
+
+// Token is an API credential for automation. It allows Operations on Keys,
+// identifiers or aliases, or on any key when Keys is empty. Only a bcrypt
+// hash of its secret is kept.
+type Token struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Keys       []string   `json:"keys"`
+	Operations []string   `json:"operations"`
+	CreatedBy  string     `json:"created_by,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	Secret     []byte     `json:"secret"`
+}
+
+// Active reports whether the token is neither revoked nor expired
+func (t *Token) Active(now time.Time) bool {
+	return t.RevokedAt == nil && now.Before(t.ExpiresAt)
+}
+
+// TokensAPI mints API tokens and authenticates requests bearing them.
+// Tokens are shown once, at Mint, as hsm.<id>.<secret>.
+type TokensAPI interface {
+	Mint(name string, keys []string, operations []string, ttl time.Duration, createdBy string) (*Token, string, error)
+	Get(id string) (*Token, error)
+	List() ([]*Token, error)
+	Revoke(id string) (*Token, error)
+	Authenticate(token string) (*Token, error)
+}
+
+type tokens struct {
+	c config.Reader
+	d bbolt.Datastore
+
+	// verified caches the SHA-256 of secrets that passed bcrypt, so that
+	// only the first request of a token pays for it. Expiry and revocation
+	// are still read on every request.
+	mu       sync.Mutex
+	verified map[string][]byte
+}
+
+// NewTokens returns the TokensAPI over the datastore
+func NewTokens(c config.Reader, d bbolt.Datastore) TokensAPI {
+	return &tokens{c: c, d: d, verified: map[string][]byte{}}
+}
+
+func (t *tokens) Mint(name string, keys []string, operations []string, ttl time.Duration, createdBy string) (*Token, string, error) {
+	if !operatorName.MatchString(name) {
+		return nil, "", fmt.Errorf("invalid token name: %q, usage: [a-z0-9._-]", name)
+	}
+
+	if len(operations) == 0 {
+		return nil, "", errors.New("a token needs at least one operation")
+	}
+
+	for _, o := range operations {
+		if err := checkOperation(o); err != nil {
+			return nil, "", err
+		}
+	}
+
+	max, err := time.ParseDuration(t.c.GetString("auth.token_max_ttl"))
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid auth.token_max_ttl: %v", err)
+	}
+
+	if ttl <= 0 || ttl > max {
+		return nil, "", fmt.Errorf("token lifetime must be positive and at most %s", max)
+	}
+
+	for _, k := range keys {
+		if strings.TrimSpace(k) == "" {
+			return nil, "", errors.New("token keys cannot be empty")
+		}
+	}
+
+	id, secret := make([]byte, 8), make([]byte, 32)
+	if _, err := io.ReadFull(crypto.Reader, id); err != nil {
+		return nil, "", err
+	}
+
+	if _, err := io.ReadFull(crypto.Reader, secret); err != nil {
+		return nil, "", err
+	}
+
+	hash, err := hashPassword([]byte(hex.EncodeToString(secret)))
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now().UTC()
+
+	tok := &Token{
+		ID:         hex.EncodeToString(id),
+		Name:       name,
+		Keys:       keys,
+		Operations: operations,
+		CreatedBy:  createdBy,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(ttl),
+		Secret:     hash,
+	}
+
+	if err := t.d.Write(func(tx bbolt.Tx) error {
+		return seal(tx, tokensBucket, []byte(tok.ID), tok)
+	}); err != nil {
+		return nil, "", err
+	}
+
+	return tok, fmt.Sprintf("%s.%s.%s", tokenPrefix, tok.ID, hex.EncodeToString(secret)), nil
+}
+
+func (t *tokens) Get(id string) (*Token, error) {
+	var tok *Token
+
+	err := t.d.Read(func(tx bbolt.Tx) error {
+		var err error
+		tok, err = getToken(tx, id)
+		return err
+	})
+
+	return tok, err
+}
+
+func (t *tokens) List() ([]*Token, error) {
+	var toks []*Token
+
+	err := t.d.Read(func(tx bbolt.Tx) error {
+		return tx.ForEach(tokensBucket, func(k, v []byte) error {
+			var tok Token
+			if err := open(tx, tokensBucket, k, &tok); err != nil {
+				return err
+			}
+
+			toks = append(toks, &tok)
+
+			return nil
+		})
+	})
+
+	sort.Slice(toks, func(i, j int) bool { return toks[i].CreatedAt.Before(toks[j].CreatedAt) })
+
+	return toks, err
+}
+
+// Revoke ends a token for good, revoking it again is a no-op
+func (t *tokens) Revoke(id string) (*Token, error) {
+	var tok *Token
+
+	err := t.d.Write(func(tx bbolt.Tx) error {
+		var err error
+		if tok, err = getToken(tx, id); err != nil || tok.RevokedAt != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		tok.RevokedAt = &now
+
+		return seal(tx, tokensBucket, []byte(id), tok)
+	})
+
+	return tok, err
+}
+
+func (t *tokens) Authenticate(token string) (*Token, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenPrefix {
+		return nil, ErrInvalidToken
+	}
+
+	id, secret := parts[1], []byte(parts[2])
+
+	tok, err := t.Get(id)
+	if err == ErrNoToken {
+		return nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	if tok.RevokedAt != nil {
+		return nil, ErrTokenRevoked
+	}
+
+	if !tok.Active(time.Now()) {
+		return nil, ErrTokenExpired
+	}
+
+	sum := sha256.Sum256(secret)
+
+	t.mu.Lock()
+	cached := t.verified[id]
+	t.mu.Unlock()
+
+	if cached != nil && subtle.ConstantTimeCompare(cached, sum[:]) == 1 {
+		return tok, nil
+	}
+
+	if err := crypto.CheckPasswordHash(tok.Secret, secret); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	t.mu.Lock()
+	t.verified[id] = sum[:]
+	t.mu.Unlock()
+
+	return tok, nil
+}
+
+// getToken opens the token sealed under id
+func getToken(tx bbolt.Tx, id string) (*Token, error) {
+	if tx.Get(tokensBucket, []byte(id)) == nil {
+		return nil, ErrNoToken
+	}
+
+	var tok Token
+	if err := open(tx, tokensBucket, []byte(id), &tok); err != nil {
+		return nil, err
+	}
+
+	return &tok, nil
+}
+
+// checkOperation refuses anything but an API permission as a token operation
+func checkOperation(o string) error {
+	for _, p := range rest.Permissions {
+		if p == o {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid operation: %q, usage: %v", o, rest.Permissions)
+}
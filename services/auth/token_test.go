@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/block27/core/services/bbolt"
+)
+
+func TestTokens(t *testing.T) {
+	_, c, d, done := newTestOperators(t)
+	defer done()
+
+	tk := NewTokens(c, d)
+
+	// Scopes and lifetimes are checked at minting
+	_, _, err := tk.Mint("ci", nil, nil, time.Hour, "alice")
+	assert.NotNil(t, err)
+	_, _, err = tk.Mint("ci", nil, []string{"sign"}, 0, "alice")
+	assert.NotNil(t, err)
+	_, _, err = tk.Mint("ci", nil, []string{"sign"}, 10*365*24*time.Hour, "alice")
+	assert.NotNil(t, err)
+	_, _, err = tk.Mint("CI runner", nil, []string{"sign"}, time.Hour, "alice")
+	assert.NotNil(t, err)
+	_, _, err = tk.Mint("ci", nil, []string{"sign", "destroy"}, time.Hour, "alice")
+	assert.NotNil(t, err)
+
+	tok, secret, err := tk.Mint("ci", []string{"release"}, []string{"sign", "verify"}, time.Hour, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, strings.HasPrefix(secret, "hsm."+tok.ID+"."))
+	assert.NotContains(t, string(tok.Secret), strings.Split(secret, ".")[2])
+
+	got, err := tk.Authenticate(secret)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "ci", got.Name)
+		assert.Equal(t, []string{"release"}, got.Keys)
+		assert.Equal(t, []string{"sign", "verify"}, got.Operations)
+		assert.Equal(t, "alice", got.CreatedBy)
+	}
+
+	// Once cached, a wrong secret must still fail
+	_, err = tk.Authenticate(secret)
+	assert.Nil(t, err)
+	_, err = tk.Authenticate(secret[:len(secret)-1] + "x")
+	assert.Equal(t, ErrInvalidToken, err)
+	_, err = tk.Authenticate("hsm.0000000000000000." + strings.Split(secret, ".")[2])
+	assert.Equal(t, ErrInvalidToken, err)
+	_, err = tk.Authenticate("garbage")
+	assert.Equal(t, ErrInvalidToken, err)
+
+	toks, err := tk.List()
+	assert.Nil(t, err)
+	assert.Len(t, toks, 1)
+
+	// Revocation applies to the cached secret too
+	revoked, err := tk.Revoke(tok.ID)
+	assert.Nil(t, err)
+	assert.NotNil(t, revoked.RevokedAt)
+	_, err = tk.Authenticate(secret)
+	assert.Equal(t, ErrTokenRevoked, err)
+
+	_, err = tk.Revoke("0000000000000000")
+	assert.Equal(t, ErrNoToken, err)
+
+	// Expired tokens are refused
+	tok, secret, err = tk.Mint("nightly", nil, []string{"read"}, time.Hour, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok.ExpiresAt = time.Now().Add(-time.Minute)
+	assert.Nil(t, d.Write(func(tx bbolt.Tx) error {
+		return seal(tx, tokensBucket, []byte(tok.ID), tok)
+	}))
+
+	_, err = tk.Authenticate(secret)
+	assert.Equal(t, ErrTokenExpired, err)
+
+	// Records cannot be altered without the master key
+	assert.Nil(t, d.Put(tokensBucket, []byte(tok.ID), []byte(`{"credentials":"e30=","mac":"AA=="}`)))
+	_, err = tk.Authenticate(secret)
+	assert.Equal(t, ErrTampered, err)
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/services/bbolt"
+)
+
+// versionsBucket holds the highest version written of every sealed record,
+// under versionsKey and a MAC like the records themselves
+const versionsBucket = "auth.versions"
+
+var versionsKey = []byte("versions")
+
+// ErrReplayed is returned for a sealed record older than the last one
+// written under its key, an earlier copy put back to reset its counters
+var ErrReplayed = errors.New("record is older than the last one written, it was rolled back")
+
+// versions maps bucket and key of every sealed record to the highest version
+// written. Each write of a record raises its version, each delete too so
+// the last copy cannot come back. It is checked in the same transaction as
+// the records, putting back an earlier copy of the whole database together
+// with them goes unnoticed.
+type versions map[string]uint64
+
+func versionID(bucket string, key []byte) string {
+	return bucket + "\x00" + string(key)
+}
+
+// loadVersions reads the versions. None are stored until the first sealed
+// record is written, records found without them were put there by hand.
+func loadVersions(tx bbolt.Tx) (versions, bool, error) {
+	raw := tx.Get(versionsBucket, versionsKey)
+	if raw == nil {
+		return versions{}, false, nil
+	}
+
+	var s sealed
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, false, ErrTampered
+	}
+
+	ok, err := crypto.CheckRecordMAC(macInput(versionsBucket, versionsKey, 0, s.Credentials), s.MAC)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !ok {
+		return nil, false, ErrTampered
+	}
+
+	v := versions{}
+	if err := json.Unmarshal(s.Credentials, &v); err != nil {
+		return nil, false, ErrTampered
+	}
+
+	return v, true, nil
+}
+
+// save writes the versions with a MAC from the master key
+func (v versions) save(tx bbolt.Tx) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	mac, err := crypto.RecordMAC(macInput(versionsBucket, versionsKey, 0, data))
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(sealed{Credentials: data, MAC: mac})
+	if err != nil {
+		return err
+	}
+
+	return tx.Put(versionsBucket, versionsKey, raw)
+}
+
+// check refuses a record older than the last one written under its key
+func (v versions) check(found bool, bucket string, key []byte, version uint64) error {
+	if !found || version < v[versionID(bucket, key)] {
+		return ErrReplayed
+	}
+
+	return nil
+}
+
+// drop deletes a sealed record and raises its version, so the copy deleted
+// is refused if it is put back
+func drop(tx bbolt.Tx, bucket string, key []byte) error {
+	v, _, err := loadVersions(tx)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Delete(bucket, key); err != nil {
+		return err
+	}
+
+	v[versionID(bucket, key)]++
+
+	return v.save(tx)
+}
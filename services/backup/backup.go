@@ -0,0 +1,369 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	goecdsa "crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/services/bbolt"
+	"github.com/block27/core/services/dsa/ecdsa"
+	enc "github.com/block27/core/services/dsa/ecdsa/encodings"
+	sig "github.com/block27/core/services/dsa/signature"
+	"github.com/block27/core/services/keystore"
+)
+
+// Version of the archive layout written by Create
+const Version = 1
+
+// magic starts every archive, followed by the MasterKeyID of the device that
+// sealed it on a line of its own and the sealed tar
+const magic = "block27-backup/2\n"
+
+// Members of the sealed tar
+const (
+	manifestFile  = "manifest.json"
+	signatureFile = "manifest.sig"
+	keysFile      = "keys.json"
+	databaseFile  = "botldb"
+	configFile    = "config.yaml"
+)
+
+// Manifest describes an archive. It is signed by a key of the device that
+// wrote it and lists the SHA256 of every other member.
+type Manifest struct {
+	Version   int               `json:"version"`
+	CreatedAt time.Time         `json:"created_at"`
+	Serial    string            `json:"serial"`
+	Backend   string            `json:"backend"`
+	MasterKey string            `json:"master_key"`
+	Keys      []Key             `json:"keys"`
+	Files     map[string]string `json:"files"`
+	Signer    Signer            `json:"signer"`
+}
+
+// Key is the manifest entry of one key record
+type Key struct {
+	GID            string `json:"gid"`
+	Name           string `json:"name"`
+	Status         string `json:"status"`
+	FingerprintSHA string `json:"fingerprint_sha"`
+	FingerprintMD5 string `json:"fingerprint_md5"`
+}
+
+// Signer identifies the key the manifest is signed with
+type Signer struct {
+	GID            string `json:"gid"`
+	Name           string `json:"name"`
+	FingerprintSHA string `json:"fingerprint_sha"`
+	PublicKeyB64   string `json:"public_key"`
+}
+
+// Archive is an opened backup, its manifest signature and member digests
+// already checked
+type Archive struct {
+	Manifest Manifest
+
+	records  []ecdsa.Record
+	database []byte
+	config   []byte
+}
+
+// MasterKeyError is returned by Open for an archive sealed under another
+// master key than the device's
+type MasterKeyError struct {
+	Archive string
+	Device  string
+}
+
+func (e *MasterKeyError) Error() string {
+	return fmt.Sprintf("archive sealed under master key %s, this device holds %s: the archive and the "+
+		"key records in it only open on a device provisioned with the master key of the device that "+
+		"wrote it, transfer that master key to this device first", e.Archive, e.Device)
+}
+
+// Create writes an archive of every key record, a snapshot of the database
+// and the config file to w, sealed under the backup key derived from the
+// hardware master key. The manifest is signed with signer.
+//
+// Key records stay wrapped and sealed under the master key, so an archive
+// restores on the device that wrote it or on a new device provisioned with
+// the same master key, which the archive names by its MasterKeyID.
+func Create(c config.Reader, d bbolt.Datastore, signer ecdsa.KeyAPI, w io.Writer) (*Manifest, error) {
+	id, err := crypto.MasterKeyID()
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := ecdsa.ExportRecords(c)
+	if err != nil {
+		return nil, err
+	}
+
+	m := Manifest{
+		Version:   Version,
+		CreatedAt: time.Now().UTC(),
+		Serial:    c.GetString("serial_number"),
+		Backend:   keystore.Backend(c),
+		MasterKey: id,
+		Files:     map[string]string{},
+		Signer: Signer{
+			GID:            signer.FilePointer(),
+			Name:           signer.Struct().Name,
+			FingerprintSHA: signer.Struct().FingerprintSHA,
+			PublicKeyB64:   signer.Struct().PublicKeyB64,
+		},
+	}
+
+	for _, r := range records {
+		k, err := ecdsa.ParseRecord(r)
+		if err != nil {
+			return nil, err
+		}
+
+		m.Keys = append(m.Keys, Key{
+			GID:            r.GID,
+			Name:           k.Struct().Name,
+			Status:         k.Struct().Status,
+			FingerprintSHA: k.Struct().FingerprintSHA,
+			FingerprintMD5: k.Struct().FingerprintMD5,
+		})
+	}
+
+	members := map[string][]byte{}
+
+	if members[keysFile], err = json.Marshal(records); err != nil {
+		return nil, err
+	}
+
+	var db bytes.Buffer
+	if err := d.Snapshot(&db); err != nil {
+		return nil, err
+	}
+
+	members[databaseFile] = db.Bytes()
+
+	if members[configFile], err = ioutil.ReadFile(configPath(c)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for name, data := range members {
+		m.Files[name] = digest(data)
+	}
+
+	if members[manifestFile], err = json.MarshalIndent(m, "", "  "); err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(members[manifestFile])
+
+	s, err := signer.Sign(hash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	if members[signatureFile], err = s.SigToDER(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	names := make([]string, 0, len(members))
+	for name := range members {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(members[name])),
+			ModTime: m.CreatedAt,
+		}); err != nil {
+			return nil, err
+		}
+
+		if _, err := tw.Write(members[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	sealed, err := crypto.SealBackup(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.WriteString(w, magic+id+"\n"); err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(sealed); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// Open decrypts an archive and checks it: that this device holds the master
+// key it was sealed under, the manifest signature, the digest of every
+// member and, unless empty, that the manifest was signed by the key with the
+// SHA256 fingerprint pin.
+func Open(r io.Reader, pin string) (*Archive, error) {
+	device, err := crypto.MasterKeyID()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(data, []byte(magic)) {
+		return nil, fmt.Errorf("not a backup archive")
+	}
+
+	line := bytes.SplitN(data[len(magic):], []byte("\n"), 2)
+	if len(line) != 2 {
+		return nil, fmt.Errorf("truncated backup archive")
+	}
+
+	if id := string(line[0]); id != device {
+		return nil, &MasterKeyError{Archive: id, Device: device}
+	}
+
+	plain, err := crypto.OpenBackup(line[1])
+	if err != nil {
+		return nil, fmt.Errorf("archive cannot be decrypted, altered or sealed under another master key: %v", err)
+	}
+
+	members := map[string][]byte{}
+
+	tr := tar.NewReader(bytes.NewReader(plain))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if members[hdr.Name], err = ioutil.ReadAll(tr); err != nil {
+			return nil, err
+		}
+	}
+
+	var a Archive
+	if err := json.Unmarshal(members[manifestFile], &a.Manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+
+	if a.Manifest.Version != Version {
+		return nil, fmt.Errorf("unsupported archive version %d", a.Manifest.Version)
+	}
+
+	if a.Manifest.MasterKey != "" && a.Manifest.MasterKey != device {
+		return nil, &MasterKeyError{Archive: a.Manifest.MasterKey, Device: device}
+	}
+
+	if err := verifySignature(a.Manifest.Signer, members[manifestFile], members[signatureFile], pin); err != nil {
+		return nil, err
+	}
+
+	for _, name := range []string{keysFile, databaseFile, configFile} {
+		want, ok := a.Manifest.Files[name]
+		if !ok {
+			return nil, fmt.Errorf("manifest does not list %s", name)
+		}
+
+		if digest(members[name]) != want {
+			return nil, fmt.Errorf("%s does not match the manifest", name)
+		}
+	}
+
+	if err := json.Unmarshal(members[keysFile], &a.records); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", keysFile, err)
+	}
+
+	if len(a.records) != len(a.Manifest.Keys) {
+		return nil, fmt.Errorf("manifest lists %d keys, archive holds %d", len(a.Manifest.Keys), len(a.records))
+	}
+
+	for i, r := range a.records {
+		k, err := ecdsa.ParseRecord(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if k.Struct().FingerprintSHA != a.Manifest.Keys[i].FingerprintSHA {
+			return nil, fmt.Errorf("key %s does not match the manifest", r.GID)
+		}
+	}
+
+	a.database = members[databaseFile]
+	a.config = members[configFile]
+
+	return &a, nil
+}
+
+func verifySignature(s Signer, manifest []byte, der []byte, pin string) error {
+	pemKey, err := base64.StdEncoding.DecodeString(s.PublicKeyB64)
+	if err != nil {
+		return err
+	}
+
+	pub, err := enc.ImportPublicKeyfromPEM(pemKey)
+	if err != nil {
+		return err
+	}
+
+	if fp := enc.FingerprintSHA256(pub); fp != s.FingerprintSHA {
+		return fmt.Errorf("signer public key does not match fingerprint %s", s.FingerprintSHA)
+	}
+
+	if pin != "" && pin != s.FingerprintSHA {
+		return fmt.Errorf("manifest signed by %s, expected %s", s.FingerprintSHA, pin)
+	}
+
+	var rs sig.Signature
+	if _, err := asn1.Unmarshal(der, &rs); err != nil || rs.R == nil || rs.S == nil {
+		return fmt.Errorf("invalid manifest signature")
+	}
+
+	hash := sha256.Sum256(manifest)
+	if !goecdsa.Verify(pub, hash[:], rs.R, rs.S) {
+		return fmt.Errorf("manifest signature does not verify")
+	}
+
+	return nil
+}
+
+func configPath(c config.Reader) string {
+	return fmt.Sprintf("%s/config.yaml", c.GetString("paths.base"))
+}
+
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,307 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/services/bbolt"
+	api "github.com/block27/core/services/dsa"
+	"github.com/block27/core/services/dsa/ecdsa"
+	"github.com/block27/core/services/keystore"
+	"github.com/block27/core/test"
+)
+
+var Config config.Reader
+
+func init() {
+	os.Setenv("ENVIRONMENT", "test")
+
+	c, err := config.LoadConfig(config.Defaults)
+	if err != nil {
+		panic(err)
+	}
+
+	if c.GetString("environment") != "test" {
+		panic(fmt.Errorf("test [environment] is not in [test] mode"))
+	}
+
+	// Stands in for HardwareAuthenticate, which needs the device attached
+	if err := crypto.LoadMasterKey([]byte(test.MasterKey), []byte(test.MasterIv)); err != nil {
+		panic(err)
+	}
+
+	Config = c
+}
+
+// deviceReader stands in for a device of its own, an fs keystore and
+// config file under base
+type deviceReader struct {
+	config.Reader
+	base string
+}
+
+func (d deviceReader) GetString(key string) string {
+	switch key {
+	case "keystore.backend":
+		return keystore.FS
+	case "paths.base":
+		return d.base
+	case "paths.keys":
+		return filepath.Join(d.base, "keys")
+	}
+
+	return d.Reader.GetString(key)
+}
+
+func newDevice(t *testing.T) (deviceReader, bbolt.Datastore, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := bbolt.NewDB(filepath.Join(dir, "botldb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return deviceReader{Reader: Config, base: dir}, d, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func uniqueName(base string) string {
+	return fmt.Sprintf("%s-%s", base, api.GenerateUUID().String()[:8])
+}
+
+func TestBackupRestore(t *testing.T) {
+	src, srcDB, done := newDevice(t)
+	defer done()
+
+	signer, err := ecdsa.NewECDSA(src, uniqueName("backup-signer"), "prime256v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := ecdsa.NewECDSA(src, uniqueName("backup-key"), "secp384r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := srcDB.Put("aliases", []byte("release"), []byte(k.FilePointer())); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := srcDB.NextSequence("tsa.serials"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(src.base, "config.yaml"), []byte("signature:\n  mode: openssl\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	m, err := Create(src, srcDB, signer, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 2, len(m.Keys))
+	assert.NotContains(t, buf.String(), k.Struct().PublicKeyB64)
+
+	// The manifest is pinned to its signer, and the archive to its bytes
+	_, err = Open(bytes.NewReader(buf.Bytes()), k.Struct().FingerprintSHA)
+	assert.NotNil(t, err)
+
+	tampered := append([]byte{}, buf.Bytes()...)
+	tampered[len(tampered)-1] ^= 0xff
+	_, err = Open(bytes.NewReader(tampered), "")
+	assert.NotNil(t, err)
+
+	a, err := Open(bytes.NewReader(buf.Bytes()), signer.Struct().FingerprintSHA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, signer.FilePointer(), a.Manifest.Signer.GID)
+
+	dst, dstDB, done := newDevice(t)
+	defer done()
+
+	// A different key already holding a backed up name can never be replaced
+	clash, err := ecdsa.NewECDSA(dst, k.Struct().Name, "prime256v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := a.Plan(dst, dstDB, PolicyOverwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 1, len(p.Conflicts()))
+	assert.Equal(t, k.FilePointer(), p.Conflicts()[0].Name)
+	assert.NotNil(t, p.Apply(dst, dstDB))
+
+	if err := ecdsa.DeleteECDSA(dst, clash.FilePointer()); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err = a.Plan(dst, dstDB, PolicyFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Empty(t, p.Conflicts())
+	assert.Equal(t, 4, p.Count(ActionCreate))
+
+	if err := p.Apply(dst, dstDB); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ecdsa.ResolveECDSA(dst, k.Struct().Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := got.Sign([]byte("restored"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, k.Verify([]byte("restored"), s))
+
+	alias, _ := dstDB.Get("aliases", []byte("release"))
+	assert.Equal(t, k.FilePointer(), string(alias))
+
+	seq, err := dstDB.NextSequence("tsa.serials")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), seq)
+
+	cfg, _ := ioutil.ReadFile(filepath.Join(dst.base, "config.yaml"))
+	assert.Equal(t, "signature:\n  mode: openssl\n", string(cfg))
+
+	// Restoring again changes nothing
+	p, err = a.Plan(dst, dstDB, PolicyFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, len(p.Changes), p.Count(ActionUnchanged))
+
+	// A key changed since the backup conflicts, unless the policy resolves it
+	if err := got.Label(dst, []string{"changed"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for policy, action := range map[string]string{
+		PolicyFail:      ActionConflict,
+		PolicySkip:      ActionSkip,
+		PolicyOverwrite: ActionReplace,
+	} {
+		p, err := a.Plan(dst, dstDB, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, 1, p.Count(action), policy)
+	}
+
+	p, err = a.Plan(dst, dstDB, PolicyOverwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Apply(dst, dstDB); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = ecdsa.GetECDSA(dst, k.FilePointer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Empty(t, got.Struct().Labels)
+
+	_, err = a.Plan(dst, dstDB, "merge")
+	assert.NotNil(t, err)
+}
+
+func TestRestoreAllOrNothing(t *testing.T) {
+	src, srcDB, done := newDevice(t)
+	defer done()
+
+	signer, err := ecdsa.NewECDSA(src, uniqueName("backup-signer"), "prime256v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(src.base, "config.yaml"), []byte("signature:\n  mode: openssl\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := Create(src, srcDB, signer, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := Open(bytes.NewReader(buf.Bytes()), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, dstDB, done := newDevice(t)
+	defer done()
+
+	p, err := a.Plan(dst, dstDB, PolicyFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The database transaction fails after the key records are written
+	dstDB.Close()
+	assert.NotNil(t, p.Apply(dst, dstDB))
+
+	_, err = ecdsa.GetECDSA(dst, signer.FilePointer())
+	assert.NotNil(t, err)
+
+	_, err = os.Stat(filepath.Join(dst.base, "config.yaml"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestOpenOtherMasterKey(t *testing.T) {
+	src, srcDB, done := newDevice(t)
+	defer done()
+
+	signer, err := ecdsa.NewECDSA(src, uniqueName("backup-signer"), "prime256v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := Create(src, srcDB, signer, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new device not yet given the master key of the one that wrote it
+	defer crypto.LoadMasterKey([]byte(test.MasterKey), []byte(test.MasterIv))
+
+	if err := crypto.LoadMasterKey([]byte("vzbd4jw3w5m7p2cq8t4xn6rk9ys5hb2e"), []byte(test.MasterIv)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Open(bytes.NewReader(buf.Bytes()), "")
+	_, ok := err.(*MasterKeyError)
+	assert.True(t, ok, "%v", err)
+}
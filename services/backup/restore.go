@@ -0,0 +1,388 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/services/bbolt"
+	"github.com/block27/core/services/dsa/ecdsa"
+)
+
+// Conflict policies, for items that differ between the archive and the
+// device
+const (
+	// PolicyFail refuses to restore anything while a conflict remains
+	PolicyFail = "fail"
+
+	// PolicySkip keeps the device's version
+	PolicySkip = "skip"
+
+	// PolicyOverwrite replaces the device's version with the archive's. A key
+	// whose name or slug belongs to a different key on the device is still a
+	// conflict, it would have to replace another key.
+	PolicyOverwrite = "overwrite"
+)
+
+// Actions planned for each item of an archive
+const (
+	ActionCreate    = "create"
+	ActionUnchanged = "unchanged"
+	ActionReplace   = "replace"
+	ActionSkip      = "skip"
+	ActionConflict  = "conflict"
+)
+
+// Kinds of item restored
+const (
+	ItemKey      = "key"
+	ItemDatabase = "db"
+	ItemConfig   = "config"
+)
+
+// Change is what a restore does to a single item
+type Change struct {
+	Item   string
+	Name   string
+	Action string
+	Detail string
+
+	// database entry the change writes
+	bucket string
+	key    string
+}
+
+// Plan lists every change a restore makes, worked out before anything is
+// written so it can be previewed with --dry-run
+type Plan struct {
+	Policy  string
+	Changes []Change
+
+	archive   *Archive
+	entries   map[string]map[string][]byte
+	sequences map[string]uint64
+}
+
+// Conflicts returns the changes that block Apply
+func (p *Plan) Conflicts() []Change {
+	var conflicts []Change
+
+	for _, ch := range p.Changes {
+		if ch.Action == ActionConflict {
+			conflicts = append(conflicts, ch)
+		}
+	}
+
+	return conflicts
+}
+
+// Count returns the number of changes with the given action
+func (p *Plan) Count(action string) int {
+	n := 0
+
+	for _, ch := range p.Changes {
+		if ch.Action == action {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Plan works out what restoring the archive on this device would change.
+// Key records, the database entries of the buckets it restores and the
+// config file are compared with the device's, conflicts resolved by policy.
+func (a *Archive) Plan(c config.Reader, d bbolt.Datastore, policy string) (*Plan, error) {
+	switch policy {
+	case PolicyFail, PolicySkip, PolicyOverwrite:
+	default:
+		return nil, fmt.Errorf("invalid conflict policy: %s, usage: [%s, %s, %s]",
+			policy, PolicyFail, PolicySkip, PolicyOverwrite)
+	}
+
+	p := &Plan{
+		Policy:    policy,
+		archive:   a,
+		entries:   map[string]map[string][]byte{},
+		sequences: map[string]uint64{},
+	}
+
+	for _, r := range a.records {
+		outcome, detail, err := ecdsa.PlanRestore(c, r)
+		if err != nil {
+			return nil, err
+		}
+
+		action := ActionCreate
+		switch outcome {
+		case ecdsa.RestoreUnchanged:
+			action = ActionUnchanged
+		case ecdsa.RestoreReplace:
+			action = p.resolve(false)
+		case ecdsa.RestoreTaken:
+			action = p.resolve(true)
+		}
+
+		p.Changes = append(p.Changes, Change{Item: ItemKey, Name: r.GID, Action: action, Detail: detail})
+	}
+
+	if err := p.planDatabase(d); err != nil {
+		return nil, err
+	}
+
+	if len(a.config) != 0 {
+		current, err := ioutil.ReadFile(configPath(c))
+
+		action := ActionCreate
+		switch {
+		case err == nil && bytes.Equal(current, a.config):
+			action = ActionUnchanged
+		case err == nil:
+			action = p.resolve(false)
+		case !os.IsNotExist(err):
+			return nil, err
+		}
+
+		p.Changes = append(p.Changes, Change{Item: ItemConfig, Name: configPath(c), Action: action})
+	}
+
+	return p, nil
+}
+
+// resolve applies the policy to an item that differs from the device's.
+// taken items cannot be overwritten.
+func (p *Plan) resolve(taken bool) string {
+	switch {
+	case p.Policy == PolicySkip:
+		return ActionSkip
+	case p.Policy == PolicyOverwrite && !taken:
+		return ActionReplace
+	default:
+		return ActionConflict
+	}
+}
+
+// planDatabase compares the entries of the snapshot with the device's
+// database, in every bucket it restores
+func (p *Plan) planDatabase(d bbolt.Datastore) error {
+	dir, err := ioutil.TempDir("", "restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, databaseFile)
+	if err := ioutil.WriteFile(path, p.archive.database, 0600); err != nil {
+		return err
+	}
+
+	snap, err := bbolt.NewDB(path)
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	if err := snap.Read(func(tx bbolt.Tx) error {
+		for _, bucket := range tx.Buckets() {
+			if !restored(bucket) {
+				continue
+			}
+
+			p.sequences[bucket] = tx.Sequence(bucket)
+
+			if err := tx.ForEach(bucket, func(k, v []byte) error {
+				if p.entries[bucket] == nil {
+					p.entries[bucket] = map[string][]byte{}
+				}
+
+				p.entries[bucket][string(k)] = append([]byte{}, v...)
+
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return d.Read(func(tx bbolt.Tx) error {
+		buckets := make([]string, 0, len(p.entries))
+		for bucket := range p.entries {
+			buckets = append(buckets, bucket)
+		}
+
+		sort.Strings(buckets)
+
+		for _, bucket := range buckets {
+			entries := p.entries[bucket]
+
+			for _, k := range sortedKeys(entries) {
+				v := entries[k]
+				action := ActionCreate
+
+				if current := tx.Get(bucket, []byte(k)); current != nil {
+					if bytes.Equal(current, v) {
+						action = ActionUnchanged
+					} else {
+						action = p.resolve(false)
+					}
+				}
+
+				p.Changes = append(p.Changes, Change{
+					Item:   ItemDatabase,
+					Name:   fmt.Sprintf("%s/%s", bucket, printable(k)),
+					Action: action,
+					bucket: bucket,
+					key:    k,
+				})
+			}
+		}
+
+		return nil
+	})
+}
+
+// Apply makes the changes of a plan without conflicts, all of them or none.
+// Database entries are written in a single transaction, bucket sequences
+// raised to at least the archive's so restored serial numbers are never
+// handed out again. The config file is staged beforehand and renamed into
+// place within that transaction, and the key records written ahead of it
+// are put back should it fail.
+func (p *Plan) Apply(c config.Reader, d bbolt.Datastore) error {
+	if conflicts := p.Conflicts(); len(conflicts) != 0 {
+		return fmt.Errorf("%d conflicts, resolve them or restore with another policy", len(conflicts))
+	}
+
+	writes := func(ch Change) bool {
+		return ch.Action == ActionCreate || ch.Action == ActionReplace
+	}
+
+	records := map[string]ecdsa.Record{}
+	for _, r := range p.archive.records {
+		records[r.GID] = r
+	}
+
+	var keys []ecdsa.Record
+	var cfg string
+
+	for _, ch := range p.Changes {
+		switch {
+		case ch.Item == ItemKey && writes(ch):
+			keys = append(keys, records[ch.Name])
+		case ch.Item == ItemConfig && writes(ch):
+			cfg = ch.Name
+		}
+	}
+
+	// The previous config is put back should the transaction fail to commit
+	// once the staged one is renamed
+	staged, renamed := cfg+".restore", false
+	var previous []byte
+
+	if cfg != "" {
+		var err error
+		if previous, err = ioutil.ReadFile(cfg); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if err := ioutil.WriteFile(staged, p.archive.config, 0644); err != nil {
+			return err
+		}
+		defer os.Remove(staged)
+	}
+
+	undo, err := ecdsa.RestoreRecords(c, keys)
+	if err != nil {
+		return err
+	}
+
+	if err := d.Write(func(tx bbolt.Tx) error {
+		for bucket, seq := range p.sequences {
+			if seq > tx.Sequence(bucket) {
+				if err := tx.SetSequence(bucket, seq); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, ch := range p.Changes {
+			if ch.Item != ItemDatabase || !writes(ch) {
+				continue
+			}
+
+			if err := tx.Put(ch.bucket, []byte(ch.key), p.entries[ch.bucket][ch.key]); err != nil {
+				return err
+			}
+		}
+
+		if cfg != "" {
+			if err := os.Rename(staged, cfg); err != nil {
+				return err
+			}
+
+			renamed = true
+		}
+
+		return nil
+	}); err != nil {
+		if renamed && previous != nil {
+			ioutil.WriteFile(cfg, previous, 0644)
+		} else if renamed {
+			os.Remove(cfg)
+		}
+
+		if uerr := undo(); uerr != nil {
+			return fmt.Errorf("%v, and the key records could not be put back: %v", err, uerr)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// restored reports whether a database bucket is restored. Keys are restored
+// from their records whatever the backend. The audit log must only ever be
+// appended to and the PIN retry counters never wound back, both stay as
+// they are on the device.
+func restored(bucket string) bool {
+	for _, prefix := range []string{"keys.", "audit", "auth"} {
+		if strings.HasPrefix(bucket, prefix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// printable shows binary keys, such as sequence numbers, in hex
+func printable(k string) string {
+	for _, r := range k {
+		if !unicode.IsPrint(r) {
+			return hex.EncodeToString([]byte(k))
+		}
+	}
+
+	return k
+}
+
+func sortedKeys(m map[string][]byte) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
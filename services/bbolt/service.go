@@ -1,7 +1,12 @@
 package bbolt
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"time"
 
 	bbolt "go.etcd.io/bbolt"
 )
@@ -10,22 +15,81 @@ const (
 	keysDB = "keys"
 )
 
+// openTimeout bounds the wait for the file lock another process holds
+var openTimeout = 5 * time.Second
+
 // Datastore ...
 type Datastore interface {
 	AllKeys() ([][]byte, error)
 	GetVal([]byte) ([]byte, error)
 	InsertKey([]byte, []byte) error
+
+	Get(string, []byte) ([]byte, error)
+	Put(string, []byte, []byte) error
+	NextSequence(string) (uint64, error)
+	ForEach(string, func([]byte, []byte) error) error
+
+	Read(func(Tx) error) error
+	Write(func(Tx) error) error
+	Snapshot(io.Writer) error
+
 	Close() error
 }
 
+// Tx is a bucket-addressed view of a single transaction, see Read and Write
+type Tx interface {
+	Get(bucket string, key []byte) []byte
+	Put(bucket string, key []byte, val []byte) error
+	Delete(bucket string, key []byte) error
+	ForEach(bucket string, fn func([]byte, []byte) error) error
+	ForEachPrefix(bucket string, prefix []byte, fn func([]byte, []byte) error) error
+	DeleteBucket(bucket string) error
+	Buckets() []string
+	Sequence(bucket string) uint64
+	SetSequence(bucket string, n uint64) error
+}
+
 // db ...
 type db struct {
 	*bbolt.DB
+
+	path string
+	refs int
 }
 
-// NewDB - build a new connection to BBolt
+// tx ...
+type tx struct {
+	*bbolt.Tx
+}
+
+var (
+	// bbolt holds an exclusive lock on the file, so a second Open from the same
+	// process would block forever. Handles are shared per path instead.
+	openMu sync.Mutex
+	opened = map[string]*db{}
+)
+
+// NewDB - build a new connection to BBolt, or share the one already open on
+// the same file. Every NewDB must be matched by a Close.
 func NewDB(path string) (Datastore, error) {
-	bDb, err := bbolt.Open(path, 0666, nil)
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return (*db)(nil), err
+	}
+
+	openMu.Lock()
+	defer openMu.Unlock()
+
+	if d, ok := opened[abs]; ok {
+		d.refs++
+		return d, nil
+	}
+
+	bDb, err := bbolt.Open(abs, 0666, &bbolt.Options{Timeout: openTimeout})
+	if err == bbolt.ErrTimeout {
+		return (*db)(nil), fmt.Errorf("datastore %s is locked by another process, is hsmd running?", abs)
+	}
+
 	if err != nil {
 		return (*db)(nil), err
 	}
@@ -38,10 +102,14 @@ func NewDB(path string) (Datastore, error) {
 
 		return nil
 	}); err != nil {
+		bDb.Close()
 		return (*db)(nil), err
 	}
 
-	return &db{DB: bDb}, nil
+	d := &db{DB: bDb, path: abs, refs: 1}
+	opened[abs] = d
+
+	return d, nil
 }
 
 // AllKeys - returns a byte slice of all keys
@@ -90,7 +158,211 @@ func (db *db) InsertKey(key []byte, val []byte) error {
 	return nil
 }
 
-// Close - return a deferable function for closing the db
+// Get - return a value for a given key in the named bucket, nil when either
+// the bucket or the key does not exist
+func (db *db) Get(bucket string, key []byte) ([]byte, error) {
+	var value []byte
+
+	if err := db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		// Values are only valid for the life of the tx, copy them out
+		if v := b.Get(key); v != nil {
+			value = append([]byte{}, v...)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// Put - insert a key/value pair into the named bucket, creating the bucket if
+// it does not exist yet
+func (db *db) Put(bucket string, key []byte, val []byte) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+
+		return b.Put(key, val)
+	})
+}
+
+// NextSequence - returns a persistent, monotonically increasing integer for
+// the named bucket, used for serial numbers
+func (db *db) NextSequence(bucket string) (uint64, error) {
+	var seq uint64
+
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+
+		seq, err = b.NextSequence()
+
+		return err
+	}); err != nil {
+		return 0, err
+	}
+
+	return seq, nil
+}
+
+// ForEach - calls fn for every key/value pair of the named bucket in key
+// order, a missing bucket is treated as empty. Slices passed to fn are only
+// valid during the call.
+func (db *db) ForEach(bucket string, fn func([]byte, []byte) error) error {
+	return db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(fn)
+	})
+}
+
+// Read - runs fn in a read-only transaction
+func (db *db) Read(fn func(Tx) error) error {
+	return db.View(func(t *bbolt.Tx) error {
+		return fn(&tx{t})
+	})
+}
+
+// Write - runs fn in a read-write transaction, committed only if fn returns
+// nil, so either every change made through the Tx lands or none does
+func (db *db) Write(fn func(Tx) error) error {
+	return db.Update(func(t *bbolt.Tx) error {
+		return fn(&tx{t})
+	})
+}
+
+// Snapshot - writes a consistent copy of the whole database to w, taken in a
+// read transaction so writers are not blocked while it runs
+func (db *db) Snapshot(w io.Writer) error {
+	return db.View(func(t *bbolt.Tx) error {
+		_, err := t.WriteTo(w)
+		return err
+	})
+}
+
+// Close - release this handle, the file is closed with the last one
 func (db *db) Close() error {
+	openMu.Lock()
+	defer openMu.Unlock()
+
+	if db.refs--; db.refs > 0 {
+		return nil
+	}
+
+	delete(opened, db.path)
+
 	return db.DB.Close()
 }
+
+// Get - value of key in bucket, copied so it outlives the transaction. Nil
+// when either does not exist.
+func (t *tx) Get(bucket string, key []byte) []byte {
+	b := t.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+
+	if v := b.Get(key); v != nil {
+		return append([]byte{}, v...)
+	}
+
+	return nil
+}
+
+// Put - insert a key/value pair, creating the bucket if needed
+func (t *tx) Put(bucket string, key []byte, val []byte) error {
+	b, err := t.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return fmt.Errorf("create bucket: %s", err)
+	}
+
+	return b.Put(key, val)
+}
+
+// Delete - remove a key, missing buckets and keys are not an error
+func (t *tx) Delete(bucket string, key []byte) error {
+	b := t.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+
+	return b.Delete(key)
+}
+
+// ForEach - like Datastore.ForEach within the transaction
+func (t *tx) ForEach(bucket string, fn func([]byte, []byte) error) error {
+	return t.ForEachPrefix(bucket, nil, fn)
+}
+
+// ForEachPrefix - calls fn for every pair whose key starts with prefix, in
+// key order. fn must not modify the bucket being iterated.
+func (t *tx) ForEachPrefix(bucket string, prefix []byte, fn func([]byte, []byte) error) error {
+	b := t.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteBucket - drop a bucket and everything in it, missing is not an error
+func (t *tx) DeleteBucket(bucket string) error {
+	if err := t.Tx.DeleteBucket([]byte(bucket)); err != nil && err != bbolt.ErrBucketNotFound {
+		return err
+	}
+
+	return nil
+}
+
+// Buckets - names of every bucket, in order
+func (t *tx) Buckets() []string {
+	var names []string
+
+	t.Tx.ForEach(func(name []byte, _ *bbolt.Bucket) error {
+		names = append(names, string(name))
+		return nil
+	})
+
+	return names
+}
+
+// Sequence - current NextSequence value of a bucket, 0 when missing
+func (t *tx) Sequence(bucket string) uint64 {
+	b := t.Bucket([]byte(bucket))
+	if b == nil {
+		return 0
+	}
+
+	return b.Sequence()
+}
+
+// SetSequence - set the NextSequence value of a bucket, creating it if needed
+func (t *tx) SetSequence(bucket string, n uint64) error {
+	b, err := t.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return fmt.Errorf("create bucket: %s", err)
+	}
+
+	return b.SetSequence(n)
+}
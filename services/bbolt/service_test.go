@@ -1 +1,276 @@
 package bbolt
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bbolt "go.etcd.io/bbolt"
+)
+
+func newTestDB(t *testing.T) (Datastore, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "bbolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestInsertKey(t *testing.T) {
+	d, done := newTestDB(t)
+	defer done()
+
+	if err := d.InsertKey([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := d.GetVal([]byte("k"))
+	if err != nil || string(v) != "v" {
+		t.Fatal("failed to read back inserted key")
+	}
+
+	keys, _ := d.AllKeys()
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 key, got %d", len(keys))
+	}
+}
+
+func TestPutGet(t *testing.T) {
+	d, done := newTestDB(t)
+	defer done()
+
+	// Missing bucket reads as empty rather than failing
+	v, err := d.Get("missing", []byte("k"))
+	if err != nil || v != nil {
+		t.Fatal("missing bucket should return nil")
+	}
+
+	if err := d.Put("other", []byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err = d.Get("other", []byte("k"))
+	if err != nil || string(v) != "v" {
+		t.Fatal("failed to read back put value")
+	}
+}
+
+func TestNextSequence(t *testing.T) {
+	d, done := newTestDB(t)
+	defer done()
+
+	for i := uint64(1); i <= 3; i++ {
+		seq, err := d.NextSequence("serials")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if seq != i {
+			t.Fatalf("expected sequence %d, got %d", i, seq)
+		}
+	}
+}
+
+func TestForEach(t *testing.T) {
+	d, done := newTestDB(t)
+	defer done()
+
+	// Missing bucket iterates nothing
+	if err := d.ForEach("missing", func(k, v []byte) error {
+		t.Fatal("unexpected pair")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"b", "a", "c"} {
+		if err := d.Put("letters", []byte(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var seen string
+	if err := d.ForEach("letters", func(k, v []byte) error {
+		seen += string(k)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if seen != "abc" {
+		t.Fatalf("expected abc, got %s", seen)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	d, done := newTestDB(t)
+	defer done()
+
+	// A failed transaction leaves nothing behind
+	err := d.Write(func(tx Tx) error {
+		if err := tx.Put("records", []byte("a"), []byte("1")); err != nil {
+			return err
+		}
+
+		return errors.New("abort")
+	})
+	if err == nil {
+		t.Fatal("expected the transaction error")
+	}
+
+	if v, _ := d.Get("records", []byte("a")); v != nil {
+		t.Fatal("rolled back write is visible")
+	}
+
+	if err := d.Write(func(tx Tx) error {
+		for _, k := range []string{"ab", "ac", "b"} {
+			if err := tx.Put("records", []byte(k), []byte(k)); err != nil {
+				return err
+			}
+		}
+
+		return tx.Delete("records", []byte("ac"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var seen string
+	if err := d.Read(func(tx Tx) error {
+		return tx.ForEachPrefix("records", []byte("a"), func(k, v []byte) error {
+			seen += string(k)
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if seen != "ab" {
+		t.Fatalf("expected ab, got %s", seen)
+	}
+
+	if err := d.Write(func(tx Tx) error {
+		return tx.DeleteBucket("records")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := d.Get("records", []byte("b")); v != nil {
+		t.Fatal("deleted bucket still readable")
+	}
+}
+
+func TestNewDBShared(t *testing.T) {
+	d, done := newTestDB(t)
+	defer done()
+
+	// A second open of the same file shares the handle instead of blocking on
+	// the file lock, and outlives the first Close
+	again, err := NewDB(d.(*db).path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := again.Put("shared", []byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := again.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := d.Get("shared", []byte("k")); err != nil || string(v) != "v" {
+		t.Fatal("handle closed while still shared")
+	}
+}
+
+func TestNewDBLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.db")
+
+	// Stands in for another process holding the file lock
+	other, err := bbolt.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	defer func(d time.Duration) { openTimeout = d }(openTimeout)
+	openTimeout = 100 * time.Millisecond
+
+	if _, err := NewDB(path); err == nil || !strings.Contains(err.Error(), "locked by another process") {
+		t.Fatalf("expected a lock error, got %v", err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	d, done := newTestDB(t)
+	defer done()
+
+	if err := d.Put("a", []byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Put("b", []byte("k"), []byte("w")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := d.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "bbolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "copy.db")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Read(func(tx Tx) error {
+		// NewDB creates the keys bucket of its own
+		if names := tx.Buckets(); len(names) != 3 || names[0] != "a" || names[1] != "b" {
+			t.Fatalf("unexpected buckets %v", names)
+		}
+
+		if v := tx.Get("b", []byte("k")); string(v) != "w" {
+			t.Fatal("snapshot lost a value")
+		}
+
+		if tx.Sequence("a") != 0 || tx.Sequence("missing") != 0 {
+			t.Fatal("unexpected sequence")
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,315 @@
+package alias
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/helpers"
+	"github.com/block27/core/services/bbolt"
+	api "github.com/block27/core/services/dsa"
+	"github.com/block27/core/services/dsa/ecdsa"
+	eer "github.com/block27/core/services/dsa/errors"
+	"github.com/block27/core/services/dsa/policy"
+)
+
+// bucket holding one JSON Alias record per alias name
+const bucket = "aliases"
+
+// validName keeps alias names usable as config.yaml keys and file names
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Version is one key generation behind an alias
+type Version struct {
+	Number    int       `json:"number"`
+	GID       string    `json:"gid"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Alias is a stable name pointing at a primary version among all the keys
+// ever rotated under it
+type Alias struct {
+	Name      string    `json:"name"`
+	Curve     string    `json:"curve"`
+	Primary   int       `json:"primary"`
+	Versions  []Version `json:"versions"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// record the alias was loaded from, nil for a new one, see save
+	raw []byte
+}
+
+// Create registers a new alias backed by a freshly generated version 1 key
+func Create(c config.Reader, d bbolt.Datastore, name string, curve string) (*Alias, error) {
+	if err := CheckName(name); err != nil {
+		return nil, err
+	}
+
+	existing, err := Get(d, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing != nil {
+		return nil, eer.NewKeyConflictError(fmt.Sprintf("%s %s", helpers.RFgB("alias already exists:"), name))
+	}
+
+	a := &Alias{
+		Name:      name,
+		Curve:     curve,
+		CreatedAt: time.Now(),
+	}
+
+	if err := a.addVersion(c, policy.Policy{}); err != nil {
+		return nil, err
+	}
+
+	return a, a.save(d)
+}
+
+// CheckName returns an error unless name is a valid alias name
+func CheckName(name string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("%s %s, usage: [a-z0-9_-]", helpers.RFgB("invalid alias name:"), name)
+	}
+
+	return nil
+}
+
+// Get returns the named alias, or nil when it does not exist
+func Get(d bbolt.Datastore, name string) (*Alias, error) {
+	data, err := d.Get(bucket, []byte(name))
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	var a Alias
+	if err := json.Unmarshal(data, &a); err != nil {
+		return nil, err
+	}
+
+	a.raw = data
+
+	return &a, nil
+}
+
+// Must is like Get but reports a missing alias as an error
+func Must(d bbolt.Datastore, name string) (*Alias, error) {
+	a, err := Get(d, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if a == nil {
+		return nil, eer.NewKeyPathError(fmt.Sprintf("%s %s", helpers.RFgB("unknown alias:"), name))
+	}
+
+	return a, nil
+}
+
+// List returns every alias ordered by name
+func List(d bbolt.Datastore) ([]*Alias, error) {
+	var aliases []*Alias
+
+	if err := d.ForEach(bucket, func(k, v []byte) error {
+		var a Alias
+		if err := json.Unmarshal(v, &a); err != nil {
+			return fmt.Errorf("alias %s: %v", k, err)
+		}
+
+		a.raw = append([]byte{}, v...)
+		aliases = append(aliases, &a)
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return aliases, nil
+}
+
+// PrimaryKey loads the key signing on behalf of the alias and its version
+func PrimaryKey(c config.Reader, d bbolt.Datastore, name string) (ecdsa.KeyAPI, int, error) {
+	a, err := Must(d, name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	key, err := a.Key(c, a.Primary)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return key, a.Primary, nil
+}
+
+// Rotate creates a new version and makes it primary. The previous primary is
+// archived as superseded so it keeps verifying but can no longer sign, once
+// the alias points away from it.
+func Rotate(c config.Reader, d bbolt.Datastore, name string) (*Alias, error) {
+	a, err := Must(d, name)
+	if err != nil {
+		return nil, err
+	}
+
+	previous, err := a.Key(c, a.Primary)
+	if err != nil {
+		return nil, err
+	}
+
+	// New versions inherit the usage policy of the one they replace
+	if err := a.addVersion(c, previous.Struct().Policy); err != nil {
+		return nil, err
+	}
+
+	if err := a.save(d); err != nil {
+		return nil, err
+	}
+
+	if previous.Struct().Status == api.StatusActive {
+		if err := previous.SetStatus(c, api.StatusArchived, api.ReasonSuperseded); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// Due returns the aliases whose primary version is older than the rotation
+// period configured for them, see Period
+func Due(c config.Reader, d bbolt.Datastore, now time.Time) ([]*Alias, error) {
+	aliases, err := List(d)
+	if err != nil {
+		return nil, err
+	}
+
+	var due []*Alias
+
+	for _, a := range aliases {
+		ok, err := a.Due(c, now)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			due = append(due, a)
+		}
+	}
+
+	return due, nil
+}
+
+// Due reports whether the primary version is older than the rotation period
+// configured for the alias
+func (a *Alias) Due(c config.Reader, now time.Time) (bool, error) {
+	period, err := Period(c, a.Name)
+	if err != nil {
+		return false, err
+	}
+
+	return period > 0 && now.Sub(a.Version(a.Primary).CreatedAt) >= period, nil
+}
+
+// Period returns the automatic rotation period of an alias, taken from
+// rotation.aliases.<name> or else rotation.period. Zero disables rotation.
+func Period(c config.Reader, name string) (time.Duration, error) {
+	p, ok := c.GetStringMapString("rotation.aliases")[name]
+	if !ok {
+		p = c.GetString("rotation.period")
+	}
+
+	return parsePeriod(p)
+}
+
+// Version returns the numbered version, or the zero Version if unknown
+func (a *Alias) Version(n int) Version {
+	for _, v := range a.Versions {
+		if v.Number == n {
+			return v
+		}
+	}
+
+	return Version{}
+}
+
+// Key loads the key behind a version number
+func (a *Alias) Key(c config.Reader, n int) (ecdsa.KeyAPI, error) {
+	v := a.Version(n)
+	if v.GID == "" {
+		return nil, fmt.Errorf("%s %s v%d", helpers.RFgB("unknown alias version:"), a.Name, n)
+	}
+
+	return ecdsa.GetECDSA(c, v.GID)
+}
+
+// addVersion generates the next key version and makes it primary
+func (a *Alias) addVersion(c config.Reader, p policy.Policy) error {
+	n := len(a.Versions) + 1
+
+	key, err := ecdsa.NewECDSAWithPolicy(c, fmt.Sprintf("%s-v%d", a.Name, n), a.Curve, p)
+	if err != nil {
+		return err
+	}
+
+	a.Versions = append(a.Versions, Version{
+		Number:    n,
+		GID:       key.FilePointer(),
+		CreatedAt: key.Struct().CreatedAt,
+	})
+	a.Primary = n
+
+	return nil
+}
+
+// save stores the alias, provided the stored record is still the one it was
+// loaded from, so of two concurrent creates or rotations one fails rather
+// than dropping the other's version
+func (a *Alias) save(d bbolt.Datastore) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	if err := d.Write(func(tx bbolt.Tx) error {
+		if !bytes.Equal(tx.Get(bucket, []byte(a.Name)), a.raw) {
+			return eer.NewKeyConflictError(fmt.Sprintf("%s %s, try again", helpers.RFgB("alias was changed by another process:"), a.Name))
+		}
+
+		return tx.Put(bucket, []byte(a.Name), data)
+	}); err != nil {
+		return err
+	}
+
+	a.raw = data
+
+	return nil
+}
+
+// parsePeriod accepts Go durations plus a "d" suffix for days, e.g. 90d
+func parsePeriod(p string) (time.Duration, error) {
+	p = strings.TrimSpace(p)
+	if p == "" || p == "0" {
+		return 0, nil
+	}
+
+	if strings.HasSuffix(p, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(p, "d"))
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid rotation period: %s", p)
+		}
+
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(p)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid rotation period: %s", p)
+	}
+
+	return d, nil
+}
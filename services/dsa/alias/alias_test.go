@@ -0,0 +1,223 @@
+package alias
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/services/bbolt"
+	api "github.com/block27/core/services/dsa"
+	"github.com/block27/core/test"
+)
+
+var Config config.Reader
+
+func init() {
+	os.Setenv("ENVIRONMENT", "test")
+
+	c, err := config.LoadConfig(config.Defaults)
+	if err != nil {
+		panic(err)
+	}
+
+	if c.GetString("environment") != "test" {
+		panic(fmt.Errorf("test [environment] is not in [test] mode"))
+	}
+
+	// Stands in for HardwareAuthenticate, which needs the device attached
+	if err := crypto.LoadMasterKey([]byte(test.MasterKey), []byte(test.MasterIv)); err != nil {
+		panic(err)
+	}
+
+	Config = c
+}
+
+// scheduleReader overrides rotation.aliases, config.yaml values would
+// otherwise win over SetDefault
+type scheduleReader struct {
+	config.Reader
+	aliases map[string]string
+}
+
+func (s scheduleReader) GetStringMapString(key string) map[string]string {
+	if key == "rotation.aliases" {
+		return s.aliases
+	}
+
+	return s.Reader.GetStringMapString(key)
+}
+
+// uniqueAlias suffixes alias names, their keys land in the shared test store
+func uniqueAlias(base string) string {
+	return fmt.Sprintf("%s-%s", base, api.GenerateUUID().String()[:8])
+}
+
+func newTestDB(t *testing.T) (bbolt.Datastore, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "alias")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := bbolt.NewDB(filepath.Join(dir, "alias.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	d, done := newTestDB(t)
+	defer done()
+
+	name := uniqueAlias("release")
+
+	a, err := Create(Config, d, name, "prime256v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 1, a.Primary)
+	assert.Equal(t, 1, len(a.Versions))
+
+	if _, err := Create(Config, d, name, "prime256v1"); err == nil {
+		t.Fatal("duplicate alias accepted")
+	}
+
+	if _, err := Create(Config, d, "Bad Name", "prime256v1"); err == nil {
+		t.Fatal("invalid alias name accepted")
+	}
+
+	if a, err := Get(d, "missing"); err != nil || a != nil {
+		t.Fatal("missing alias should be nil")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	d, done := newTestDB(t)
+	defer done()
+
+	name := uniqueAlias("rotating")
+
+	if _, err := Create(Config, d, name, "prime256v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := Rotate(Config, d, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 2, a.Primary)
+
+	v1, err := a.Key(Config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v2, err := a.Key(Config, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The superseded version verifies old signatures but no longer signs
+	assert.Equal(t, api.StatusArchived, v1.Struct().Status)
+	assert.Equal(t, api.StatusActive, v2.Struct().Status)
+
+	digest := sha256.Sum256([]byte("data"))
+	if _, err := v1.Sign(digest[:]); err == nil {
+		t.Fatal("superseded version signed")
+	}
+
+	if _, err := Rotate(Config, d, "missing"); err == nil {
+		t.Fatal("rotated a missing alias")
+	}
+}
+
+func TestSaveStale(t *testing.T) {
+	d, done := newTestDB(t)
+	defer done()
+
+	name := uniqueAlias("stale")
+
+	if _, err := Create(Config, d, name, "prime256v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	stale, err := Must(d, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Rotate(Config, d, name); err != nil {
+		t.Fatal(err)
+	}
+
+	// A copy loaded before the rotation cannot drop the version it added
+	stale.Primary = 1
+	assert.NotNil(t, stale.save(d))
+
+	a, err := Must(d, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 2, a.Primary)
+	assert.Equal(t, 2, len(a.Versions))
+}
+
+func TestDue(t *testing.T) {
+	d, done := newTestDB(t)
+	defer done()
+
+	fast, slow := uniqueAlias("fast"), uniqueAlias("slow")
+
+	for _, name := range []string{fast, slow} {
+		if _, err := Create(Config, d, name, "prime256v1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := scheduleReader{Config, map[string]string{fast: "1h", slow: "90d"}}
+
+	due, err := Due(c, d, time.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 1, len(due))
+	assert.Equal(t, fast, due[0].Name)
+}
+
+func TestParsePeriod(t *testing.T) {
+	for in, want := range map[string]time.Duration{
+		"":     0,
+		"0":    0,
+		"90d":  90 * 24 * time.Hour,
+		"720h": 720 * time.Hour,
+	} {
+		got, err := parsePeriod(in)
+		if err != nil || got != want {
+			t.Fatalf("%q: got %v, %v", in, got, err)
+		}
+	}
+
+	for _, in := range []string{"soon", "-1h", "xd"} {
+		if _, err := parsePeriod(in); err == nil {
+			t.Fatalf("%q should not parse", in)
+		}
+	}
+}
@@ -48,3 +48,56 @@ func TestGenerateUUID(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestCheckTransition(t *testing.T) {
+	valid := [][2]string{
+		{StatusActive, StatusArchived},
+		{StatusArchived, StatusActive},
+		{StatusActive, StatusCompromised},
+		{StatusArchived, StatusDestroyed},
+		{StatusCompromised, StatusDestroyed},
+	}
+
+	for _, tr := range valid {
+		if err := CheckTransition(tr[0], tr[1]); err != nil {
+			t.Fatalf("%s -> %s: %v", tr[0], tr[1], err)
+		}
+	}
+
+	invalid := [][2]string{
+		{StatusActive, StatusActive},
+		{StatusCompromised, StatusActive},
+		{StatusDestroyed, StatusActive},
+		{"junk", StatusActive},
+	}
+
+	for _, tr := range invalid {
+		if err := CheckTransition(tr[0], tr[1]); err == nil {
+			t.Fatalf("%s -> %s should be refused", tr[0], tr[1])
+		}
+	}
+}
+
+func TestRevokeStatus(t *testing.T) {
+	if s, err := RevokeStatus(ReasonCompromised); err != nil || s != StatusCompromised {
+		t.Fail()
+	}
+
+	if s, err := RevokeStatus(ReasonSuperseded); err != nil || s != StatusArchived {
+		t.Fail()
+	}
+
+	if _, err := RevokeStatus("junk"); err == nil {
+		t.Fail()
+	}
+}
+
+func TestCanSignVerify(t *testing.T) {
+	if !CanSign(StatusActive) || CanSign(StatusArchived) || CanSign(StatusCompromised) {
+		t.Fail()
+	}
+
+	if !CanVerify(StatusArchived) || !CanVerify(StatusCompromised) || CanVerify(StatusDestroyed) {
+		t.Fail()
+	}
+}
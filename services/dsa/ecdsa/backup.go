@@ -0,0 +1,213 @@
+package ecdsa
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/services/keystore"
+)
+
+// Outcomes of restoring a backed up record, see PlanRestore
+const (
+	RestoreNew       = "new"
+	RestoreUnchanged = "unchanged"
+	RestoreReplace   = "replace"
+	RestoreTaken     = "taken"
+)
+
+// Record is a key record exactly as kept in the keystore
+type Record struct {
+	GID  string `json:"gid"`
+	Data []byte `json:"data"`
+}
+
+// ExportRecords returns every key record as stored, for backups. Unreadable
+// records are an error, `store migrate` lists them.
+func ExportRecords(c config.Reader) ([]Record, error) {
+	s, err := openStore(c)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := loadState(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+
+	err = s.List(kind, func(gid string, data []byte) error {
+		if _, err := loadRecord(st, gid, data); err != nil {
+			return LoadFailure{GID: gid, Err: err}
+		}
+
+		records = append(records, Record{GID: gid, Data: data})
+
+		return nil
+	})
+
+	return records, err
+}
+
+// ParseRecord reads an exported record
+func ParseRecord(r Record) (KeyAPI, error) {
+	k, _, err := decodeRecord(r.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	if k.FilePointer() != r.GID {
+		return nil, fmt.Errorf("record %s holds key %s", r.GID, k.FilePointer())
+	}
+
+	return k, nil
+}
+
+// PlanRestore reports what RestoreRecord would do with a backed up record:
+// add a new key, nothing, replace a different record stored under the same
+// GID, or nothing because its name or slug is taken by another key, which
+// detail names. Wrapped private keys must unwrap under this device's master
+// key, or the record is refused.
+func PlanRestore(c config.Reader, r Record) (outcome string, detail string, err error) {
+	k, err := ParseRecord(r)
+	if err != nil {
+		return "", "", err
+	}
+
+	if k.Struct().PrivateKeyB64 != "" {
+		if _, err := k.Struct().privateKey(); err != nil {
+			return "", "", fmt.Errorf("key %s cannot be unwrapped on this device: %v", r.GID, err)
+		}
+	}
+
+	s, err := openStore(c)
+	if err != nil {
+		return "", "", err
+	}
+
+	for field, value := range map[string]string{indexName: k.Struct().Name, indexSlug: k.Struct().Slug} {
+		gids, err := s.Find(kind, field, value)
+		if err != nil {
+			return "", "", err
+		}
+
+		for _, gid := range gids {
+			if gid != r.GID {
+				return RestoreTaken, fmt.Sprintf("%s %s belongs to %s", field, value, gid), nil
+			}
+		}
+	}
+
+	current, err := s.Get(kind, r.GID)
+	switch {
+	case err == keystore.ErrNotFound:
+		return RestoreNew, "", nil
+	case err != nil:
+		return "", "", err
+	case samePayload(current, r.Data):
+		return RestoreUnchanged, "", nil
+	default:
+		return RestoreReplace, "differs from the record on this device", nil
+	}
+}
+
+// RestoreRecord stores a backed up record, replacing any record kept under
+// its GID. The record is rewritten at the current schema version.
+func RestoreRecord(c config.Reader, r Record) error {
+	k, err := ParseRecord(r)
+	if err != nil {
+		return err
+	}
+
+	return k.Struct().replace(c)
+}
+
+// RestoreRecords is RestoreRecord for every record, all or none: when one
+// fails the ones already stored are put back the way they were. undo does
+// the same once they are all in, for a later step of the restore failing.
+func RestoreRecords(c config.Reader, records []Record) (undo func() error, err error) {
+	s, err := openStore(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var prev []Record
+
+	undo = func() error {
+		var first error
+
+		for i := len(prev) - 1; i >= 0; i-- {
+			if err := putBack(c, s, prev[i]); err != nil && first == nil {
+				first = err
+			}
+		}
+
+		return first
+	}
+
+	for _, r := range records {
+		data, err := s.Get(kind, r.GID)
+		if err != nil && err != keystore.ErrNotFound {
+			undo()
+			return nil, err
+		}
+
+		prev = append(prev, Record{GID: r.GID, Data: data})
+
+		if err := RestoreRecord(c, r); err != nil {
+			undo()
+			return nil, err
+		}
+	}
+
+	return undo, nil
+}
+
+// putBack stores the record a restore replaced, or removes the one it added
+func putBack(c config.Reader, s keystore.Store, r Record) error {
+	if r.Data == nil {
+		if err := s.Delete(kind, r.GID); err != nil && err != keystore.ErrNotFound {
+			return err
+		}
+
+		return nil
+	}
+
+	k, _, err := decodeRecord(r.Data)
+	if err != nil || k.FilePointer() != r.GID {
+		// Unreadable before the restore, and put back as it was
+		return s.Put(kind, keystore.Entry{GID: r.GID, Data: r.Data})
+	}
+
+	return k.replace(c)
+}
+
+// replace saves the key over whatever record is stored under its GID
+func (k *key) replace(c config.Reader) error {
+	s, err := openStore(c)
+	if err != nil {
+		return err
+	}
+
+	current, err := s.Get(kind, k.FilePointer())
+	if err != nil && err != keystore.ErrNotFound {
+		return err
+	}
+
+	k.raw = current
+
+	return k.save(c)
+}
+
+// samePayload reports whether two records hold the same key, whatever version
+// of it they were written at
+func samePayload(a []byte, b []byte) bool {
+	var ra, rb record
+	if json.Unmarshal(a, &ra) != nil || json.Unmarshal(b, &rb) != nil {
+		return bytes.Equal(a, b)
+	}
+
+	return ra.Schema == rb.Schema && bytes.Equal(ra.Key, rb.Key)
+}
@@ -0,0 +1,250 @@
+package ecdsa
+
+import (
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/block27/core/crypto"
+	api "github.com/block27/core/services/dsa"
+	eer "github.com/block27/core/services/dsa/errors"
+	"github.com/block27/core/services/dsa/policy"
+	sig "github.com/block27/core/services/dsa/signature"
+)
+
+// BatchItem is a single digest to sign, as read from a JSONL line or an API
+// request. The optional hash is used to validate the digest length, and is
+// required by RSA keys whose signatures name it.
+type BatchItem struct {
+	ID     string `json:"id,omitempty"`
+	Digest string `json:"digest"`
+	Hash   string `json:"hash,omitempty"`
+}
+
+// BatchResult is the outcome of signing one BatchItem. Exactly one of
+// Signature (base64 ASN.1 DER, PKCS #1 v1.5 for RSA keys) and Error is set.
+type BatchResult struct {
+	Index     int    `json:"index"`
+	ID        string `json:"id,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// SignBatch signs every item with the key using at most workers goroutines.
+// The private key is decoded a single time up front. Results are returned in
+// the order of the items, a failing item never aborts the others; the error
+// return is reserved for problems with the key itself. Items are validated
+// against the key policy first so that only valid ones count towards its
+// signature limit.
+func SignBatch(k KeyAPI, items []BatchItem, mode string, workers int) ([]BatchResult, error) {
+	if status := k.Struct().Status; !api.CanSign(status) {
+		return nil, eer.NewKeyStatusError(fmt.Sprintf("key is %s, signing refused", status))
+	}
+
+	if err := k.Authorize(policy.OpSign, ""); err != nil {
+		return nil, err
+	}
+
+	if err := CheckMode(k.Struct().Curve(), mode); err != nil {
+		return nil, err
+	}
+
+	pri, err := k.Struct().privateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make([]BatchResult, len(items))
+	payloads := make([][]byte, len(items))
+
+	var valid []int
+
+	for i, item := range items {
+		results[i] = BatchResult{Index: i, ID: item.ID}
+
+		payload, err := batchPayload(k, item, mode)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+
+		payloads[i] = payload
+		valid = append(valid, i)
+	}
+
+	granted := 0
+	if len(valid) > 0 {
+		if granted, err = k.reserve(len(valid)); err != nil {
+			granted = 0
+
+			// The limit is exhausted, report it per item; anything else is fatal
+			if _, ok := err.(*eer.KeyPolicy); !ok {
+				return nil, err
+			}
+		}
+	}
+
+	for _, i := range valid[granted:] {
+		results[i].Error = fmt.Sprintf("policy: signature limit of %d reached",
+			k.Struct().Policy.MaxSignatures)
+	}
+
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := range jobs {
+				signItem(pri, items[i].Hash, payloads[i], &results[i])
+			}
+		}()
+	}
+
+	for _, i := range valid[:granted] {
+		jobs <- i
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	return results, nil
+}
+
+// batchPayload validates an item against its declared hash and the key
+// policy and returns the bytes to sign
+func batchPayload(k KeyAPI, item BatchItem, mode string) ([]byte, error) {
+	digest, err := itemDigest(item)
+	if err != nil {
+		return nil, err
+	}
+
+	if item.Hash == "" && len(k.Struct().Policy.Hashes) != 0 {
+		return nil, fmt.Errorf("policy: hash is required for this key")
+	}
+
+	if err := k.Authorize(policy.OpSign, item.Hash); err != nil {
+		return nil, err
+	}
+
+	if err := CheckHash(k.Struct().Curve(), item.Hash); err != nil {
+		return nil, err
+	}
+
+	return sig.Payload(digest, mode)
+}
+
+// itemDigest decodes the digest of an item, checking its length against
+// the declared hash
+func itemDigest(item BatchItem) ([]byte, error) {
+	digest, err := hex.DecodeString(item.Digest)
+	if err != nil || len(digest) == 0 {
+		return nil, fmt.Errorf("digest must be a non empty hex string")
+	}
+
+	if item.Hash != "" {
+		h, err := crypto.NewHash(item.Hash)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(digest) != h.Size() {
+			return nil, fmt.Errorf("digest length %d does not match %s", len(digest), item.Hash)
+		}
+	}
+
+	return digest, nil
+}
+
+// signItem signs a single payload made by hash into res, never returning an
+// error so the pool keeps going
+func signItem(pri gocrypto.Signer, hash string, payload []byte, res *BatchResult) {
+	var der []byte
+	var err error
+
+	switch pri := pri.(type) {
+	case *rsa.PrivateKey:
+		der, err = rsaSign(pri, hash, payload)
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		if r, s, err = ecdsa.Sign(crypto.Reader, pri, payload); err == nil {
+			der, err = (&sig.Signature{R: r, S: s}).SigToDER()
+		}
+	default:
+		err = fmt.Errorf("unsupported private key %T", pri)
+	}
+
+	if err != nil {
+		res.Error = err.Error()
+		return
+	}
+
+	res.Signature = base64.StdEncoding.EncodeToString(der)
+}
+
+// SignDigest signs a single item with the checks SignBatch applies, and
+// returns the ASN.1 DER signature, or the PKCS #1 v1.5 one of RSA keys
+func SignDigest(k KeyAPI, item BatchItem, mode string) ([]byte, error) {
+	if err := CheckMode(k.Struct().Curve(), mode); err != nil {
+		return nil, err
+	}
+
+	payload, err := batchPayload(k, item, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	if IsRSA(k.Struct().Curve()) {
+		return k.Struct().signRSA(item.Hash, payload)
+	}
+
+	s, err := k.Sign(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.SigToDER()
+}
+
+// VerifyDigest checks an ASN.1 DER signature, or the PKCS #1 v1.5 one of RSA
+// keys, over a single item, false as well for keys that may no longer verify
+func VerifyDigest(k KeyAPI, item BatchItem, mode string, der []byte) (bool, error) {
+	digest, err := itemDigest(item)
+	if err != nil {
+		return false, err
+	}
+
+	if IsRSA(k.Struct().Curve()) {
+		if err := CheckMode(k.Struct().Curve(), mode); err != nil {
+			return false, err
+		}
+
+		return k.Struct().verifyRSA(item.Hash, digest, der)
+	}
+
+	var s sig.Signature
+	if rest, err := asn1.Unmarshal(der, &s); err != nil || len(rest) != 0 || s.R == nil || s.S == nil {
+		return false, fmt.Errorf("signature must be ASN.1 DER")
+	}
+
+	payload, err := sig.Payload(digest, mode)
+	if err != nil {
+		return false, err
+	}
+
+	return k.Verify(payload, &s), nil
+}
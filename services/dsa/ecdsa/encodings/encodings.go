@@ -8,6 +8,7 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/pem"
+	"fmt"
 	"os"
 	"strings"
 
@@ -29,12 +30,21 @@ var (
 // ImportPublicKeyfromPEM ...
 func ImportPublicKeyfromPEM(pempub []byte) (*ecdsa.PublicKey, error) {
 	block, _ := pem.Decode(pempub)
+	if block == nil {
+		return nil, fmt.Errorf("invalid public key")
+	}
+
 	objct, err := x509.ParsePKIXPublicKey(block.Bytes)
 	if err != nil {
 		return nil, err
 	}
 
-	return objct.(*ecdsa.PublicKey), nil
+	pub, ok := objct.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an ECDSA public key")
+	}
+
+	return pub, nil
 }
 
 // ExportPublicKeytoPEM ...
@@ -0,0 +1,99 @@
+package ecdsa
+
+import (
+	"encoding/base64"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/crypto"
+	eer "github.com/block27/core/services/dsa/errors"
+)
+
+// EncryptStore migrates keys written before private material was encrypted,
+// wrapping their records in place under the master key. Keys already
+// encrypted are skipped, so the migration can be re-run safely. It returns
+// the GIDs of the keys that were migrated. Records of an older schema do
+// not load, it fails while any remain; MigrateStore wraps them.
+func EncryptStore(c config.Reader) ([]string, error) {
+	if !crypto.MasterKeyLoaded() {
+		return nil, crypto.ErrMasterKeyLocked
+	}
+
+	s, err := openStore(c)
+	if err != nil {
+		return nil, err
+	}
+
+	unsealed, _, err := schemas(c, s)
+	if err != nil {
+		return nil, err
+	}
+
+	if unsealed {
+		return nil, eer.NewKeyIntegrityError("key records predating integrity protection remain, run `store migrate`")
+	}
+
+	keys, err := ListECDSA(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrated []string
+
+	for _, k := range keys {
+		done, err := k.Struct().encrypt(c)
+		if err != nil {
+			return migrated, err
+		}
+
+		if done {
+			migrated = append(migrated, k.FilePointer())
+		}
+	}
+
+	return migrated, nil
+}
+
+// encrypt wraps the private material of a plaintext key and saves it
+func (k *key) encrypt(c config.Reader) (bool, error) {
+	k.sink.Lock()
+	defer k.sink.Unlock()
+
+	done, err := k.wrap()
+	if err != nil || !done {
+		return false, err
+	}
+
+	return true, k.save(c)
+}
+
+// wrap wraps the private material of a plaintext key in memory, reporting
+// whether the key was in plaintext
+func (k *key) wrap() (bool, error) {
+	if k.Encrypted {
+		return false, nil
+	}
+
+	// Public only and destroyed keys have no private material left to wrap
+	if k.PrivateKeyB64 != "" {
+		// Refuse to wrap anything that is not a readable key
+		if _, err := k.privateKey(); err != nil {
+			return false, err
+		}
+
+		plain, err := base64.StdEncoding.DecodeString(k.PrivateKeyB64)
+		if err != nil {
+			return false, err
+		}
+
+		wrapped, err := crypto.Wrap(plain)
+		if err != nil {
+			return false, err
+		}
+
+		k.PrivateKeyB64 = base64.StdEncoding.EncodeToString(wrapped)
+	}
+
+	k.Encrypted = true
+
+	return true, nil
+}
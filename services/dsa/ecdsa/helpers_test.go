@@ -2,11 +2,9 @@ package ecdsa
 
 import (
 	"fmt"
-	"os"
 	"testing"
 
 	"github.com/block27/core/config"
-	"github.com/block27/core/helpers"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -21,11 +19,8 @@ func AssertStructCorrectness(t *testing.T, k KeyAPI, o string, c string) {
 	assert.NotNil(t, k.Struct().FingerprintMD5)
 	assert.NotNil(t, k.Struct().FingerprintSHA)
 
-	assert.NotNil(t, k.Struct().PrivatePemPath)
 	assert.NotNil(t, k.Struct().PrivateKeyB64)
 	assert.NotNil(t, k.Struct().PublicKeyB64)
-	assert.NotNil(t, k.Struct().PrivateKeyPath)
-	assert.NotNil(t, k.Struct().PublicKeyPath)
 
 	assert.Equal(t, "active", k.Struct().Status)
 	assert.Equal(t, fmt.Sprintf("ecdsa.%s <==> %s", o, c), k.Struct().KeyType)
@@ -43,45 +38,48 @@ func AssertStructNilness(t *testing.T, k KeyAPI) {
 	assert.Equal(t, k.Struct().FingerprintMD5, "")
 	assert.Equal(t, k.Struct().FingerprintSHA, "")
 
-	assert.Equal(t, k.Struct().PrivatePemPath, "")
 	assert.Equal(t, k.Struct().PrivateKeyB64, "")
 	assert.Equal(t, k.Struct().PublicKeyB64, "")
-	assert.Equal(t, k.Struct().PrivateKeyPath, "")
-	assert.Equal(t, k.Struct().PublicKeyPath, "")
 }
 
-func ClearSingleTestKey(t *testing.T, p string) {
+func ClearSingleTestKey(t *testing.T, c config.Reader, k KeyAPI) {
 	t.Helper()
 
-	err := os.RemoveAll(p)
-	if err != nil {
+	if err := DeleteECDSA(c, k.FilePointer()); err != nil {
 		t.Fatal(err)
 	}
 
-	t.Logf("successfully removed [%s]", p)
+	t.Logf("successfully removed [%s]", k.FilePointer())
 }
 
-// CheckFullKeyFileObjects checks that a full private, public pem and object
-// files are created when a new key is created
-func CheckFullKeyFileObjects(t *testing.T, c config.Reader, k KeyAPI, f string) {
+// storedRecord returns the raw keystore record of a key
+func storedRecord(t *testing.T, c config.Reader, gid string) []byte {
 	t.Helper()
 
-	// Check for filesystem keys are present
-	checkKeyFileObjects(t, f,
-		fmt.Sprintf("%s/ecdsa/%s", c.GetString("paths.keys"), k.FilePointer()))
+	s, err := openStore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s.Get(kind, gid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
 }
 
-func checkKeyFileObjects(t *testing.T, f string, p string) {
-	paths := []string{
-		fmt.Sprintf("%s/%s", p, "obj.bin"),
-		fmt.Sprintf("%s/%s", p, "public.key"),
-		fmt.Sprintf("%s/%s", p, "private.key"),
-		fmt.Sprintf("%s/%s", p, "private.pem"),
+// CheckKeyRecord checks that a new key's record and index entries were
+// committed to the keystore
+func CheckKeyRecord(t *testing.T, c config.Reader, k KeyAPI, f string) {
+	t.Helper()
+
+	got, err := ResolveECDSA(c, k.Struct().Name)
+	if err != nil {
+		t.Fatalf("%s failed to store the key: %v", f, err)
 	}
 
-	for _, p := range paths {
-		if !helpers.FileExists(p) {
-			t.Fatalf("%s failed to writeToFS() -> %s", f, p)
-		}
+	if got.FilePointer() != k.FilePointer() {
+		t.Fatalf("%s indexed the wrong key: %s", f, got.FilePointer())
 	}
 }
@@ -0,0 +1,420 @@
+package ecdsa
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/helpers"
+	eer "github.com/block27/core/services/dsa/errors"
+	"github.com/block27/core/services/keystore"
+)
+
+// kind is the keystore bucket ECDSA key records live in
+const kind = "ecdsa"
+
+// minPrefix is the shortest GID prefix ResolveECDSA accepts
+const minPrefix = 4
+
+// Secondary indexes kept by the keystore for every key record
+const (
+	indexName        = "name"
+	indexSlug        = "slug"
+	indexFingerprint = "fingerprint"
+	indexStatus      = "status"
+	indexLabel       = "label"
+	indexTag         = "tag"
+)
+
+// openStore returns the keystore backend configured for the process
+func openStore(c config.Reader) (keystore.Store, error) {
+	return keystore.Open(c)
+}
+
+// normalizeMD5 strips the MD5: prefix and colons, so fingerprints match as
+// printed by either ssh-keygen or this tool
+func normalizeMD5(fp string) string {
+	return strings.Replace(strings.ToLower(strings.TrimPrefix(fp, "MD5:")), ":", "", -1)
+}
+
+// index returns the values the key is looked up by. Tags are indexed both
+// as k=v and as a bare k, so either form of filter can use the index.
+func (k *key) index() keystore.Index {
+	idx := keystore.Index{
+		indexName:        {k.Name},
+		indexSlug:        {k.Slug},
+		indexFingerprint: {k.FingerprintSHA, normalizeMD5(k.FingerprintMD5)},
+		indexStatus:      {k.Status},
+		indexLabel:       k.Labels,
+	}
+
+	for name, val := range k.Tags {
+		idx[indexTag] = append(idx[indexTag], name, fmt.Sprintf("%s=%s", name, val))
+	}
+
+	return idx
+}
+
+// maxUpdates bounds how often update reloads a key other copies keep saving
+// first
+const maxUpdates = 16
+
+// save writes the key record and its index entries in one transaction,
+// provided the stored record is still the one the key was loaded from
+func (k *key) save(c config.Reader) error {
+	return conflictError(k.put(c))
+}
+
+// update applies fn to the key and saves it like save. When another copy of
+// the key saved first, the key is reloaded and fn applied again, so it checks
+// against the record as it is now. fn reports whether it changed the key;
+// when it did not, nothing is written but the record must still be current.
+// The caller holds k.sink.
+func (k *key) update(c config.Reader, fn func() (bool, error)) error {
+	for attempt := 0; ; attempt++ {
+		changed, err := fn()
+		if err == nil && changed {
+			err = k.put(c)
+		} else if err == nil {
+			err = k.current(c)
+		}
+
+		if err != keystore.ErrModified || attempt == maxUpdates {
+			if err != nil && changed {
+				// Best effort, so the key does not claim what was not stored
+				k.reload(c)
+			}
+
+			return conflictError(err)
+		}
+
+		if err := k.reload(c); err != nil {
+			return err
+		}
+	}
+}
+
+// current returns keystore.ErrModified unless the stored record is the one
+// the key was loaded from
+func (k *key) current(c config.Reader) error {
+	s, err := openStore(c)
+	if err != nil {
+		return err
+	}
+
+	data, err := s.Get(kind, k.FilePointer())
+	if err != nil && err != keystore.ErrNotFound {
+		return err
+	}
+
+	if !bytes.Equal(data, k.raw) {
+		return keystore.ErrModified
+	}
+
+	return nil
+}
+
+// reload replaces the key with the record now stored under its GID
+func (k *key) reload(c config.Reader) error {
+	s, err := openStore(c)
+	if err != nil {
+		return err
+	}
+
+	gid := k.FilePointer()
+
+	data, err := s.Get(kind, gid)
+	if err == keystore.ErrNotFound {
+		return eer.NewKeyPathError("invalid key path")
+	} else if err != nil {
+		return err
+	}
+
+	st, err := loadState(s)
+	if err != nil {
+		return err
+	}
+
+	fresh, err := loadRecord(st, gid, data)
+	if err != nil {
+		return err
+	}
+
+	k.assign(fresh)
+
+	return nil
+}
+
+// assign copies the stored fields of from, keeping the lock and config of k
+func (k *key) assign(from *key) {
+	k.GID, k.Name, k.Slug = from.GID, from.Name, from.Slug
+	k.Status, k.Transitions = from.Status, from.Transitions
+	k.Policy, k.Signatures = from.Policy, from.Signatures
+	k.KeyType, k.Labels, k.Tags = from.KeyType, from.Labels, from.Tags
+	k.FingerprintMD5, k.FingerprintSHA = from.FingerprintMD5, from.FingerprintSHA
+	k.PrivateKeyB64, k.PublicKeyB64 = from.PrivateKeyB64, from.PublicKeyB64
+	k.Encrypted, k.CreatedAt = from.Encrypted, from.CreatedAt
+	k.version, k.raw = from.version, from.raw
+}
+
+// put is save reporting name and slug clashes as *keystore.Conflict, and a
+// record changed since the key was loaded as keystore.ErrModified
+func (k *key) put(c config.Reader) error {
+	s, err := openStore(c)
+	if err != nil {
+		return err
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	st, err := loadState(s)
+	if err == nil && st.missing {
+		st, err = newState(c, s)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return k.write(s, st)
+}
+
+// write stores the record at the next version of its GID, then raises the
+// version in the store state. A crash in between leaves the record ahead of
+// the state, which loads. The record is swapped for the one the key was
+// loaded from, a key never loaded must not be stored yet. The caller holds
+// stateMu.
+func (k *key) write(s keystore.Store, st *storeState) error {
+	gid := k.FilePointer()
+
+	version := k.version
+	if st.Versions[gid] > version {
+		version = st.Versions[gid]
+	}
+
+	prev := k.version
+	k.version = version + 1
+
+	data, err := encodeRecord(k)
+	if err != nil {
+		k.version = prev
+		return err
+	}
+
+	e := keystore.Entry{
+		GID:   gid,
+		Data:  data,
+		Index: k.index(),
+	}
+
+	if err := s.CompareAndSwap(kind, k.raw, e, indexName, indexSlug); err != nil {
+		k.version = prev
+		return err
+	}
+
+	k.raw = data
+	st.Versions[gid] = k.version
+
+	return saveState(s, st)
+}
+
+// create stores a new key, refusing names already in use and picking a
+// fresh slug if the generated one collides
+func (k *key) create(c config.Reader) error {
+	for attempt := 0; ; attempt++ {
+		err := k.put(c)
+		if err == keystore.ErrModified {
+			return eer.NewKeyConflictError("key gid already in use")
+		}
+
+		conflict, ok := err.(*keystore.Conflict)
+		if !ok || conflict.Field != indexSlug {
+			return conflictError(err)
+		}
+
+		if attempt == 16 {
+			return eer.NewKeyConflictError("could not generate a unique slug")
+		}
+
+		k.Slug = helpers.NewHaikunator().Haikunate()
+	}
+}
+
+// conflictError turns keystore clashes into the errors callers expect
+func conflictError(err error) error {
+	if conflict, ok := err.(*keystore.Conflict); ok {
+		return eer.NewKeyConflictError(fmt.Sprintf("key %s already in use: %s (%s)",
+			conflict.Field, conflict.Value, conflict.GID))
+	}
+
+	if err == keystore.ErrModified {
+		return eer.NewKeyConflictError("key record was changed by another process, try again")
+	}
+
+	return err
+}
+
+// DeleteECDSA removes a key record for good, unlike destroying it which
+// keeps the public half on record
+func DeleteECDSA(c config.Reader, gid string) error {
+	s, err := openStore(c)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Delete(kind, gid); err == keystore.ErrNotFound {
+		return eer.NewKeyPathError("invalid key path")
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RebuildIndex drops and rebuilds every secondary index from the key
+// records, returning the number of keys indexed. Unreadable records are
+// left out, `store migrate` reports them.
+func RebuildIndex(c config.Reader) (int, error) {
+	s, err := openStore(c)
+	if err != nil {
+		return 0, err
+	}
+
+	return s.Reindex(kind, func(gid string, data []byte) (keystore.Index, error) {
+		k, _, err := decodeRecord(data)
+		if err != nil {
+			return nil, nil
+		}
+
+		return k.index(), nil
+	})
+}
+
+// ResolveECDSA finds a key by GID, name, slug, SHA256 or MD5 fingerprint, or
+// an unambiguous GID prefix of at least four characters, in that order of
+// precedence. Several keys matching at the same level is an error listing
+// the candidates.
+func ResolveECDSA(c config.Reader, ref string) (KeyAPI, error) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return nil, eer.NewKeyPathError("empty key reference")
+	}
+
+	s, err := openStore(c)
+	if err != nil {
+		return nil, err
+	}
+
+	sha, md5 := strings.TrimPrefix(ref, "SHA256:"), normalizeMD5(ref)
+
+	// Each tier finds candidates and checks the loaded record really matches,
+	// so a forged index entry cannot redirect a lookup to another key
+	tiers := []struct {
+		find    func() ([]string, error)
+		matches func(k *key) bool
+	}{
+		{
+			func() ([]string, error) {
+				if _, err := s.Get(kind, ref); err != nil {
+					return nil, nil
+				}
+
+				return []string{ref}, nil
+			},
+			func(k *key) bool { return k.FilePointer() == ref },
+		},
+		{
+			func() ([]string, error) { return s.Find(kind, indexName, ref) },
+			func(k *key) bool { return k.Name == ref },
+		},
+		{
+			func() ([]string, error) { return s.Find(kind, indexSlug, ref) },
+			func(k *key) bool { return k.Slug == ref },
+		},
+		{
+			func() ([]string, error) {
+				bySHA, err := s.Find(kind, indexFingerprint, sha)
+				if err != nil {
+					return nil, err
+				}
+
+				byMD5, err := s.Find(kind, indexFingerprint, md5)
+
+				return unique(append(bySHA, byMD5...)), err
+			},
+			func(k *key) bool { return k.FingerprintSHA == sha || normalizeMD5(k.FingerprintMD5) == md5 },
+		},
+		{
+			func() ([]string, error) {
+				if len(ref) < minPrefix {
+					return nil, nil
+				}
+
+				return s.Prefix(kind, strings.ToLower(ref))
+			},
+			func(k *key) bool { return strings.HasPrefix(k.FilePointer(), strings.ToLower(ref)) },
+		},
+	}
+
+	for _, tier := range tiers {
+		found, err := tier.find()
+		if err != nil {
+			return nil, err
+		}
+
+		switch len(found) {
+		case 0:
+			continue
+		case 1:
+			k, err := GetECDSA(c, found[0])
+			if err != nil {
+				return nil, err
+			}
+
+			if !tier.matches(k.Struct()) {
+				return nil, eer.NewKeyIntegrityError(fmt.Sprintf(
+					"index entry for %s does not match key %s, run `store verify`", ref, found[0]))
+			}
+
+			return k, nil
+		default:
+			return nil, ambiguous(c, ref, found)
+		}
+	}
+
+	return nil, eer.NewKeyPathError(fmt.Sprintf("no key matches: %s", ref))
+}
+
+func ambiguous(c config.Reader, ref string, found []string) error {
+	sort.Strings(found)
+
+	lines := []string{fmt.Sprintf("%s %q matches %d keys, use a longer or more specific reference:",
+		helpers.RFgB("ambiguous key reference"), ref, len(found))}
+
+	for _, gid := range found {
+		if k, err := GetECDSA(c, gid); err == nil {
+			lines = append(lines, fmt.Sprintf("  %s  name=%s slug=%s", gid, k.Struct().Name, k.Struct().Slug))
+		} else {
+			lines = append(lines, fmt.Sprintf("  %s", gid))
+		}
+	}
+
+	return eer.NewKeyAmbiguousError(strings.Join(lines, "\n"))
+}
+
+func unique(values []string) []string {
+	seen := map[string]bool{}
+	out := values[:0]
+
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,194 @@
+package ecdsa
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/block27/core/config"
+)
+
+// Sort orders accepted by ListOptions
+const (
+	SortCreated = "created"
+	SortName    = "name"
+	SortStatus  = "status"
+	SortCurve   = "curve"
+)
+
+// ListOptions filters, sorts and paginates ListECDSAWith. Zero values match
+// everything, so the zero ListOptions lists all keys oldest first.
+type ListOptions struct {
+	Name        string            // case insensitive substring of the name
+	Slug        string            // exact slug
+	Curve       string            // e.g. prime256v1
+	Status      string            // e.g. active
+	Label       string            // key carries this label
+	Tags        map[string]string // key carries every tag, an empty value matches any
+	Fingerprint string            // prefix of the SHA256 or MD5 fingerprint
+	GIDs        []string          // only these keys, every key when nil
+
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+
+	Sort   string // one of Sort*, default SortCreated
+	Desc   bool
+	Offset int
+	Limit  int // 0 is unlimited
+}
+
+// ListECDSAWith returns the page of keys matching the options along with the
+// total number of matches before pagination
+func ListECDSAWith(c config.Reader, o ListOptions) ([]KeyAPI, int, error) {
+	less, err := o.less()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	all, err := ListECDSA(c)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var keys []KeyAPI
+
+	for _, k := range all {
+		if o.Match(k.Struct()) {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.SliceStable(keys, func(i, j int) bool {
+		if o.Desc {
+			return less(keys[j].Struct(), keys[i].Struct())
+		}
+
+		return less(keys[i].Struct(), keys[j].Struct())
+	})
+
+	total := len(keys)
+
+	if o.Offset >= total {
+		return nil, total, nil
+	}
+
+	if o.Offset > 0 {
+		keys = keys[o.Offset:]
+	}
+
+	if o.Limit > 0 && o.Limit < len(keys) {
+		keys = keys[:o.Limit]
+	}
+
+	return keys, total, nil
+}
+
+// Match reports whether the key satisfies every filter
+func (o ListOptions) Match(k *key) bool {
+	if o.Name != "" && !strings.Contains(strings.ToLower(k.Name), strings.ToLower(o.Name)) {
+		return false
+	}
+
+	if o.Slug != "" && k.Slug != o.Slug {
+		return false
+	}
+
+	if o.Curve != "" && k.Curve() != o.Curve {
+		return false
+	}
+
+	if o.Status != "" && k.Status != o.Status {
+		return false
+	}
+
+	if o.Label != "" && !hasLabel(k.Labels, o.Label) {
+		return false
+	}
+
+	for name, val := range o.Tags {
+		v, ok := k.Tags[name]
+		if !ok || (val != "" && v != val) {
+			return false
+		}
+	}
+
+	if o.Fingerprint != "" && !matchFingerprint(k, o.Fingerprint) {
+		return false
+	}
+
+	if o.GIDs != nil && !hasLabel(o.GIDs, k.FilePointer()) {
+		return false
+	}
+
+	if !o.CreatedAfter.IsZero() && k.CreatedAt.Before(o.CreatedAfter) {
+		return false
+	}
+
+	if !o.CreatedBefore.IsZero() && !k.CreatedAt.Before(o.CreatedBefore) {
+		return false
+	}
+
+	return true
+}
+
+func (o ListOptions) less() (func(a, b *key) bool, error) {
+	switch o.Sort {
+	case "", SortCreated:
+		return func(a, b *key) bool { return a.CreatedAt.Before(b.CreatedAt) }, nil
+	case SortName:
+		return func(a, b *key) bool { return a.Name < b.Name }, nil
+	case SortStatus:
+		return func(a, b *key) bool { return a.Status < b.Status }, nil
+	case SortCurve:
+		return func(a, b *key) bool { return a.Curve() < b.Curve() }, nil
+	default:
+		return nil, fmt.Errorf("invalid sort: %s, usage: [%s, %s, %s, %s]",
+			o.Sort, SortCreated, SortName, SortStatus, SortCurve)
+	}
+}
+
+// ParseTags turns k=v pairs into a tag map, a bare k matches any value
+func ParseTags(pairs []string) (map[string]string, error) {
+	tags := map[string]string{}
+
+	for _, p := range pairs {
+		kv := strings.SplitN(p, "=", 2)
+
+		name := strings.TrimSpace(kv[0])
+		if name == "" {
+			return nil, fmt.Errorf("invalid tag: %q, usage: key=value", p)
+		}
+
+		if len(kv) == 2 {
+			tags[name] = strings.TrimSpace(kv[1])
+		} else {
+			tags[name] = ""
+		}
+	}
+
+	return tags, nil
+}
+
+// matchFingerprint reports whether fp is a prefix of the key's SHA256
+// fingerprint, as printed by ssh-keygen with or without its SHA256: prefix,
+// or of its MD5 fingerprint with or without colons
+func matchFingerprint(k *key, fp string) bool {
+	if sha := strings.TrimPrefix(fp, "SHA256:"); strings.HasPrefix(k.FingerprintSHA, sha) {
+		return true
+	}
+
+	md5 := strings.Replace(strings.ToLower(strings.TrimPrefix(fp, "MD5:")), ":", "", -1)
+
+	return md5 != "" && strings.HasPrefix(strings.Replace(k.FingerprintMD5, ":", "", -1), md5)
+}
+
+func hasLabel(labels []string, label string) bool {
+	for _, l := range labels {
+		if l == label {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,449 @@
+package ecdsa
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/helpers"
+	eer "github.com/block27/core/services/dsa/errors"
+	"github.com/block27/core/services/keystore"
+)
+
+// schemaVersion is the key record format written by this build
+//
+//	1  base64 gob of the key struct, no version marker
+//	2  JSON {"schema": 2, "key": {...}} holding the exported key fields
+//	3  key file paths dropped, records live in the keystore
+//	4  records carry a MAC under the master key, see sealedSchema
+//	5  records carry a version the MAC covers, see versionedSchema
+const schemaVersion = 5
+
+// sealedSchema is the first version whose records carry a MAC. Older ones
+// are only ever loaded by `store migrate`, which seals them, otherwise an
+// edited record could simply claim an older version to skip the check.
+const sealedSchema = 4
+
+// versionedSchema is the first version whose records carry a version, one
+// more on every write of the key and checked against the store state so an
+// older record put back in place is refused
+const versionedSchema = 5
+
+// migration upgrades a record payload from one schema version to the next
+type migration func(payload []byte) ([]byte, error)
+
+// migrations are keyed by the schema version they upgrade from. A format
+// change bumps schemaVersion and registers the step from the previous one.
+var migrations = map[int]migration{
+	1: migrateGOB,
+	2: dropPaths,
+	3: seal,
+	4: seal,
+}
+
+// record is the versioned envelope stored in the keystore
+type record struct {
+	Schema  int             `json:"schema"`
+	Version uint64          `json:"version,omitempty"`
+	Key     json.RawMessage `json:"key"`
+	MAC     []byte          `json:"mac,omitempty"`
+}
+
+// Integrity failures reported by decodeRecord, see VerifyStore
+var (
+	errUnsealed = eer.NewKeyIntegrityError("key record predates integrity protection, run `store migrate`")
+	errTampered = eer.NewKeyIntegrityError("key record failed its integrity check, it was altered or not written by this device")
+	errReplayed = eer.NewKeyIntegrityError("key record is older than the last one written for the key, it was rolled back")
+
+	errStateTampered = eer.NewKeyIntegrityError("key store state failed its integrity check, it was altered or not written by this device")
+	errRefused       = eer.NewKeyIntegrityError("key store is sealed, records predating integrity protection are refused")
+)
+
+// LoadFailure is a key record that could not be read or migrated
+type LoadFailure struct {
+	GID string
+	Err error
+}
+
+func (f LoadFailure) Error() string {
+	return fmt.Sprintf("%s: %v", f.GID, f.Err)
+}
+
+// encodeRecord serialises and seals the key at the current schema version
+func encodeRecord(k *key) ([]byte, error) {
+	payload, err := json.Marshal(k)
+	if err != nil {
+		return nil, err
+	}
+
+	mac, err := crypto.RecordMAC(macInput(k.FilePointer(), schemaVersion, k.version, payload))
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(record{Schema: schemaVersion, Version: k.version, Key: payload, MAC: mac})
+}
+
+// macInput binds the MAC to the GID, schema and record version as well as
+// the payload, so neither records nor MACs can be swapped between keys or
+// passed off as another version
+func macInput(gid string, schema int, version uint64, payload []byte) []byte {
+	if schema < versionedSchema {
+		return append([]byte(fmt.Sprintf("%s\x00%d\x00", gid, schema)), payload...)
+	}
+
+	return append([]byte(fmt.Sprintf("%s\x00%d\x00%d\x00", gid, schema, version)), payload...)
+}
+
+// decodeRecord reads a sealed record of any known schema version, checking
+// its MAC and upgrading it in memory, and returns the version it was stored
+// at
+func decodeRecord(data []byte) (*key, int, error) {
+	return readRecord(data, false)
+}
+
+// decodeUnsealed is decodeRecord also accepting the records written before
+// sealedSchema, for migrating them
+func decodeUnsealed(data []byte) (*key, int, error) {
+	return readRecord(data, true)
+}
+
+// loadRecord is decodeRecord for the record stored under gid, which must be
+// the key's own and no older than the last one written according to st
+func loadRecord(st *storeState, gid string, data []byte) (*key, error) {
+	k, _, err := decodeRecord(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if k.FilePointer() != gid {
+		return nil, errTampered
+	}
+
+	if err := st.check(k); err != nil {
+		return nil, err
+	}
+
+	k.raw = data
+
+	return k, nil
+}
+
+func readRecord(data []byte, unsealed bool) (*key, int, error) {
+	schema, payload := 1, bytes.TrimSpace(data)
+
+	var r record
+
+	// Version 1 is bare base64, which can never start with a brace
+	if len(payload) > 0 && payload[0] == '{' {
+		if err := json.Unmarshal(payload, &r); err != nil {
+			return nil, 0, eer.NewKeyObjtError(fmt.Sprintf("invalid key record: %v", err))
+		}
+
+		schema, payload = r.Schema, r.Key
+	}
+
+	if schema < 1 || schema > schemaVersion {
+		return nil, 0, eer.NewKeyObjtError(fmt.Sprintf("unsupported key record schema %d, this build reads up to %d",
+			schema, schemaVersion))
+	}
+
+	if schema < sealedSchema && !unsealed {
+		return nil, 0, errUnsealed
+	}
+
+	if schema >= sealedSchema {
+		var id struct{ GID string }
+		if err := json.Unmarshal(payload, &id); err != nil {
+			return nil, 0, eer.NewKeyObjtError(fmt.Sprintf("invalid key record: %v", err))
+		}
+
+		ok, err := crypto.CheckRecordMAC(macInput(id.GID, schema, r.Version, payload), r.MAC)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if !ok {
+			return nil, 0, errTampered
+		}
+	}
+
+	stored := schema
+
+	for ; schema < schemaVersion; schema++ {
+		m, ok := migrations[schema]
+		if !ok {
+			return nil, 0, eer.NewKeyObjtError(fmt.Sprintf("no migration from key record schema %d", schema))
+		}
+
+		var err error
+		if payload, err = m(payload); err != nil {
+			return nil, 0, eer.NewKeyObjtError(fmt.Sprintf("key record schema %d: %v", schema, err))
+		}
+	}
+
+	var k key
+	if err := json.Unmarshal(payload, &k); err != nil {
+		return nil, 0, eer.NewKeyObjtError(fmt.Sprintf("invalid key record: %v", err))
+	}
+
+	k.version = r.Version
+
+	return &k, stored, nil
+}
+
+// migrateGOB turns a version 1 gob record into the version 2 JSON payload
+func migrateGOB(payload []byte) ([]byte, error) {
+	k, err := keyFromGOB64(string(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(k)
+}
+
+// dropPaths removes the paths of the key files written next to version 2
+// records, the record itself carries the same material
+func dropPaths(payload []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, err
+	}
+
+	for _, f := range []string{"PrivatePemPath", "PrivateKeyPath", "PublicKeyPath"} {
+		delete(fields, f)
+	}
+
+	return json.Marshal(fields)
+}
+
+// seal leaves the payload as is, encodeRecord adds the MAC and version when
+// the migrated record is saved
+func seal(payload []byte) ([]byte, error) {
+	return payload, nil
+}
+
+// ScanECDSA is ListECDSA that also returns the records that could not be
+// loaded, rather than skipping them. Keys are returned oldest first.
+func ScanECDSA(c config.Reader) ([]KeyAPI, []LoadFailure, error) {
+	s, err := openStore(c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	st, err := loadState(s)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var keys []KeyAPI
+	var failures []LoadFailure
+
+	if err := s.List(kind, func(gid string, data []byte) error {
+		k, err := loadRecord(st, gid, data)
+		if err != nil {
+			failures = append(failures, LoadFailure{GID: gid, Err: err})
+			return nil
+		}
+
+		k.c = c
+		keys = append(keys, k)
+
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].Struct().CreatedAt.Before(keys[j].Struct().CreatedAt)
+	})
+
+	return keys, failures, nil
+}
+
+// MigrateStore upgrades every key record to the current schema version. Keys
+// still in the original directory layout under paths.keys are moved into
+// the keystore, their directory removed once the record is committed. It
+// returns the GIDs migrated and the records that could not be, which are
+// left untouched. Private material still in plaintext is wrapped under the
+// master key on the way, see EncryptStore.
+//
+// Sealing the records written before integrity protection happens once: the
+// store is marked sealed when the migration completes, or from the start on
+// a store that never held such records, and unsealed records are refused
+// from then on rather than sealed, they cannot have been written here.
+func MigrateStore(c config.Reader) ([]string, []LoadFailure, error) {
+	s, err := openStore(c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	st, err := loadState(s)
+	if err == nil && st.missing {
+		st, err = newState(c, s)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	migrated, failures, err := importLegacy(c, s, st)
+	if err != nil {
+		return migrated, failures, err
+	}
+
+	var stale []*key
+
+	if err := s.List(kind, func(gid string, data []byte) error {
+		k, stored, err := decodeUnsealed(data)
+		if err == nil {
+			k.raw = data
+		}
+
+		if err == nil && k.FilePointer() != gid {
+			err = fmt.Errorf("%s %s", helpers.RFgB("record belongs to key"), k.FilePointer())
+		}
+
+		if err == nil && stored < sealedSchema && st.Sealed {
+			err = errRefused
+		}
+
+		if err == nil {
+			err = st.check(k)
+		}
+
+		if err != nil {
+			failures = append(failures, LoadFailure{GID: gid, Err: err})
+		} else if stored < schemaVersion {
+			stale = append(stale, k)
+		}
+
+		return nil
+	}); err != nil {
+		return migrated, failures, err
+	}
+
+	for _, k := range stale {
+		if _, err := k.wrap(); err != nil {
+			failures = append(failures, LoadFailure{GID: k.FilePointer(), Err: err})
+			continue
+		}
+
+		if err := k.write(s, st); err != nil {
+			failures = append(failures, LoadFailure{GID: k.FilePointer(), Err: conflictError(err)})
+			continue
+		}
+
+		migrated = append(migrated, k.FilePointer())
+	}
+
+	st.Sealed = true
+
+	return migrated, failures, saveState(s, st)
+}
+
+// legacyFiles are the files of the original directory layout, the record and
+// the key files next to it that duplicate its material
+var legacyFiles = []string{"obj.bin", "public.key", "private.key", "private.pem"}
+
+// importLegacy moves <paths.keys>/ecdsa/<gid>/obj.bin records into the
+// keystore. Only legacyFiles are removed once the record is committed, the
+// directory goes with them when nothing else, such as signatures, is kept
+// in it.
+func importLegacy(c config.Reader, s keystore.Store, st *storeState) ([]string, []LoadFailure, error) {
+	// The fs backend keeps records in this very layout, the stale ones are
+	// upgraded in place like any other
+	if keystore.Backend(c) == keystore.FS {
+		return nil, nil, nil
+	}
+
+	root := fmt.Sprintf("%s/ecdsa", c.GetString("paths.keys"))
+
+	files, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var migrated []string
+	var failures []LoadFailure
+
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(root, f.Name())
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, "obj.bin"))
+		if os.IsNotExist(err) {
+			// Already imported, what is left is the user's
+			continue
+		}
+
+		if err != nil {
+			failures = append(failures, LoadFailure{GID: f.Name(), Err: err})
+			continue
+		}
+
+		k, stored, err := decodeUnsealed(data)
+		if err == nil && stored < sealedSchema && st.Sealed {
+			err = errRefused
+		}
+
+		if err != nil {
+			failures = append(failures, LoadFailure{GID: f.Name(), Err: err})
+			continue
+		}
+
+		if k.FilePointer() != f.Name() {
+			failures = append(failures, LoadFailure{GID: f.Name(),
+				Err: fmt.Errorf("%s %s", helpers.RFgB("record belongs to key"), k.FilePointer())})
+			continue
+		}
+
+		if _, err := s.Get(kind, k.FilePointer()); err == nil {
+			failures = append(failures, LoadFailure{GID: f.Name(),
+				Err: fmt.Errorf("%s %s", helpers.RFgB("already in the keystore, remove by hand:"), dir)})
+			continue
+		}
+
+		if _, err := k.wrap(); err != nil {
+			failures = append(failures, LoadFailure{GID: f.Name(), Err: err})
+			continue
+		}
+
+		if err := k.write(s, st); err != nil {
+			failures = append(failures, LoadFailure{GID: f.Name(), Err: conflictError(err)})
+			continue
+		}
+
+		for _, name := range legacyFiles {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+				return migrated, failures, err
+			}
+		}
+
+		// Fails, leaving the directory, unless it is empty
+		os.Remove(dir)
+
+		migrated = append(migrated, k.FilePointer())
+	}
+
+	// The JSON lookup index is superseded by the keystore indexes
+	os.Remove(fmt.Sprintf("%s/ecdsa.index.json", c.GetString("paths.keys")))
+
+	return migrated, failures, nil
+}
@@ -0,0 +1,163 @@
+package ecdsa
+
+import (
+	"encoding/base64"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/crypto"
+	eer "github.com/block27/core/services/dsa/errors"
+	"github.com/block27/core/services/keystore"
+)
+
+// resealed is a key read for Reseal, with its private material unwrapped
+type resealed struct {
+	k     *key
+	plain []byte
+	prev  []byte
+}
+
+// resealer rewrites the key records and store state under the master key
+type resealer struct {
+	s  keystore.Store
+	st *storeState
+
+	// state as stored, nil when none was
+	state []byte
+
+	keys    []*resealed
+	written int
+}
+
+// Reseal reads every key record and the store state under the master key
+// loaded, for crypto.RotateMasterKey to wrap and seal under the next one,
+// and returns how many keys it read. A record that does not load is
+// refused, it could never be read again; `store verify` and `store migrate`
+// report them.
+func Reseal(c config.Reader) (crypto.Resealer, int, error) {
+	s, err := openStore(c)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	unsealed, _, err := schemas(c, s)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if unsealed {
+		return nil, 0, eer.NewKeyIntegrityError("key records predating integrity protection remain, run `store migrate`")
+	}
+
+	r := &resealer{s: s}
+
+	if r.state, err = s.Get(stateKind, stateGID); err != nil && err != keystore.ErrNotFound {
+		return nil, 0, err
+	}
+
+	if r.st, err = loadState(s); err == nil && r.st.missing {
+		r.st, err = newState(c, s)
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := s.List(kind, func(gid string, data []byte) error {
+		k, err := loadRecord(r.st, gid, data)
+		if err != nil {
+			return LoadFailure{GID: gid, Err: err}
+		}
+
+		rk := &resealed{k: k}
+
+		if k.Encrypted && k.PrivateKeyB64 != "" {
+			wrapped, err := base64.StdEncoding.DecodeString(k.PrivateKeyB64)
+			if err == nil {
+				rk.plain, err = crypto.Unwrap(wrapped)
+			}
+
+			if err != nil {
+				return LoadFailure{GID: gid, Err: err}
+			}
+		}
+
+		r.keys = append(r.keys, rk)
+
+		return nil
+	}); err != nil {
+		return nil, 0, err
+	}
+
+	return r, len(r.keys), nil
+}
+
+// Seal wraps the private material under the master key loaded and writes
+// every record at its next version, then the state
+func (r *resealer) Seal() error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	// The unwrapped material is not kept past this call, whatever happens
+	defer func() {
+		for _, rk := range r.keys {
+			for i := range rk.plain {
+				rk.plain[i] = 0
+			}
+		}
+	}()
+
+	for _, rk := range r.keys {
+		if rk.plain != nil {
+			wrapped, err := crypto.Wrap(rk.plain)
+			if err != nil {
+				return err
+			}
+
+			rk.k.PrivateKeyB64 = base64.StdEncoding.EncodeToString(wrapped)
+		}
+
+		rk.prev = rk.k.raw
+		r.written++
+
+		if err := rk.k.write(r.s, r.st); err != nil {
+			return conflictError(err)
+		}
+	}
+
+	if r.state == nil && len(r.keys) == 0 {
+		return nil
+	}
+
+	return saveState(r.s, r.st)
+}
+
+// Restore puts back the records Seal wrote and the state as it was
+func (r *resealer) Restore() error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	var first error
+
+	for i := r.written - 1; i >= 0; i-- {
+		rk := r.keys[i]
+
+		if err := r.s.Put(kind, keystore.Entry{GID: rk.k.FilePointer(), Data: rk.prev, Index: rk.k.index()}); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	var err error
+	if r.state == nil {
+		if err = r.s.Delete(stateKind, stateGID); err == keystore.ErrNotFound {
+			err = nil
+		}
+	} else {
+		err = r.s.Put(stateKind, keystore.Entry{GID: stateGID, Data: r.state})
+	}
+
+	if err != nil && first == nil {
+		first = err
+	}
+
+	return first
+}
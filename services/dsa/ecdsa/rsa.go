@@ -0,0 +1,202 @@
+package ecdsa
+
+import (
+	gocrypto "crypto"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/helpers"
+	api "github.com/block27/core/services/dsa"
+	eer "github.com/block27/core/services/dsa/errors"
+	"github.com/block27/core/services/dsa/policy"
+	renc "github.com/block27/core/services/dsa/rsa/encodings"
+	sig "github.com/block27/core/services/dsa/signature"
+)
+
+// RSATypes lists the RSA sizes keys can be created with, given wherever a
+// curve is. RSA keys sign digests with PKCS #1 v1.5.
+var RSATypes = []string{"rsa2048", "rsa3072", "rsa4096"}
+
+// KeyTypes lists everything keys can be created as, Curves and RSATypes
+var KeyTypes = append(append([]string{}, Curves...), RSATypes...)
+
+// rsaStrength maps an RSA size to the size of a curve of comparable strength
+// as per SP 800-57 table 2, which is what digests are picked by
+var rsaStrength = map[string]int{
+	"rsa2048": 224,
+	"rsa3072": 256,
+	"rsa4096": 256,
+}
+
+// IsRSA reports whether a key type names an RSA size rather than a curve
+func IsRSA(ty string) bool {
+	_, ok := rsaStrength[ty]
+	return ok
+}
+
+// CheckMode refuses the payload modes a key type cannot sign in. RSA names
+// the digest inside the signature, so it only signs in sig.ModeOpenSSL.
+func CheckMode(ty string, mode string) error {
+	if IsRSA(ty) && mode != sig.ModeOpenSSL {
+		return fmt.Errorf("%s keys only sign in %s mode", ty, sig.ModeOpenSSL)
+	}
+
+	return nil
+}
+
+// CheckHash refuses the digests a key type cannot sign. RSA signatures name
+// the digest, which must be one crypto.HashID knows.
+func CheckHash(ty string, alg string) error {
+	if !IsRSA(ty) {
+		return nil
+	}
+
+	_, err := rsaHash(alg)
+	return err
+}
+
+// generateRSA creates the material of an RSA key of the size named, the
+// private key wrapped under the master key as NewECDSAWithPolicy wraps it
+func generateRSA(ty string) (*key, error) {
+	var bits int
+	if _, err := fmt.Sscanf(ty, "rsa%d", &bits); err != nil || !IsRSA(ty) {
+		return nil, fmt.Errorf("%s", helpers.RFgB("incorrect rsa size passed"))
+	}
+
+	pri, err := rsa.GenerateKey(crypto.Reader, bits)
+	if err != nil {
+		return nil, err
+	}
+
+	pemKey, pemPub, err := renc.Encode(pri)
+	if err != nil {
+		return nil, err
+	}
+
+	md5, err := renc.FingerprintMD5(&pri.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sha, err := renc.FingerprintSHA256(&pri.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := crypto.Wrap([]byte(pemKey))
+	if err != nil {
+		return nil, err
+	}
+
+	return &key{
+		KeyType:        fmt.Sprintf("rsa.PrivateKey <==> %s", ty),
+		PublicKeyB64:   base64.StdEncoding.EncodeToString([]byte(pemPub)),
+		PrivateKeyB64:  base64.StdEncoding.EncodeToString(wrapped),
+		Encrypted:      true,
+		FingerprintMD5: md5,
+		FingerprintSHA: sha,
+	}, nil
+}
+
+// privateKey returns the private key whichever its kind, unwrapped in memory
+func (k *key) privateKey() (gocrypto.Signer, error) {
+	if IsRSA(k.Curve()) {
+		return k.getRSAPrivateKey()
+	}
+
+	pri, err := k.getPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return pri, nil
+}
+
+// getRSAPrivateKey is getPrivateKey for RSA keys
+func (k *key) getRSAPrivateKey() (*rsa.PrivateKey, error) {
+	by, err := k.privatePEM()
+	if err != nil {
+		return nil, err
+	}
+
+	pri, err := renc.DecodePrivate(by)
+	if err != nil {
+		return nil, eer.NewKeyObjtError("invalid private key")
+	}
+
+	return pri, nil
+}
+
+// getRSAPublicKey is getPublicKey for RSA keys
+func (k *key) getRSAPublicKey() (*rsa.PublicKey, error) {
+	by, err := base64.StdEncoding.DecodeString(k.PublicKeyB64)
+	if err != nil {
+		return nil, err
+	}
+
+	return renc.DecodePublic(by)
+}
+
+// rsaHash returns the crypto.Hash an RSA signature over a digest of the
+// algorithm names, which RSA keys cannot do without
+func rsaHash(alg string) (gocrypto.Hash, error) {
+	if alg == "" {
+		return 0, fmt.Errorf("hash is required for RSA keys")
+	}
+
+	return crypto.HashID(alg)
+}
+
+// rsaSign signs the digest made by alg with PKCS #1 v1.5
+func rsaSign(pri *rsa.PrivateKey, alg string, digest []byte) ([]byte, error) {
+	h, err := rsaHash(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	return rsa.SignPKCS1v15(crypto.Reader, pri, h, digest)
+}
+
+// signRSA signs a digest made by alg with the checks Sign applies
+func (k *key) signRSA(alg string, digest []byte) ([]byte, error) {
+	if !api.CanSign(k.Status) {
+		return nil, eer.NewKeyStatusError(fmt.Sprintf("key is %s, signing refused", k.Status))
+	}
+
+	if err := k.Authorize(policy.OpSign, alg); err != nil {
+		return nil, err
+	}
+
+	if _, err := k.reserve(1); err != nil {
+		return nil, err
+	}
+
+	pri, err := k.getRSAPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return rsaSign(pri, alg, digest)
+}
+
+// verifyRSA checks a PKCS #1 v1.5 signature over a digest made by alg,
+// false as Verify is for keys that may no longer verify
+func (k *key) verifyRSA(alg string, digest []byte, signature []byte) (bool, error) {
+	h, err := rsaHash(alg)
+	if err != nil {
+		return false, err
+	}
+
+	if !api.CanVerify(k.Status) || !k.Policy.Allows(policy.OpVerify) {
+		return false, nil
+	}
+
+	pub, err := k.getRSAPublicKey()
+	if err != nil {
+		return false, err
+	}
+
+	return rsa.VerifyPKCS1v15(pub, h, digest, signature) == nil, nil
+}
@@ -9,12 +9,12 @@ import (
 	"encoding/gob"
 	"encoding/pem"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/user"
 	"runtime"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -25,7 +25,9 @@ import (
 	enc "github.com/block27/core/services/dsa/ecdsa/encodings"
 	mar "github.com/block27/core/services/dsa/ecdsa/marshall"
 	eer "github.com/block27/core/services/dsa/errors"
+	"github.com/block27/core/services/dsa/policy"
 	sig "github.com/block27/core/services/dsa/signature"
+	"github.com/block27/core/services/keystore"
 
 	guuid "github.com/google/uuid"
 	"github.com/jedib0t/go-pretty/table"
@@ -36,6 +38,7 @@ import (
 type KeyAPI interface {
 	FilePointer() string
 	Struct() *key
+	BitSize() (int, error)
 
 	getArtSignature() string
 	getPrivateKey() (*ecdsa.PrivateKey, error)
@@ -44,6 +47,12 @@ type KeyAPI interface {
 	Marshall() (string, error)
 	Unmarshall(string) (KeyAPI, error)
 
+	SetStatus(c config.Reader, status string, reason string) error
+	Authorize(op string, hash string) error
+	Label(c config.Reader, add []string, remove []string) error
+	Tag(c config.Reader, set map[string]string, remove []string) error
+	reserve(int) (int, error)
+
 	Sign([]byte) (*sig.Signature, error)
 	Verify([]byte, *sig.Signature) bool
 }
@@ -60,23 +69,46 @@ type key struct {
 	// Slug auto generated from Haiku *not indexed
 	Slug string
 
-	// Hold the base key status, {archive, active}
+	// Hold the base key status, {active, archive, compromised, destroyed}
 	Status string
 
+	// Every status change the key went through, oldest first
+	Transitions []api.Transition
+
+	// Usage restrictions fixed at create time
+	Policy policy.Policy
+
+	// Signatures produced, only tracked when the policy caps them
+	Signatures int
+
 	// Basically the elliptic curve size of the key
 	KeyType string
 
+	// Free-form labels and key/value tags, editable after creation
+	Labels []string
+	Tags   map[string]string
+
 	FingerprintMD5 string // Real fingerprint in  MD5  (legacy)  of the key
 	FingerprintSHA string // Real fingerprint in  SHA256  of the key
 
-	PrivatePemPath string // Pem PKS8 format of the private key
-	PrivateKeyPath string // ECDSA path for private key
-	PublicKeyPath  string // ECDSA path for public key
-
 	PrivateKeyB64 string // B64 of private key
 	PublicKeyB64  string // B64 of public key
 
+	// Private material above and in private.key/private.pem is wrapped under
+	// the hardware master key, false only on stores predating encryption
+	Encrypted bool
+
 	CreatedAt time.Time
+
+	// config the key was loaded with, used to persist usage counters
+	c config.Reader
+
+	// version of the record the key was loaded from, see versionedSchema
+	version uint64
+
+	// record the key was loaded from, saving swaps it for the new one and
+	// fails when another copy of the key saved first
+	raw []byte
 }
 
 // NewECDSABlank simply returns a blank object of KeyAPI/key struct
@@ -88,6 +120,44 @@ func NewECDSABlank(c config.Reader) (KeyAPI, error) {
 // complicated but what happens here is complete key generation using our
 // cyrpto/rand lib, and then writes encrypted key to FS
 func NewECDSA(c config.Reader, name string, curve string) (KeyAPI, error) {
+	return NewECDSAWithPolicy(c, name, curve, policy.Policy{})
+}
+
+// NewECDSAWithPolicy is NewECDSA restricted by a usage policy. Curve may
+// name one of RSATypes as well, for an RSA key.
+func NewECDSAWithPolicy(c config.Reader, name string, curve string, p policy.Policy) (KeyAPI, error) {
+	if name == "" {
+		return nil, fmt.Errorf("name cannot be empty")
+	}
+
+	generate := generateECDSA
+	if IsRSA(curve) {
+		generate = generateRSA
+	}
+
+	key, err := generate(curve)
+	if err != nil {
+		return nil, err
+	}
+
+	key.GID = api.GenerateUUID()
+	key.Name = name
+	key.Slug = helpers.NewHaikunator().Haikunate()
+	key.Status = api.StatusActive
+	key.Policy = p
+	key.CreatedAt = time.Now()
+	key.c = c
+
+	// Store the record, refusing a name already in use
+	if err := key.create(c); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// generateECDSA creates the material of a key on the curve named
+func generateECDSA(curve string) (*key, error) {
 	// Validate the type of curve passed
 	ec, ty, err := getCurve(curve)
 	if err != nil {
@@ -109,74 +179,63 @@ func NewECDSA(c config.Reader, name string, curve string) (KeyAPI, error) {
 		return nil, perr
 	}
 
-	// Create the key struct object
-	key := &key{
-		GID:            api.GenerateUUID(),
-		Name:           name,
-		Slug:           helpers.NewHaikunator().Haikunate(),
+	// Private material is only ever stored wrapped under the master key
+	wrapped, err := crypto.Wrap([]byte(pemKey))
+	if err != nil {
+		return nil, err
+	}
+
+	return &key{
 		KeyType:        fmt.Sprintf("ecdsa.PrivateKey <==> %s", ty),
-		Status:         api.StatusActive,
 		PublicKeyB64:   base64.StdEncoding.EncodeToString([]byte(pemPub)),
-		PrivateKeyB64:  base64.StdEncoding.EncodeToString([]byte(pemKey)),
+		PrivateKeyB64:  base64.StdEncoding.EncodeToString(wrapped),
+		Encrypted:      true,
 		FingerprintMD5: enc.FingerprintMD5(pub),
 		FingerprintSHA: enc.FingerprintSHA256(pub),
-		CreatedAt:      time.Now(),
-	}
-
-	// Write the entire key object to FS
-	if err := key.writeToFS(c, pri, pub); err != nil {
-		return nil, err
-	}
-
-	return key, nil
+	}, nil
 }
 
-// GetECDSA fetches a system key that lives on the file system. Return useful
+// GetECDSA fetches a system key from the keystore. Return useful
 // identification data aobut the key, likes its SHA256 and MD5 signatures
 func GetECDSA(c config.Reader, fp string) (KeyAPI, error) {
-	dirPath := fmt.Sprintf("%s/ecdsa/%s", c.GetString("paths.keys"), fp)
-	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
+	s, err := openStore(c)
+	if err != nil {
+		return (*key)(nil), err
+	}
+
+	data, err := s.Get(kind, fp)
+	if err == keystore.ErrNotFound {
 		return (*key)(nil), eer.NewKeyPathError("invalid key path")
+	} else if err != nil {
+		return (*key)(nil), eer.NewKeyObjtError("invalid key objt")
 	}
 
-	data, err := helpers.ReadFile(fmt.Sprintf("%s/obj.bin", dirPath))
+	st, err := loadState(s)
 	if err != nil {
-		return (*key)(nil), eer.NewKeyObjtError("invalid key objt")
+		return (*key)(nil), err
 	}
 
-	obj, err := keyFromGOB64(data)
+	obj, err := loadRecord(st, fp, data)
 	if err != nil {
 		return (*key)(nil), err
 	}
 
+	obj.c = c
+
 	return obj, nil
 }
 
 // ListECDSA returns a list of active keys stored on the local filesystem. Of
-// which are all encrypted via AES from the hardware block
+// which are all encrypted via AES from the hardware block. Records that fail
+// to load are left out with a warning on stderr, see ScanECDSA.
 func ListECDSA(c config.Reader) ([]KeyAPI, error) {
-	files, err := ioutil.ReadDir(fmt.Sprintf("%s/ecdsa", c.GetString("paths.keys")))
-	if err != nil {
-		return nil, err
-	}
-
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].ModTime().Before(files[j].ModTime())
-	})
-
-	var keys []KeyAPI
+	keys, failures, err := ScanECDSA(c)
 
-	for _, f := range files {
-		_key, _err := GetECDSA(c, f.Name())
-
-		if _err != nil {
-			continue
-		}
-
-		keys = append(keys, _key)
+	for _, f := range failures {
+		fmt.Fprintf(os.Stderr, "%s %v\n", helpers.YFgB("skipping unreadable key"), f)
 	}
 
-	return keys, nil
+	return keys, err
 }
 
 // ImportPublicECDSA imports an existing ECDSA key into a KeyAPI object for
@@ -218,99 +277,170 @@ func ImportPublicECDSA(c config.Reader, name string, curve string, public []byte
 		FingerprintMD5: enc.FingerprintMD5(pub),
 		FingerprintSHA: enc.FingerprintSHA256(pub),
 		CreatedAt:      time.Now(),
+		c:              c,
 	}
 
-	// Write the entire key object to FS
-	if err := key.writeToFS(c, nil, pub); err != nil {
+	// Store the record, refusing a name already in use
+	if err := key.create(c); err != nil {
 		return nil, err
 	}
 
 	return key, nil
 }
 
-// writeToFS publishes the keys to the filesystem
-func (k *key) writeToFS(c config.Reader, pri *ecdsa.PrivateKey, pub *ecdsa.PublicKey) error {
-	// Create the keys root directory based on it's FilePointer method
-	dirPath := fmt.Sprintf("%s/ecdsa/%s", c.GetString("paths.keys"), k.FilePointer())
-	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
-		os.Mkdir(dirPath, os.ModePerm)
-	}
+// SetStatus moves the key to a new lifecycle state, recording when and why.
+// Destroying a key erases its private material from the record.
+func (k *key) SetStatus(c config.Reader, status string, reason string) error {
+	k.sink.Lock()
+	defer k.sink.Unlock()
 
-	k.PublicKeyPath = fmt.Sprintf("%s/%s", dirPath, "public.key")
-	k.PrivateKeyPath = fmt.Sprintf("%s/%s", dirPath, "private.key")
-	k.PrivatePemPath = fmt.Sprintf("%s/%s", dirPath, "private.pem")
+	return k.update(c, func() (bool, error) {
+		if err := api.CheckTransition(k.Status, status); err != nil {
+			return false, err
+		}
 
-	// OBJ marshalling -----------------------------------------------------------
-	objPath := fmt.Sprintf("%s/%s", dirPath, "obj.bin")
-	objFile, err := os.Create(objPath)
-	if err != nil {
-		return err
-	}
-	defer objFile.Close()
+		if status == api.StatusDestroyed {
+			k.PrivateKeyB64 = ""
+		}
 
-	// Marshall the objects
-	obj, err := keyToGOB64(k)
-	if err != nil {
-		return err
+		k.Transitions = append(k.Transitions, api.Transition{
+			From:   k.Status,
+			To:     status,
+			Reason: reason,
+			At:     time.Now(),
+		})
+		k.Status = status
+
+		return true, nil
+	})
+}
+
+// Authorize checks an operation, and for signing the digest used, against the
+// key policy
+func (k *key) Authorize(op string, hash string) error {
+	if err := k.Policy.Authorize(op, hash, time.Now()); err != nil {
+		return eer.NewKeyPolicyError(err.Error())
 	}
 
-	if _, err := helpers.WriteBinary(objPath, []byte(obj)); err != nil {
-		return err
+	return nil
+}
+
+// reserve claims up to n signatures from the policy limit and returns how
+// many were granted. The counter is only persisted for capped keys, the
+// status and limit are checked against the stored record for every key.
+func (k *key) reserve(n int) (int, error) {
+	k.sink.Lock()
+	defer k.sink.Unlock()
+
+	if k.c == nil {
+		if k.Policy.Remaining(k.Signatures) < 0 {
+			return n, nil
+		}
+
+		return 0, eer.NewKeyPolicyError("policy: key has no store to record usage")
 	}
 
-	// Public Key ----------------------------------------------------------------
-	if pub != nil {
-		publickeyFile, err := os.Create(k.PublicKeyPath)
-		if err != nil {
-			return err
+	granted := 0
+
+	err := k.update(k.c, func() (bool, error) {
+		granted = 0
+
+		if !api.CanSign(k.Status) {
+			return false, eer.NewKeyStatusError(
+				fmt.Sprintf("key is %s, signing refused", k.Status))
+		}
+
+		remaining := k.Policy.Remaining(k.Signatures)
+		if remaining < 0 {
+			granted = n
+			return false, nil
+		}
+
+		if remaining == 0 {
+			return false, eer.NewKeyPolicyError(fmt.Sprintf(
+				"policy: signature limit of %d reached", k.Policy.MaxSignatures))
 		}
 
-		pubBytes, err := x509.MarshalPKIXPublicKey(pub)
-		if err != nil {
-			return err
+		granted = n
+		if granted > remaining {
+			granted = remaining
 		}
 
-		publickeyFile.Write(pubBytes)
-		publickeyFile.Close()
+		k.Signatures += granted
+
+		return true, nil
+	})
+
+	if err != nil {
+		return 0, err
 	}
 
-	// Private Key ---------------------------------------------------------------
-	if pri != nil {
-		privatekeyFile, err := os.Create(k.PrivateKeyPath)
-		if err != nil {
-			return err
+	return granted, nil
+}
+
+// Curve returns the curve name recorded in KeyType, e.g. prime256v1
+func (k *key) Curve() string {
+	parts := strings.Split(k.KeyType, " <==> ")
+
+	return parts[len(parts)-1]
+}
+
+// Label adds and removes labels, keeping them unique and sorted
+func (k *key) Label(c config.Reader, add []string, remove []string) error {
+	k.sink.Lock()
+	defer k.sink.Unlock()
+
+	return k.update(c, func() (bool, error) {
+		set := map[string]bool{}
+		for _, l := range k.Labels {
+			set[l] = true
+		}
+
+		for _, l := range add {
+			if l = strings.TrimSpace(l); l != "" {
+				set[l] = true
+			}
+		}
+
+		for _, l := range remove {
+			delete(set, strings.TrimSpace(l))
 		}
 
-		priBytes, priErr := x509.MarshalECPrivateKey(pri)
-		if priErr != nil {
-			return priErr
+		labels := make([]string, 0, len(set))
+		for l := range set {
+			labels = append(labels, l)
 		}
 
-		privatekeyFile.Write(priBytes)
-		privatekeyFile.Close()
+		sort.Strings(labels)
+		k.Labels = labels
 
-		// Private Pem -------------------------------------------------------------
-		pemfile, err := os.Create(k.PrivatePemPath)
-		if err != nil {
-			return err
+		return true, nil
+	})
+}
+
+// Tag sets and removes key/value tags
+func (k *key) Tag(c config.Reader, set map[string]string, remove []string) error {
+	k.sink.Lock()
+	defer k.sink.Unlock()
+
+	return k.update(c, func() (bool, error) {
+		tags := map[string]string{}
+		for name, val := range k.Tags {
+			tags[name] = val
 		}
 
-		// Marshall the private key to PKCS8
-		pem509, pemErr := x509.MarshalPKCS8PrivateKey(pri)
-		if pemErr != nil {
-			return pemErr
+		for name, val := range set {
+			tags[name] = val
 		}
 
-		// Create pem file
-		if e := pem.Encode(pemfile, &pem.Block{
-			Type:  enc.ECPrivateKey,
-			Bytes: pem509,
-		}); e != nil {
-			return e
+		for _, name := range remove {
+			delete(tags, name)
 		}
-	}
 
-	return nil
+		k.Tags = tags
+
+		return true, nil
+	})
 }
 
 // FilePointer returns a string that will represent the path the key can be
@@ -319,19 +449,19 @@ func (k *key) FilePointer() string {
 	return k.GID.String()
 }
 
-// Marshall dumps the entire object to Base64 encoding
+// Marshall dumps the entire object as a current version key record
 func (k *key) Marshall() (string, error) {
-	d, err := keyToGOB64(k)
+	d, err := encodeRecord(k)
 	if err != nil {
 		return "", err
 	}
 
-	return d, nil
+	return string(d), nil
 }
 
-// Unmarshall returns a Base64 string to a KeyAPI object
+// Unmarshall returns a key record of any known version to a KeyAPI object
 func (k *key) Unmarshall(obj string) (KeyAPI, error) {
-	d, err := keyFromGOB64(obj)
+	d, _, err := decodeRecord([]byte(obj))
 	if err != nil {
 		return (KeyAPI)(nil), err
 	}
@@ -346,12 +476,45 @@ func (k *key) Struct() *key {
 	return k
 }
 
+// BitSize returns the size of the key's underlying curve, used to pick a
+// digest of matching strength. RSA keys give the size of a curve as strong.
+func (k *key) BitSize() (int, error) {
+	if IsRSA(k.Curve()) {
+		return CurveBits(k.Curve())
+	}
+
+	pub, err := k.getPublicKey()
+	if err != nil {
+		return 0, err
+	}
+
+	return pub.Params().BitSize, nil
+}
+
 // Sign signs a hash (which should be the result of hashing a larger message)
 // using the private key, priv. If the hash is longer than the bit-length of the
 // private key's curve order, the hash will be truncated to that length.  It
 // returns the signature as a pair of integers{R,S}. The security of the private
-// key depends on the entropy of rand / which in this case we implement our own
+// key depends on the entropy of rand / which in this case we implement our own.
+// RSA keys sign through SignDigest, which knows the hash.
 func (k *key) Sign(data []byte) (*sig.Signature, error) {
+	if IsRSA(k.Curve()) {
+		return (*sig.Signature)(nil), eer.NewKeyObjtError("RSA keys have no {R,S} signature, use SignDigest")
+	}
+
+	if !api.CanSign(k.Status) {
+		return (*sig.Signature)(nil), eer.NewKeyStatusError(
+			fmt.Sprintf("key is %s, signing refused", k.Status))
+	}
+
+	if err := k.Authorize(policy.OpSign, ""); err != nil {
+		return (*sig.Signature)(nil), err
+	}
+
+	if _, err := k.reserve(1); err != nil {
+		return (*sig.Signature)(nil), err
+	}
+
 	pri, err := k.getPrivateKey()
 	if err != nil {
 		return (*sig.Signature)(nil), err
@@ -371,8 +534,13 @@ func (k *key) Sign(data []byte) (*sig.Signature, error) {
 }
 
 // Verify verifies the signature in r, s of hash using the public key, pub. Its
-// return value records whether the signature is valid.
+// return value records whether the signature is valid. Destroyed keys never
+// verify, nor do RSA keys, see VerifyDigest.
 func (k *key) Verify(hash []byte, sig *sig.Signature) bool {
+	if IsRSA(k.Curve()) || !api.CanVerify(k.Status) || !k.Policy.Allows(policy.OpVerify) {
+		return false
+	}
+
 	pub, err := k.getPublicKey()
 	if err != nil {
 		panic(err)
@@ -381,6 +549,24 @@ func (k *key) Verify(hash []byte, sig *sig.Signature) bool {
 	return ecdsa.Verify(pub, hash, sig.R, sig.S)
 }
 
+// Curves lists the curve names keys can be created on
+var Curves = []string{"secp224r1", "prime256v1", "secp384r1", "secp521r1"}
+
+// CurveBits returns the size in bits of a curve named in Curves, or for one
+// of RSATypes that of a curve of the same strength
+func CurveBits(curve string) (int, error) {
+	if bits, ok := rsaStrength[curve]; ok {
+		return bits, nil
+	}
+
+	c, _, err := getCurve(curve)
+	if err != nil {
+		return 0, err
+	}
+
+	return c.Params().BitSize, nil
+}
+
 // getCurve checks the string param matched and should return a valid ec curve
 func getCurve(curve string) (elliptic.Curve, string, error) {
 	switch curve {
@@ -436,15 +622,19 @@ func (k *key) getArtSignature() string {
 	return outStr
 }
 
-// getPrivateKey takes in the key's base64 encodings and converts to a valid
-// ecdsa.PrivateKey
+// getPrivateKey takes in the key's base64 encodings, unwraps them in memory
+// and converts to a valid ecdsa.PrivateKey
 func (k *key) getPrivateKey() (*ecdsa.PrivateKey, error) {
-	by, err := base64.StdEncoding.DecodeString(k.PrivateKeyB64)
+	by, err := k.privatePEM()
 	if err != nil {
 		return (*ecdsa.PrivateKey)(nil), err
 	}
 
 	block, _ := pem.Decode([]byte(by))
+	if block == nil {
+		return (*ecdsa.PrivateKey)(nil), eer.NewKeyObjtError("invalid private key")
+	}
+
 	tempKey, err := x509.ParseECPrivateKey(block.Bytes)
 	if err != nil {
 		return (*ecdsa.PrivateKey)(nil), err
@@ -453,6 +643,20 @@ func (k *key) getPrivateKey() (*ecdsa.PrivateKey, error) {
 	return tempKey, nil
 }
 
+// privatePEM returns the PEM of the private key, unwrapped in memory
+func (k *key) privatePEM() ([]byte, error) {
+	by, err := base64.StdEncoding.DecodeString(k.PrivateKeyB64)
+	if err != nil {
+		return nil, err
+	}
+
+	if k.Encrypted {
+		return crypto.Unwrap(by)
+	}
+
+	return by, nil
+}
+
 // getPublicKey takes in the key's base64 encodings and converts to a valid
 // ecdsa.PublicKey
 func (k *key) getPublicKey() (*ecdsa.PublicKey, error) {
@@ -462,16 +666,25 @@ func (k *key) getPublicKey() (*ecdsa.PublicKey, error) {
 	}
 
 	blockPub, _ := pem.Decode([]byte(by))
+	if blockPub == nil {
+		return (*ecdsa.PublicKey)(nil), eer.NewKeyObjtError("invalid public key")
+	}
+
 	genericPublicKey, err := x509.ParsePKIXPublicKey(blockPub.Bytes)
 	if err != nil {
 		return (*ecdsa.PublicKey)(nil), err
 	}
 
-	return genericPublicKey.(*ecdsa.PublicKey), nil
+	pub, ok := genericPublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return (*ecdsa.PublicKey)(nil), eer.NewKeyObjtError("not an ecdsa key")
+	}
+
+	return pub, nil
 }
 
 // keyToGOB64 takes a pointer to an existing key and return it's entire body
-// object base64 encoded for storage.
+// object base64 encoded, the version 1 record format.
 func keyToGOB64(k *key) (string, error) {
 	b := bytes.Buffer{}
 	e := gob.NewEncoder(&b)
@@ -483,8 +696,8 @@ func keyToGOB64(k *key) (string, error) {
 	return base64.StdEncoding.EncodeToString(b.Bytes()), nil
 }
 
-// keyFromGOB64 takes a base64 encoded string and convert that to an object. We
-// need a way to handle updates here.
+// keyFromGOB64 takes a base64 encoded string and convert that to an object,
+// only used to read version 1 records, see migrateGOB.
 func keyFromGOB64(str string) (*key, error) {
 	by, err := base64.StdEncoding.DecodeString(str)
 	if err != nil {
@@ -498,7 +711,11 @@ func keyFromGOB64(str string) (*key, error) {
 	var k *key
 
 	if err = d.Decode(&k); err != nil {
-		fmt.Println("failed gob Decode", err)
+		return (*key)(nil), err
+	}
+
+	if k == nil {
+		return (*key)(nil), fmt.Errorf("empty gob record")
 	}
 
 	return k, nil
@@ -542,6 +759,26 @@ func PrintKeysTW(keys []KeyAPI) {
 				"Type",
 				helpers.RFgB(f.Struct().KeyType),
 			},
+			{
+				"Status",
+				f.Struct().Status,
+			},
+			{
+				"Labels",
+				strings.Join(f.Struct().Labels, ", "),
+			},
+			{
+				"Tags",
+				formatTags(f.Struct().Tags),
+			},
+			{
+				"Policy",
+				f.Struct().Policy.String(),
+			},
+			{
+				"Signatures",
+				f.Struct().Signatures,
+			},
 			{
 				"Created",
 				f.Struct().CreatedAt,
@@ -588,6 +825,18 @@ func PrintKeysTW(keys []KeyAPI) {
 	}
 }
 
+// formatTags renders tags as sorted k=v pairs
+func formatTags(tags map[string]string) string {
+	var pairs []string
+	for name, val := range tags {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", name, val))
+	}
+
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ", ")
+}
+
 // PrintKeyTW takes an array of keys and runs them through prettyPrint function
 func PrintKeyTW(k *key) {
 	PrintKeysTW([]KeyAPI{k})
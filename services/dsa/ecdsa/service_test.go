@@ -1,34 +1,55 @@
 package ecdsa
 
 import (
+	"bytes"
+	gocrypto "crypto"
+	goecdsa "crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"math/big"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
 	"github.com/block27/core/config"
+	"github.com/block27/core/crypto"
 	"github.com/block27/core/helpers"
 	"github.com/block27/core/test"
 
+	api "github.com/block27/core/services/dsa"
 	enc "github.com/block27/core/services/dsa/ecdsa/encodings"
+	eer "github.com/block27/core/services/dsa/errors"
+	"github.com/block27/core/services/dsa/policy"
+	sig "github.com/block27/core/services/dsa/signature"
+	"github.com/block27/core/services/keystore"
 )
 
 var Config config.Reader
-var Curves = []string{
-	"secp224r1",
-	"prime256v1",
-	"secp384r1",
-	"secp521r1",
-}
 
 var Key *key
 
+// uniqueName suffixes key names, they must be unique within the store and the
+// test store outlives a single run
+func uniqueName(base string) string {
+	return fmt.Sprintf("%s-%s", base, api.GenerateUUID().String()[:8])
+}
+
 func init() {
 	os.Setenv("ENVIRONMENT", "test")
 
@@ -41,7 +62,12 @@ func init() {
 		panic(fmt.Errorf("test [environment] is not in [test] mode"))
 	}
 
-	k1, err := NewECDSA(c, "test-key-0", "prime256v1")
+	// Stands in for HardwareAuthenticate, which needs the device attached
+	if err := crypto.LoadMasterKey([]byte(test.MasterKey), []byte(test.MasterIv)); err != nil {
+		panic(err)
+	}
+
+	k1, err := NewECDSA(c, uniqueName("test-key-0"), "prime256v1")
 	if err != nil {
 		panic(err)
 	}
@@ -65,14 +91,14 @@ func TestImportPublicECDSA256v1(t *testing.T) {
 		t.Fail()
 	}
 
-	k1, e := ImportPublicECDSA(Config, "prime256v1-name", "prime256v1", pub.GetBody())
+	k1, e := ImportPublicECDSA(Config, uniqueName("prime256v1-name"), "prime256v1", pub.GetBody())
 	if e != nil {
 		t.Fail()
 	}
 
 	AssertStructCorrectness(t, k1, "PublicKey", "prime256v1")
 
-	if k1.Struct().Name != "prime256v1-name" {
+	if !strings.HasPrefix(k1.Struct().Name, "prime256v1-name-") {
 		t.Fail()
 	}
 
@@ -82,8 +108,7 @@ func TestImportPublicECDSA256v1(t *testing.T) {
 
 	t.Logf("successfully imported [prime256v1-pubkey] [%s]", k1.FilePointer())
 
-	ClearSingleTestKey(t, fmt.Sprintf("%s/ecdsa/%s", Config.GetString("paths.keys"),
-		k1.FilePointer()))
+	ClearSingleTestKey(t, Config, k1)
 }
 
 func TestImportPublicECDSA384r1(t *testing.T) {
@@ -92,14 +117,14 @@ func TestImportPublicECDSA384r1(t *testing.T) {
 		t.Fail()
 	}
 
-	k1, e := ImportPublicECDSA(Config, "secp384r1-name", "secp384r1", pub.GetBody())
+	k1, e := ImportPublicECDSA(Config, uniqueName("secp384r1-name"), "secp384r1", pub.GetBody())
 	if e != nil {
 		t.Fail()
 	}
 
 	AssertStructCorrectness(t, k1, "PublicKey", "secp384r1")
 
-	if k1.Struct().Name != "secp384r1-name" {
+	if !strings.HasPrefix(k1.Struct().Name, "secp384r1-name-") {
 		t.Fail()
 	}
 
@@ -109,8 +134,7 @@ func TestImportPublicECDSA384r1(t *testing.T) {
 
 	t.Logf("successfully imported [secp384r1-pubkey] [%s]", k1.FilePointer())
 
-	ClearSingleTestKey(t, fmt.Sprintf("%s/ecdsa/%s", Config.GetString("paths.keys"),
-		k1.FilePointer()))
+	ClearSingleTestKey(t, Config, k1)
 }
 
 func TestImportPublicECDSA512r1(t *testing.T) {
@@ -144,14 +168,14 @@ func TestImportPublicECDSA512r1(t *testing.T) {
 	}
 
 	// Valid key
-	k1, e := ImportPublicECDSA(Config, "secp521r1-name", "secp521r1", pub.GetBody())
+	k1, e := ImportPublicECDSA(Config, uniqueName("secp521r1-name"), "secp521r1", pub.GetBody())
 	if e != nil {
 		t.Fatal(e)
 	}
 
 	AssertStructCorrectness(t, k1, "PublicKey", "secp521r1")
 
-	if k1.Struct().Name != "secp521r1-name" {
+	if !strings.HasPrefix(k1.Struct().Name, "secp521r1-name-") {
 		t.Fatalf("k1.Struct().Name did not equal expected valud: %s", k1.Struct().Name)
 	}
 
@@ -161,19 +185,18 @@ func TestImportPublicECDSA512r1(t *testing.T) {
 
 	t.Logf("successfully imported [secp521r1-pubkey] [%s]", k1.FilePointer())
 
-	ClearSingleTestKey(t, fmt.Sprintf("%s/ecdsa/%s", Config.GetString("paths.keys"),
-		k1.FilePointer()))
+	ClearSingleTestKey(t, Config, k1)
 }
 
 func TestNewECDSA(t *testing.T) {
 	// Invalid curve
-	_, q := NewECDSA(Config, "test-key-1", "prim56v1")
+	_, q := NewECDSA(Config, uniqueName("test-key-1"), "prim56v1")
 	if q == nil {
 		t.Fatal("invalid curve")
 	}
 
 	// Valid
-	k, err := NewECDSA(Config, "test-key-1", "prime256v1")
+	k, err := NewECDSA(Config, uniqueName("test-key-1"), "prime256v1")
 	if err != nil {
 		t.Fail()
 	}
@@ -190,11 +213,10 @@ func TestNewECDSA(t *testing.T) {
 		t.Fail()
 	}
 
-	// Check for filesystem keys are present
-	CheckFullKeyFileObjects(t, Config, k, "NewECDSA")
+	// Check the record landed in the keystore
+	CheckKeyRecord(t, Config, k, "NewECDSA")
 
-	ClearSingleTestKey(t, fmt.Sprintf("%s/ecdsa/%s", Config.GetString("paths.keys"),
-		k.FilePointer()))
+	ClearSingleTestKey(t, Config, k)
 }
 
 // TestVerifyReadability ...
@@ -208,11 +230,31 @@ func TestVerifyReadability(t *testing.T) {
 
 	AssertStructCorrectness(t, getKey, "PrivateKey", "prime256v1")
 
-	path := fmt.Sprintf("%s/ecdsa/%s", Config.GetString("paths.keys"), getKey.FilePointer())
-	t.Logf("Path reference: %s\n", path)
+	stored, _, err := decodeRecord(storedRecord(t, Config, getKey.FilePointer()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(stored.PrivateKeyB64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if block, _ := pem.Decode(wrapped); block != nil {
+		t.Fatal("private key is stored in the clear")
+	}
+
+	pemBytes, err := crypto.Unwrap(wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		t.Fatal("unwrapped private key is not PEM")
+	}
 
-	priBytes, _ := helpers.ReadBinary(fmt.Sprintf("%s/private.key", path))
-	datPri, datErr := x509.ParseECPrivateKey(priBytes)
+	datPri, datErr := x509.ParseECPrivateKey(block.Bytes)
 	if datErr != nil {
 		t.Fatal(datErr)
 	}
@@ -281,7 +323,7 @@ func BenchmarkSignP224(b *testing.B) {
 	b.ResetTimer()
 	hashed := []byte("testing")
 
-	k, err := NewECDSA(Config, "bench-key-224", "secp224r1")
+	k, err := NewECDSA(Config, uniqueName("bench-key-224"), "secp224r1")
 	if err != nil {
 		b.Fail()
 	}
@@ -304,7 +346,7 @@ func BenchmarkSignP256(b *testing.B) {
 	b.ResetTimer()
 	hashed := []byte("testing")
 
-	k, err := NewECDSA(Config, "bench-key-256", "prime256v1")
+	k, err := NewECDSA(Config, uniqueName("bench-key-256"), "prime256v1")
 	if err != nil {
 		b.Fail()
 	}
@@ -327,7 +369,7 @@ func BenchmarkSignP384(b *testing.B) {
 	b.ResetTimer()
 	hashed := []byte("testing")
 
-	k, err := NewECDSA(Config, "bench-key-384", "secp384r1")
+	k, err := NewECDSA(Config, uniqueName("bench-key-384"), "secp384r1")
 	if err != nil {
 		b.Fail()
 	}
@@ -350,7 +392,7 @@ func BenchmarkSignP521(b *testing.B) {
 	b.ResetTimer()
 	hashed := []byte("testing")
 
-	k, err := NewECDSA(Config, "bench-key-521", "secp521r1")
+	k, err := NewECDSA(Config, uniqueName("bench-key-521"), "secp521r1")
 	if err != nil {
 		b.Fail()
 	}
@@ -373,7 +415,7 @@ func BenchmarkVerifyP224(b *testing.B) {
 	b.ResetTimer()
 	hashed := []byte("testing")
 
-	k, err := NewECDSA(Config, "bench-key-224", "secp224r1")
+	k, err := NewECDSA(Config, uniqueName("bench-key-224"), "secp224r1")
 	if err != nil {
 		b.Fail()
 	}
@@ -395,7 +437,7 @@ func BenchmarkVerifyP256(b *testing.B) {
 	b.ResetTimer()
 	hashed := []byte("testing")
 
-	k, err := NewECDSA(Config, "bench-key-256", "prime256v1")
+	k, err := NewECDSA(Config, uniqueName("bench-key-256"), "prime256v1")
 	if err != nil {
 		b.Fail()
 	}
@@ -417,7 +459,7 @@ func BenchmarkVerifyP384(b *testing.B) {
 	b.ResetTimer()
 	hashed := []byte("testing")
 
-	k, err := NewECDSA(Config, "bench-key-384", "secp384r1")
+	k, err := NewECDSA(Config, uniqueName("bench-key-384"), "secp384r1")
 	if err != nil {
 		b.Fail()
 	}
@@ -439,7 +481,7 @@ func BenchmarkVerifyP521(b *testing.B) {
 	b.ResetTimer()
 	hashed := []byte("testing")
 
-	k, err := NewECDSA(Config, "bench-key-521", "secp521r1")
+	k, err := NewECDSA(Config, uniqueName("bench-key-521"), "secp521r1")
 	if err != nil {
 		b.Fail()
 	}
@@ -557,13 +599,7 @@ func TestUnmarshall(t *testing.T) {
 		t.Fail()
 	}
 
-	path := fmt.Sprintf("%s/ecdsa/%s", Config.GetString("paths.keys"), k.FilePointer())
-	obPa := fmt.Sprintf("%s/obj.bin", path)
-
-	objBytes, objErr := helpers.ReadBinary(obPa)
-	if objErr != nil {
-		t.Fatal(objErr)
-	}
+	objBytes := storedRecord(t, Config, k.FilePointer())
 
 	unmarshalled, err := k.Unmarshall(string(objBytes))
 	if err != nil {
@@ -633,23 +669,49 @@ func TestKeyToGOB64(t *testing.T) {
 }
 
 func TestKeyFromGOB64(t *testing.T) {
-	file := fmt.Sprintf("%s/ecdsa/%s/obj.bin", Config.GetString("paths.keys"), Key.FilePointer())
-	data, err := helpers.ReadFile(file)
+	if _, err := keyFromGOB64(base64.StdEncoding.EncodeToString([]byte("not gob"))); err == nil {
+		t.Fatal("invalid gob decoded")
+	}
+}
+
+func TestDecodeRecord(t *testing.T) {
+	k, schema, err := decodeRecord(storedRecord(t, Config, Key.FilePointer()))
 	if err != nil {
-		t.Logf(err.Error())
-		t.Fail()
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, schemaVersion, schema)
+
+	if err := checkFields(Key, k); err != nil {
+		t.Fatal(err)
 	}
 
-	key64, err := keyFromGOB64(data)
+	// Version 1 records are upgraded in memory
+	gob64, err := keyToGOB64(Key)
 	if err != nil {
-		t.Logf(err.Error())
-		t.Fail()
+		t.Fatal(err)
 	}
 
-	if err := checkFields(Key, key64); err != nil {
-		t.Logf(err.Error())
-		t.Fail()
+	// Only migrations may read records written before they were sealed
+	_, _, err = decodeRecord([]byte(gob64))
+	assert.Equal(t, errUnsealed, err)
+
+	k, schema, err = decodeUnsealed([]byte(gob64))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 1, schema)
+
+	if err := checkFields(Key, k); err != nil {
+		t.Fatal(err)
 	}
+
+	_, _, err = decodeRecord([]byte(`{"schema": 99, "key": {}}`))
+	assert.NotNil(t, err)
+
+	_, _, err = decodeRecord([]byte(`{"schema": 2, "key": `))
+	assert.NotNil(t, err)
 }
 
 func checkFields(original *key, copied *key) error {
@@ -685,17 +747,1320 @@ func checkFields(original *key, copied *key) error {
 		return fmt.Errorf("failed[PublicKeyB64]")
 	}
 
-	if !reflect.DeepEqual(original.PublicKeyPath, copied.PublicKeyPath) {
-		return fmt.Errorf("failed[PublicKeyPath]")
+	return nil
+}
+
+func TestBitSize(t *testing.T) {
+	size, err := Key.BitSize()
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	if !reflect.DeepEqual(original.PrivateKeyPath, copied.PrivateKeyPath) {
-		return fmt.Errorf("failed[PrivateKeyPath]")
+	assert.Equal(t, 256, size)
+}
+
+func TestSignOpenSSLInterop(t *testing.T) {
+	bin, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip("openssl binary not available")
 	}
 
-	if !reflect.DeepEqual(original.PrivatePemPath, copied.PrivatePemPath) {
-		return fmt.Errorf("failed[PrivatePemPath]")
+	data, _ := helpers.ReadBinary("../../../data/hello")
+	digest := sha256.Sum256(data)
+
+	payload, err := sig.Payload(digest[:], sig.ModeOpenSSL)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	return nil
+	s, err := Key.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := s.SigToDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, _ := base64.StdEncoding.DecodeString(Key.PublicKeyB64)
+
+	dir, err := ioutil.TempDir("", "interop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "public.pem"), pub, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "signature.der"), der, 0600)
+
+	out, err := exec.Command(bin, "dgst", "-sha256",
+		"-verify", filepath.Join(dir, "public.pem"),
+		"-signature", filepath.Join(dir, "signature.der"),
+		"../../../data/hello").CombinedOutput()
+	if err != nil {
+		t.Fatalf("openssl rejected signature: %s", out)
+	}
+}
+
+func TestNewSigner(t *testing.T) {
+	s, err := NewSigner(Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256([]byte("hello, world"))
+
+	der, err := s.Sign(nil, digest[:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs := struct{ R, S *big.Int }{}
+	if _, err := asn1.Unmarshal(der, &rs); err != nil {
+		t.Fatal(err)
+	}
+
+	pub := s.Public().(*goecdsa.PublicKey)
+	if !goecdsa.Verify(pub, digest[:], rs.R, rs.S) {
+		t.Fatal("signer produced an invalid signature")
+	}
+}
+
+func TestSignBatch(t *testing.T) {
+	pub, err := Key.getPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var items []BatchItem
+	for i := 0; i < 32; i++ {
+		d := sha256.Sum256([]byte(fmt.Sprintf("manifest-%d", i)))
+		items = append(items, BatchItem{
+			ID:     fmt.Sprintf("m%d", i),
+			Digest: fmt.Sprintf("%x", d[:]),
+			Hash:   "sha256",
+		})
+	}
+
+	// Malformed and mismatched items must fail on their own
+	items = append(items,
+		BatchItem{ID: "bad-hex", Digest: "zz"},
+		BatchItem{ID: "bad-len", Digest: "abcd", Hash: "sha256"},
+	)
+
+	results, err := SignBatch(Key, items, sig.ModeOpenSSL, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, len(items), len(results))
+
+	for i, res := range results {
+		assert.Equal(t, i, res.Index)
+		assert.Equal(t, items[i].ID, res.ID)
+
+		if i >= 32 {
+			assert.NotEmpty(t, res.Error)
+			assert.Empty(t, res.Signature)
+			continue
+		}
+
+		der, err := base64.StdEncoding.DecodeString(res.Signature)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var rs struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(der, &rs); err != nil {
+			t.Fatal(err)
+		}
+
+		d := sha256.Sum256([]byte(fmt.Sprintf("manifest-%d", i)))
+		if !goecdsa.Verify(pub, d[:], rs.R, rs.S) {
+			t.Fatalf("item %d: signature does not verify", i)
+		}
+	}
+}
+
+func TestSignVerifyDigest(t *testing.T) {
+	d := sha256.Sum256([]byte("digest"))
+	item := BatchItem{Digest: fmt.Sprintf("%x", d[:]), Hash: "sha256"}
+
+	der, err := SignDigest(Key, item, sig.ModeOpenSSL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := VerifyDigest(Key, item, sig.ModeOpenSSL, der)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// The same digest signed in the other mode is a different payload
+	ok, err = VerifyDigest(Key, item, sig.ModeLegacy, der)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	_, err = VerifyDigest(Key, item, sig.ModeOpenSSL, []byte("not der"))
+	assert.NotNil(t, err)
+
+	_, err = SignDigest(Key, BatchItem{Digest: "abcd", Hash: "sha256"}, sig.ModeOpenSSL)
+	assert.NotNil(t, err)
+}
+
+func TestRSA(t *testing.T) {
+	k, err := NewECDSA(Config, uniqueName("test-rsa"), "rsa2048")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ClearSingleTestKey(t, Config, k)
+
+	assert.Equal(t, "rsa.PrivateKey <==> rsa2048", k.Struct().KeyType)
+	assert.Equal(t, "rsa2048", k.Struct().Curve())
+	assert.True(t, k.Struct().Encrypted)
+	assert.NotEmpty(t, k.Struct().FingerprintSHA)
+
+	bits, err := k.BitSize()
+	assert.Nil(t, err)
+	assert.Equal(t, 224, bits)
+
+	pub, err := k.Struct().getRSAPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 2048, pub.N.BitLen())
+
+	// The ECDSA accessors refuse the key rather than panic
+	_, err = k.getPublicKey()
+	assert.NotNil(t, err)
+	_, err = k.Sign(make([]byte, 32))
+	assert.NotNil(t, err)
+
+	d := sha256.Sum256([]byte("digest"))
+	item := BatchItem{Digest: fmt.Sprintf("%x", d[:]), Hash: "sha256"}
+
+	signature, err := SignDigest(k, item, sig.ModeOpenSSL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, rsa.VerifyPKCS1v15(pub, gocrypto.SHA256, d[:], signature))
+
+	ok, err := VerifyDigest(k, item, sig.ModeOpenSSL, signature)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	other := sha256.Sum256([]byte("other"))
+	ok, err = VerifyDigest(k, BatchItem{Digest: fmt.Sprintf("%x", other[:]), Hash: "sha256"}, sig.ModeOpenSSL, signature)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// RSA names the digest, so it needs a hash it can name and the raw digest
+	_, err = SignDigest(k, item, sig.ModeLegacy)
+	assert.NotNil(t, err)
+	_, err = SignDigest(k, BatchItem{Digest: item.Digest}, sig.ModeOpenSSL)
+	assert.NotNil(t, err)
+	_, err = SignDigest(k, BatchItem{Digest: item.Digest, Hash: "sha3-256"}, sig.ModeOpenSSL)
+	assert.NotNil(t, err)
+	_, err = SignBatch(k, []BatchItem{item}, sig.ModeLegacy, 1)
+	assert.NotNil(t, err)
+
+	results, err := SignBatch(k, []BatchItem{item, {Digest: item.Digest}}, sig.ModeOpenSSL, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batched, err := base64.StdEncoding.DecodeString(results[0].Signature)
+	assert.Nil(t, err)
+	assert.Nil(t, rsa.VerifyPKCS1v15(pub, gocrypto.SHA256, d[:], batched))
+	assert.NotEmpty(t, results[1].Error)
+
+	s, err := NewSigner(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := s.Sign(nil, d[:], gocrypto.SHA256)
+	assert.Nil(t, err)
+	assert.Nil(t, rsa.VerifyPKCS1v15(s.Public().(*rsa.PublicKey), gocrypto.SHA256, d[:], signed))
+
+	_, err = s.Sign(nil, d[:], &rsa.PSSOptions{Hash: gocrypto.SHA256})
+	assert.NotNil(t, err)
+
+	// The record reads back and still unwraps
+	got, err := GetECDSA(Config, k.FilePointer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = got.Struct().privateKey()
+	assert.Nil(t, err)
+
+	bin, err := exec.LookPath("openssl")
+	if err != nil {
+		return
+	}
+
+	data, _ := helpers.ReadBinary("../../../data/hello")
+	digest := sha256.Sum256(data)
+
+	der, err := SignDigest(k, BatchItem{Digest: fmt.Sprintf("%x", digest[:]), Hash: "sha256"}, sig.ModeOpenSSL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "interop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pemPub, _ := base64.StdEncoding.DecodeString(k.Struct().PublicKeyB64)
+	ioutil.WriteFile(filepath.Join(dir, "public.pem"), pemPub, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "signature.bin"), der, 0600)
+
+	out, err := exec.Command(bin, "dgst", "-sha256",
+		"-verify", filepath.Join(dir, "public.pem"),
+		"-signature", filepath.Join(dir, "signature.bin"),
+		"../../../data/hello").CombinedOutput()
+	if err != nil {
+		t.Fatalf("openssl rejected signature: %s", out)
+	}
+}
+
+// TestSignatureFile signs the way dsa sign does and verifies the written file
+func TestSignatureFile(t *testing.T) {
+	d := sha256.Sum256([]byte("signature file"))
+
+	payload, err := sig.Payload(d[:], sig.ModeOpenSSL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Key.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := s.SigToDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := sig.File(Config.GetString("paths.signatures"), "", Key.FilePointer(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(sig.MetadataPath(path))
+	defer os.Remove(path)
+
+	assert.False(t, strings.HasPrefix(path, Config.GetString("paths.keys")))
+
+	meta := &sig.Metadata{Key: Key.FilePointer(), Hash: "sha256", Mode: sig.ModeOpenSSL, CreatedAt: time.Now()}
+	if err := sig.Write(path, der, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := sig.LoadSignature(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := sig.LoadMetadata(path)
+	if err != nil || m == nil {
+		t.Fatalf("sidecar not written: %v", err)
+	}
+
+	payload, err = sig.Payload(d[:], m.Mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, Key.FilePointer(), m.Key)
+	assert.True(t, Key.Verify(payload, loaded))
+
+	// An explicit output path wins
+	out, err := sig.File(Config.GetString("paths.signatures"), "/tmp/out.der", Key.FilePointer(), time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, "/tmp/out.der", out)
+}
+
+func TestSetStatus(t *testing.T) {
+	k, err := NewECDSA(Config, uniqueName("test-lifecycle"), "prime256v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := sha256.Sum256([]byte("lifecycle"))
+
+	active, err := k.Sign(d[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Archived keys refuse to sign but still verify
+	assert.Nil(t, k.SetStatus(Config, api.StatusArchived, "archived"))
+
+	if _, err := k.Sign(d[:]); err == nil {
+		t.Fatal("archived key signed")
+	}
+
+	if _, err := SignBatch(k, []BatchItem{{Digest: fmt.Sprintf("%x", d)}}, sig.ModeOpenSSL, 1); err == nil {
+		t.Fatal("archived key signed a batch")
+	}
+
+	assert.True(t, k.Verify(d[:], active))
+
+	assert.Nil(t, k.SetStatus(Config, api.StatusActive, "activated"))
+
+	if _, err := k.Sign(d[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compromised keys can never come back
+	assert.Nil(t, k.SetStatus(Config, api.StatusCompromised, api.ReasonCompromised))
+	assert.NotNil(t, k.SetStatus(Config, api.StatusActive, "activated"))
+
+	assert.Nil(t, k.SetStatus(Config, api.StatusDestroyed, "destroyed"))
+	assert.False(t, k.Verify(d[:], active))
+
+	// The persisted record carries the state and its full history
+	k2, err := GetECDSA(Config, k.FilePointer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, api.StatusDestroyed, k2.Struct().Status)
+	assert.Equal(t, "", k2.Struct().PrivateKeyB64)
+	assert.Equal(t, 4, len(k2.Struct().Transitions))
+	assert.Equal(t, api.StatusCompromised, k2.Struct().Transitions[3].From)
+	assert.False(t, k2.Struct().Transitions[3].At.IsZero())
+
+	// The public half stays usable
+	assert.True(t, k2.Struct().Encrypted)
+	if _, err := k2.getPublicKey(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPolicyEnforcement(t *testing.T) {
+	p, err := policy.New([]string{policy.OpSign}, time.Time{}, time.Time{}, 3, []string{"sha256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := NewECDSAWithPolicy(Config, uniqueName("test-policy"), "prime256v1", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := sha256.Sum256([]byte("policy"))
+
+	if _, err := k.Sign(d[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NotNil(t, k.Authorize(policy.OpExport, ""))
+	assert.NotNil(t, k.Authorize(policy.OpSign, "sha512"))
+
+	// Verify is not granted by this policy
+	s, _ := Key.Sign(d[:])
+	assert.False(t, k.Verify(d[:], s))
+
+	// Two signatures left: the sha512 and hashless items are refused and do
+	// not consume any, the third valid item hits the limit
+	items := []BatchItem{
+		{ID: "a", Digest: fmt.Sprintf("%x", d), Hash: "sha256"},
+		{ID: "b", Digest: fmt.Sprintf("%x", sha512.Sum512(d[:])), Hash: "sha512"},
+		{ID: "c", Digest: fmt.Sprintf("%x", d)},
+		{ID: "d", Digest: fmt.Sprintf("%x", d), Hash: "sha256"},
+		{ID: "e", Digest: fmt.Sprintf("%x", d), Hash: "sha256"},
+	}
+
+	results, err := SignBatch(k, items, sig.ModeOpenSSL, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NotEmpty(t, results[0].Signature)
+	assert.Contains(t, results[1].Error, "sha512")
+	assert.Contains(t, results[2].Error, "hash is required")
+	assert.NotEmpty(t, results[3].Signature)
+	assert.Contains(t, results[4].Error, "limit")
+
+	if _, err := k.Sign(d[:]); err == nil {
+		t.Fatal("signature limit not enforced")
+	}
+
+	// The counter survives a reload
+	k2, err := GetECDSA(Config, k.FilePointer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 3, k2.Struct().Signatures)
+	assert.Equal(t, p.Hashes, k2.Struct().Policy.Hashes)
+
+	if _, err := k2.Sign(d[:]); err == nil {
+		t.Fatal("signature limit not enforced after reload")
+	}
+}
+
+func TestConcurrentCopies(t *testing.T) {
+	p, err := policy.New([]string{policy.OpSign}, time.Time{}, time.Time{}, 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := NewECDSAWithPolicy(Config, uniqueName("test-copies"), "prime256v1", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two requests each load their own copy of the key
+	a, err := GetECDSA(Config, k.FilePointer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := GetECDSA(Config, k.FilePointer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := sha256.Sum256([]byte("copies"))
+
+	// Neither copy's counter is lost to the other's
+	for _, c := range []KeyAPI{a, b, a} {
+		if _, err := c.Sign(d[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reloaded, err := GetECDSA(Config, k.FilePointer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 3, reloaded.Struct().Signatures)
+
+	// Labels and tags set through one copy survive edits through the other
+	assert.Nil(t, a.Label(Config, []string{"one"}, nil))
+	assert.Nil(t, b.Label(Config, []string{"two"}, nil))
+	assert.Nil(t, a.Tag(Config, map[string]string{"env": "prod"}, nil))
+	assert.Nil(t, b.Tag(Config, map[string]string{"team": "ops"}, nil))
+
+	// A copy loaded before the revoke neither signs nor puts the status back
+	assert.Nil(t, a.SetStatus(Config, api.StatusCompromised, api.ReasonCompromised))
+
+	if _, err := b.Sign(d[:]); err == nil {
+		t.Fatal("stale copy signed with a revoked key")
+	}
+
+	assert.NotNil(t, b.SetStatus(Config, api.StatusArchived, "archived"))
+
+	reloaded, err = GetECDSA(Config, k.FilePointer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, api.StatusCompromised, reloaded.Struct().Status)
+	assert.Equal(t, 3, reloaded.Struct().Signatures)
+	assert.Equal(t, []string{"one", "two"}, reloaded.Struct().Labels)
+	assert.Equal(t, map[string]string{"env": "prod", "team": "ops"}, reloaded.Struct().Tags)
+
+	// A key whose signatures are not counted checks its status all the same
+	free, err := NewECDSA(Config, uniqueName("test-copies"), "prime256v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale, err := GetECDSA(Config, free.FilePointer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, free.SetStatus(Config, api.StatusArchived, "archived"))
+
+	if _, err := stale.Sign(d[:]); err == nil {
+		t.Fatal("stale copy signed with an archived key")
+	}
+}
+
+func TestListECDSAWith(t *testing.T) {
+	// Keys persist across runs in the test store, scope by a unique prefix
+	prefix := fmt.Sprintf("list-%d", time.Now().UnixNano())
+	start := time.Now()
+
+	var made []KeyAPI
+	for i, curve := range []string{"prime256v1", "secp384r1", "prime256v1"} {
+		k, err := NewECDSA(Config, fmt.Sprintf("%s-%d", prefix, i), curve)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		made = append(made, k)
+	}
+
+	assert.Nil(t, made[0].Label(Config, []string{"release", "ci", "release"}, nil))
+	assert.Nil(t, made[1].Label(Config, []string{"release"}, nil))
+	assert.Nil(t, made[1].Tag(Config, map[string]string{"env": "prod", "team": "a"}, nil))
+	assert.Nil(t, made[2].Tag(Config, map[string]string{"env": "dev"}, nil))
+	assert.Nil(t, made[0].Label(Config, nil, []string{"ci"}))
+
+	list := func(o ListOptions) []string {
+		o.Name = prefix
+
+		keys, _, err := ListECDSAWith(Config, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, k := range keys {
+			names = append(names, k.Struct().Name)
+		}
+
+		return names
+	}
+
+	name := func(i int) string { return fmt.Sprintf("%s-%d", prefix, i) }
+
+	assert.Equal(t, []string{name(0), name(1), name(2)}, list(ListOptions{}))
+	assert.Equal(t, []string{name(2), name(1), name(0)}, list(ListOptions{Sort: SortName, Desc: true}))
+	assert.Equal(t, []string{name(1)}, list(ListOptions{Curve: "secp384r1"}))
+	assert.Equal(t, []string{name(0), name(1)}, list(ListOptions{Label: "release"}))
+	assert.Equal(t, []string{name(1), name(2)}, list(ListOptions{Tags: map[string]string{"env": ""}}))
+	assert.Equal(t, []string{name(1)}, list(ListOptions{Tags: map[string]string{"env": "prod"}}))
+	assert.Equal(t, []string{name(2)}, list(ListOptions{Slug: made[2].Struct().Slug}))
+	assert.Equal(t, []string{name(1)}, list(ListOptions{Offset: 1, Limit: 1}))
+	assert.Nil(t, list(ListOptions{Offset: 5}))
+	assert.Nil(t, list(ListOptions{CreatedBefore: start}))
+	assert.Equal(t, 3, len(list(ListOptions{CreatedAfter: start})))
+
+	fp := made[1].Struct().FingerprintSHA[:12]
+	assert.Equal(t, []string{name(1)}, list(ListOptions{Fingerprint: "SHA256:" + fp}))
+	assert.Equal(t, []string{name(1)}, list(ListOptions{Fingerprint: made[1].Struct().FingerprintMD5[:8]}))
+
+	// Labels persist sorted and unique, the removed one is gone
+	k, err := GetECDSA(Config, made[0].FilePointer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"release"}, k.Struct().Labels)
+
+	if _, _, err := ListECDSAWith(Config, ListOptions{Sort: "size"}); err == nil {
+		t.Fatal("invalid sort accepted")
+	}
+
+	if _, err := ParseTags([]string{"=x"}); err == nil {
+		t.Fatal("empty tag name accepted")
+	}
+}
+
+func TestResolveECDSA(t *testing.T) {
+	name := uniqueName("test-resolve")
+
+	k, err := NewECDSA(Config, name, "prime256v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Names are unique within the store
+	if _, err := NewECDSA(Config, name, "prime256v1"); err == nil {
+		t.Fatal("duplicate name accepted")
+	}
+
+	gid := k.FilePointer()
+	s := k.Struct()
+
+	for _, ref := range []string{
+		gid,
+		name,
+		s.Slug,
+		s.FingerprintSHA,
+		"SHA256:" + s.FingerprintSHA,
+		s.FingerprintMD5,
+		strings.Replace(s.FingerprintMD5, ":", "", -1),
+		gid[:13],
+	} {
+		r, err := ResolveECDSA(Config, ref)
+		if err != nil {
+			t.Fatalf("%s: %v", ref, err)
+		}
+
+		assert.Equal(t, gid, r.FilePointer())
+	}
+
+	if _, err := ResolveECDSA(Config, "no-such-key-anywhere"); err == nil {
+		t.Fatal("unknown reference resolved")
+	}
+
+	// Too short to be taken as a prefix
+	if _, err := ResolveECDSA(Config, gid[:3]); err == nil {
+		t.Fatal("short prefix resolved")
+	}
+
+	_, err = ResolveECDSA(Config, "")
+	assert.NotNil(t, err)
+
+	// Stores from before names were unique can hold duplicates, which must be
+	// reported rather than silently picking one
+	a, err := NewECDSA(Config, uniqueName("test-resolve"), "prime256v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := openStore(Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := encodeRecord(a.Struct())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dup := a.Struct().index()
+	dup[indexName] = []string{name}
+
+	if err := store.Put(kind, keystore.Entry{GID: a.FilePointer(), Data: data, Index: dup}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ResolveECDSA(Config, name)
+	if _, ok := err.(*eer.KeyAmbiguous); !ok {
+		t.Fatalf("expected an ambiguous match, got %v", err)
+	}
+
+	assert.Contains(t, err.Error(), gid)
+	assert.Contains(t, err.Error(), a.FilePointer())
+
+	// A rebuilt index resolves the same keys
+	if _, err := RebuildIndex(Config); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := ResolveECDSA(Config, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, gid, r.FilePointer())
+}
+
+func TestEncryptStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := backendReader{Reader: Config, backend: keystore.FS, keys: dir}
+
+	// plaintext rewinds a key to how stores were written before encryption
+	// at rest
+	plaintext := func(k KeyAPI) *key {
+		pri, err := k.getPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pemKey, _, err := enc.Encode(pri, &pri.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		legacy := k.Struct()
+		legacy.PrivateKeyB64 = base64.StdEncoding.EncodeToString([]byte(pemKey))
+		legacy.Encrypted = false
+
+		return legacy
+	}
+
+	// A store of version 1 records does not load, encrypting fails until it
+	// is migrated
+	v1, err := NewECDSA(Config, uniqueName("test-encrypt"), "prime256v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v1Plain := plaintext(v1)
+	ClearSingleTestKey(t, Config, v1)
+
+	gob64, err := keyToGOB64(v1Plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := openStore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Put(kind, keystore.Entry{GID: v1.FilePointer(), Data: []byte(gob64), Index: v1Plain.index()}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = EncryptStore(c)
+	assert.NotNil(t, err)
+
+	// Migrating wraps its private material on the way
+	migrated, failures, err := MigrateStore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Empty(t, failures)
+	assert.Contains(t, migrated, v1.FilePointer())
+	assert.NotContains(t, string(storedRecord(t, c, v1.FilePointer())), v1Plain.PrivateKeyB64)
+
+	got, err := GetECDSA(c, v1.FilePointer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, got.Struct().Encrypted)
+
+	// Sealed records may still hold plaintext material
+	k, err := NewECDSA(c, uniqueName("test-encrypt"), "prime256v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pri, err := k.getPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	legacy := plaintext(k)
+	if err := legacy.save(c); err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, err = EncryptStore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{k.FilePointer()}, migrated)
+
+	got, err = GetECDSA(c, k.FilePointer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, got.Struct().Encrypted)
+	assert.NotEqual(t, legacy.PrivateKeyB64, got.Struct().PrivateKeyB64)
+	assert.NotContains(t, string(storedRecord(t, c, k.FilePointer())), legacy.PrivateKeyB64)
+
+	after, err := got.getPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, pri.D, after.D)
+
+	// Re-running leaves encrypted keys alone
+	again, err := EncryptStore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Empty(t, again)
+}
+
+func TestMigrateStore(t *testing.T) {
+	// A store upgraded from a release predating integrity protection, one
+	// holding no sealed record yet
+	base, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	c := backendReader{Reader: Config, backend: keystore.Bbolt, keys: filepath.Join(base, "keys"), base: base}
+
+	s, err := openStore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A key left in the original directory layout, as a gob record
+	legacy, err := NewECDSA(Config, uniqueName("test-migrate"), "prime256v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gob64, err := keyToGOB64(legacy.Struct())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ClearSingleTestKey(t, Config, legacy)
+
+	root := filepath.Join(c.keys, "ecdsa")
+	dir := filepath.Join(root, legacy.FilePointer())
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "obj.bin"), []byte(gob64), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files the user kept with the key are not the import's to remove
+	kept := filepath.Join(dir, "signature-1.der")
+	if err := ioutil.WriteFile(kept, []byte("signature"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A version 2 record still carrying key file paths
+	v2, err := NewECDSA(Config, uniqueName("test-migrate"), "prime256v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ClearSingleTestKey(t, Config, v2)
+
+	unsealed := func(k KeyAPI) []byte {
+		payload, err := json.Marshal(k.Struct())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		payload = append(payload[:len(payload)-1], []byte(`,"PrivateKeyPath":"/tmp/private.key"}`)...)
+		old, err := json.Marshal(record{Schema: 2, Key: payload})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return old
+	}
+
+	if err := s.Put(kind, keystore.Entry{GID: v2.FilePointer(), Data: unsealed(v2), Index: v2.Struct().index()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unreadable records, in either place, are reported rather than skipped
+	broken, err := ioutil.TempDir(root, "broken")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(broken, "obj.bin"), []byte("###"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := uniqueName("corrupt")
+	if err := s.Put(kind, keystore.Entry{GID: corrupt, Data: []byte("###")}); err != nil {
+		t.Fatal(err)
+	}
+
+	reported := func(failures []LoadFailure, gid string) bool {
+		for _, f := range failures {
+			if f.GID == gid {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	_, failures, err := ScanECDSA(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, reported(failures, corrupt))
+
+	migrated, failures, err := MigrateStore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Contains(t, migrated, legacy.FilePointer())
+	assert.Contains(t, migrated, v2.FilePointer())
+	assert.True(t, reported(failures, filepath.Base(broken)))
+	assert.True(t, reported(failures, corrupt))
+
+	if _, err := os.Stat(filepath.Join(dir, "obj.bin")); !os.IsNotExist(err) {
+		t.Fatal("legacy key record survived the import")
+	}
+
+	if _, err := os.Stat(kept); err != nil {
+		t.Fatalf("import removed a file it did not consume: %v", err)
+	}
+
+	for _, want := range []KeyAPI{legacy, v2} {
+		got, schema, err := decodeRecord(storedRecord(t, c, want.FilePointer()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, schemaVersion, schema)
+		assert.NotContains(t, string(storedRecord(t, c, want.FilePointer())), "PrivateKeyPath")
+
+		if err := checkFields(want.Struct(), got); err != nil {
+			t.Fatal(err)
+		}
+
+		// Migrated keys still resolve and sign
+		r, err := ResolveECDSA(c, want.Struct().Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := r.Sign([]byte("migrated")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	again, _, err := MigrateStore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NotContains(t, again, legacy.FilePointer())
+	assert.NotContains(t, again, v2.FilePointer())
+
+	// Migrating happens once: an unsealed record put in place afterwards is
+	// refused, not sealed
+	forged, err := NewECDSA(Config, uniqueName("test-migrate"), "prime256v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ClearSingleTestKey(t, Config, forged)
+
+	if err := s.Put(kind, keystore.Entry{GID: forged.FilePointer(), Data: unsealed(forged),
+		Index: forged.Struct().index()}); err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, failures, err = MigrateStore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NotContains(t, migrated, forged.FilePointer())
+	assert.True(t, reported(failures, forged.FilePointer()))
+
+	_, err = GetECDSA(c, forged.FilePointer())
+	assert.Equal(t, errUnsealed, err)
+}
+
+// backendReader points the keystore at another backend
+type backendReader struct {
+	config.Reader
+	backend string
+	keys    string
+	base    string
+}
+
+func (b backendReader) GetString(key string) string {
+	switch key {
+	case "keystore.backend":
+		return b.backend
+	case "paths.keys":
+		return b.keys
+	case "paths.base":
+		if b.base != "" {
+			return b.base
+		}
+	}
+
+	return b.Reader.GetString(key)
+}
+
+func TestKeystoreBackends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, backend := range []string{keystore.FS, keystore.Memory} {
+		c := backendReader{Reader: Config, backend: backend, keys: dir}
+
+		k, err := NewECDSA(c, uniqueName("test-backend"), "prime256v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Nothing lands in the default store
+		_, err = GetECDSA(Config, k.FilePointer())
+		assert.NotNil(t, err)
+
+		_, err = NewECDSA(c, k.Struct().Name, "prime256v1")
+		assert.NotNil(t, err)
+
+		r, err := ResolveECDSA(c, k.Struct().Slug)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sig, err := r.Sign([]byte("backend"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.True(t, k.Verify([]byte("backend"), sig))
+
+		keys, err := ListECDSA(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, 1, len(keys))
+
+		if err := DeleteECDSA(c, k.FilePointer()); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = GetECDSA(c, k.FilePointer())
+		assert.NotNil(t, err)
+	}
+
+	// The fs backend keeps the original directory layout
+	if _, err := os.Stat(filepath.Join(dir, "ecdsa")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := backendReader{Reader: Config, backend: keystore.FS, keys: dir}
+
+	s, err := openStore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := map[string]KeyAPI{}
+	for _, problem := range []string{"", ProblemTampered, ProblemUnsealed, ProblemReplayed, ProblemMissing,
+		ProblemOrphaned, ProblemStaleIndex} {
+		k, err := NewECDSA(c, uniqueName("test-verify"), "prime256v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys[problem] = k
+	}
+
+	checked, findings, err := VerifyStore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, len(keys), checked)
+	assert.Empty(t, findings)
+
+	put := func(k KeyAPI, data []byte, idx keystore.Index) {
+		if err := s.Put(kind, keystore.Entry{GID: k.FilePointer(), Data: data, Index: idx}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A record edited on disk, and one swapped in from another key
+	tampered := keys[ProblemTampered]
+	put(tampered, bytes.Replace(storedRecord(t, c, tampered.FilePointer()),
+		[]byte(tampered.Struct().Name), []byte("renamed"), 1), tampered.Struct().index())
+
+	_, err = GetECDSA(c, tampered.FilePointer())
+	assert.Equal(t, errTampered, err)
+
+	put(tampered, storedRecord(t, c, keys[""].FilePointer()), tampered.Struct().index())
+
+	_, err = GetECDSA(c, tampered.FilePointer())
+	assert.Equal(t, errTampered, err)
+
+	// A record rewritten at an older, unsealed schema version
+	unsealed := keys[ProblemUnsealed]
+	payload, err := json.Marshal(unsealed.Struct())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := json.Marshal(record{Schema: 3, Key: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put(unsealed, old, unsealed.Struct().index())
+
+	_, err = GetECDSA(c, unsealed.FilePointer())
+	assert.Equal(t, errUnsealed, err)
+
+	// An earlier record of the key put back after the key changed, which
+	// would wind back its usage counters
+	replayed := keys[ProblemReplayed]
+	earlier := storedRecord(t, c, replayed.FilePointer())
+
+	if err := replayed.Label(c, []string{"changed"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	put(replayed, earlier, replayed.Struct().index())
+
+	_, err = GetECDSA(c, replayed.FilePointer())
+	assert.Equal(t, errReplayed, err)
+
+	// An index pointing a name at the wrong key is caught on lookup
+	stale := keys[ProblemStaleIndex]
+	idx := stale.Struct().index()
+	idx[indexName] = []string{"forged"}
+	put(stale, storedRecord(t, c, stale.FilePointer()), idx)
+
+	_, err = ResolveECDSA(c, "forged")
+	assert.NotNil(t, err)
+
+	// A record dropped from the indexes, and one deleted leaving its index
+	indexes := map[string]keystore.Index{}
+	if err := s.Indexes(kind, func(gid string, idx keystore.Index) error {
+		indexes[gid] = idx
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Reindex(kind, func(gid string, data []byte) (keystore.Index, error) {
+		if gid == keys[ProblemOrphaned].FilePointer() {
+			return nil, nil
+		}
+
+		return indexes[gid], nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, kind, keys[ProblemMissing].FilePointer(), "obj.bin")); err != nil {
+		t.Fatal(err)
+	}
+
+	checked, findings, err = VerifyStore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, len(keys)-1, checked)
+
+	found := map[string]string{}
+	for _, f := range findings {
+		found[f.GID] = f.Problem
+	}
+
+	assert.Equal(t, len(keys)-1, len(found))
+
+	for problem, k := range keys {
+		if problem != "" {
+			assert.Equal(t, problem, found[k.FilePointer()], problem)
+		}
+	}
+
+	// The store is sealed, migrating refuses the old record rather than
+	// sealing whatever was put in place
+	_, failures, err := MigrateStore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refused := false
+	for _, f := range failures {
+		if f.GID == unsealed.FilePointer() {
+			refused = f.Err == errRefused
+		}
+	}
+
+	assert.True(t, refused)
+
+	_, err = GetECDSA(c, unsealed.FilePointer())
+	assert.Equal(t, errUnsealed, err)
+
+	// Neither can the state be edited to accept the earlier record
+	state, err := s.Get(stateKind, stateGID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Put(stateKind, keystore.Entry{GID: stateGID,
+		Data: bytes.Replace(state, []byte(`"sealed":true`), []byte(`"sealed":false`), 1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = GetECDSA(c, replayed.FilePointer())
+	assert.Equal(t, errStateTampered, err)
+}
+
+func TestReseal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reseal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := backendReader{Reader: Config, backend: keystore.FS, keys: dir}
+
+	k, err := NewECDSA(c, uniqueName("test-reseal"), "prime256v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := sha256.Sum256([]byte("reseal"))
+
+	before, err := k.Sign(d[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, n, err := Reseal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 1, n)
+
+	defer crypto.LoadMasterKey([]byte(test.MasterKey), []byte(test.MasterIv))
+
+	if err := crypto.RotateMasterKey([]byte("vzbd4jw3w5m7p2cq8t4xn6rk9ys5hb2e"), []byte(test.MasterIv), r); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key loads, signs and verifies under the new master key
+	rotated, err := GetECDSA(c, k.FilePointer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := rotated.Sign(d[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, rotated.Verify(d[:], before))
+	assert.True(t, k.Verify(d[:], after))
+
+	checked, findings, err := VerifyStore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 1, checked)
+	assert.Empty(t, findings)
+
+	// and no longer under the old one
+	if err := crypto.LoadMasterKey([]byte(test.MasterKey), []byte(test.MasterIv)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = GetECDSA(c, k.FilePointer())
+	assert.NotNil(t, err)
 }
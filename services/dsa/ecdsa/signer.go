@@ -0,0 +1,67 @@
+package ecdsa
+
+import (
+	gocrypto "crypto"
+	"crypto/rsa"
+	"fmt"
+	"io"
+
+	"github.com/block27/core/crypto"
+)
+
+// signer adapts a stored key to the standard library crypto.Signer so it can
+// be handed to x509, tls and CMS code without ever exporting the private key
+type signer struct {
+	k   KeyAPI
+	pub gocrypto.PublicKey
+}
+
+// NewSigner returns a crypto.Signer backed by the key. Every signature goes
+// through KeyAPI.Sign, or the same checks for RSA keys, so the rand reader
+// passed by callers is ignored in favour of our own crypto.Reader
+func NewSigner(k KeyAPI) (gocrypto.Signer, error) {
+	if IsRSA(k.Struct().Curve()) {
+		pub, err := k.Struct().getRSAPublicKey()
+		if err != nil {
+			return nil, err
+		}
+
+		return &signer{k: k, pub: pub}, nil
+	}
+
+	pub, err := k.getPublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return &signer{k: k, pub: pub}, nil
+}
+
+// Public returns the public half of the key
+func (s *signer) Public() gocrypto.PublicKey {
+	return s.pub
+}
+
+// Sign signs the digest and returns an ASN.1 DER encoded signature, or a
+// PKCS #1 v1.5 one for RSA keys, which do not sign PSS
+func (s *signer) Sign(rand io.Reader, digest []byte, opts gocrypto.SignerOpts) ([]byte, error) {
+	if _, ok := s.pub.(*rsa.PublicKey); ok {
+		if _, pss := opts.(*rsa.PSSOptions); pss {
+			return nil, fmt.Errorf("RSA keys only sign PKCS #1 v1.5")
+		}
+
+		alg, err := crypto.HashName(opts.HashFunc())
+		if err != nil {
+			return nil, err
+		}
+
+		return s.k.Struct().signRSA(alg, digest)
+	}
+
+	sig, err := s.k.Sign(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return sig.SigToDER()
+}
@@ -0,0 +1,174 @@
+package ecdsa
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"sync"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/services/keystore"
+)
+
+// stateKind and stateGID locate the store state among the key records
+const (
+	stateKind = kind + ".state"
+	stateGID  = "state"
+)
+
+// stateMu serialises the writes of the process, each one bumps a version
+// in the store state
+var stateMu sync.Mutex
+
+// storeState is kept in the keystore next to the key records, under a MAC
+// like them. Sealed is set once every record carries a MAC, records older
+// than sealedSchema are refused from then on. Versions holds the highest
+// version written for every GID, a record older than that was rolled back.
+//
+// Records and state are only checked against each other. Putting back an
+// earlier state together with earlier records, of one key or all of them,
+// goes unnoticed.
+type storeState struct {
+	Sealed   bool              `json:"sealed"`
+	Versions map[string]uint64 `json:"versions"`
+	MAC      []byte            `json:"mac,omitempty"`
+
+	// no state was stored yet
+	missing bool
+}
+
+// stateInput is what the state MAC covers
+func stateInput(st storeState) ([]byte, error) {
+	st.MAC = nil
+
+	payload, err := json.Marshal(st)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(stateKind+"\x00"), payload...), nil
+}
+
+// loadState returns the store state, an empty one if none was stored yet
+func loadState(s keystore.Store) (*storeState, error) {
+	data, err := s.Get(stateKind, stateGID)
+	if err == keystore.ErrNotFound {
+		return &storeState{Versions: map[string]uint64{}, missing: true}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var st storeState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, errStateTampered
+	}
+
+	input, err := stateInput(st)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := crypto.CheckRecordMAC(input, st.MAC)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, errStateTampered
+	}
+
+	if st.Versions == nil {
+		st.Versions = map[string]uint64{}
+	}
+
+	return &st, nil
+}
+
+// saveState seals and stores the state
+func saveState(s keystore.Store, st *storeState) error {
+	input, err := stateInput(*st)
+	if err != nil {
+		return err
+	}
+
+	if st.MAC, err = crypto.RecordMAC(input); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Put(stateKind, keystore.Entry{GID: stateGID, Data: data}); err != nil {
+		return err
+	}
+
+	st.missing = false
+
+	return nil
+}
+
+// check refuses a record older than the last one written under its GID
+func (st *storeState) check(k *key) error {
+	if k.version < st.Versions[k.FilePointer()] {
+		return errReplayed
+	}
+
+	return nil
+}
+
+// schemas reports whether any record of the store predates sealedSchema, or
+// any key is still in the original directory layout, and whether any is
+// sealed
+func schemas(c config.Reader, s keystore.Store) (unsealed bool, sealed bool, err error) {
+	if err := s.List(kind, func(gid string, data []byte) error {
+		if schema, err := recordSchema(data); err == nil && schema < sealedSchema {
+			unsealed = true
+		} else if err == nil {
+			sealed = true
+		}
+
+		return nil
+	}); err != nil {
+		return false, false, err
+	}
+
+	if unsealed || keystore.Backend(c) == keystore.FS {
+		return unsealed, sealed, nil
+	}
+
+	dirs, err := filepath.Glob(filepath.Join(c.GetString("paths.keys"), kind, "*", "obj.bin"))
+
+	return len(dirs) != 0, sealed, err
+}
+
+// recordSchema returns the schema version of a stored record
+func recordSchema(data []byte) (int, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != '{' {
+		return 1, nil
+	}
+
+	var r record
+	if err := json.Unmarshal(data, &r); err != nil {
+		return 0, err
+	}
+
+	return r.Schema, nil
+}
+
+// newState is the state of a store none was stored for yet. It is sealed
+// unless only records written before integrity protection are kept, a store
+// holding a sealed record has been sealed whatever became of its state.
+func newState(c config.Reader, s keystore.Store) (*storeState, error) {
+	unsealed, sealed, err := schemas(c, s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &storeState{Sealed: sealed || !unsealed, Versions: map[string]uint64{}, missing: true}, nil
+}
@@ -0,0 +1,192 @@
+package ecdsa
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/services/keystore"
+)
+
+// Problems reported by VerifyStore
+const (
+	// ProblemTampered records fail their MAC or are stored under another
+	// key's GID
+	ProblemTampered = "tampered"
+
+	// ProblemUnsealed records predate integrity protection, `store migrate`
+	// seals them
+	ProblemUnsealed = "unsealed"
+
+	// ProblemReplayed records are older than the last version written for
+	// their key, an earlier copy was put back in place
+	ProblemReplayed = "replayed"
+
+	// ProblemUnreadable records cannot be decoded at all
+	ProblemUnreadable = "unreadable"
+
+	// ProblemMissing index entries point at a record that is gone
+	ProblemMissing = "missing"
+
+	// ProblemOrphaned records have no index entries, lookups never find them
+	ProblemOrphaned = "orphaned"
+
+	// ProblemStaleIndex index entries disagree with the record they point at
+	ProblemStaleIndex = "stale index"
+)
+
+// Finding is one problem VerifyStore found with a key record
+type Finding struct {
+	GID     string
+	Problem string
+	Detail  string
+}
+
+// VerifyStore checks every key record against its MAC and the indexes
+// against the records, returning the number of records checked and every
+// problem found in GID order
+func VerifyStore(c config.Reader) (int, []Finding, error) {
+	s, err := openStore(c)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	indexes := map[string]keystore.Index{}
+
+	if err := s.Indexes(kind, func(gid string, idx keystore.Index) error {
+		indexes[gid] = idx
+		return nil
+	}); err != nil {
+		return 0, nil, err
+	}
+
+	var (
+		checked  int
+		findings []Finding
+		keys     []*key
+	)
+
+	// Records are still checked against their MACs without the state
+	st, err := loadState(s)
+	if err == errStateTampered {
+		findings = append(findings, Finding{GID: stateKind, Problem: ProblemTampered, Detail: err.Error()})
+		st = &storeState{Versions: map[string]uint64{}}
+	} else if err != nil {
+		return 0, nil, err
+	}
+
+	if err := s.List(kind, func(gid string, data []byte) error {
+		checked++
+
+		k, err := loadRecord(st, gid, data)
+		switch {
+		case err == errUnsealed:
+			findings = append(findings, Finding{GID: gid, Problem: ProblemUnsealed, Detail: err.Error()})
+		case err == errReplayed:
+			findings = append(findings, Finding{GID: gid, Problem: ProblemReplayed, Detail: err.Error()})
+		case err == errTampered:
+			findings = append(findings, Finding{GID: gid, Problem: ProblemTampered, Detail: err.Error()})
+		case err != nil:
+			findings = append(findings, Finding{GID: gid, Problem: ProblemUnreadable, Detail: err.Error()})
+		default:
+			keys = append(keys, k)
+		}
+
+		return nil
+	}); err != nil {
+		return 0, nil, err
+	}
+
+	stored := map[string]bool{}
+
+	for _, k := range keys {
+		gid := k.FilePointer()
+		stored[gid] = true
+
+		idx, ok := indexes[gid]
+		if !ok {
+			findings = append(findings, Finding{GID: gid, Problem: ProblemOrphaned,
+				Detail: "record has no index entries, run `dsa reindex`"})
+			continue
+		}
+
+		if problem := staleIndex(s, gid, k.index(), idx); problem != "" {
+			findings = append(findings, Finding{GID: gid, Problem: ProblemStaleIndex,
+				Detail: problem + ", run `dsa reindex`"})
+		}
+	}
+
+	for gid := range indexes {
+		if stored[gid] {
+			continue
+		}
+
+		// Unreadable records are reported already
+		if _, err := s.Get(kind, gid); err == keystore.ErrNotFound {
+			findings = append(findings, Finding{GID: gid, Problem: ProblemMissing,
+				Detail: "index entries for a record that does not exist"})
+		}
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].GID < findings[j].GID
+	})
+
+	return checked, findings, nil
+}
+
+// staleIndex describes how the index stored for gid differs from the one
+// its record should have, or returns "" if they agree. Every value must
+// also find the record, the lookup tables can drift from the stored index.
+func staleIndex(s keystore.Store, gid string, want keystore.Index, got keystore.Index) string {
+	for field, values := range want {
+		if !sameValues(values, got[field]) {
+			return field + " does not match the record"
+		}
+
+		for _, v := range values {
+			found, err := s.Find(kind, field, v)
+			if err != nil || !contains(found, gid) {
+				return field + " " + v + " does not find the record"
+			}
+		}
+	}
+
+	for field, values := range got {
+		if _, ok := want[field]; !ok && len(values) != 0 {
+			return "unexpected " + field + " " + strings.Join(values, ", ")
+		}
+	}
+
+	return ""
+}
+
+// sameValues compares index values ignoring order and duplicates
+func sameValues(a []string, b []string) bool {
+	a = unique(append([]string{}, a...))
+	b = unique(append([]string{}, b...))
+	if len(a) != len(b) {
+		return false
+	}
+
+	sort.Strings(a)
+	sort.Strings(b)
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -47,3 +47,123 @@ func NewKeyObjtError(message string) KeyObjtAPI {
 func (k *KeyObjt) Error() string {
     return k.Message
 }
+
+
+//------------------------------------------------------------------------------
+
+// KeyStatusAPI ...
+type KeyStatusAPI interface {
+	Error() string
+}
+
+// KeyStatus ...
+type KeyStatus struct{
+	Message string
+}
+
+// NewKeyStatusError ...
+func NewKeyStatusError(message string) KeyStatusAPI {
+	return &KeyStatus{
+		Message: message,
+	}
+}
+
+func (k *KeyStatus) Error() string {
+    return k.Message
+}
+
+
+//------------------------------------------------------------------------------
+
+// KeyPolicyAPI ...
+type KeyPolicyAPI interface {
+	Error() string
+}
+
+// KeyPolicy ...
+type KeyPolicy struct{
+	Message string
+}
+
+// NewKeyPolicyError ...
+func NewKeyPolicyError(message string) KeyPolicyAPI {
+	return &KeyPolicy{
+		Message: message,
+	}
+}
+
+func (k *KeyPolicy) Error() string {
+    return k.Message
+}
+
+
+//------------------------------------------------------------------------------
+
+// KeyConflictAPI ...
+type KeyConflictAPI interface {
+	Error() string
+}
+
+// KeyConflict ...
+type KeyConflict struct{
+	Message string
+}
+
+// NewKeyConflictError ...
+func NewKeyConflictError(message string) KeyConflictAPI {
+	return &KeyConflict{
+		Message: message,
+	}
+}
+
+func (k *KeyConflict) Error() string {
+    return k.Message
+}
+
+
+//------------------------------------------------------------------------------
+
+// KeyAmbiguousAPI ...
+type KeyAmbiguousAPI interface {
+	Error() string
+}
+
+// KeyAmbiguous ...
+type KeyAmbiguous struct{
+	Message string
+}
+
+// NewKeyAmbiguousError ...
+func NewKeyAmbiguousError(message string) KeyAmbiguousAPI {
+	return &KeyAmbiguous{
+		Message: message,
+	}
+}
+
+func (k *KeyAmbiguous) Error() string {
+    return k.Message
+}
+
+
+//------------------------------------------------------------------------------
+
+// KeyIntegrityAPI ...
+type KeyIntegrityAPI interface {
+	Error() string
+}
+
+// KeyIntegrity ...
+type KeyIntegrity struct{
+	Message string
+}
+
+// NewKeyIntegrityError ...
+func NewKeyIntegrityError(message string) KeyIntegrityAPI {
+	return &KeyIntegrity{
+		Message: message,
+	}
+}
+
+func (k *KeyIntegrity) Error() string {
+    return k.Message
+}
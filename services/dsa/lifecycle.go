@@ -0,0 +1,91 @@
+package dsa
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/block27/core/helpers"
+)
+
+// Key states beyond active/archive, named after NIST SP 800-57 Part 1 section
+// 7. StatusArchived plays the role of the "deactivated" state.
+const (
+	// StatusCompromised is for keys whose private half is known or suspected
+	// to be disclosed, they may never sign again
+	StatusCompromised = "compromised"
+
+	// StatusDestroyed is for keys whose private material has been erased, only
+	// the record and public key remain
+	StatusDestroyed = "destroyed"
+)
+
+// Revocation reasons accepted by `dsa revoke`
+const (
+	// ReasonCompromised moves the key to StatusCompromised
+	ReasonCompromised = "compromised"
+
+	// ReasonSuperseded archives a key replaced by a newer one
+	ReasonSuperseded = "superseded"
+
+	// ReasonCeased archives a key whose purpose no longer exists
+	ReasonCeased = "ceased"
+)
+
+// transitions lists, for every state, the states it may move to
+var transitions = map[string][]string{
+	StatusActive:      {StatusArchived, StatusCompromised, StatusDestroyed},
+	StatusArchived:    {StatusActive, StatusCompromised, StatusDestroyed},
+	StatusCompromised: {StatusDestroyed},
+	StatusDestroyed:   {},
+}
+
+// Transition is a timestamped state change kept on the key record
+type Transition struct {
+	From   string
+	To     string
+	Reason string
+	At     time.Time
+}
+
+// CheckTransition returns an error unless a key may move from one state to
+// the other
+func CheckTransition(from, to string) error {
+	next, ok := transitions[from]
+	if !ok {
+		return fmt.Errorf("%s %s", helpers.RFgB("unknown key status:"), from)
+	}
+
+	for _, s := range next {
+		if s == to {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s %s -> %s", helpers.RFgB("invalid key transition:"), from, to)
+}
+
+// RevokeStatus maps a revocation reason to the resulting state
+func RevokeStatus(reason string) (string, error) {
+	switch reason {
+	case ReasonCompromised:
+		return StatusCompromised, nil
+	case ReasonSuperseded, ReasonCeased:
+		return StatusArchived, nil
+	default:
+		return "", fmt.Errorf("invalid revocation reason: %s, usage: [%s, %s, %s]",
+			reason, ReasonCompromised, ReasonSuperseded, ReasonCeased)
+	}
+}
+
+// CanSign reports whether a key in the state may produce signatures
+func CanSign(status string) bool {
+	return status == StatusActive
+}
+
+// CanVerify reports whether a key in the state may verify signatures. Only
+// destroyed keys are refused, compromised keys verify but callers should warn.
+func CanVerify(status string) bool {
+	_, known := transitions[status]
+
+	return known && status != StatusDestroyed
+}
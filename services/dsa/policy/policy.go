@@ -0,0 +1,196 @@
+package policy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/block27/core/crypto"
+)
+
+// Operations a key may be allowed to perform
+const (
+	OpSign    = "sign"
+	OpVerify  = "verify"
+	OpDerive  = "derive"
+	OpEncrypt = "encrypt"
+	OpExport  = "export"
+)
+
+// Operations returns every operation a policy may grant
+func Operations() []string {
+	return []string{OpSign, OpVerify, OpDerive, OpEncrypt, OpExport}
+}
+
+// Policy restricts what a key may be used for. It is fixed at create time and
+// stored on the key record. The zero value, as found on keys created before
+// policies existed, allows everything.
+type Policy struct {
+	// Operations allowed, empty allows all
+	Operations []string
+
+	// Validity window for producing new signatures, zero times are open ended
+	NotBefore time.Time
+	NotAfter  time.Time
+
+	// MaxSignatures caps the number of signatures, 0 is unlimited
+	MaxSignatures int
+
+	// Hashes allowed for signing, empty allows any digest
+	Hashes []string
+}
+
+// New builds a validated policy from the CLI/API inputs
+func New(ops []string, notBefore, notAfter time.Time, maxSignatures int, hashes []string) (Policy, error) {
+	p := Policy{
+		NotBefore:     notBefore,
+		NotAfter:      notAfter,
+		MaxSignatures: maxSignatures,
+	}
+
+	for _, op := range ops {
+		if op = strings.TrimSpace(op); op == "" {
+			continue
+		}
+
+		if !contains(Operations(), op) {
+			return Policy{}, fmt.Errorf("invalid operation: %s, usage: [%s]",
+				op, strings.Join(Operations(), ", "))
+		}
+
+		p.Operations = append(p.Operations, op)
+	}
+
+	for _, h := range hashes {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+
+		if _, err := crypto.NewHash(h); err != nil {
+			return Policy{}, err
+		}
+
+		p.Hashes = append(p.Hashes, h)
+	}
+
+	if maxSignatures < 0 {
+		return Policy{}, fmt.Errorf("max signatures cannot be negative")
+	}
+
+	if !notBefore.IsZero() && !notAfter.IsZero() && !notAfter.After(notBefore) {
+		return Policy{}, fmt.Errorf("not-after must be later than not-before")
+	}
+
+	sort.Strings(p.Operations)
+
+	return p, nil
+}
+
+// Allows reports whether the operation is granted
+func (p Policy) Allows(op string) bool {
+	return len(p.Operations) == 0 || contains(p.Operations, op)
+}
+
+// AllowsHash reports whether signing with the digest is granted
+func (p Policy) AllowsHash(hash string) bool {
+	return len(p.Hashes) == 0 || contains(p.Hashes, hash)
+}
+
+// Authorize checks an operation against the policy. The validity window and
+// hash list apply to signing only, so old signatures keep verifying once a key
+// expires; an empty hash skips the hash check.
+func (p Policy) Authorize(op string, hash string, now time.Time) error {
+	if !p.Allows(op) {
+		return fmt.Errorf("policy: %s is not allowed for this key", op)
+	}
+
+	if op != OpSign {
+		return nil
+	}
+
+	if !p.NotBefore.IsZero() && now.Before(p.NotBefore) {
+		return fmt.Errorf("policy: key is not valid before %s", p.NotBefore.Format(time.RFC3339))
+	}
+
+	if !p.NotAfter.IsZero() && now.After(p.NotAfter) {
+		return fmt.Errorf("policy: key expired at %s", p.NotAfter.Format(time.RFC3339))
+	}
+
+	if hash != "" && !p.AllowsHash(hash) {
+		return fmt.Errorf("policy: %s is not allowed, usage: [%s]", hash, strings.Join(p.Hashes, ", "))
+	}
+
+	return nil
+}
+
+// Remaining returns how many more signatures are allowed after used, or -1
+// when unlimited
+func (p Policy) Remaining(used int) int {
+	if p.MaxSignatures == 0 {
+		return -1
+	}
+
+	if used >= p.MaxSignatures {
+		return 0
+	}
+
+	return p.MaxSignatures - used
+}
+
+// String is a compact single line form used in key listings
+func (p Policy) String() string {
+	ops := "all"
+	if len(p.Operations) != 0 {
+		ops = strings.Join(p.Operations, ",")
+	}
+
+	parts := []string{fmt.Sprintf("ops=%s", ops)}
+
+	if !p.NotBefore.IsZero() {
+		parts = append(parts, fmt.Sprintf("not-before=%s", p.NotBefore.Format(time.RFC3339)))
+	}
+
+	if !p.NotAfter.IsZero() {
+		parts = append(parts, fmt.Sprintf("not-after=%s", p.NotAfter.Format(time.RFC3339)))
+	}
+
+	if p.MaxSignatures != 0 {
+		parts = append(parts, fmt.Sprintf("max-signatures=%d", p.MaxSignatures))
+	}
+
+	if len(p.Hashes) != 0 {
+		parts = append(parts, fmt.Sprintf("hashes=%s", strings.Join(p.Hashes, ",")))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// ParseTime accepts RFC 3339 timestamps or plain 2006-01-02 dates, empty is
+// the zero time
+func ParseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date: %s, usage: [2006-01-02, RFC 3339]", s)
+	}
+
+	return t, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
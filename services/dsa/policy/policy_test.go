@@ -0,0 +1,91 @@
+package policy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	p, err := New([]string{"verify", "sign", ""}, time.Time{}, time.Time{}, 5, []string{"sha256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{OpSign, OpVerify}, p.Operations)
+	assert.Equal(t, []string{"sha256"}, p.Hashes)
+
+	if _, err := New([]string{"fly"}, time.Time{}, time.Time{}, 0, nil); err == nil {
+		t.Fatal("invalid operation accepted")
+	}
+
+	if _, err := New(nil, time.Time{}, time.Time{}, 0, []string{"md5"}); err == nil {
+		t.Fatal("invalid hash accepted")
+	}
+
+	if _, err := New(nil, time.Time{}, time.Time{}, -1, nil); err == nil {
+		t.Fatal("negative limit accepted")
+	}
+
+	now := time.Now()
+	if _, err := New(nil, now, now.Add(-time.Hour), 0, nil); err == nil {
+		t.Fatal("inverted window accepted")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	now := time.Now()
+
+	// The zero policy allows everything
+	for _, op := range Operations() {
+		assert.Nil(t, Policy{}.Authorize(op, "sha512", now))
+	}
+
+	p := Policy{
+		Operations: []string{OpSign, OpVerify},
+		NotBefore:  now.Add(-time.Hour),
+		NotAfter:   now.Add(time.Hour),
+		Hashes:     []string{"sha256"},
+	}
+
+	assert.Nil(t, p.Authorize(OpSign, "sha256", now))
+	assert.Nil(t, p.Authorize(OpSign, "", now))
+	assert.NotNil(t, p.Authorize(OpSign, "sha512", now))
+	assert.NotNil(t, p.Authorize(OpExport, "", now))
+	assert.NotNil(t, p.Authorize(OpSign, "sha256", now.Add(2*time.Hour)))
+	assert.NotNil(t, p.Authorize(OpSign, "sha256", now.Add(-2*time.Hour)))
+
+	// Expired keys still verify
+	assert.Nil(t, p.Authorize(OpVerify, "", now.Add(2*time.Hour)))
+}
+
+func TestRemaining(t *testing.T) {
+	assert.Equal(t, -1, Policy{}.Remaining(100))
+	assert.Equal(t, 3, Policy{MaxSignatures: 5}.Remaining(2))
+	assert.Equal(t, 0, Policy{MaxSignatures: 5}.Remaining(7))
+}
+
+func TestParseTime(t *testing.T) {
+	if tm, err := ParseTime(""); err != nil || !tm.IsZero() {
+		t.Fail()
+	}
+
+	if tm, err := ParseTime("2030-01-02"); err != nil || tm.Year() != 2030 {
+		t.Fail()
+	}
+
+	if _, err := ParseTime("2030-01-02T03:04:05Z"); err != nil {
+		t.Fail()
+	}
+
+	if _, err := ParseTime("tomorrow"); err == nil {
+		t.Fail()
+	}
+}
+
+func TestString(t *testing.T) {
+	assert.Equal(t, "ops=all", Policy{}.String())
+	assert.Equal(t, "ops=sign max-signatures=3 hashes=sha256",
+		Policy{Operations: []string{OpSign}, MaxSignatures: 3, Hashes: []string{"sha256"}}.String())
+}
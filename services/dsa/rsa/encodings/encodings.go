@@ -1 +1,104 @@
 package encodings
+
+import (
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// RSAPrivateKey ...
+	RSAPrivateKey = "RSA PRIVATE KEY"
+
+	// SDPublicKey ...
+	SDPublicKey = "PUBLIC KEY"
+)
+
+// FingerprintMD5 - returns the user presentation of the key's fingerprint
+// as described by RFC 4716 section 4.
+func FingerprintMD5(publicKey *rsa.PublicKey) (string, error) {
+	pub, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	md5sum := md5.Sum(pub.Marshal())
+	hexarray := make([]string, len(md5sum))
+
+	for i, c := range md5sum {
+		hexarray[i] = hex.EncodeToString([]byte{c})
+	}
+
+	return strings.Join(hexarray, ":"), nil
+}
+
+// FingerprintSHA256 - returns the user presentation of the key's fingerprint
+// as unpadded base64 encoded sha256 hash, as ssh-keygen -l prints it
+func FingerprintSHA256(publicKey *rsa.PublicKey) (string, error) {
+	pub, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	sha256sum := sha256.Sum256(pub.Marshal())
+	return base64.RawStdEncoding.EncodeToString(sha256sum[:]), nil
+}
+
+// Encode returns the PKCS#1 PEM of the private key and the PKIX PEM of its
+// public half
+func Encode(privateKey *rsa.PrivateKey) (string, string, error) {
+	pemEncoded := pem.EncodeToMemory(&pem.Block{
+		Type:  RSAPrivateKey,
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	})
+
+	x509EncodedPub, e := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if e != nil {
+		return "", "", e
+	}
+
+	pemEncodedPub := pem.EncodeToMemory(&pem.Block{
+		Type:  SDPublicKey,
+		Bytes: x509EncodedPub,
+	})
+
+	return string(pemEncoded), string(pemEncodedPub), nil
+}
+
+// DecodePrivate parses the PKCS#1 PEM made by Encode
+func DecodePrivate(pemEncoded []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemEncoded)
+	if block == nil {
+		return nil, fmt.Errorf("invalid private key")
+	}
+
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// DecodePublic parses the PKIX PEM made by Encode
+func DecodePublic(pemEncodedPub []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(pemEncodedPub)
+	if block == nil {
+		return nil, fmt.Errorf("invalid public key")
+	}
+
+	generic, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, ok := generic.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA public key")
+	}
+
+	return pub, nil
+}
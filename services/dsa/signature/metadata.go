@@ -0,0 +1,85 @@
+package signature
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Metadata is written next to a signature file as <signature>.json and tells
+// verifiers which key version, digest and payload mode produced it
+type Metadata struct {
+	Key       string    `json:"key"`
+	Alias     string    `json:"alias,omitempty"`
+	Version   int       `json:"version,omitempty"`
+	Hash      string    `json:"hash"`
+	Mode      string    `json:"mode"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// File returns where a signature by the key is written, out when one is asked
+// for and otherwise signature-<unix>.der in a directory per key under dir,
+// the configured paths.signatures. Signatures never go into the keystore.
+func File(dir, out, key string, t time.Time) (string, error) {
+	if out != "" {
+		return out, nil
+	}
+
+	if dir == "" || key == "" {
+		return "", fmt.Errorf("signature: no output path, set paths.signatures or --out")
+	}
+
+	return filepath.Join(dir, key, fmt.Sprintf("signature-%d.der", t.Unix())), nil
+}
+
+// Write stores the DER signature at path with its sidecar, creating the
+// directory it goes in
+func Write(path string, der []byte, m *Metadata) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path, der, 0644); err != nil {
+		return err
+	}
+
+	return WriteMetadata(path, m)
+}
+
+// MetadataPath returns the sidecar path for a signature file
+func MetadataPath(sigPath string) string {
+	return sigPath + ".json"
+}
+
+// WriteMetadata stores the sidecar for the signature file
+func WriteMetadata(sigPath string, m *Metadata) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(MetadataPath(sigPath), data, 0644)
+}
+
+// LoadMetadata reads the sidecar of a signature file, returning nil without
+// error when the signature predates sidecars
+func LoadMetadata(sigPath string) (*Metadata, error) {
+	data, err := ioutil.ReadFile(MetadataPath(sigPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var m Metadata
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
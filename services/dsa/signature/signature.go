@@ -3,11 +3,35 @@ package signature
 import (
 	"encoding/asn1"
 	"encoding/hex"
+	"fmt"
 	"math/big"
 
 	h "github.com/block27/core/helpers"
 )
 
+const (
+	// ModeOpenSSL signs the raw digest bytes, exactly what `openssl dgst -sign`
+	// and every standard ECDSA/RSA verifier expect
+	ModeOpenSSL = "openssl"
+
+	// ModeLegacy signs the ASCII hex string of the digest. Kept so signatures
+	// produced before ModeOpenSSL existed can still be verified
+	ModeLegacy = "legacy"
+)
+
+// Payload returns the bytes handed to the signer for a given digest and mode
+func Payload(digest []byte, mode string) ([]byte, error) {
+	switch mode {
+	case ModeOpenSSL:
+		return digest, nil
+	case ModeLegacy:
+		return []byte(hex.EncodeToString(digest)), nil
+	default:
+		return nil, fmt.Errorf("invalid signature mode: %s, usage: [%s, %s]",
+			mode, ModeOpenSSL, ModeLegacy)
+	}
+}
+
 // Signature - this struct is unique and must not be modified. ASN1 package
 // uses the exact format here to Marshall/Unmarshall data to and from and Must
 // only have {R,S} as types
@@ -1,8 +1,12 @@
 package signature
 
 import (
+	"bytes"
 	"encoding/hex"
+	"io/ioutil"
 	"math/big"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -48,3 +52,50 @@ func TestPointsFromDER(t *testing.T) {
 		}
 	}
 }
+
+func TestPayload(t *testing.T) {
+	digest, _ := hex.DecodeString("2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824")
+
+	raw, err := Payload(digest, ModeOpenSSL)
+	if err != nil || !bytes.Equal(raw, digest) {
+		t.Fatal("openssl mode must sign the raw digest bytes")
+	}
+
+	leg, err := Payload(digest, ModeLegacy)
+	if err != nil || string(leg) != hex.EncodeToString(digest) {
+		t.Fatal("legacy mode must sign the hex string of the digest")
+	}
+
+	if _, err := Payload(digest, "junk"); err == nil {
+		t.Fatal("invalid mode did not fail")
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "signature.der")
+
+	// No sidecar is not an error
+	if m, err := LoadMetadata(path); err != nil || m != nil {
+		t.Fatal("expected nil metadata without a sidecar")
+	}
+
+	in := &Metadata{Key: "gid", Alias: "release", Version: 2, Hash: "sha256", Mode: ModeOpenSSL}
+	if err := WriteMetadata(path, in); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := LoadMetadata(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out.Alias != "release" || out.Version != 2 || out.Mode != ModeOpenSSL {
+		t.Fatalf("metadata mismatch: %+v", out)
+	}
+}
@@ -0,0 +1,240 @@
+package hsmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/block27/core/services/dsa/alias"
+	"github.com/block27/core/services/rest"
+)
+
+// ClientAPI talks to a local hsmd over its socket. Failed requests return
+// the *rest.Error the daemon answered with.
+type ClientAPI interface {
+	Login(operator string, pin []byte) (*Session, error)
+	Logout() error
+	Health() (*rest.Health, error)
+	ListKeys(query url.Values) (*rest.KeyList, error)
+	GetKey(id string) (*rest.Key, error)
+	CreateKey(req rest.CreateKeyRequest) (*rest.Key, error)
+	ArchiveKey(id string, reason string) (*rest.Key, error)
+	SetKeyStatus(id string, req rest.StatusRequest) (*rest.Key, error)
+	LabelKey(id string, req rest.LabelRequest) (*rest.Key, error)
+	TagKey(id string, req rest.TagRequest) (*rest.Key, error)
+	PublicKey(id string) (*rest.PublicKey, error)
+	Sign(id string, req rest.SignRequest) (*rest.Signature, error)
+	Verify(id string, req rest.VerifyRequest) (*rest.Verification, error)
+	Batch(req rest.BatchRequest) (*rest.BatchResponse, error)
+	Reindex() (*rest.Reindexed, error)
+	ListAliases() (*rest.AliasList, error)
+	GetAlias(name string) (*alias.Alias, error)
+	CreateAlias(req rest.CreateAliasRequest) (*alias.Alias, error)
+	RotateAlias(name string) (*alias.Alias, error)
+}
+
+type client struct {
+	http  *http.Client
+	token string
+}
+
+// NewClient returns a client of the daemon listening on socket
+func NewClient(socket string) ClientAPI {
+	return &client{http: newHTTPClient(socket, 0)}
+}
+
+// Running tells whether a daemon answers on socket
+func Running(socket string) bool {
+	c := &client{http: newHTTPClient(socket, 2*time.Second)}
+
+	_, err := c.Health()
+	return err == nil
+}
+
+func newHTTPClient(socket string, timeout time.Duration) *http.Client {
+	var d net.Dialer
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
+func (c *client) Login(operator string, pin []byte) (*Session, error) {
+	var s Session
+	if err := c.do(http.MethodPost, SessionPath, SessionRequest{Operator: operator, Pin: string(pin)}, &s); err != nil {
+		return nil, err
+	}
+
+	c.token = s.Token
+
+	return &s, nil
+}
+
+func (c *client) Logout() error {
+	if c.token == "" {
+		return nil
+	}
+
+	err := c.do(http.MethodDelete, SessionPath, nil, nil)
+	c.token = ""
+
+	return err
+}
+
+func (c *client) Health() (*rest.Health, error) {
+	var h rest.Health
+	return &h, c.do(http.MethodGet, rest.Prefix+"/health", nil, &h)
+}
+
+func (c *client) ListKeys(query url.Values) (*rest.KeyList, error) {
+	var l rest.KeyList
+	return &l, c.do(http.MethodGet, rest.Prefix+"/keys?"+query.Encode(), nil, &l)
+}
+
+func (c *client) GetKey(id string) (*rest.Key, error) {
+	var k rest.Key
+	return &k, c.do(http.MethodGet, keyPath(id, ""), nil, &k)
+}
+
+func (c *client) CreateKey(req rest.CreateKeyRequest) (*rest.Key, error) {
+	var k rest.Key
+	return &k, c.do(http.MethodPost, rest.Prefix+"/keys", req, &k)
+}
+
+func (c *client) ArchiveKey(id string, reason string) (*rest.Key, error) {
+	var k rest.Key
+	return &k, c.do(http.MethodPost, keyPath(id, "/archive"), rest.ArchiveRequest{Reason: reason}, &k)
+}
+
+func (c *client) SetKeyStatus(id string, req rest.StatusRequest) (*rest.Key, error) {
+	var k rest.Key
+	return &k, c.do(http.MethodPost, keyPath(id, "/status"), req, &k)
+}
+
+func (c *client) LabelKey(id string, req rest.LabelRequest) (*rest.Key, error) {
+	var k rest.Key
+	return &k, c.do(http.MethodPost, keyPath(id, "/labels"), req, &k)
+}
+
+func (c *client) TagKey(id string, req rest.TagRequest) (*rest.Key, error) {
+	var k rest.Key
+	return &k, c.do(http.MethodPost, keyPath(id, "/tags"), req, &k)
+}
+
+func (c *client) PublicKey(id string) (*rest.PublicKey, error) {
+	var p rest.PublicKey
+	return &p, c.do(http.MethodGet, keyPath(id, "/public"), nil, &p)
+}
+
+func (c *client) Sign(id string, req rest.SignRequest) (*rest.Signature, error) {
+	var s rest.Signature
+	return &s, c.do(http.MethodPost, keyPath(id, "/sign"), req, &s)
+}
+
+func (c *client) Verify(id string, req rest.VerifyRequest) (*rest.Verification, error) {
+	var v rest.Verification
+	return &v, c.do(http.MethodPost, keyPath(id, "/verify"), req, &v)
+}
+
+func (c *client) Batch(req rest.BatchRequest) (*rest.BatchResponse, error) {
+	var b rest.BatchResponse
+	return &b, c.do(http.MethodPost, rest.Prefix+"/dsa/batch", req, &b)
+}
+
+func (c *client) Reindex() (*rest.Reindexed, error) {
+	var r rest.Reindexed
+	return &r, c.do(http.MethodPost, rest.Prefix+"/dsa/reindex", nil, &r)
+}
+
+func (c *client) ListAliases() (*rest.AliasList, error) {
+	var l rest.AliasList
+	return &l, c.do(http.MethodGet, rest.Prefix+"/aliases", nil, &l)
+}
+
+func (c *client) GetAlias(name string) (*alias.Alias, error) {
+	var a alias.Alias
+	return &a, c.do(http.MethodGet, aliasPath(name, ""), nil, &a)
+}
+
+func (c *client) CreateAlias(req rest.CreateAliasRequest) (*alias.Alias, error) {
+	var a alias.Alias
+	return &a, c.do(http.MethodPost, rest.Prefix+"/aliases", req, &a)
+}
+
+func (c *client) RotateAlias(name string) (*alias.Alias, error) {
+	var a alias.Alias
+	return &a, c.do(http.MethodPost, aliasPath(name, "/rotate"), nil, &a)
+}
+
+func keyPath(id string, action string) string {
+	return rest.Prefix + "/keys/" + url.PathEscape(id) + action
+}
+
+func aliasPath(name string, action string) string {
+	return rest.Prefix + "/aliases/" + url.PathEscape(name) + action
+}
+
+// do sends a request, body encoded as JSON when set, and decodes the
+// response into v when set
+func (c *client) do(method string, path string, body interface{}, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+
+		r = bytes.NewReader(data)
+	}
+
+	// The host is ignored, every connection goes to the socket
+	req, err := http.NewRequest(method, "http://hsmd"+path, r)
+	if err != nil {
+		return err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		var e struct {
+			Error *rest.Error `json:"error"`
+		}
+
+		if err := json.NewDecoder(res.Body).Decode(&e); err != nil || e.Error == nil {
+			return fmt.Errorf("hsmd: %s", res.Status)
+		}
+
+		e.Error.Status = res.StatusCode
+
+		return e.Error
+	}
+
+	if v == nil || res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
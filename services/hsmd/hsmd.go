@@ -0,0 +1,328 @@
+package hsmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/block27/core/backend"
+	"github.com/block27/core/config"
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/services/audit"
+	"github.com/block27/core/services/auth"
+	"github.com/block27/core/services/rest"
+	"github.com/block27/core/services/tsa"
+)
+
+// SessionPath is where clients log in (POST) and out (DELETE)
+const SessionPath = rest.Prefix + "/session"
+
+// SessionRequest is the body of POST /api/v1/session. Operator is empty
+// until operators are enrolled, the PIN is then the device PIN.
+type SessionRequest struct {
+	Operator string `json:"operator,omitempty"`
+	Pin      string `json:"pin"`
+}
+
+// Session is a login, Token goes in the Authorization header as a bearer
+// token until ExpiresAt
+type Session struct {
+	Token     string    `json:"token"`
+	Operator  string    `json:"operator,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// session is a login as the daemon keeps it, under the token's hash
+type session struct {
+	operator  string
+	uid       int
+	expiresAt time.Time
+}
+
+type handler struct {
+	b   *backend.Backend
+	c   config.Reader
+	api http.Handler
+	ttl time.Duration
+
+	// allowed are the uids let in, any when empty
+	allowed map[int]bool
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// Socket returns the path of the daemon's Unix socket
+func Socket(c config.Reader) string {
+	return c.GetString("hsmd.socket")
+}
+
+// Listen opens the daemon's socket, refusing while another daemon answers
+// on it and replacing one left behind by a daemon that did not shut down
+func Listen(c config.Reader) (net.Listener, error) {
+	path := Socket(c)
+
+	if Running(path) {
+		return nil, fmt.Errorf("hsmd is already running on %s", path)
+	}
+
+	mode, err := strconv.ParseUint(c.GetString("hsmd.socket_mode"), 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hsmd.socket_mode: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// NewServer returns the daemon's HTTP server, to Serve on the listener of
+// Listen. Every route of rest.NewServer is served to clients holding a
+// session, and sessions are opened by crypto users over SessionPath. The
+// health route is open to any client the socket lets in. Keys are destroyed
+// once the approvals sent along satisfy quorum.destroy, see quorum.
+func NewServer(b *backend.Backend, t tsa.TimestampAPI) (*http.Server, error) {
+	h, err := newHandler(b, t)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Server{Handler: h, ConnContext: withPeer}, nil
+}
+
+func newHandler(b *backend.Backend, t tsa.TimestampAPI) (*handler, error) {
+	c := *b.C
+
+	ttl, err := time.ParseDuration(c.GetString("hsmd.session_ttl"))
+	if err != nil || ttl <= 0 {
+		return nil, fmt.Errorf("invalid hsmd.session_ttl: %q", c.GetString("hsmd.session_ttl"))
+	}
+
+	allowed := map[int]bool{}
+	for _, v := range c.GetStringSlice("hsmd.allowed_uids") {
+		uid, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid uid in hsmd.allowed_uids: %q", v)
+		}
+
+		allowed[uid] = true
+	}
+
+	return &handler{
+		b:        b,
+		c:        c,
+		api:      rest.NewServer(b, t),
+		ttl:      ttl,
+		allowed:  allowed,
+		sessions: map[string]*session{},
+	}, nil
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	uid, ok := peerUID(r.Context())
+	if len(h.allowed) > 0 && (!ok || !h.allowed[uid]) {
+		rest.WriteError(w, rest.NewError(http.StatusForbidden, rest.CodeForbidden, "uid %d is not allowed", uid))
+		return
+	}
+
+	switch r.URL.Path {
+	case SessionPath:
+		switch r.Method {
+		case http.MethodPost:
+			h.login(w, r, uid)
+		case http.MethodDelete:
+			h.logout(w, r)
+		default:
+			w.Header().Set("Allow", "POST, DELETE")
+			rest.WriteError(w, rest.NewError(http.StatusMethodNotAllowed, rest.CodeMethodNotAllowed,
+				"%s not allowed", r.Method))
+		}
+
+		return
+	case rest.Prefix + "/health":
+		h.api.ServeHTTP(w, r)
+		return
+	}
+
+	s, err := h.session(r, uid)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="hsmd"`)
+		rest.WriteError(w, err)
+		return
+	}
+
+	actor := s.operator
+	if actor == "" {
+		actor = fmt.Sprintf("uid:%d", uid)
+	}
+
+	h.api.ServeHTTP(w, rest.WithQuorum(rest.WithActor(r, actor), quorum{c: h.c, d: h.b.D, actor: actor}))
+}
+
+// login checks the credentials of a client and opens its session. Every
+// attempt is audited.
+func (h *handler) login(w http.ResponseWriter, r *http.Request, uid int) {
+	var req SessionRequest
+
+	r.Body = http.MaxBytesReader(w, r.Body, 4<<10)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&req); err != nil {
+		rest.WriteError(w, rest.NewError(http.StatusBadRequest, rest.CodeInvalidRequest, "invalid body: %v", err))
+		return
+	}
+
+	entry := audit.Entry{Op: audit.OpAuth, Actor: fmt.Sprintf("uid:%d", uid), Detail: "hsmd session"}
+	if req.Operator != "" {
+		entry.Actor = req.Operator
+	}
+
+	_, err := auth.Authenticate(h.c, h.b.D, req.Operator, []byte(req.Pin), auth.RoleUser)
+	if err != nil {
+		entry.Result, entry.Detail = audit.ResultFailed, fmt.Sprintf("%s: %v", entry.Detail, err)
+	}
+
+	if _, aerr := audit.NewLog(h.c, h.b.D).Append(entry); aerr != nil {
+		h.b.L.Errorf("hsmd: audit log unavailable: %v", aerr)
+		rest.WriteError(w, rest.NewError(http.StatusServiceUnavailable, rest.CodeUnavailable, "audit log unavailable"))
+		return
+	}
+
+	if err != nil {
+		if _, ok := err.(*auth.Forbidden); ok {
+			rest.WriteError(w, rest.NewError(http.StatusForbidden, rest.CodeForbidden, "%v", err))
+		} else {
+			rest.WriteError(w, rest.NewError(http.StatusUnauthorized, rest.CodeUnauthorized, "%v", err))
+		}
+
+		return
+	}
+
+	token := make([]byte, 32)
+	if _, err := io.ReadFull(crypto.Reader, token); err != nil {
+		rest.WriteError(w, rest.NewError(http.StatusInternalServerError, rest.CodeInternal, "internal error"))
+		return
+	}
+
+	s := &session{operator: req.Operator, uid: uid, expiresAt: time.Now().Add(h.ttl)}
+
+	h.mu.Lock()
+	for k, v := range h.sessions {
+		if time.Now().After(v.expiresAt) {
+			delete(h.sessions, k)
+		}
+	}
+	h.sessions[tokenHash(hex.EncodeToString(token))] = s
+	h.mu.Unlock()
+
+	writeJSON(w, http.StatusCreated, Session{
+		Token:     hex.EncodeToString(token),
+		Operator:  s.operator,
+		ExpiresAt: s.expiresAt,
+	})
+}
+
+func (h *handler) logout(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	delete(h.sessions, tokenHash(bearer(r)))
+	h.mu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// session returns the live session of a request. A token is only good for
+// the uid that logged in with it.
+func (h *handler) session(r *http.Request, uid int) (*session, *rest.Error) {
+	token := bearer(r)
+	if token == "" {
+		return nil, rest.NewError(http.StatusUnauthorized, rest.CodeUnauthorized, "a session is required, log in first")
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := tokenHash(token)
+
+	s, ok := h.sessions[key]
+	if !ok || s.uid != uid {
+		return nil, rest.NewError(http.StatusUnauthorized, rest.CodeUnauthorized, "invalid session")
+	}
+
+	if time.Now().After(s.expiresAt) {
+		delete(h.sessions, key)
+		return nil, rest.NewError(http.StatusUnauthorized, rest.CodeUnauthorized, "session expired, log in again")
+	}
+
+	return s, nil
+}
+
+func bearer(r *http.Request) string {
+	v := r.Header.Get("Authorization")
+	if !strings.HasPrefix(v, "Bearer ") {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.TrimPrefix(v, "Bearer "))
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+type contextKey int
+
+const peerKey contextKey = 0
+
+// withPeer records the uid of the process on the other end of a connection
+func withPeer(ctx context.Context, c net.Conn) context.Context {
+	if uid, ok := connUID(c); ok {
+		return context.WithValue(ctx, peerKey, uid)
+	}
+
+	return ctx
+}
+
+// peerUID returns the uid recorded by withPeer, -1 when unknown
+func peerUID(ctx context.Context) (int, bool) {
+	uid, ok := ctx.Value(peerKey).(int)
+	if !ok {
+		return -1, false
+	}
+
+	return uid, true
+}
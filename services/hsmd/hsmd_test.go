@@ -0,0 +1,449 @@
+package hsmd
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/block27/core/backend"
+	"github.com/block27/core/config"
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/services/audit"
+	"github.com/block27/core/services/auth"
+	"github.com/block27/core/services/bbolt"
+	"github.com/block27/core/services/dsa/ecdsa"
+	"github.com/block27/core/services/dsa/signature"
+	"github.com/block27/core/services/keystore"
+	"github.com/block27/core/services/rest"
+	"github.com/block27/core/test"
+)
+
+var Config config.Reader
+
+func init() {
+	os.Setenv("ENVIRONMENT", "test")
+
+	c, err := config.LoadConfig(config.Defaults)
+	if err != nil {
+		panic(err)
+	}
+
+	if c.GetString("environment") != "test" {
+		panic(fmt.Errorf("test [environment] is not in [test] mode"))
+	}
+
+	// Stands in for HardwareAuthenticate, which needs the device attached
+	if err := crypto.LoadMasterKey([]byte(test.MasterKey), []byte(test.MasterIv)); err != nil {
+		panic(err)
+	}
+
+	Config = c
+}
+
+// deviceReader keeps the keystore and socket under a directory of their own
+type deviceReader struct {
+	config.Reader
+	dir string
+}
+
+func (d deviceReader) GetString(key string) string {
+	switch key {
+	case "keystore.backend":
+		return keystore.FS
+	case "paths.keys":
+		return filepath.Join(d.dir, "keys")
+	case "hsmd.socket":
+		return filepath.Join(d.dir, "hsmd.sock")
+	case "paths.signatures":
+		return filepath.Join(d.dir, "signatures")
+	}
+
+	return d.Reader.GetString(key)
+}
+
+// newTestDaemon serves a daemon on a socket of its own, the device PIN is
+// 123456
+func newTestDaemon(t *testing.T) (string, config.Reader, bbolt.Datastore, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "hsmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := bbolt.NewDB(filepath.Join(dir, "botldb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var c config.Reader = deviceReader{Reader: Config, dir: dir}
+
+	if err := auth.NewPin(c, d).Init([]byte("123456"), []byte("12345678")); err != nil {
+		t.Fatal(err)
+	}
+
+	l := logrus.New()
+	l.SetOutput(ioutil.Discard)
+
+	srv, err := NewServer(&backend.Backend{C: &c, D: d, L: l}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := Listen(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.Serve(ln)
+
+	return Socket(c), c, d, func() {
+		srv.Close()
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func code(err error) string {
+	if e, ok := err.(*rest.Error); ok {
+		return e.Code
+	}
+
+	return ""
+}
+
+func TestDaemon(t *testing.T) {
+	socket, c, d, done := newTestDaemon(t)
+	defer done()
+
+	assert.True(t, Running(socket))
+
+	// A second daemon cannot take the socket over
+	_, err := Listen(c)
+	assert.NotNil(t, err)
+
+	cl := NewClient(socket)
+
+	health, err := cl.Health()
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", health.Status)
+
+	_, err = cl.GetKey("anything")
+	assert.Equal(t, rest.CodeUnauthorized, code(err))
+
+	_, err = cl.Login("", []byte("000000"))
+	assert.Equal(t, rest.CodeUnauthorized, code(err))
+
+	s, err := cl.Login("", []byte("123456"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(t, s.Token)
+
+	created, err := cl.CreateKey(rest.CreateKeyRequest{Name: "daemon-key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "prime256v1", created.Curve)
+
+	list, err := cl.ListKeys(url.Values{"name": {"daemon-key"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, list.Total)
+
+	digest := sha256.Sum256([]byte("payload"))
+
+	sig, err := cl.Sign("daemon-key", rest.SignRequest{Digest: fmt.Sprintf("%x", digest[:]), Hash: "sha256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := cl.Verify(created.GID, rest.VerifyRequest{
+		Digest:    fmt.Sprintf("%x", digest[:]),
+		Hash:      "sha256",
+		Signature: sig.Signature,
+	})
+	assert.Nil(t, err)
+	assert.True(t, v.Valid)
+
+	pub, err := cl.PublicKey("daemon-key")
+	assert.Nil(t, err)
+	assert.Contains(t, pub.PEM, "PUBLIC KEY")
+
+	_, err = cl.GetKey("missing")
+	assert.Equal(t, rest.CodeNotFound, code(err))
+	assert.Equal(t, http.StatusNotFound, err.(*rest.Error).Status)
+
+	archived, err := cl.ArchiveKey("daemon-key", "done")
+	assert.Nil(t, err)
+	assert.Equal(t, "archive", archived.Status)
+
+	// Logins and operations are audited under the client's uid
+	entries, err := audit.NewLog(c, d).Entries(audit.Filter{Op: audit.OpSign})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, fmt.Sprintf("uid:%d", os.Getuid()), entries[0].Actor)
+
+	entries, err = audit.NewLog(c, d).Entries(audit.Filter{Op: audit.OpAuth})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, audit.ResultFailed, entries[0].Result)
+
+	assert.Nil(t, cl.Logout())
+
+	_, err = cl.GetKey("daemon-key")
+	assert.Equal(t, rest.CodeUnauthorized, code(err))
+}
+
+// TestSignatureFile follows dsa sign while the daemon runs, the signature
+// it returns is written under paths.signatures and verifies once read back
+func TestSignatureFile(t *testing.T) {
+	socket, c, _, done := newTestDaemon(t)
+	defer done()
+
+	cl := NewClient(socket)
+
+	if _, err := cl.Login("", []byte("123456")); err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := cl.CreateKey(rest.CreateKeyRequest{Name: "file-key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256([]byte("payload"))
+
+	s, err := cl.Sign(created.GID, rest.SignRequest{Digest: fmt.Sprintf("%x", digest[:]), Hash: "sha256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := base64.StdEncoding.DecodeString(s.Signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := signature.File(c.GetString("paths.signatures"), "", created.GID, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, filepath.Join(c.GetString("paths.signatures"), created.GID), filepath.Dir(path))
+
+	meta := &signature.Metadata{Key: created.GID, Hash: s.Hash, Mode: s.Mode, CreatedAt: time.Now()}
+	if err := signature.Write(path, der, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := signature.LoadMetadata(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, created.GID, loaded.Key)
+	assert.Equal(t, "sha256", loaded.Hash)
+
+	sig, err := signature.LoadSignature(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GetECDSA(c, created.GID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := signature.Payload(digest[:], loaded.Mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, key.Verify(payload, sig))
+
+	v, err := cl.Verify(created.GID, rest.VerifyRequest{
+		Digest:    fmt.Sprintf("%x", digest[:]),
+		Hash:      loaded.Hash,
+		Mode:      loaded.Mode,
+		Signature: base64.StdEncoding.EncodeToString(der),
+	})
+	assert.Nil(t, err)
+	assert.True(t, v.Valid)
+
+	// Nothing lands next to the key records
+	matches, err := filepath.Glob(filepath.Join(c.GetString("paths.keys"), "*", "*", "signature-*"))
+	assert.Nil(t, err)
+	assert.Empty(t, matches)
+}
+
+func TestSessions(t *testing.T) {
+	socket, _, _, done := newTestDaemon(t)
+	defer done()
+
+	cl := NewClient(socket)
+	if _, err := cl.Login("", []byte("123456")); err != nil {
+		t.Fatal(err)
+	}
+
+	other := NewClient(socket).(*client)
+
+	// Tokens are checked, not merely present
+	other.token = "00"
+	_, err := other.GetKey("anything")
+	assert.Equal(t, rest.CodeUnauthorized, code(err))
+
+	// A token belongs to the uid that logged in with it, until it expires
+	token := cl.(*client).token
+
+	h := &handler{sessions: map[string]*session{}}
+	h.sessions[tokenHash(token)] = &session{uid: os.Getuid() + 1, expiresAt: time.Now().Add(time.Minute)}
+
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	_, rerr := h.session(req, os.Getuid())
+	assert.Equal(t, rest.CodeUnauthorized, rerr.Code)
+
+	s, rerr := h.session(req, os.Getuid()+1)
+	assert.Nil(t, rerr)
+	assert.NotNil(t, s)
+
+	h.sessions[tokenHash(token)].expiresAt = time.Now().Add(-time.Second)
+	_, rerr = h.session(req, os.Getuid()+1)
+	assert.Equal(t, rest.CodeUnauthorized, rerr.Code)
+	assert.Equal(t, 0, len(h.sessions))
+}
+
+// TestCommands follows the key and alias commands through the daemon
+func TestCommands(t *testing.T) {
+	socket, _, _, done := newTestDaemon(t)
+	defer done()
+
+	cl := NewClient(socket)
+	if _, err := cl.Login("", []byte("123456")); err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := cl.CreateKey(rest.CreateKeyRequest{Name: "managed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := cl.LabelKey("managed", rest.LabelRequest{Add: []string{"ci"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ci"}, key.Labels)
+
+	key, err = cl.TagKey("managed", rest.TagRequest{Set: map[string]string{"env": "prod"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "prod", key.Tags["env"])
+
+	n, err := cl.Reindex()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n.Keys)
+
+	a, err := cl.CreateAlias(rest.CreateAliasRequest{Name: "release"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err = cl.RotateAlias("release")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, a.Primary)
+
+	got, err := cl.GetAlias("release")
+	assert.Nil(t, err)
+	assert.Equal(t, a.Versions, got.Versions)
+
+	list, err := cl.ListAliases()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(list.Aliases))
+
+	_, err = cl.GetAlias("missing")
+	assert.Equal(t, rest.CodeNotFound, code(err))
+
+	digest := sha256.Sum256([]byte("payload"))
+
+	b, err := cl.Batch(rest.BatchRequest{
+		Alias: "release",
+		Items: []ecdsa.BatchItem{{ID: "1", Digest: fmt.Sprintf("%x", digest[:]), Hash: "sha256"}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, a.Version(2).GID, b.Key)
+	assert.Equal(t, 1, len(b.Results))
+	assert.Empty(t, b.Results[0].Error)
+
+	// Until operators are enrolled destroying takes no approvals
+	for _, status := range []string{"archive", "active", "compromised", "destroyed"} {
+		key, err = cl.SetKeyStatus(created.GID, rest.StatusRequest{Status: status})
+		assert.Nil(t, err, status)
+		assert.Equal(t, status, key.Status)
+	}
+}
+
+// TestQuorum destroys keys once the officers sent along make the quorum
+func TestQuorum(t *testing.T) {
+	socket, c, d, done := newTestDaemon(t)
+	defer done()
+
+	// The first operator enrolled must be an officer
+	ops := auth.NewOperators(c, d)
+	for _, op := range [][2]string{{"alice", auth.RoleOfficer}, {"bob", auth.RoleOfficer}, {"carol", auth.RoleUser}} {
+		if _, err := ops.Add(op[0], op[1], []byte("123456")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cl := NewClient(socket)
+	if _, err := cl.Login("carol", []byte("123456")); err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := cl.CreateKey(rest.CreateKeyRequest{Name: "doomed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	destroy := func(officers ...string) error {
+		a := &rest.Approvals{}
+		for _, name := range officers {
+			a.Officers = append(a.Officers, rest.Officer{Name: name, Pin: "123456"})
+		}
+
+		_, err := cl.SetKeyStatus(created.GID, rest.StatusRequest{Status: "destroyed", Approvals: a})
+		return err
+	}
+
+	assert.Equal(t, rest.CodeForbidden, code(destroy()))
+	assert.Equal(t, rest.CodeForbidden, code(destroy("alice")))
+	assert.Equal(t, rest.CodeForbidden, code(destroy("alice", "carol")))
+	assert.Nil(t, destroy("alice", "bob"))
+
+	key, err := cl.GetKey(created.GID)
+	assert.Nil(t, err)
+	assert.Equal(t, "destroyed", key.Status)
+
+	// Every check is audited under the session's operator
+	entries, err := audit.NewLog(c, d).Entries(audit.Filter{Op: audit.OpAuth, Key: created.GID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 4, len(entries))
+	assert.Equal(t, "carol", entries[3].Actor)
+	assert.Equal(t, audit.ResultOK, entries[3].Result)
+}
@@ -0,0 +1,33 @@
+//go:build linux
+// +build linux
+
+package hsmd
+
+import (
+	"net"
+	"syscall"
+)
+
+// connUID reads the peer credentials the kernel keeps for a Unix socket
+func connUID(c net.Conn) (int, bool) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return 0, false
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+
+	var cred *syscall.Ucred
+	var cerr error
+
+	if err := raw.Control(func(fd uintptr) {
+		cred, cerr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil || cerr != nil {
+		return 0, false
+	}
+
+	return int(cred.Uid), true
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package hsmd
+
+import "net"
+
+// connUID is not supported here, hsmd.allowed_uids then refuses every
+// client and only the socket's mode restricts access
+func connUID(c net.Conn) (int, bool) {
+	return 0, false
+}
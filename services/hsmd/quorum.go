@@ -0,0 +1,77 @@
+package hsmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/services/audit"
+	"github.com/block27/core/services/auth"
+	"github.com/block27/core/services/bbolt"
+	"github.com/block27/core/services/rest"
+)
+
+// quorum checks the approvals sent with a request the way the command line
+// checks --approver and --approval, none are needed until operators are
+// enrolled. Every check is audited under the session's actor.
+type quorum struct {
+	c     config.Reader
+	d     bbolt.Datastore
+	actor string
+}
+
+func (q quorum) Destroy(gid string, a rest.Approvals) error {
+	enrolled, err := auth.NewOperators(q.c, q.d).Enrolled()
+	if err != nil || !enrolled {
+		return err
+	}
+
+	entry := audit.Entry{Op: audit.OpAuth, Key: gid, Actor: q.actor, Detail: "quorum " + auth.ActionDestroy}
+
+	approvers, err := q.approve(auth.ActionDestroy, gid, a)
+	if err != nil {
+		entry.Result, entry.Detail = audit.ResultFailed, fmt.Sprintf("%s: %v", entry.Detail, err)
+	} else {
+		entry.Detail = fmt.Sprintf("%s approved by %s", entry.Detail, strings.Join(approvers, ", "))
+	}
+
+	if _, aerr := audit.NewLog(q.c, q.d).Append(entry); aerr != nil {
+		return rest.NewError(http.StatusServiceUnavailable, rest.CodeUnavailable, "audit log unavailable")
+	}
+
+	if err != nil {
+		return rest.NewError(http.StatusForbidden, rest.CodeForbidden, "%v", err)
+	}
+
+	return nil
+}
+
+// approve counts the officers and tokens, spending the tokens once they
+// make the quorum, and returns the approvers
+func (q quorum) approve(action string, target string, a rest.Approvals) ([]string, error) {
+	qa, err := auth.NewQuorum(q.c, q.d, action, target)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, o := range a.Officers {
+		if err := qa.Approve(o.Name, []byte(o.Pin)); err != nil {
+			return nil, fmt.Errorf("approval by %s: %v", o.Name, err)
+		}
+	}
+
+	for i, data := range a.Tokens {
+		var t auth.Approval
+		if err := json.Unmarshal(data, &t); err != nil {
+			return nil, fmt.Errorf("approval token %d: %v", i+1, err)
+		}
+
+		if err := qa.Token(&t); err != nil {
+			return nil, fmt.Errorf("approval token %d: %v", i+1, err)
+		}
+	}
+
+	return qa.Approvers(), qa.Commit()
+}
@@ -0,0 +1,269 @@
+package keystore
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/block27/core/services/bbolt"
+)
+
+// boltStore keeps key records in bbolt, one bucket of records per key type
+// plus a bucket per secondary index, every change in a single transaction.
+//
+//	keys.<kind>              gid -> record
+//	keys.<kind>.idx.<field>  value NUL gid -> ""
+//	keys.<kind>.indexed      gid -> JSON Index the record was stored with
+type boltStore struct {
+	d bbolt.Datastore
+}
+
+// NewBolt keeps key records in an open datastore
+func NewBolt(d bbolt.Datastore) Store {
+	return &boltStore{d: d}
+}
+
+func recordBucket(kind string) string {
+	return fmt.Sprintf("keys.%s", kind)
+}
+
+func indexBucket(kind string, field string) string {
+	return fmt.Sprintf("keys.%s.idx.%s", kind, field)
+}
+
+func indexedBucket(kind string) string {
+	return fmt.Sprintf("keys.%s.indexed", kind)
+}
+
+func indexKey(value string, gid string) []byte {
+	return []byte(value + "\x00" + gid)
+}
+
+// Get returns the record stored under gid
+func (s *boltStore) Get(kind string, gid string) ([]byte, error) {
+	data, err := s.d.Get(recordBucket(kind), []byte(gid))
+	if err != nil {
+		return nil, err
+	}
+
+	if data == nil {
+		return nil, ErrNotFound
+	}
+
+	return data, nil
+}
+
+// Put creates or replaces a record and its index entries
+func (s *boltStore) Put(kind string, e Entry, unique ...string) error {
+	return s.put(kind, e, nil, false, unique)
+}
+
+// CompareAndSwap replaces a record only if it still equals old
+func (s *boltStore) CompareAndSwap(kind string, old []byte, e Entry, unique ...string) error {
+	return s.put(kind, e, old, true, unique)
+}
+
+func (s *boltStore) put(kind string, e Entry, old []byte, cas bool, unique []string) error {
+	return s.d.Write(func(tx bbolt.Tx) error {
+		if err := checkPut(e, unique, func(field string, value string) []string {
+			return find(tx, kind, field, value)
+		}); err != nil {
+			return err
+		}
+
+		if cas && !swapped(tx.Get(recordBucket(kind), []byte(e.GID)), old) {
+			return ErrModified
+		}
+
+		if err := unindex(tx, kind, e.GID); err != nil {
+			return err
+		}
+
+		if err := tx.Put(recordBucket(kind), []byte(e.GID), e.Data); err != nil {
+			return err
+		}
+
+		return index(tx, kind, e.GID, e.Index)
+	})
+}
+
+// Delete removes a record and its index entries
+func (s *boltStore) Delete(kind string, gid string) error {
+	return s.d.Write(func(tx bbolt.Tx) error {
+		if tx.Get(recordBucket(kind), []byte(gid)) == nil {
+			return ErrNotFound
+		}
+
+		if err := unindex(tx, kind, gid); err != nil {
+			return err
+		}
+
+		return tx.Delete(recordBucket(kind), []byte(gid))
+	})
+}
+
+// List calls fn for every record of a kind in GID order
+func (s *boltStore) List(kind string, fn func(gid string, data []byte) error) error {
+	return s.d.ForEach(recordBucket(kind), func(k, v []byte) error {
+		return fn(string(k), append([]byte{}, v...))
+	})
+}
+
+// Find returns the GIDs indexed under value
+func (s *boltStore) Find(kind string, field string, value string) ([]string, error) {
+	var gids []string
+
+	err := s.d.Read(func(tx bbolt.Tx) error {
+		gids = find(tx, kind, field, value)
+		return nil
+	})
+
+	return gids, err
+}
+
+// Prefix returns the GIDs starting with prefix
+func (s *boltStore) Prefix(kind string, prefix string) ([]string, error) {
+	var gids []string
+
+	err := s.d.Read(func(tx bbolt.Tx) error {
+		return tx.ForEachPrefix(recordBucket(kind), []byte(prefix), func(k, v []byte) error {
+			gids = append(gids, string(k))
+			return nil
+		})
+	})
+
+	return gids, err
+}
+
+// Indexes calls fn with the index each record was stored with
+func (s *boltStore) Indexes(kind string, fn func(gid string, idx Index) error) error {
+	return s.d.ForEach(indexedBucket(kind), func(k, v []byte) error {
+		var idx Index
+		if err := json.Unmarshal(v, &idx); err != nil {
+			return fmt.Errorf("index of %s: %v", k, err)
+		}
+
+		return fn(string(k), idx)
+	})
+}
+
+// Reindex drops every index of a kind and rebuilds them from the records,
+// in one transaction. fn returns the index of a record, nil leaves the
+// record unindexed. It returns the number of records indexed.
+func (s *boltStore) Reindex(kind string, fn func(gid string, data []byte) (Index, error)) (int, error) {
+	n := 0
+
+	err := s.d.Write(func(tx bbolt.Tx) error {
+		fields := map[string]bool{}
+		indexes := map[string]Index{}
+
+		if err := tx.ForEach(indexedBucket(kind), func(k, v []byte) error {
+			var old Index
+			if json.Unmarshal(v, &old) == nil {
+				for field := range old {
+					fields[field] = true
+				}
+			}
+
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		if err := tx.ForEach(recordBucket(kind), func(k, v []byte) error {
+			idx, err := fn(string(k), append([]byte{}, v...))
+			if err != nil {
+				return err
+			}
+
+			for field := range idx {
+				fields[field] = true
+			}
+
+			indexes[string(k)] = idx
+
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		if err := tx.DeleteBucket(indexedBucket(kind)); err != nil {
+			return err
+		}
+
+		for field := range fields {
+			if err := tx.DeleteBucket(indexBucket(kind, field)); err != nil {
+				return err
+			}
+		}
+
+		for gid, idx := range indexes {
+			if idx == nil {
+				continue
+			}
+
+			if err := index(tx, kind, gid, idx); err != nil {
+				return err
+			}
+
+			n++
+		}
+
+		return nil
+	})
+
+	return n, err
+}
+
+func find(tx bbolt.Tx, kind string, field string, value string) []string {
+	var gids []string
+
+	prefix := indexKey(value, "")
+
+	tx.ForEachPrefix(indexBucket(kind, field), prefix, func(k, v []byte) error {
+		gids = append(gids, string(k[len(prefix):]))
+		return nil
+	})
+
+	return gids
+}
+
+// index writes the entries of a record, remembering them for unindex
+func index(tx bbolt.Tx, kind string, gid string, idx Index) error {
+	for field, values := range idx {
+		for _, v := range values {
+			if err := tx.Put(indexBucket(kind, field), indexKey(v, gid), []byte{}); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Put(indexedBucket(kind), []byte(gid), data)
+}
+
+// unindex removes the entries written for a record by index
+func unindex(tx bbolt.Tx, kind string, gid string) error {
+	data := tx.Get(indexedBucket(kind), []byte(gid))
+	if data == nil {
+		return nil
+	}
+
+	var idx Index
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return err
+	}
+
+	for field, values := range idx {
+		for _, v := range values {
+			if err := tx.Delete(indexBucket(kind, field), indexKey(v, gid)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Delete(indexedBucket(kind), []byte(gid))
+}
@@ -0,0 +1,462 @@
+package keystore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	recordFile = "obj.bin"
+	indexFile  = "index.json"
+)
+
+// fsStore keeps key records in the original directory layout, one directory
+// per key holding the record and the values it is indexed by:
+//
+//	<root>/<kind>/<gid>/obj.bin     record
+//	<root>/<kind>/<gid>/index.json  JSON Index
+//
+// The store owns those two files only, anything else kept in a key directory
+// is left alone. Each is written next to itself as <file>.new and renamed
+// into place, the record last, so a crash never leaves a half-written key
+// behind. Index lookups scan the key directories. Only one process may
+// write to a root at a time.
+type fsStore struct {
+	mu sync.Mutex
+
+	root string
+}
+
+// NewFS keeps key records in directories under root, finishing or rolling
+// back any write interrupted by a crash
+func NewFS(root string) (Store, error) {
+	s := &fsStore{root: root}
+
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *fsStore) dir(kind string, gid string) string {
+	return filepath.Join(s.root, kind, gid)
+}
+
+// staged returns the path a file of the store is written to before it is
+// renamed into place
+func staged(path string) string {
+	return path + ".new"
+}
+
+// validGID keeps a GID to a single path element of its own
+func validGID(gid string) bool {
+	return gid != "" && !strings.HasPrefix(gid, ".") && !strings.ContainsAny(gid, `/\`)
+}
+
+// Get returns the record stored under gid
+func (s *fsStore) Get(kind string, gid string) ([]byte, error) {
+	if !validGID(gid) {
+		return nil, ErrNotFound
+	}
+
+	return s.read(kind, gid)
+}
+
+// Put creates or replaces a record and its index entries
+func (s *fsStore) Put(kind string, e Entry, unique ...string) error {
+	return s.put(kind, e, nil, false, unique)
+}
+
+// CompareAndSwap replaces a record only if it still equals old
+func (s *fsStore) CompareAndSwap(kind string, old []byte, e Entry, unique ...string) error {
+	return s.put(kind, e, old, true, unique)
+}
+
+func (s *fsStore) put(kind string, e Entry, old []byte, cas bool, unique []string) error {
+	if e.GID != "" && !validGID(e.GID) {
+		return &os.PathError{Op: "put", Path: e.GID, Err: os.ErrInvalid}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	indexes, err := s.indexes(kind)
+	if err != nil {
+		return err
+	}
+
+	if err := checkPut(e, unique, func(field string, value string) []string {
+		return findIn(indexes, field, value)
+	}); err != nil {
+		return err
+	}
+
+	if cas {
+		current, err := s.read(kind, e.GID)
+		if err == ErrNotFound {
+			current = nil
+		} else if err != nil {
+			return err
+		}
+
+		if !swapped(current, old) {
+			return ErrModified
+		}
+	}
+
+	idx, err := json.Marshal(e.Index)
+	if err != nil {
+		return err
+	}
+
+	dir := s.dir(kind, e.GID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	rec, ix := filepath.Join(dir, recordFile), filepath.Join(dir, indexFile)
+
+	// While the staged record exists the index is not committed either
+	if err := writeSynced(staged(rec), e.Data); err != nil {
+		os.Remove(staged(rec))
+		return err
+	}
+
+	if err := writeSynced(staged(ix), idx); err != nil {
+		os.Remove(staged(rec))
+		os.Remove(staged(ix))
+		return err
+	}
+
+	// The record going in commits the write, recover finishes the index
+	if err := os.Rename(staged(rec), rec); err != nil {
+		os.Remove(staged(rec))
+		os.Remove(staged(ix))
+		return err
+	}
+
+	return os.Rename(staged(ix), ix)
+}
+
+// Delete removes a record and its index entries
+func (s *fsStore) Delete(kind string, gid string) error {
+	if !validGID(gid) {
+		return ErrNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := s.dir(kind, gid)
+
+	// The record going commits the delete, recover drops an index left alone
+	if err := os.Remove(filepath.Join(dir, recordFile)); os.IsNotExist(err) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if err := os.Remove(filepath.Join(dir, indexFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Fails, leaving the directory, unless it is empty
+	os.Remove(dir)
+
+	return nil
+}
+
+// List calls fn for every record of a kind in GID order
+func (s *fsStore) List(kind string, fn func(gid string, data []byte) error) error {
+	gids, err := s.gids(kind)
+	if err != nil {
+		return err
+	}
+
+	for _, gid := range gids {
+		data, err := s.read(kind, gid)
+		if err == ErrNotFound {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := fn(gid, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Find returns the GIDs indexed under value
+func (s *fsStore) Find(kind string, field string, value string) ([]string, error) {
+	indexes, err := s.indexes(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	return findIn(indexes, field, value), nil
+}
+
+// Prefix returns the GIDs starting with prefix
+func (s *fsStore) Prefix(kind string, prefix string) ([]string, error) {
+	gids, err := s.gids(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []string
+
+	for _, gid := range gids {
+		if strings.HasPrefix(gid, prefix) {
+			found = append(found, gid)
+		}
+	}
+
+	return found, nil
+}
+
+// Indexes calls fn with the index file of every key directory
+func (s *fsStore) Indexes(kind string, fn func(gid string, idx Index) error) error {
+	indexes, err := s.indexes(kind)
+	if err != nil {
+		return err
+	}
+
+	gids := make([]string, 0, len(indexes))
+	for gid := range indexes {
+		gids = append(gids, gid)
+	}
+
+	sort.Strings(gids)
+
+	for _, gid := range gids {
+		if err := fn(gid, indexes[gid]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reindex rewrites the index file of every record. Each file is replaced
+// atomically, but not all of them at once.
+func (s *fsStore) Reindex(kind string, fn func(gid string, data []byte) (Index, error)) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	gids, err := s.gids(kind)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+
+	for _, gid := range gids {
+		data, err := s.read(kind, gid)
+		if err == ErrNotFound {
+			continue
+		}
+
+		if err != nil {
+			return n, err
+		}
+
+		idx, err := fn(gid, data)
+		if err != nil {
+			return n, err
+		}
+
+		raw, err := json.Marshal(idx)
+		if err != nil {
+			return n, err
+		}
+
+		path := filepath.Join(s.dir(kind, gid), indexFile)
+		if err := writeSynced(staged(path), raw); err != nil {
+			return n, err
+		}
+
+		if err := os.Rename(staged(path), path); err != nil {
+			return n, err
+		}
+
+		if idx != nil {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (s *fsStore) read(kind string, gid string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir(kind, gid), recordFile))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+
+	return data, err
+}
+
+// gids returns the key directories of a kind in order
+func (s *fsStore) gids(kind string) ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(s.root, kind))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var gids []string
+
+	for _, f := range files {
+		if f.IsDir() && validGID(f.Name()) {
+			gids = append(gids, f.Name())
+		}
+	}
+
+	sort.Strings(gids)
+
+	return gids, nil
+}
+
+// indexes reads the index file of every key. Keys without one, such as
+// directories left by older releases, are simply not indexed.
+func (s *fsStore) indexes(kind string) (map[string]Index, error) {
+	gids, err := s.gids(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	indexes := map[string]Index{}
+
+	for _, gid := range gids {
+		data, err := ioutil.ReadFile(filepath.Join(s.dir(kind, gid), indexFile))
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		// Reindex leaves null for records it dropped from the indexes
+		var idx Index
+		if json.Unmarshal(data, &idx) == nil && idx != nil {
+			indexes[gid] = idx
+		}
+	}
+
+	return indexes, nil
+}
+
+// recover finishes the writes interrupted by a crash: a record that made it
+// into place gets its staged index, one that did not is rolled back, and the
+// index a delete left behind goes.
+func (s *fsStore) recover() error {
+	kinds, err := ioutil.ReadDir(s.root)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range kinds {
+		if !k.IsDir() {
+			continue
+		}
+
+		files, err := ioutil.ReadDir(filepath.Join(s.root, k.Name()))
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			if !f.IsDir() || !validGID(f.Name()) {
+				continue
+			}
+
+			if err := recoverKey(filepath.Join(s.root, k.Name(), f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// recoverKey settles the files of one key directory
+func recoverKey(dir string) error {
+	rec, ix := filepath.Join(dir, recordFile), filepath.Join(dir, indexFile)
+
+	if _, err := os.Stat(staged(rec)); err == nil {
+		if err := os.Remove(staged(rec)); err != nil {
+			return err
+		}
+
+		if err := os.Remove(staged(ix)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(staged(ix)); err == nil {
+		if err := os.Rename(staged(ix), ix); err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(rec); os.IsNotExist(err) {
+		if err := os.Remove(ix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func findIn(indexes map[string]Index, field string, value string) []string {
+	var gids []string
+
+	for gid, idx := range indexes {
+		if indexed(idx, field, value) {
+			gids = append(gids, gid)
+		}
+	}
+
+	sort.Strings(gids)
+
+	return gids
+}
+
+// writeSynced writes a private file and flushes it to disk
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
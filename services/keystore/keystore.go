@@ -0,0 +1,190 @@
+package keystore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/services/bbolt"
+)
+
+// Backends selectable with keystore.backend
+const (
+	Bbolt  = "bbolt"
+	FS     = "fs"
+	Memory = "memory"
+)
+
+// ErrNotFound is returned by Get for an unknown GID
+var ErrNotFound = errors.New("key record not found")
+
+// ErrModified is returned by CompareAndSwap when the record is no longer the
+// one the caller read
+var ErrModified = errors.New("key record changed since it was read")
+
+// Index maps an index name, e.g. "name" or "status", to the values a record
+// can be found under
+type Index map[string][]string
+
+// Entry is one key record together with the values it is indexed by
+type Entry struct {
+	GID   string
+	Data  []byte
+	Index Index
+}
+
+// Conflict is returned by Put when a unique index value already belongs to a
+// different record
+type Conflict struct {
+	Field string
+	Value string
+	GID   string
+}
+
+func (c *Conflict) Error() string {
+	return fmt.Sprintf("%s %q already in use by %s", c.Field, c.Value, c.GID)
+}
+
+// Store keeps opaque key records, one namespace per key type (kind), each
+// findable by GID, GID prefix or the values of its Index. A record and its
+// index entries are always written together, so they can never disagree.
+type Store interface {
+	// Get returns the record stored under gid, or ErrNotFound
+	Get(kind string, gid string) ([]byte, error)
+
+	// Put creates or replaces a record and its index entries. Values of the
+	// unique indexes must not be held by any other record, or Put fails with
+	// a *Conflict and nothing is written.
+	Put(kind string, e Entry, unique ...string) error
+
+	// CompareAndSwap is Put only if the stored record still equals old, nil
+	// meaning no record may exist yet, and fails with ErrModified otherwise
+	CompareAndSwap(kind string, old []byte, e Entry, unique ...string) error
+
+	// Delete removes a record and its index entries, or returns ErrNotFound
+	Delete(kind string, gid string) error
+
+	// List calls fn for every record of a kind in GID order
+	List(kind string, fn func(gid string, data []byte) error) error
+
+	// Find returns the GIDs indexed under value
+	Find(kind string, field string, value string) ([]string, error)
+
+	// Prefix returns the GIDs starting with prefix
+	Prefix(kind string, prefix string) ([]string, error)
+
+	// Indexes calls fn in GID order with the index stored for every indexed
+	// GID, including any whose record has gone, for integrity checks
+	Indexes(kind string, fn func(gid string, idx Index) error) error
+
+	// Reindex drops every index of a kind and rebuilds them from the records.
+	// fn returns the index of a record, nil leaves the record unindexed. It
+	// returns the number of records indexed.
+	Reindex(kind string, fn func(gid string, data []byte) (Index, error)) (int, error)
+}
+
+var (
+	openMu sync.Mutex
+	opened = map[string]Store{}
+)
+
+// Backend returns the backend named by keystore.backend
+func Backend(c config.Reader) string {
+	return c.GetString("keystore.backend")
+}
+
+// Open returns the store selected by keystore.backend, shared by the whole
+// process and open for its lifetime:
+//
+//	bbolt   the application database, <paths.base>/botldb
+//	fs      a directory per key under paths.keys
+//	memory  nothing persisted, for tests
+func Open(c config.Reader) (Store, error) {
+	backend := Backend(c)
+
+	var path string
+	switch backend {
+	case Bbolt:
+		path = fmt.Sprintf("%s/botldb", c.GetString("paths.base"))
+	case FS:
+		path = c.GetString("paths.keys")
+	case Memory:
+	default:
+		return nil, fmt.Errorf("unknown keystore backend %q, use %s, %s or %s", backend, Bbolt, FS, Memory)
+	}
+
+	openMu.Lock()
+	defer openMu.Unlock()
+
+	if s, ok := opened[backend+":"+path]; ok {
+		return s, nil
+	}
+
+	var s Store
+
+	switch backend {
+	case Bbolt:
+		d, err := bbolt.NewDB(path)
+		if err != nil {
+			return nil, err
+		}
+
+		s = NewBolt(d)
+	case FS:
+		fs, err := NewFS(path)
+		if err != nil {
+			return nil, err
+		}
+
+		s = fs
+	case Memory:
+		s = NewMemory()
+	}
+
+	opened[backend+":"+path] = s
+
+	return s, nil
+}
+
+// checkPut enforces the unique indexes of e and, for CompareAndSwap, that
+// current still equals old. find looks a value up in the store as it is.
+func checkPut(e Entry, unique []string, find func(field string, value string) []string) error {
+	if e.GID == "" {
+		return errors.New("key record without a gid")
+	}
+
+	for _, field := range unique {
+		for _, v := range e.Index[field] {
+			for _, gid := range find(field, v) {
+				if gid != e.GID {
+					return &Conflict{Field: field, Value: v, GID: gid}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// swapped reports whether current is still the record a CompareAndSwap
+// caller read
+func swapped(current []byte, old []byte) bool {
+	if old == nil {
+		return current == nil
+	}
+
+	return current != nil && bytes.Equal(current, old)
+}
+
+// indexed reports whether idx holds value under field
+func indexed(idx Index, field string, value string) bool {
+	for _, v := range idx[field] {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
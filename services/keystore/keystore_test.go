@@ -0,0 +1,258 @@
+package keystore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/block27/core/services/bbolt"
+	"github.com/stretchr/testify/assert"
+)
+
+// forEachBackend runs a test against a fresh store of every backend
+func forEachBackend(t *testing.T, fn func(t *testing.T, s Store)) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := bbolt.NewDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	fs, err := NewFS(filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, s := range map[string]Store{Bbolt: NewBolt(d), FS: fs, Memory: NewMemory()} {
+		s := s
+		t.Run(name, func(t *testing.T) { fn(t, s) })
+	}
+}
+
+func TestPutFind(t *testing.T) {
+	forEachBackend(t, testPutFind)
+}
+
+func testPutFind(t *testing.T, s Store) {
+	_, err := s.Get("ecdsa", "a")
+	assert.Equal(t, ErrNotFound, err)
+
+	if err := s.Put("ecdsa", Entry{GID: "a", Data: []byte("1"), Index: Index{"name": {"one"}}}, "name"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s.Get("ecdsa", "a")
+	assert.Nil(t, err)
+	assert.Equal(t, "1", string(data))
+
+	found, _ := s.Find("ecdsa", "name", "one")
+	assert.Equal(t, []string{"a"}, found)
+
+	// Another record cannot take a unique value, and nothing is written
+	err = s.Put("ecdsa", Entry{GID: "b", Data: []byte("2"), Index: Index{"name": {"one"}}}, "name")
+	conflict, ok := err.(*Conflict)
+	if !ok {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+
+	assert.Equal(t, "a", conflict.GID)
+
+	_, err = s.Get("ecdsa", "b")
+	assert.Equal(t, ErrNotFound, err)
+
+	// Re-putting a record replaces its old index entries
+	if err := s.Put("ecdsa", Entry{GID: "a", Data: []byte("1"), Index: Index{"name": {"uno"}}}, "name"); err != nil {
+		t.Fatal(err)
+	}
+
+	found, _ = s.Find("ecdsa", "name", "one")
+	assert.Empty(t, found)
+
+	found, _ = s.Find("ecdsa", "name", "uno")
+	assert.Equal(t, []string{"a"}, found)
+
+	found, _ = s.Prefix("ecdsa", "a")
+	assert.Equal(t, []string{"a"}, found)
+
+	if err := s.Delete("ecdsa", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, ErrNotFound, s.Delete("ecdsa", "a"))
+
+	found, _ = s.Find("ecdsa", "name", "uno")
+	assert.Empty(t, found)
+}
+
+func TestReindex(t *testing.T) {
+	forEachBackend(t, testReindex)
+}
+
+func testReindex(t *testing.T, s Store) {
+	for _, gid := range []string{"a", "b"} {
+		if err := s.Put("ecdsa", Entry{GID: gid, Data: []byte(gid), Index: Index{"name": {"stale"}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := s.Reindex("ecdsa", func(gid string, data []byte) (Index, error) {
+		if gid == "b" {
+			return nil, nil
+		}
+
+		return Index{"name": {"fresh"}}, nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	found, _ := s.Find("ecdsa", "name", "stale")
+	assert.Empty(t, found)
+
+	found, _ = s.Find("ecdsa", "name", "fresh")
+	assert.Equal(t, []string{"a"}, found)
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	forEachBackend(t, testCompareAndSwap)
+}
+
+func testCompareAndSwap(t *testing.T, s Store) {
+	// nil old only creates
+	if err := s.CompareAndSwap("ecdsa", nil, Entry{GID: "a", Data: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, ErrModified, s.CompareAndSwap("ecdsa", nil, Entry{GID: "a", Data: []byte("x")}))
+
+	// A stale read loses, the current one wins
+	assert.Equal(t, ErrModified, s.CompareAndSwap("ecdsa", []byte("0"), Entry{GID: "a", Data: []byte("x")}))
+
+	if err := s.CompareAndSwap("ecdsa", []byte("1"), Entry{GID: "a", Data: []byte("2")}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := s.Get("ecdsa", "a")
+	assert.Equal(t, "2", string(data))
+
+	var listed []string
+	s.List("ecdsa", func(gid string, data []byte) error {
+		listed = append(listed, gid+"="+string(data))
+		return nil
+	})
+
+	assert.Equal(t, []string{"a=2"}, listed)
+}
+
+func TestFSRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewFS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Crashed mid write: d staged but not committed, e committed without its
+	// index, f deleted with its index left behind
+	kind := filepath.Join(dir, "ecdsa")
+	idx := []byte(`{"name":["x"]}`)
+
+	for _, gid := range []string{"d", "e", "f"} {
+		if err := s.Put("ecdsa", Entry{GID: gid, Data: []byte(gid)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ioutil.WriteFile(filepath.Join(kind, "d", "obj.bin.new"), []byte("dd"), 0600)
+	ioutil.WriteFile(filepath.Join(kind, "d", "index.json.new"), idx, 0600)
+	ioutil.WriteFile(filepath.Join(kind, "e", "index.json.new"), idx, 0600)
+	os.Remove(filepath.Join(kind, "f", "obj.bin"))
+	ioutil.WriteFile(filepath.Join(kind, "f", "index.json"), idx, 0600)
+
+	s, err = NewFS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s.Get("ecdsa", "d")
+	assert.Nil(t, err)
+	assert.Equal(t, "d", string(data))
+
+	found, err := s.Find("ecdsa", "name", "x")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"e"}, found)
+
+	left, _ := filepath.Glob(filepath.Join(kind, "*", "*.new"))
+	assert.Empty(t, left)
+
+	// GIDs never escape the key directory
+	_, err = s.Get("ecdsa", "../ecdsa/d")
+	assert.Equal(t, ErrNotFound, err)
+	assert.NotNil(t, s.Put("ecdsa", Entry{GID: "../x", Data: []byte("x")}))
+}
+
+func TestFSKeepsOtherFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewFS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Put("ecdsa", Entry{GID: "a", Data: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file an operator keeps next to the key survives writes and deletes
+	kept := filepath.Join(dir, "ecdsa", "a", "signature-1.der")
+	if err := ioutil.WriteFile(kept, []byte("signature"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Put("ecdsa", Entry{GID: "a", Data: []byte("2")}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s.Get("ecdsa", "a")
+	assert.Nil(t, err)
+	assert.Equal(t, "2", string(data))
+
+	if err := s.Delete("ecdsa", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Get("ecdsa", "a")
+	assert.Equal(t, ErrNotFound, err)
+
+	got, err := ioutil.ReadFile(kept)
+	assert.Nil(t, err)
+	assert.Equal(t, "signature", string(got))
+
+	// Nothing else left, the directory goes with the key
+	if err := s.Put("ecdsa", Entry{GID: "b", Data: []byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Delete("ecdsa", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(filepath.Join(dir, "ecdsa", "b"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,233 @@
+package keystore
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memStore keeps key records in maps, nothing survives the process. Index
+// lookups scan the records, which is fine at test sizes.
+type memStore struct {
+	mu sync.RWMutex
+
+	kinds map[string]map[string]Entry
+}
+
+// NewMemory returns an empty store held in memory
+func NewMemory() Store {
+	return &memStore{kinds: map[string]map[string]Entry{}}
+}
+
+// Get returns the record stored under gid
+func (s *memStore) Get(kind string, gid string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.kinds[kind][gid]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return copyBytes(e.Data), nil
+}
+
+// Put creates or replaces a record and its index entries
+func (s *memStore) Put(kind string, e Entry, unique ...string) error {
+	return s.put(kind, e, nil, false, unique)
+}
+
+// CompareAndSwap replaces a record only if it still equals old
+func (s *memStore) CompareAndSwap(kind string, old []byte, e Entry, unique ...string) error {
+	return s.put(kind, e, old, true, unique)
+}
+
+func (s *memStore) put(kind string, e Entry, old []byte, cas bool, unique []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := checkPut(e, unique, func(field string, value string) []string {
+		return s.find(kind, field, value)
+	}); err != nil {
+		return err
+	}
+
+	if cas {
+		var current []byte
+		if c, ok := s.kinds[kind][e.GID]; ok {
+			current = c.Data
+		}
+
+		if !swapped(current, old) {
+			return ErrModified
+		}
+	}
+
+	if s.kinds[kind] == nil {
+		s.kinds[kind] = map[string]Entry{}
+	}
+
+	s.kinds[kind][e.GID] = Entry{GID: e.GID, Data: copyBytes(e.Data), Index: copyIndex(e.Index)}
+
+	return nil
+}
+
+// Delete removes a record and its index entries
+func (s *memStore) Delete(kind string, gid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.kinds[kind][gid]; !ok {
+		return ErrNotFound
+	}
+
+	delete(s.kinds[kind], gid)
+
+	return nil
+}
+
+// List calls fn for every record of a kind in GID order. fn runs without
+// the lock held, so it may call back into the store.
+func (s *memStore) List(kind string, fn func(gid string, data []byte) error) error {
+	s.mu.RLock()
+
+	gids := s.gids(kind)
+	records := make([][]byte, len(gids))
+
+	for i, gid := range gids {
+		records[i] = copyBytes(s.kinds[kind][gid].Data)
+	}
+
+	s.mu.RUnlock()
+
+	for i, gid := range gids {
+		if err := fn(gid, records[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Find returns the GIDs indexed under value
+func (s *memStore) Find(kind string, field string, value string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.find(kind, field, value), nil
+}
+
+// Prefix returns the GIDs starting with prefix
+func (s *memStore) Prefix(kind string, prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var gids []string
+
+	for _, gid := range s.gids(kind) {
+		if strings.HasPrefix(gid, prefix) {
+			gids = append(gids, gid)
+		}
+	}
+
+	return gids, nil
+}
+
+// Indexes calls fn with the index of every indexed record
+func (s *memStore) Indexes(kind string, fn func(gid string, idx Index) error) error {
+	s.mu.RLock()
+
+	var gids []string
+	indexes := map[string]Index{}
+
+	for _, gid := range s.gids(kind) {
+		if idx := s.kinds[kind][gid].Index; idx != nil {
+			gids = append(gids, gid)
+			indexes[gid] = copyIndex(idx)
+		}
+	}
+
+	s.mu.RUnlock()
+
+	for _, gid := range gids {
+		if err := fn(gid, indexes[gid]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reindex replaces the index of every record with the one fn returns
+func (s *memStore) Reindex(kind string, fn func(gid string, data []byte) (Index, error)) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	indexes := map[string]Index{}
+
+	for _, gid := range s.gids(kind) {
+		idx, err := fn(gid, copyBytes(s.kinds[kind][gid].Data))
+		if err != nil {
+			return 0, err
+		}
+
+		indexes[gid] = idx
+	}
+
+	n := 0
+
+	for gid, idx := range indexes {
+		e := s.kinds[kind][gid]
+		e.Index = copyIndex(idx)
+		s.kinds[kind][gid] = e
+
+		if idx != nil {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// gids returns the GIDs of a kind in order, the caller holds the lock
+func (s *memStore) gids(kind string) []string {
+	gids := make([]string, 0, len(s.kinds[kind]))
+
+	for gid := range s.kinds[kind] {
+		gids = append(gids, gid)
+	}
+
+	sort.Strings(gids)
+
+	return gids
+}
+
+// find is Find with the lock already held
+func (s *memStore) find(kind string, field string, value string) []string {
+	var gids []string
+
+	for _, gid := range s.gids(kind) {
+		if indexed(s.kinds[kind][gid].Index, field, value) {
+			gids = append(gids, gid)
+		}
+	}
+
+	return gids
+}
+
+func copyBytes(b []byte) []byte {
+	return append([]byte{}, b...)
+}
+
+func copyIndex(idx Index) Index {
+	if idx == nil {
+		return nil
+	}
+
+	out := Index{}
+	for field, values := range idx {
+		out[field] = append([]string{}, values...)
+	}
+
+	return out
+}
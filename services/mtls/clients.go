@@ -0,0 +1,202 @@
+package mtls
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/services/auth"
+	"github.com/block27/core/services/rest"
+)
+
+// rolePermissions are what each operator role may do through the API,
+// mirroring the commands the CLI allows it
+var rolePermissions = map[string][]string{
+	auth.RoleUser:    rest.Permissions,
+	auth.RoleAuditor: {rest.PermRead, rest.PermVerify},
+	auth.RoleOfficer: {rest.PermRead, rest.PermTokens},
+}
+
+// Client maps a certificate subject to a role and, optionally, the keys it
+// is limited to. Subject is the distinguished name as RFC 2253 prints it,
+// e.g. "CN=ci-runner,O=Block27", compared without case.
+type Client struct {
+	Subject string
+	Role    string
+	Keys    []string
+}
+
+// Clients reads the client mapping from api.tls.clients, a list of
+//
+//   - subject: CN=ci-runner,O=Block27
+//     role: crypto-user
+//     keys: [release-signing]
+func Clients(c config.Reader) ([]Client, error) {
+	raw := c.Get("api.tls.clients")
+	if raw == nil {
+		return nil, nil
+	}
+
+	items, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("api.tls.clients must be a list")
+	}
+
+	var clients []Client
+	seen := map[string]bool{}
+
+	for i, item := range items {
+		m := stringMap(item)
+		if m == nil {
+			return nil, fmt.Errorf("api.tls.clients[%d] must be a map", i)
+		}
+
+		subject, _ := m["subject"].(string)
+		role, _ := m["role"].(string)
+
+		cl := Client{Subject: strings.TrimSpace(subject), Role: role}
+		if cl.Subject == "" {
+			return nil, fmt.Errorf("api.tls.clients[%d]: subject is required", i)
+		}
+
+		if _, ok := rolePermissions[cl.Role]; !ok {
+			return nil, fmt.Errorf("api.tls.clients[%d]: invalid role: %q, usage: %v", i, cl.Role, auth.Roles)
+		}
+
+		if seen[strings.ToLower(cl.Subject)] {
+			return nil, fmt.Errorf("api.tls.clients[%d]: duplicate subject %s", i, cl.Subject)
+		}
+
+		seen[strings.ToLower(cl.Subject)] = true
+
+		if keys, ok := m["keys"].([]interface{}); ok {
+			for _, k := range keys {
+				cl.Keys = append(cl.Keys, fmt.Sprint(k))
+			}
+		}
+
+		clients = append(clients, cl)
+	}
+
+	return clients, nil
+}
+
+// stringMap accepts the map types YAML, JSON and defaults decode to
+func stringMap(v interface{}) map[string]interface{} {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m
+	case map[interface{}]interface{}:
+		out := map[string]interface{}{}
+		for k, val := range m {
+			out[fmt.Sprint(k)] = val
+		}
+
+		return out
+	}
+
+	return nil
+}
+
+// Scope returns what the client of a certificate may do, nil when its
+// subject is not mapped
+func Scope(clients []Client, cert *x509.Certificate) *rest.Scope {
+	subject := cert.Subject.String()
+
+	for _, cl := range clients {
+		if strings.EqualFold(cl.Subject, subject) {
+			return &rest.Scope{
+				Actor:       "cert:" + subject,
+				Permissions: rolePermissions[cl.Role],
+				Keys:        cl.Keys,
+			}
+		}
+	}
+
+	return nil
+}
+
+// TokenScope returns what a token may do, its operations are permission
+// names
+func TokenScope(t *auth.Token) *rest.Scope {
+	return &rest.Scope{
+		Actor:       "token:" + t.Name,
+		Permissions: t.Operations,
+		Keys:        t.Keys,
+	}
+}
+
+// revoker revokes tokens for the token routes of the server
+type revoker struct {
+	tokens auth.TokensAPI
+}
+
+func (rv revoker) Revoke(id string) (*rest.RevokedToken, error) {
+	t, err := rv.tokens.Revoke(id)
+	if err == auth.ErrNoToken {
+		return nil, rest.NewError(http.StatusNotFound, rest.CodeNotFound, "%v: %s", err, id)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &rest.RevokedToken{ID: t.ID, Name: t.Name, RevokedAt: *t.RevokedAt}, nil
+}
+
+// Handler serves h to clients presenting a bearer token from tokens or a
+// verified certificate whose subject is mapped, limited to the scope of the
+// token or of the client's role and keys. A token is used over the
+// certificate when both are presented. The health route answers any
+// authenticated client, security officers revoke tokens through h.
+func Handler(h http.Handler, clients []Client, tokens auth.TokensAPI) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var scope *rest.Scope
+
+		if token := bearer(r); token != "" {
+			t, err := tokens.Authenticate(token)
+			switch err {
+			case nil:
+			case auth.ErrInvalidToken, auth.ErrTokenExpired, auth.ErrTokenRevoked:
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+				rest.WriteError(w, rest.NewError(http.StatusUnauthorized, rest.CodeUnauthorized, "%v", err))
+				return
+			default:
+				rest.WriteError(w, rest.NewError(http.StatusInternalServerError, rest.CodeInternal, "%v", err))
+				return
+			}
+
+			scope = TokenScope(t)
+		} else if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			cert := r.TLS.VerifiedChains[0][0]
+
+			if scope = Scope(clients, cert); scope == nil && r.URL.Path != rest.Prefix+"/health" {
+				rest.WriteError(w, rest.NewError(http.StatusForbidden, rest.CodeForbidden, "%s is not a known client", cert.Subject))
+				return
+			}
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			rest.WriteError(w, rest.NewError(http.StatusUnauthorized, rest.CodeUnauthorized, "a client certificate or token is required"))
+			return
+		}
+
+		if r.URL.Path == rest.Prefix+"/health" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		h.ServeHTTP(w, rest.WithRevoker(rest.WithScope(r, scope), revoker{tokens}))
+	})
+}
+
+// bearer returns the token of an Authorization header, empty when none
+func bearer(r *http.Request) string {
+	v := r.Header.Get("Authorization")
+	if !strings.HasPrefix(v, "Bearer ") {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.TrimPrefix(v, "Bearer "))
+}
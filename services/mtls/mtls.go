@@ -0,0 +1,274 @@
+package mtls
+
+import (
+	"bytes"
+	gocrypto "crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/helpers"
+	"github.com/block27/core/services/bbolt"
+	"github.com/block27/core/services/dsa/ecdsa"
+)
+
+// bucket holding the pointer to the server key
+const bucket = "mtls"
+
+var keyPointer = []byte("key")
+
+// ServerAPI terminates TLS for the API with a server key that never leaves
+// the keystore, verifying client certificates against the client CA
+type ServerAPI interface {
+	// Config is the TLS configuration to serve with, it follows Reload
+	Config() *tls.Config
+
+	// Certificate is the server certificate in use
+	Certificate() *x509.Certificate
+
+	// Reload reads the server certificate and client CA again, keeping
+	// the current ones if either is invalid
+	Reload() error
+}
+
+type server struct {
+	c      config.Reader
+	signer gocrypto.Signer
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	pool *x509.CertPool
+}
+
+// Setup creates the dedicated server key in the ECDSA keystore and records
+// it for Load
+func Setup(c config.Reader, d bbolt.Datastore, name string, curve string) (ecdsa.KeyAPI, error) {
+	key, err := ecdsa.NewECDSA(c, name, curve)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.Put(bucket, keyPointer, []byte(key.FilePointer())); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Signer returns the server key recorded by Setup
+func Signer(c config.Reader, d bbolt.Datastore) (gocrypto.Signer, error) {
+	gid, err := d.Get(bucket, keyPointer)
+	if err != nil {
+		return nil, err
+	}
+
+	if gid == nil {
+		return nil, fmt.Errorf("%s", helpers.RFgB("api tls is not configured, run `tls setup`"))
+	}
+
+	key, err := ecdsa.GetECDSA(c, string(gid))
+	if err != nil {
+		return nil, err
+	}
+
+	return ecdsa.NewSigner(key)
+}
+
+// CreateRequest returns a PEM certificate signing request for the server
+// key, for the CA issuing the server certificate
+func CreateRequest(s gocrypto.Signer, commonName string, hosts []string) ([]byte, error) {
+	tmpl := &x509.CertificateRequest{Subject: pkix.Name{CommonName: commonName, Organization: []string{"Block27"}}}
+	tmpl.DNSNames, tmpl.IPAddresses = splitHosts(hosts)
+
+	der, err := x509.CreateCertificateRequest(crypto.Reader, tmpl, s)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// SelfSign issues a self-signed server certificate, for serving until the
+// CA has signed the request
+func SelfSign(s gocrypto.Signer, commonName string, hosts []string, validity time.Duration) (*x509.Certificate, error) {
+	sb := make([]byte, 16)
+	if _, err := io.ReadFull(crypto.Reader, sb); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	tmpl := &x509.Certificate{
+		SerialNumber: new(big.Int).SetBytes(sb),
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: []string{"Block27"},
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	tmpl.DNSNames, tmpl.IPAddresses = splitHosts(hosts)
+
+	der, err := x509.CreateCertificate(crypto.Reader, tmpl, tmpl, s.Public(), s)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+// Load returns the ServerAPI over the key recorded by Setup, the server
+// certificate chain at api.tls.cert and the client CA at api.tls.client_ca
+func Load(c config.Reader, d bbolt.Datastore) (ServerAPI, error) {
+	s, err := Signer(c, d)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &server{c: c, signer: s}
+	if err := srv.Reload(); err != nil {
+		return nil, err
+	}
+
+	return srv, nil
+}
+
+func (s *server) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+
+		// Only consulted by http.Server to tell a certificate is configured,
+		// every handshake takes the config below
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			s.mu.RLock()
+			defer s.mu.RUnlock()
+
+			return s.cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s.mu.RLock()
+			defer s.mu.RUnlock()
+
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*s.cert},
+				// Tokens stand in for a certificate, Handler requires one or
+				// the other
+				ClientAuth: tls.VerifyClientCertIfGiven,
+				ClientCAs:  s.pool,
+			}, nil
+		},
+	}
+}
+
+func (s *server) Certificate() *x509.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.cert.Leaf
+}
+
+func (s *server) Reload() error {
+	chain, err := readCertificates(s.c.GetString("api.tls.cert"))
+	if err != nil {
+		return err
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(s.signer.Public())
+	if err != nil {
+		return err
+	}
+
+	leaf := chain[0]
+	if !bytes.Equal(leaf.RawSubjectPublicKeyInfo, pub) {
+		return fmt.Errorf("%s %s", helpers.RFgB("certificate does not match the server key:"), s.c.GetString("api.tls.cert"))
+	}
+
+	cas, err := readCertificates(s.c.GetString("api.tls.client_ca"))
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	for _, ca := range cas {
+		pool.AddCert(ca)
+	}
+
+	cert := &tls.Certificate{PrivateKey: s.signer, Leaf: leaf}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+
+	s.mu.Lock()
+	s.cert, s.pool = cert, pool
+	s.mu.Unlock()
+
+	return nil
+}
+
+// EncodeCertificate returns a certificate in PEM
+func EncodeCertificate(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+// readCertificates parses every certificate of a PEM file, in order
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s %s", helpers.RFgB("no certificate in"), path)
+	}
+
+	return certs, nil
+}
+
+func splitHosts(hosts []string) ([]string, []net.IP) {
+	var names []string
+	var ips []net.IP
+
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			names = append(names, h)
+		}
+	}
+
+	return names, ips
+}
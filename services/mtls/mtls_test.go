@@ -0,0 +1,469 @@
+package mtls
+
+import (
+	goecdsa "crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/block27/core/backend"
+	"github.com/block27/core/config"
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/services/auth"
+	"github.com/block27/core/services/bbolt"
+	"github.com/block27/core/services/keystore"
+	"github.com/block27/core/services/rest"
+	"github.com/block27/core/test"
+)
+
+var Config config.Reader
+
+func init() {
+	os.Setenv("ENVIRONMENT", "test")
+
+	c, err := config.LoadConfig(config.Defaults)
+	if err != nil {
+		panic(err)
+	}
+
+	if c.GetString("environment") != "test" {
+		panic(fmt.Errorf("test [environment] is not in [test] mode"))
+	}
+
+	// Stands in for HardwareAuthenticate, which needs the device attached
+	if err := crypto.LoadMasterKey([]byte(test.MasterKey), []byte(test.MasterIv)); err != nil {
+		panic(err)
+	}
+
+	Config = c
+}
+
+// deviceReader keeps the keystore and certificates under a directory of
+// their own and maps the test clients
+type deviceReader struct {
+	config.Reader
+	dir string
+}
+
+func (d deviceReader) GetString(key string) string {
+	switch key {
+	case "keystore.backend":
+		return keystore.FS
+	case "paths.keys":
+		return filepath.Join(d.dir, "keys")
+	case "api.tls.cert":
+		return filepath.Join(d.dir, "server.pem")
+	case "api.tls.client_ca":
+		return filepath.Join(d.dir, "client-ca.pem")
+	}
+
+	return d.Reader.GetString(key)
+}
+
+func (d deviceReader) Get(key string) interface{} {
+	if key == "api.tls.clients" {
+		return []interface{}{
+			map[interface{}]interface{}{"subject": "CN=ci,O=Block27", "role": "crypto-user"},
+			map[interface{}]interface{}{"subject": "CN=audit,O=Block27", "role": "auditor"},
+			map[string]interface{}{"subject": "cn=release,o=block27", "role": "crypto-user", "keys": []interface{}{"release"}},
+			map[string]interface{}{"subject": "CN=officer,O=Block27", "role": "security-officer"},
+		}
+	}
+
+	return d.Reader.Get(key)
+}
+
+// testCA issues client certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *goecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := goecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Client CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) issue(t *testing.T, cn string) tls.Certificate {
+	t.Helper()
+
+	key, err := goecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"Block27"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func newTestServer(t *testing.T) (*httptest.Server, ServerAPI, *testCA, config.Reader, auth.TokensAPI, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "mtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := bbolt.NewDB(filepath.Join(dir, "botldb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var c config.Reader = deviceReader{Reader: Config, dir: dir}
+
+	if _, err := Setup(c, d, "api-tls", "prime256v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Signer(c, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := SelfSign(s, "localhost", []string{"localhost", "127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := newTestCA(t)
+
+	ioutil.WriteFile(c.GetString("api.tls.cert"), EncodeCertificate(cert), 0644)
+	ioutil.WriteFile(c.GetString("api.tls.client_ca"), EncodeCertificate(ca.cert), 0644)
+
+	srv, err := Load(c, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clients, err := Clients(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := logrus.New()
+	l.SetOutput(ioutil.Discard)
+
+	tokens := auth.NewTokens(c, d)
+
+	ts := httptest.NewUnstartedServer(Handler(rest.NewServer(&backend.Backend{C: &c, D: d, L: l}, nil), clients, tokens))
+	ts.TLS = srv.Config()
+	ts.StartTLS()
+
+	return ts, srv, ca, c, tokens, func() {
+		ts.Close()
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// client trusts the server certificate in use and presents certs
+func client(srv ServerAPI, certs ...tls.Certificate) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      roots,
+		Certificates: certs,
+		ServerName:   "localhost",
+	}}}
+}
+
+func call(t *testing.T, cl *http.Client, method string, url string, body string) (int, string) {
+	t.Helper()
+
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := cl.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	data, _ := ioutil.ReadAll(res.Body)
+
+	var e struct {
+		Error *rest.Error `json:"error"`
+	}
+
+	if json.Unmarshal(data, &e) == nil && e.Error != nil {
+		return res.StatusCode, e.Error.Code
+	}
+
+	return res.StatusCode, ""
+}
+
+func TestClients(t *testing.T) {
+	clients, err := Clients(deviceReader{Reader: Config})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 4, len(clients))
+	assert.Equal(t, []string{"release"}, clients[2].Keys)
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "release", Organization: []string{"Block27"}}}
+
+	scope := Scope(clients, cert)
+	if assert.NotNil(t, scope) {
+		assert.Equal(t, rest.Permissions, scope.Permissions)
+		assert.Equal(t, "cert:CN=release,O=Block27", scope.Actor)
+	}
+
+	cert.Subject.CommonName = "unknown"
+	assert.Nil(t, Scope(clients, cert))
+
+	_, err = Clients(clientsReader{Config, []interface{}{map[string]interface{}{"subject": "CN=x", "role": "root"}}})
+	assert.NotNil(t, err)
+
+	_, err = Clients(clientsReader{Config, []interface{}{
+		map[string]interface{}{"subject": "CN=x", "role": "auditor"},
+		map[string]interface{}{"subject": "cn=X", "role": "auditor"},
+	}})
+	assert.NotNil(t, err)
+}
+
+// clientsReader maps other clients
+type clientsReader struct {
+	config.Reader
+	clients []interface{}
+}
+
+func (c clientsReader) Get(key string) interface{} {
+	return c.clients
+}
+
+func TestMutualTLS(t *testing.T) {
+	ts, srv, ca, _, _, done := newTestServer(t)
+	defer done()
+
+	// Without a client certificate or token nothing is served
+	status, code := call(t, client(srv), "GET", ts.URL+"/api/v1/health", "")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, rest.CodeUnauthorized, code)
+
+	// Certificates from another CA fail the handshake
+	other := newTestCA(t)
+	_, err := client(srv, other.issue(t, "ci")).Get(ts.URL + "/api/v1/health")
+	assert.NotNil(t, err)
+
+	ci := client(srv, ca.issue(t, "ci"))
+
+	status, _ = call(t, ci, "POST", ts.URL+"/api/v1/keys", `{"name":"release"}`)
+	assert.Equal(t, http.StatusCreated, status)
+
+	status, _ = call(t, ci, "POST", ts.URL+"/api/v1/keys", `{"name":"other"}`)
+	assert.Equal(t, http.StatusCreated, status)
+
+	// Verified but unmapped subjects only reach health
+	stranger := client(srv, ca.issue(t, "stranger"))
+
+	status, _ = call(t, stranger, "GET", ts.URL+"/api/v1/health", "")
+	assert.Equal(t, http.StatusOK, status)
+
+	status, code = call(t, stranger, "GET", ts.URL+"/api/v1/keys", "")
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, rest.CodeForbidden, code)
+
+	// Auditors read but cannot create or sign
+	auditor := client(srv, ca.issue(t, "audit"))
+
+	status, _ = call(t, auditor, "GET", ts.URL+"/api/v1/keys/release", "")
+	assert.Equal(t, http.StatusOK, status)
+
+	status, code = call(t, auditor, "POST", ts.URL+"/api/v1/keys", `{"name":"nope"}`)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, rest.CodeForbidden, code)
+
+	// Clients limited to keys only reach those
+	release := client(srv, ca.issue(t, "release"))
+
+	status, _ = call(t, release, "GET", ts.URL+"/api/v1/keys/release", "")
+	assert.Equal(t, http.StatusOK, status)
+
+	status, _ = call(t, release, "GET", ts.URL+"/api/v1/keys/other", "")
+	assert.Equal(t, http.StatusForbidden, status)
+}
+
+// bearerClient presents token on every request
+type bearerClient struct {
+	http.RoundTripper
+	token string
+}
+
+func (b bearerClient) RoundTrip(r *http.Request) (*http.Response, error) {
+	r.Header.Set("Authorization", "Bearer "+b.token)
+	return b.RoundTripper.RoundTrip(r)
+}
+
+func TestTokens(t *testing.T) {
+	ts, srv, ca, _, tokens, done := newTestServer(t)
+	defer done()
+
+	ci := client(srv, ca.issue(t, "ci"))
+
+	for _, name := range []string{"release", "other"} {
+		status, _ := call(t, ci, "POST", ts.URL+"/api/v1/keys", fmt.Sprintf(`{"name":"%s"}`, name))
+		assert.Equal(t, http.StatusCreated, status)
+	}
+
+	tok, secret, err := tokens.Mint("nightly", []string{"release"}, []string{rest.PermRead}, time.Hour, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens need no client certificate, and are held to their scope
+	cl := client(srv)
+	cl.Transport = bearerClient{cl.Transport, secret}
+
+	status, _ := call(t, cl, "GET", ts.URL+"/api/v1/keys/release", "")
+	assert.Equal(t, http.StatusOK, status)
+
+	status, _ = call(t, cl, "GET", ts.URL+"/api/v1/keys/other", "")
+	assert.Equal(t, http.StatusForbidden, status)
+
+	status, _ = call(t, cl, "POST", ts.URL+"/api/v1/keys", `{"name":"nope"}`)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	// A token is used over the certificate
+	ci.Transport = bearerClient{ci.Transport, secret}
+
+	status, _ = call(t, ci, "POST", ts.URL+"/api/v1/keys", `{"name":"nope"}`)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	// Unknown and revoked tokens are unauthorized
+	cl.Transport = bearerClient{cl.Transport.(bearerClient).RoundTripper, "hsm.0.0"}
+
+	status, code := call(t, cl, "GET", ts.URL+"/api/v1/health", "")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, rest.CodeUnauthorized, code)
+
+	// Only security officers revoke tokens through the API
+	revoke := ts.URL + "/api/v1/tokens/" + tok.ID + "/revoke"
+
+	status, code = call(t, ci, "POST", revoke, "")
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, rest.CodeForbidden, code)
+
+	status, _ = call(t, client(srv, ca.issue(t, "ci")), "POST", revoke, "")
+	assert.Equal(t, http.StatusForbidden, status)
+
+	officer := client(srv, ca.issue(t, "officer"))
+
+	status, code = call(t, officer, "POST", ts.URL+"/api/v1/tokens/0000000000000000/revoke", "")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, rest.CodeNotFound, code)
+
+	status, _ = call(t, officer, "GET", revoke, "")
+	assert.Equal(t, http.StatusMethodNotAllowed, status)
+
+	status, _ = call(t, officer, "POST", revoke, "")
+	assert.Equal(t, http.StatusOK, status)
+
+	got, err := tokens.Get(tok.ID)
+	if assert.Nil(t, err) {
+		assert.NotNil(t, got.RevokedAt)
+	}
+
+	status, _ = call(t, ci, "GET", ts.URL+"/api/v1/keys/release", "")
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestReload(t *testing.T) {
+	ts, srv, ca, c, _, done := newTestServer(t)
+	defer done()
+
+	before := srv.Certificate()
+
+	// A certificate for another key is refused and the current one kept
+	key, _ := goecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(2), NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	foreign, _ := x509.ParseCertificate(der)
+
+	ioutil.WriteFile(c.GetString("api.tls.cert"), EncodeCertificate(foreign), 0644)
+	assert.NotNil(t, srv.Reload())
+	assert.Equal(t, before.Raw, srv.Certificate().Raw)
+
+	// A new certificate for the server key is served without a restart
+	s := srv.(*server).signer
+
+	renewed, err := SelfSign(s, "localhost", []string{"localhost", "127.0.0.1"}, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(c.GetString("api.tls.cert"), EncodeCertificate(renewed), 0644)
+	assert.Nil(t, srv.Reload())
+	assert.Equal(t, renewed.Raw, srv.Certificate().Raw)
+
+	conn, err := tls.Dial("tcp", strings.TrimPrefix(ts.URL, "https://"), &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{ca.issue(t, "ci")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, renewed.Raw, conn.ConnectionState().PeerCertificates[0].Raw)
+	conn.Close()
+
+	// The request carries the server key
+	csr, err := CreateRequest(s, "localhost", []string{"localhost"})
+	assert.Nil(t, err)
+	assert.Contains(t, string(csr), "CERTIFICATE REQUEST")
+}
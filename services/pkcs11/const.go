@@ -0,0 +1,131 @@
+package pkcs11
+
+// Values of the PKCS#11 v2.40 specification used by the module, named as the
+// specification names them so they read the same as in cryptoki headers
+
+// Return values
+const (
+	CKR_OK                             = 0x00
+	CKR_HOST_MEMORY                    = 0x02
+	CKR_SLOT_ID_INVALID                = 0x03
+	CKR_GENERAL_ERROR                  = 0x05
+	CKR_FUNCTION_FAILED                = 0x06
+	CKR_ARGUMENTS_BAD                  = 0x07
+	CKR_CANT_LOCK                      = 0x0a
+	CKR_ATTRIBUTE_READ_ONLY            = 0x10
+	CKR_ATTRIBUTE_SENSITIVE            = 0x11
+	CKR_ATTRIBUTE_TYPE_INVALID         = 0x12
+	CKR_ATTRIBUTE_VALUE_INVALID        = 0x13
+	CKR_DATA_INVALID                   = 0x20
+	CKR_DATA_LEN_RANGE                 = 0x21
+	CKR_DEVICE_ERROR                   = 0x30
+	CKR_FUNCTION_NOT_SUPPORTED         = 0x54
+	CKR_KEY_HANDLE_INVALID             = 0x60
+	CKR_KEY_TYPE_INCONSISTENT          = 0x63
+	CKR_KEY_FUNCTION_NOT_PERMITTED     = 0x68
+	CKR_MECHANISM_INVALID              = 0x70
+	CKR_MECHANISM_PARAM_INVALID        = 0x71
+	CKR_OBJECT_HANDLE_INVALID          = 0x82
+	CKR_OPERATION_ACTIVE               = 0x90
+	CKR_OPERATION_NOT_INITIALIZED      = 0x91
+	CKR_PIN_INCORRECT                  = 0xa0
+	CKR_PIN_LOCKED                     = 0xa4
+	CKR_SESSION_HANDLE_INVALID         = 0xb3
+	CKR_SESSION_PARALLEL_NOT_SUPPORTED = 0xb4
+	CKR_SESSION_READ_ONLY              = 0xb5
+	CKR_SIGNATURE_INVALID              = 0xc0
+	CKR_SIGNATURE_LEN_RANGE            = 0xc1
+	CKR_TEMPLATE_INCOMPLETE            = 0xd0
+	CKR_TEMPLATE_INCONSISTENT          = 0xd1
+	CKR_USER_ALREADY_LOGGED_IN         = 0x100
+	CKR_USER_NOT_LOGGED_IN             = 0x101
+	CKR_USER_TYPE_INVALID              = 0x103
+	CKR_BUFFER_TOO_SMALL               = 0x150
+	CKR_CRYPTOKI_NOT_INITIALIZED       = 0x190
+	CKR_CRYPTOKI_ALREADY_INITIALIZED   = 0x191
+)
+
+// Object classes
+const (
+	CKO_PUBLIC_KEY  = 0x02
+	CKO_PRIVATE_KEY = 0x03
+)
+
+// Key types
+const (
+	CKK_RSA = 0x00
+	CKK_EC  = 0x03
+)
+
+// Attributes
+const (
+	CKA_CLASS               = 0x000
+	CKA_TOKEN               = 0x001
+	CKA_PRIVATE             = 0x002
+	CKA_LABEL               = 0x003
+	CKA_KEY_TYPE            = 0x100
+	CKA_ID                  = 0x102
+	CKA_SENSITIVE           = 0x103
+	CKA_ENCRYPT             = 0x104
+	CKA_DECRYPT             = 0x105
+	CKA_WRAP                = 0x106
+	CKA_UNWRAP              = 0x107
+	CKA_SIGN                = 0x108
+	CKA_SIGN_RECOVER        = 0x109
+	CKA_VERIFY              = 0x10a
+	CKA_VERIFY_RECOVER      = 0x10b
+	CKA_DERIVE              = 0x10c
+	CKA_MODULUS             = 0x120
+	CKA_MODULUS_BITS        = 0x121
+	CKA_PUBLIC_EXPONENT     = 0x122
+	CKA_EXTRACTABLE         = 0x162
+	CKA_LOCAL               = 0x163
+	CKA_NEVER_EXTRACTABLE   = 0x164
+	CKA_ALWAYS_SENSITIVE    = 0x165
+	CKA_MODIFIABLE          = 0x170
+	CKA_EC_PARAMS           = 0x180
+	CKA_EC_POINT            = 0x181
+	CKA_ALWAYS_AUTHENTICATE = 0x202
+)
+
+// Mechanisms
+const (
+	CKM_RSA_PKCS_KEY_PAIR_GEN = 0x0000
+	CKM_RSA_PKCS              = 0x0001
+	CKM_SHA256_RSA_PKCS       = 0x0040
+	CKM_SHA384_RSA_PKCS       = 0x0041
+	CKM_SHA512_RSA_PKCS       = 0x0042
+	CKM_EC_KEY_PAIR_GEN       = 0x1040
+	CKM_ECDSA                 = 0x1041
+	CKM_ECDSA_SHA256          = 0x1044
+	CKM_ECDSA_SHA384          = 0x1045
+	CKM_ECDSA_SHA512          = 0x1046
+)
+
+// Mechanism flags
+const (
+	CKF_HW                = 0x00000001
+	CKF_SIGN              = 0x00000800
+	CKF_VERIFY            = 0x00002000
+	CKF_GENERATE_KEY_PAIR = 0x00010000
+	CKF_EC_F_P            = 0x00100000
+	CKF_EC_NAMEDCURVE     = 0x00800000
+	CKF_EC_UNCOMPRESS     = 0x01000000
+)
+
+// Session flags and states
+const (
+	CKF_RW_SESSION     = 0x02
+	CKF_SERIAL_SESSION = 0x04
+
+	CKS_RO_PUBLIC_SESSION = 0
+	CKS_RO_USER_FUNCTIONS = 1
+	CKS_RW_PUBLIC_SESSION = 2
+	CKS_RW_USER_FUNCTIONS = 3
+)
+
+// User types
+const (
+	CKU_SO   = 0
+	CKU_USER = 1
+)
@@ -0,0 +1,319 @@
+package pkcs11
+
+import (
+	"bytes"
+	gocrypto "crypto"
+	goecdsa "crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+	"unsafe"
+
+	"github.com/block27/core/services/dsa"
+	"github.com/block27/core/services/dsa/ecdsa"
+	"github.com/block27/core/services/rest"
+)
+
+// pageSize is the largest page the daemon lists, api.max_page_size
+const pageSize = 500
+
+// curveOIDs are the named curves of the keystore, CKA_EC_PARAMS holding the
+// DER of one
+var curveOIDs = map[string]asn1.ObjectIdentifier{
+	"secp224r1":  {1, 3, 132, 0, 33},
+	"prime256v1": {1, 2, 840, 10045, 3, 1, 7},
+	"secp384r1":  {1, 3, 132, 0, 34},
+	"secp521r1":  {1, 3, 132, 0, 35},
+}
+
+// MechanismInfo is a CK_MECHANISM_INFO, key sizes in bits
+type MechanismInfo struct {
+	MinKeySize uint
+	MaxKeySize uint
+	Flags      uint
+}
+
+// Mechanisms are those the token supports, on the keystore's curves and RSA
+// sizes
+var Mechanisms = map[uint]MechanismInfo{
+	CKM_EC_KEY_PAIR_GEN: {224, 521, CKF_HW | CKF_GENERATE_KEY_PAIR | CKF_EC_F_P | CKF_EC_NAMEDCURVE | CKF_EC_UNCOMPRESS},
+	CKM_ECDSA:           {224, 521, CKF_HW | CKF_SIGN | CKF_VERIFY | CKF_EC_F_P | CKF_EC_NAMEDCURVE | CKF_EC_UNCOMPRESS},
+	CKM_ECDSA_SHA256:    {224, 521, CKF_HW | CKF_SIGN | CKF_VERIFY | CKF_EC_F_P | CKF_EC_NAMEDCURVE | CKF_EC_UNCOMPRESS},
+	CKM_ECDSA_SHA384:    {224, 521, CKF_HW | CKF_SIGN | CKF_VERIFY | CKF_EC_F_P | CKF_EC_NAMEDCURVE | CKF_EC_UNCOMPRESS},
+	CKM_ECDSA_SHA512:    {224, 521, CKF_HW | CKF_SIGN | CKF_VERIFY | CKF_EC_F_P | CKF_EC_NAMEDCURVE | CKF_EC_UNCOMPRESS},
+
+	CKM_RSA_PKCS_KEY_PAIR_GEN: {2048, 4096, CKF_HW | CKF_GENERATE_KEY_PAIR},
+	CKM_RSA_PKCS:              {2048, 4096, CKF_HW | CKF_SIGN | CKF_VERIFY},
+	CKM_SHA256_RSA_PKCS:       {2048, 4096, CKF_HW | CKF_SIGN | CKF_VERIFY},
+	CKM_SHA384_RSA_PKCS:       {2048, 4096, CKF_HW | CKF_SIGN | CKF_VERIFY},
+	CKM_SHA512_RSA_PKCS:       {2048, 4096, CKF_HW | CKF_SIGN | CKF_VERIFY},
+}
+
+// rsaMechanisms are the Mechanisms of RSA keys, the others being of keys on
+// curves
+var rsaMechanisms = map[uint]bool{
+	CKM_RSA_PKCS_KEY_PAIR_GEN: true,
+	CKM_RSA_PKCS:              true,
+	CKM_SHA256_RSA_PKCS:       true,
+	CKM_SHA384_RSA_PKCS:       true,
+	CKM_SHA512_RSA_PKCS:       true,
+}
+
+// object is one half of a daemon key
+type object struct {
+	class uint
+	key   rest.Key
+
+	// pub is the public key, read from the daemon when first asked
+	pub gocrypto.PublicKey
+}
+
+// id is unique to the object and stable across listings
+func (o *object) id() string {
+	return fmt.Sprintf("%d/%s", o.class, o.key.GID)
+}
+
+// attribute returns the value of typ for o, false if o has no such
+// attribute. With t.mu held.
+func (t *token) attribute(o *object, typ uint) ([]byte, bool, error) {
+	private := o.class == CKO_PRIVATE_KEY
+
+	switch typ {
+	case CKA_CLASS:
+		return Ulong(o.class), true, nil
+	case CKA_KEY_TYPE:
+		if ecdsa.IsRSA(o.key.Curve) {
+			return Ulong(CKK_RSA), true, nil
+		}
+
+		return Ulong(CKK_EC), true, nil
+	case CKA_LABEL:
+		return []byte(o.key.Name), true, nil
+	case CKA_ID:
+		return []byte(o.key.GID), true, nil
+	case CKA_TOKEN, CKA_LOCAL:
+		return Bool(true), true, nil
+	case CKA_PRIVATE:
+		return Bool(private), true, nil
+	case CKA_MODIFIABLE, CKA_DERIVE:
+		return Bool(false), true, nil
+	case CKA_EC_PARAMS:
+		if ecdsa.IsRSA(o.key.Curve) {
+			return nil, false, nil
+		}
+
+		oid, ok := curveOIDs[o.key.Curve]
+		if !ok {
+			return nil, false, RV(CKR_GENERAL_ERROR)
+		}
+
+		der, err := asn1.Marshal(oid)
+		if err != nil {
+			return nil, false, RV(CKR_GENERAL_ERROR)
+		}
+
+		return der, true, nil
+	case CKA_MODULUS, CKA_PUBLIC_EXPONENT:
+		pub, ok, err := t.rsaPublic(o)
+		if !ok || err != nil {
+			return nil, false, err
+		}
+
+		if typ == CKA_MODULUS {
+			return pub.N.Bytes(), true, nil
+		}
+
+		return big.NewInt(int64(pub.E)).Bytes(), true, nil
+	}
+
+	if private {
+		switch typ {
+		case CKA_SIGN:
+			return Bool(dsa.CanSign(o.key.Status)), true, nil
+		case CKA_SENSITIVE, CKA_ALWAYS_SENSITIVE, CKA_NEVER_EXTRACTABLE:
+			return Bool(true), true, nil
+		case CKA_EXTRACTABLE, CKA_DECRYPT, CKA_UNWRAP, CKA_SIGN_RECOVER, CKA_ALWAYS_AUTHENTICATE:
+			return Bool(false), true, nil
+		}
+
+		return nil, false, nil
+	}
+
+	switch typ {
+	case CKA_VERIFY:
+		return Bool(dsa.CanVerify(o.key.Status)), true, nil
+	case CKA_ENCRYPT, CKA_WRAP, CKA_VERIFY_RECOVER:
+		return Bool(false), true, nil
+	case CKA_MODULUS_BITS:
+		pub, ok, err := t.rsaPublic(o)
+		if !ok || err != nil {
+			return nil, false, err
+		}
+
+		return Ulong(uint(pub.N.BitLen())), true, nil
+	case CKA_EC_POINT:
+		if ecdsa.IsRSA(o.key.Curve) {
+			return nil, false, nil
+		}
+
+		pub, err := t.public(o)
+		if err != nil {
+			return nil, false, err
+		}
+
+		ec, ok := pub.(*goecdsa.PublicKey)
+		if !ok {
+			return nil, false, RV(CKR_DEVICE_ERROR)
+		}
+
+		// DER of the uncompressed point in an OCTET STRING
+		der, err := asn1.Marshal(elliptic.Marshal(ec.Curve, ec.X, ec.Y))
+		if err != nil {
+			return nil, false, RV(CKR_GENERAL_ERROR)
+		}
+
+		return der, true, nil
+	}
+
+	return nil, false, nil
+}
+
+// public reads the public key of o from the daemon, once. With t.mu held.
+func (t *token) public(o *object) (gocrypto.PublicKey, error) {
+	if o.pub != nil {
+		return o.pub, nil
+	}
+
+	pub, err := t.client.PublicKey(o.key.GID)
+	if err != nil {
+		return nil, deviceError(err)
+	}
+
+	block, _ := pem.Decode([]byte(pub.PEM))
+	if block == nil {
+		return nil, RV(CKR_DEVICE_ERROR)
+	}
+
+	k, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, RV(CKR_DEVICE_ERROR)
+	}
+
+	o.pub = k
+
+	return k, nil
+}
+
+// rsaPublic is public for RSA keys, false for keys on curves. With t.mu
+// held.
+func (t *token) rsaPublic(o *object) (*rsa.PublicKey, bool, error) {
+	if !ecdsa.IsRSA(o.key.Curve) {
+		return nil, false, nil
+	}
+
+	pub, err := t.public(o)
+	if err != nil {
+		return nil, false, err
+	}
+
+	r, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, false, RV(CKR_DEVICE_ERROR)
+	}
+
+	return r, true, nil
+}
+
+// matches reports whether o has every attribute of template. With t.mu
+// held.
+func (t *token) matches(o *object, template []Attribute) (bool, error) {
+	for _, a := range template {
+		v, ok, err := t.attribute(o, a.Type)
+		if err != nil {
+			return false, err
+		}
+
+		if !ok || !bytes.Equal(v, a.Value) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// sortedHandles lists the object handles in the order they were assigned
+func (t *token) sortedHandles() []uint {
+	handles := make([]uint, 0, len(t.objects))
+	for h := range t.objects {
+		handles = append(handles, h)
+	}
+
+	sort.Slice(handles, func(i, j int) bool { return handles[i] < handles[j] })
+
+	return handles
+}
+
+// curveOf returns the curve named by a DER CKA_EC_PARAMS
+func curveOf(params []byte) (string, error) {
+	var oid asn1.ObjectIdentifier
+
+	left, err := asn1.Unmarshal(params, &oid)
+	if err != nil || len(left) != 0 {
+		return "", RV(CKR_ATTRIBUTE_VALUE_INVALID)
+	}
+
+	for name, o := range curveOIDs {
+		if o.Equal(oid) {
+			return name, nil
+		}
+	}
+
+	return "", RV(CKR_ATTRIBUTE_VALUE_INVALID)
+}
+
+// rsaTypeOf returns the RSA size of a CKA_MODULUS_BITS. The daemon makes
+// keys with the public exponent 65537 only.
+func rsaTypeOf(bits uint, exponent []byte) (string, error) {
+	if exponent != nil && new(big.Int).SetBytes(exponent).Cmp(big.NewInt(65537)) != 0 {
+		return "", RV(CKR_ATTRIBUTE_VALUE_INVALID)
+	}
+
+	ty := fmt.Sprintf("rsa%d", bits)
+	if !ecdsa.IsRSA(ty) {
+		return "", RV(CKR_ATTRIBUTE_VALUE_INVALID)
+	}
+
+	return ty, nil
+}
+
+// Ulong encodes a CK_ULONG, a native unsigned long
+func Ulong(v uint) []byte {
+	b := make([]byte, unsafe.Sizeof(v))
+	*(*uint)(unsafe.Pointer(&b[0])) = v
+
+	return b
+}
+
+// ParseUlong decodes a CK_ULONG
+func ParseUlong(b []byte) (uint, bool) {
+	var v uint
+	if len(b) != int(unsafe.Sizeof(v)) {
+		return 0, false
+	}
+
+	return *(*uint)(unsafe.Pointer(&b[0])), true
+}
+
+// Bool encodes a CK_BBOOL
+func Bool(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+
+	return []byte{0}
+}
@@ -0,0 +1,590 @@
+package pkcs11
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/services/dsa"
+	"github.com/block27/core/services/dsa/ecdsa"
+	sig "github.com/block27/core/services/dsa/signature"
+	"github.com/block27/core/services/rest"
+)
+
+// operation is a sign or verify in progress on a session
+type operation struct {
+	mechanism uint
+	key       rest.Key
+
+	// data are the parts given so far to a multi-part operation
+	data  []byte
+	parts bool
+}
+
+// mechanismHashes are the digests the ECDSA_SHA* and SHA*_RSA_PKCS
+// mechanisms compute before the daemon signs. Only they take data in parts.
+var mechanismHashes = map[uint]string{
+	CKM_ECDSA_SHA256:    crypto.SHA256,
+	CKM_ECDSA_SHA384:    crypto.SHA384,
+	CKM_ECDSA_SHA512:    crypto.SHA512,
+	CKM_SHA256_RSA_PKCS: crypto.SHA256,
+	CKM_SHA384_RSA_PKCS: crypto.SHA384,
+	CKM_SHA512_RSA_PKCS: crypto.SHA512,
+}
+
+// digestInfoOIDs are the digests a CKM_RSA_PKCS DigestInfo may name, those
+// the daemon signs with RSA keys
+var digestInfoOIDs = map[string]asn1.ObjectIdentifier{
+	crypto.SHA256: {2, 16, 840, 1, 101, 3, 4, 2, 1},
+	crypto.SHA384: {2, 16, 840, 1, 101, 3, 4, 2, 2},
+	crypto.SHA512: {2, 16, 840, 1, 101, 3, 4, 2, 3},
+}
+
+func (t *token) SignInit(h uint, mechanism uint, handle uint) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, err := t.session(h)
+	if err != nil {
+		return err
+	}
+
+	if s.sign != nil {
+		return RV(CKR_OPERATION_ACTIVE)
+	}
+
+	op, err := t.operation(mechanism, handle, CKO_PRIVATE_KEY)
+	if err != nil {
+		return err
+	}
+
+	if !dsa.CanSign(op.key.Status) {
+		return RV(CKR_KEY_FUNCTION_NOT_PERMITTED)
+	}
+
+	s.sign = op
+
+	return nil
+}
+
+func (t *token) SignatureLength(h uint) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, err := t.session(h)
+	if err != nil {
+		return 0, err
+	}
+
+	if s.sign == nil {
+		return 0, RV(CKR_OPERATION_NOT_INITIALIZED)
+	}
+
+	return signatureSize(s.sign.key.Curve)
+}
+
+func (t *token) Sign(h uint, data []byte) ([]byte, error) {
+	op, err := t.take(h, true, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.sign(op, data)
+}
+
+func (t *token) SignUpdate(h uint, part []byte) error {
+	return t.update(h, true, part)
+}
+
+func (t *token) SignFinal(h uint) ([]byte, error) {
+	op, err := t.take(h, true, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.sign(op, op.data)
+}
+
+func (t *token) VerifyInit(h uint, mechanism uint, handle uint) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, err := t.session(h)
+	if err != nil {
+		return err
+	}
+
+	if s.verify != nil {
+		return RV(CKR_OPERATION_ACTIVE)
+	}
+
+	op, err := t.operation(mechanism, handle, CKO_PUBLIC_KEY)
+	if err != nil {
+		return err
+	}
+
+	if !dsa.CanVerify(op.key.Status) {
+		return RV(CKR_KEY_FUNCTION_NOT_PERMITTED)
+	}
+
+	s.verify = op
+
+	return nil
+}
+
+func (t *token) Verify(h uint, data []byte, signature []byte) error {
+	op, err := t.take(h, false, false)
+	if err != nil {
+		return err
+	}
+
+	return t.verify(op, data, signature)
+}
+
+func (t *token) VerifyUpdate(h uint, part []byte) error {
+	return t.update(h, false, part)
+}
+
+func (t *token) VerifyFinal(h uint, signature []byte) error {
+	op, err := t.take(h, false, true)
+	if err != nil {
+		return err
+	}
+
+	return t.verify(op, op.data, signature)
+}
+
+func (t *token) GenerateKeyPair(h uint, mechanism uint, public []Attribute, private []Attribute) (uint, uint, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, err := t.session(h)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if !s.rw {
+		return 0, 0, RV(CKR_SESSION_READ_ONLY)
+	}
+
+	keyType := uint(CKK_EC)
+
+	switch mechanism {
+	case CKM_EC_KEY_PAIR_GEN:
+	case CKM_RSA_PKCS_KEY_PAIR_GEN:
+		keyType = CKK_RSA
+	default:
+		return 0, 0, RV(CKR_MECHANISM_INVALID)
+	}
+
+	var params, label, exponent []byte
+	var bits uint
+
+	// The private template's label wins, it being the one tools name
+	for i, template := range [][]Attribute{public, private} {
+		class := uint(CKO_PUBLIC_KEY)
+		if i == 1 {
+			class = CKO_PRIVATE_KEY
+		}
+
+		for _, a := range template {
+			switch a.Type {
+			case CKA_EC_PARAMS:
+				if keyType != CKK_EC {
+					return 0, 0, RV(CKR_TEMPLATE_INCONSISTENT)
+				}
+
+				params = a.Value
+			case CKA_MODULUS_BITS:
+				v, ok := ParseUlong(a.Value)
+				if !ok || keyType != CKK_RSA {
+					return 0, 0, RV(CKR_TEMPLATE_INCONSISTENT)
+				}
+
+				bits = v
+			case CKA_PUBLIC_EXPONENT:
+				if keyType != CKK_RSA {
+					return 0, 0, RV(CKR_TEMPLATE_INCONSISTENT)
+				}
+
+				exponent = a.Value
+			case CKA_LABEL:
+				label = a.Value
+			case CKA_ID:
+				// The daemon assigns the GID
+				return 0, 0, RV(CKR_ATTRIBUTE_READ_ONLY)
+			case CKA_CLASS:
+				if v, ok := ParseUlong(a.Value); !ok || v != class {
+					return 0, 0, RV(CKR_TEMPLATE_INCONSISTENT)
+				}
+			case CKA_KEY_TYPE:
+				if v, ok := ParseUlong(a.Value); !ok || v != keyType {
+					return 0, 0, RV(CKR_TEMPLATE_INCONSISTENT)
+				}
+			case CKA_EXTRACTABLE:
+				if class == CKO_PRIVATE_KEY && !isFalse(a.Value) {
+					return 0, 0, RV(CKR_TEMPLATE_INCONSISTENT)
+				}
+			case CKA_SENSITIVE:
+				if class == CKO_PRIVATE_KEY && isFalse(a.Value) {
+					return 0, 0, RV(CKR_TEMPLATE_INCONSISTENT)
+				}
+			}
+		}
+	}
+
+	if len(label) == 0 || (keyType == CKK_EC && params == nil) || (keyType == CKK_RSA && bits == 0) {
+		return 0, 0, RV(CKR_TEMPLATE_INCOMPLETE)
+	}
+
+	var curve string
+	if keyType == CKK_RSA {
+		curve, err = rsaTypeOf(bits, exponent)
+	} else {
+		curve, err = curveOf(params)
+	}
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	k, err := t.client.CreateKey(rest.CreateKeyRequest{Name: string(label), Curve: curve})
+	if err != nil {
+		if e, ok := err.(*rest.Error); ok && (e.Code == rest.CodeInvalidRequest || e.Code == rest.CodeConflict) {
+			return 0, 0, RV(CKR_ATTRIBUTE_VALUE_INVALID)
+		}
+
+		return 0, 0, deviceError(err)
+	}
+
+	return t.track(k, CKO_PUBLIC_KEY), t.track(k, CKO_PRIVATE_KEY), nil
+}
+
+// operation starts a sign or verify with an object of class, the
+// mechanism being one of its key type. With t.mu held.
+func (t *token) operation(mechanism uint, handle uint, class uint) (*operation, error) {
+	if m, ok := Mechanisms[mechanism]; !ok || m.Flags&CKF_GENERATE_KEY_PAIR != 0 {
+		return nil, RV(CKR_MECHANISM_INVALID)
+	}
+
+	o, ok := t.objects[handle]
+	if !ok {
+		return nil, RV(CKR_KEY_HANDLE_INVALID)
+	}
+
+	if o.class != class || rsaMechanisms[mechanism] != ecdsa.IsRSA(o.key.Curve) {
+		return nil, RV(CKR_KEY_TYPE_INCONSISTENT)
+	}
+
+	return &operation{mechanism: mechanism, key: o.key}, nil
+}
+
+// take ends the session's sign or verify for the daemon call, single or
+// multi-part as final asks
+func (t *token) take(h uint, signing bool, final bool) (*operation, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, err := t.session(h)
+	if err != nil {
+		return nil, err
+	}
+
+	op := s.verify
+	if signing {
+		op = s.sign
+	}
+
+	if op == nil {
+		return nil, RV(CKR_OPERATION_NOT_INITIALIZED)
+	}
+
+	if signing {
+		s.sign = nil
+	} else {
+		s.verify = nil
+	}
+
+	switch {
+	case final && !multiPart(op.mechanism):
+		return nil, RV(CKR_FUNCTION_NOT_SUPPORTED)
+	case op.parts && !final:
+		return nil, RV(CKR_OPERATION_ACTIVE)
+	}
+
+	return op, nil
+}
+
+// update adds a part to a multi-part operation, which CKM_ECDSA and
+// CKM_RSA_PKCS do not support
+func (t *token) update(h uint, signing bool, part []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, err := t.session(h)
+	if err != nil {
+		return err
+	}
+
+	op := s.verify
+	if signing {
+		op = s.sign
+	}
+
+	if op == nil {
+		return RV(CKR_OPERATION_NOT_INITIALIZED)
+	}
+
+	if !multiPart(op.mechanism) {
+		if signing {
+			s.sign = nil
+		} else {
+			s.verify = nil
+		}
+
+		return RV(CKR_FUNCTION_NOT_SUPPORTED)
+	}
+
+	op.data = append(op.data, part...)
+	op.parts = true
+
+	return nil
+}
+
+// multiPart reports whether the mechanism takes data in parts, it hashing the
+// data itself
+func multiPart(mechanism uint) bool {
+	_, ok := mechanismHashes[mechanism]
+	return ok
+}
+
+// digest hashes data as the mechanism asks. CKM_RSA_PKCS takes the DER
+// DigestInfo of a digest already made, see digestInfo. CKM_ECDSA takes a digest
+// already made, of any length, SHA-1 and SHA-224 included: it is truncated
+// to the order of the curve as X9.62 does, and handed to the daemon as a
+// digest of the curve's default hash standing for the same integer.
+func digest(mechanism uint, curve string, data []byte) (string, []byte, error) {
+	if name, ok := mechanismHashes[mechanism]; ok {
+		h, err := crypto.NewHash(name)
+		if err != nil {
+			return "", nil, RV(CKR_GENERAL_ERROR)
+		}
+
+		h.Write(data)
+
+		return name, h.Sum(nil), nil
+	}
+
+	if mechanism == CKM_RSA_PKCS {
+		return digestInfo(data)
+	}
+
+	if len(data) == 0 {
+		return "", nil, RV(CKR_DATA_LEN_RANGE)
+	}
+
+	bits, err := ecdsa.CurveBits(curve)
+	if err != nil {
+		return "", nil, RV(CKR_GENERAL_ERROR)
+	}
+
+	name := crypto.HashForCurve(bits)
+
+	h, err := crypto.NewHash(name)
+	if err != nil {
+		return "", nil, RV(CKR_GENERAL_ERROR)
+	}
+
+	size := h.Size()
+
+	// The leftmost bits of data, as many as the order has
+	e := new(big.Int).SetBytes(data)
+	if excess := 8*len(data) - bits; excess > 0 {
+		e.Rsh(e, uint(excess))
+	}
+
+	// The daemon keeps as many leftmost bits of the digest in turn
+	if excess := 8*size - bits; excess > 0 {
+		e.Lsh(e, uint(excess))
+	}
+
+	// Only data over 64 bytes on secp521r1 outgrows the largest digest
+	if e.BitLen() > 8*size {
+		return "", nil, RV(CKR_DATA_LEN_RANGE)
+	}
+
+	d := make([]byte, size)
+	b := e.Bytes()
+	copy(d[size-len(b):], b)
+
+	return name, d, nil
+}
+
+// digestInfo parses the DigestInfo CKM_RSA_PKCS signs, the daemon making
+// the PKCS #1 v1.5 encoding again from the digest and its name. Raw data of
+// any other form cannot be signed.
+func digestInfo(data []byte) (string, []byte, error) {
+	var info struct {
+		Algorithm pkix.AlgorithmIdentifier
+		Digest    []byte
+	}
+
+	if left, err := asn1.Unmarshal(data, &info); err != nil || len(left) != 0 {
+		return "", nil, RV(CKR_DATA_INVALID)
+	}
+
+	for name, oid := range digestInfoOIDs {
+		if !oid.Equal(info.Algorithm.Algorithm) {
+			continue
+		}
+
+		h, err := crypto.NewHash(name)
+		if err != nil {
+			return "", nil, RV(CKR_GENERAL_ERROR)
+		}
+
+		if len(info.Digest) != h.Size() {
+			return "", nil, RV(CKR_DATA_INVALID)
+		}
+
+		return name, info.Digest, nil
+	}
+
+	return "", nil, RV(CKR_DATA_INVALID)
+}
+
+// sign has the daemon sign the raw digest, returning r || s, or the
+// signature itself on RSA keys
+func (t *token) sign(op *operation, data []byte) ([]byte, error) {
+	hash, d, err := digest(op.mechanism, op.key.Curve, data)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := t.client.Sign(op.key.GID, rest.SignRequest{
+		Digest: hex.EncodeToString(d),
+		Hash:   hash,
+		Mode:   sig.ModeOpenSSL,
+	})
+	if err != nil {
+		return nil, deviceError(err)
+	}
+
+	der, err := base64.StdEncoding.DecodeString(res.Signature)
+	if err != nil {
+		return nil, RV(CKR_DEVICE_ERROR)
+	}
+
+	if ecdsa.IsRSA(op.key.Curve) {
+		if size, err := signatureSize(op.key.Curve); err != nil || len(der) != size {
+			return nil, RV(CKR_DEVICE_ERROR)
+		}
+
+		return der, nil
+	}
+
+	size, err := scalarSize(op.key.Curve)
+	if err != nil {
+		return nil, err
+	}
+
+	var rs sig.Signature
+	if left, err := asn1.Unmarshal(der, &rs); err != nil || len(left) != 0 || rs.R == nil || rs.S == nil {
+		return nil, RV(CKR_DEVICE_ERROR)
+	}
+
+	r, s := rs.R.Bytes(), rs.S.Bytes()
+	if len(r) > size || len(s) > size {
+		return nil, RV(CKR_DEVICE_ERROR)
+	}
+
+	out := make([]byte, 2*size)
+	copy(out[size-len(r):size], r)
+	copy(out[2*size-len(s):], s)
+
+	return out, nil
+}
+
+// verify has the daemon check r || s, or an RSA signature, over the digest
+func (t *token) verify(op *operation, data []byte, signature []byte) error {
+	size, err := signatureSize(op.key.Curve)
+	if err != nil {
+		return err
+	}
+
+	if len(signature) != size {
+		return RV(CKR_SIGNATURE_LEN_RANGE)
+	}
+
+	hash, d, err := digest(op.mechanism, op.key.Curve, data)
+	if err != nil {
+		return err
+	}
+
+	der := signature
+
+	if !ecdsa.IsRSA(op.key.Curve) {
+		rs := sig.Signature{
+			R: new(big.Int).SetBytes(signature[:size/2]),
+			S: new(big.Int).SetBytes(signature[size/2:]),
+		}
+
+		if der, err = rs.SigToDER(); err != nil {
+			return RV(CKR_GENERAL_ERROR)
+		}
+	}
+
+	res, err := t.client.Verify(op.key.GID, rest.VerifyRequest{
+		Digest:    hex.EncodeToString(d),
+		Hash:      hash,
+		Mode:      sig.ModeOpenSSL,
+		Signature: base64.StdEncoding.EncodeToString(der),
+	})
+	if err != nil {
+		return deviceError(err)
+	}
+
+	if !res.Valid {
+		return RV(CKR_SIGNATURE_INVALID)
+	}
+
+	return nil
+}
+
+// signatureSize is the length in bytes of a signature by a key, r || s on
+// curves and that of the modulus on RSA keys
+func signatureSize(curve string) (int, error) {
+	if ecdsa.IsRSA(curve) {
+		var bits int
+		if _, err := fmt.Sscanf(curve, "rsa%d", &bits); err != nil {
+			return 0, RV(CKR_GENERAL_ERROR)
+		}
+
+		return (bits + 7) / 8, nil
+	}
+
+	size, err := scalarSize(curve)
+	if err != nil {
+		return 0, err
+	}
+
+	return 2 * size, nil
+}
+
+// scalarSize is the length in bytes of r and s on a curve
+func scalarSize(curve string) (int, error) {
+	bits, err := ecdsa.CurveBits(curve)
+	if err != nil {
+		return 0, RV(CKR_GENERAL_ERROR)
+	}
+
+	return (bits + 7) / 8, nil
+}
+
+func isFalse(v []byte) bool {
+	return len(v) == 1 && v[0] == 0
+}
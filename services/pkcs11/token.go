@@ -0,0 +1,476 @@
+package pkcs11
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/block27/core/services/dsa"
+	"github.com/block27/core/services/dsa/ecdsa"
+	"github.com/block27/core/services/hsmd"
+	"github.com/block27/core/services/rest"
+)
+
+// RV is a PKCS#11 return value as an error
+type RV uint
+
+func (r RV) Error() string {
+	return fmt.Sprintf("pkcs11: CKR 0x%x", uint(r))
+}
+
+// Code returns the return value for err, CKR_OK when nil
+func Code(err error) uint {
+	switch e := err.(type) {
+	case nil:
+		return CKR_OK
+	case RV:
+		return uint(e)
+	}
+
+	return CKR_GENERAL_ERROR
+}
+
+// Attribute is a CK_ATTRIBUTE, Value encoded as cryptoki expects it
+type Attribute struct {
+	Type  uint
+	Value []byte
+}
+
+// SessionInfo is a CK_SESSION_INFO
+type SessionInfo struct {
+	State uint
+	Flags uint
+}
+
+// TokenAPI is the single token of the module, the keys of the daemon. Each
+// key shows as a private and a public key object, CKA_ID its GID and
+// CKA_LABEL its name. Handles are session handles or object handles as
+// the function expects.
+type TokenAPI interface {
+	OpenSession(flags uint) (uint, error)
+	CloseSession(session uint) error
+	CloseAllSessions() error
+	SessionInfo(session uint) (*SessionInfo, error)
+	Sessions() (total int, rw int)
+
+	// Login opens a daemon session with pin, "<operator>:<pin>" once
+	// operators are enrolled
+	Login(session uint, userType uint, pin []byte) error
+	Logout(session uint) error
+
+	FindObjectsInit(session uint, template []Attribute) error
+	FindObjects(session uint, max int) ([]uint, error)
+	FindObjectsFinal(session uint) error
+
+	// Attributes returns the values of types, nil for those the object
+	// does not have and CKR_ATTRIBUTE_TYPE_INVALID then
+	Attributes(session uint, object uint, types []uint) ([][]byte, error)
+
+	SignInit(session uint, mechanism uint, key uint) error
+	SignatureLength(session uint) (int, error)
+	Sign(session uint, data []byte) ([]byte, error)
+	SignUpdate(session uint, part []byte) error
+	SignFinal(session uint) ([]byte, error)
+
+	VerifyInit(session uint, mechanism uint, key uint) error
+	Verify(session uint, data []byte, signature []byte) error
+	VerifyUpdate(session uint, part []byte) error
+	VerifyFinal(session uint, signature []byte) error
+
+	GenerateKeyPair(session uint, mechanism uint, public []Attribute, private []Attribute) (uint, uint, error)
+}
+
+type session struct {
+	rw     bool
+	found  []uint
+	finds  bool
+	sign   *operation
+	verify *operation
+}
+
+type token struct {
+	mu sync.Mutex
+
+	client   hsmd.ClientAPI
+	loggedIn bool
+
+	sessions    map[uint]*session
+	nextSession uint
+
+	objects    map[uint]*object
+	handles    map[string]uint
+	nextObject uint
+}
+
+// NewToken returns the TokenAPI over a daemon client
+func NewToken(client hsmd.ClientAPI) TokenAPI {
+	return &token{
+		client:   client,
+		sessions: map[uint]*session{},
+		objects:  map[uint]*object{},
+		handles:  map[string]uint{},
+	}
+}
+
+func (t *token) OpenSession(flags uint) (uint, error) {
+	if flags&CKF_SERIAL_SESSION == 0 {
+		return 0, RV(CKR_SESSION_PARALLEL_NOT_SUPPORTED)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nextSession++
+	t.sessions[t.nextSession] = &session{rw: flags&CKF_RW_SESSION != 0}
+
+	return t.nextSession, nil
+}
+
+func (t *token) CloseSession(h uint) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.sessions[h]; !ok {
+		return RV(CKR_SESSION_HANDLE_INVALID)
+	}
+
+	delete(t.sessions, h)
+
+	// Closing the last session logs the application out
+	if len(t.sessions) == 0 {
+		return t.logout()
+	}
+
+	return nil
+}
+
+func (t *token) CloseAllSessions() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sessions = map[uint]*session{}
+
+	return t.logout()
+}
+
+func (t *token) SessionInfo(h uint) (*SessionInfo, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.sessions[h]
+	if !ok {
+		return nil, RV(CKR_SESSION_HANDLE_INVALID)
+	}
+
+	info := &SessionInfo{Flags: CKF_SERIAL_SESSION, State: CKS_RO_PUBLIC_SESSION}
+	if s.rw {
+		info.Flags |= CKF_RW_SESSION
+		info.State = CKS_RW_PUBLIC_SESSION
+	}
+
+	if t.loggedIn {
+		info.State++
+	}
+
+	return info, nil
+}
+
+func (t *token) Sessions() (int, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rw := 0
+	for _, s := range t.sessions {
+		if s.rw {
+			rw++
+		}
+	}
+
+	return len(t.sessions), rw
+}
+
+func (t *token) Login(h uint, userType uint, pin []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.sessions[h]; !ok {
+		return RV(CKR_SESSION_HANDLE_INVALID)
+	}
+
+	if userType != CKU_USER && userType != CKU_SO {
+		return RV(CKR_USER_TYPE_INVALID)
+	}
+
+	if t.loggedIn {
+		return RV(CKR_USER_ALREADY_LOGGED_IN)
+	}
+
+	var operator string
+	if i := strings.IndexByte(string(pin), ':'); i >= 0 {
+		operator, pin = string(pin[:i]), pin[i+1:]
+	}
+
+	if _, err := t.client.Login(operator, pin); err != nil {
+		if e, ok := err.(*rest.Error); ok && (e.Status == 401 || e.Status == 403) {
+			if strings.Contains(e.Message, "locked") || strings.Contains(e.Message, "blocked") {
+				return RV(CKR_PIN_LOCKED)
+			}
+
+			return RV(CKR_PIN_INCORRECT)
+		}
+
+		return deviceError(err)
+	}
+
+	t.loggedIn = true
+
+	return nil
+}
+
+func (t *token) Logout(h uint) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.sessions[h]; !ok {
+		return RV(CKR_SESSION_HANDLE_INVALID)
+	}
+
+	if !t.loggedIn {
+		return RV(CKR_USER_NOT_LOGGED_IN)
+	}
+
+	return t.logout()
+}
+
+// logout ends the daemon session, with t.mu held
+func (t *token) logout() error {
+	if !t.loggedIn {
+		return nil
+	}
+
+	t.loggedIn = false
+
+	for _, s := range t.sessions {
+		s.found, s.finds, s.sign, s.verify = nil, false, nil, nil
+	}
+
+	if err := t.client.Logout(); err != nil {
+		return deviceError(err)
+	}
+
+	return nil
+}
+
+func (t *token) FindObjectsInit(h uint, template []Attribute) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.sessions[h]
+	if !ok {
+		return RV(CKR_SESSION_HANDLE_INVALID)
+	}
+
+	if s.finds {
+		return RV(CKR_OPERATION_ACTIVE)
+	}
+
+	s.found, s.finds = nil, true
+
+	// The daemon shows nothing before a login
+	if !t.loggedIn {
+		return nil
+	}
+
+	if err := t.refresh(); err != nil {
+		s.finds = false
+		return err
+	}
+
+	for _, handle := range t.sortedHandles() {
+		o := t.objects[handle]
+
+		match, err := t.matches(o, template)
+		if err != nil {
+			s.finds = false
+			return err
+		}
+
+		if match {
+			s.found = append(s.found, handle)
+		}
+	}
+
+	return nil
+}
+
+func (t *token) FindObjects(h uint, max int) ([]uint, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.sessions[h]
+	if !ok {
+		return nil, RV(CKR_SESSION_HANDLE_INVALID)
+	}
+
+	if !s.finds {
+		return nil, RV(CKR_OPERATION_NOT_INITIALIZED)
+	}
+
+	if max > len(s.found) {
+		max = len(s.found)
+	}
+
+	out := s.found[:max]
+	s.found = s.found[max:]
+
+	return out, nil
+}
+
+func (t *token) FindObjectsFinal(h uint) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.sessions[h]
+	if !ok {
+		return RV(CKR_SESSION_HANDLE_INVALID)
+	}
+
+	if !s.finds {
+		return RV(CKR_OPERATION_NOT_INITIALIZED)
+	}
+
+	s.found, s.finds = nil, false
+
+	return nil
+}
+
+func (t *token) Attributes(h uint, handle uint, types []uint) ([][]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.sessions[h]; !ok {
+		return nil, RV(CKR_SESSION_HANDLE_INVALID)
+	}
+
+	o, ok := t.objects[handle]
+	if !ok || !t.loggedIn {
+		return nil, RV(CKR_OBJECT_HANDLE_INVALID)
+	}
+
+	values := make([][]byte, len(types))
+
+	var err error
+	for i, typ := range types {
+		v, ok, aerr := t.attribute(o, typ)
+		if aerr != nil {
+			return nil, aerr
+		}
+
+		if !ok {
+			err = RV(CKR_ATTRIBUTE_TYPE_INVALID)
+			continue
+		}
+
+		values[i] = v
+	}
+
+	return values, err
+}
+
+// refresh lists the daemon's keys, keeping the handles of known ones.
+// Destroyed keys are left out.
+func (t *token) refresh() error {
+	seen := map[uint]bool{}
+
+	for offset := 0; ; {
+		q := url.Values{}
+		q.Set("offset", strconv.Itoa(offset))
+		q.Set("limit", strconv.Itoa(pageSize))
+		q.Set("sort", ecdsa.SortCreated)
+
+		page, err := t.client.ListKeys(q)
+		if err != nil {
+			return deviceError(err)
+		}
+
+		for i := range page.Keys {
+			k := page.Keys[i]
+			if k.Status == dsa.StatusDestroyed {
+				continue
+			}
+
+			for _, class := range []uint{CKO_PRIVATE_KEY, CKO_PUBLIC_KEY} {
+				seen[t.track(&k, class)] = true
+			}
+		}
+
+		offset += len(page.Keys)
+		if len(page.Keys) == 0 || offset >= page.Total {
+			break
+		}
+	}
+
+	for handle := range t.objects {
+		if !seen[handle] {
+			delete(t.handles, t.objects[handle].id())
+			delete(t.objects, handle)
+		}
+	}
+
+	return nil
+}
+
+// track returns the handle of a key's object, assigning one the first time
+// it is seen
+func (t *token) track(k *rest.Key, class uint) uint {
+	o := &object{class: class, key: *k}
+
+	if handle, ok := t.handles[o.id()]; ok {
+		// Keep the public point already read
+		t.objects[handle].key = *k
+		return handle
+	}
+
+	t.nextObject++
+	t.objects[t.nextObject] = o
+	t.handles[o.id()] = t.nextObject
+
+	return t.nextObject
+}
+
+// session returns a session, with t.mu held
+func (t *token) session(h uint) (*session, error) {
+	s, ok := t.sessions[h]
+	if !ok {
+		return nil, RV(CKR_SESSION_HANDLE_INVALID)
+	}
+
+	if !t.loggedIn {
+		return nil, RV(CKR_USER_NOT_LOGGED_IN)
+	}
+
+	return s, nil
+}
+
+// deviceError maps daemon failures to return values
+func deviceError(err error) error {
+	e, ok := err.(*rest.Error)
+	if !ok {
+		return RV(CKR_DEVICE_ERROR)
+	}
+
+	switch e.Code {
+	case rest.CodeUnauthorized:
+		return RV(CKR_USER_NOT_LOGGED_IN)
+	case rest.CodeNotFound:
+		return RV(CKR_KEY_HANDLE_INVALID)
+	case rest.CodeForbidden, rest.CodePolicy, rest.CodeKeyState:
+		return RV(CKR_KEY_FUNCTION_NOT_PERMITTED)
+	case rest.CodeInvalidRequest:
+		return RV(CKR_DATA_INVALID)
+	}
+
+	return RV(CKR_DEVICE_ERROR)
+}
@@ -0,0 +1,547 @@
+package pkcs11
+
+import (
+	gocrypto "crypto"
+	goecdsa "crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/services/dsa"
+	sig "github.com/block27/core/services/dsa/signature"
+	"github.com/block27/core/services/hsmd"
+	"github.com/block27/core/services/rest"
+)
+
+// fakeClient is a daemon holding its keys in memory
+type fakeClient struct {
+	hsmd.ClientAPI
+
+	keys     []rest.Key
+	private  map[string]gocrypto.Signer
+	loggedIn bool
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{private: map[string]gocrypto.Signer{}}
+}
+
+// ec returns the private key of an ECDSA key
+func (f *fakeClient) ec(id string) *goecdsa.PrivateKey {
+	return f.private[id].(*goecdsa.PrivateKey)
+}
+
+func (f *fakeClient) Login(operator string, pin []byte) (*hsmd.Session, error) {
+	switch {
+	case operator == "locked":
+		return nil, rest.NewError(401, rest.CodeUnauthorized, "operator is locked")
+	case operator != "" && operator != "alice", string(pin) != "1234":
+		return nil, rest.NewError(401, rest.CodeUnauthorized, "invalid pin")
+	}
+
+	f.loggedIn = true
+
+	return &hsmd.Session{Token: "session", Operator: operator}, nil
+}
+
+func (f *fakeClient) Logout() error {
+	f.loggedIn = false
+	return nil
+}
+
+func (f *fakeClient) ListKeys(q url.Values) (*rest.KeyList, error) {
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	limit, _ := strconv.Atoi(q.Get("limit"))
+
+	end := offset + limit
+	if end > len(f.keys) {
+		end = len(f.keys)
+	}
+
+	return &rest.KeyList{Keys: f.keys[offset:end], Total: len(f.keys), Offset: offset, Limit: limit}, nil
+}
+
+func (f *fakeClient) CreateKey(req rest.CreateKeyRequest) (*rest.Key, error) {
+	curves := map[string]elliptic.Curve{"prime256v1": elliptic.P256(), "secp384r1": elliptic.P384()}
+
+	var pri gocrypto.Signer
+	var err error
+
+	if req.Curve == "rsa2048" {
+		pri, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		pri, err = goecdsa.GenerateKey(curves[req.Curve], rand.Reader)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	k := rest.Key{GID: fmt.Sprintf("gid-%d", len(f.keys)), Name: req.Name, Curve: req.Curve, Status: dsa.StatusActive}
+	f.keys = append(f.keys, k)
+	f.private[k.GID] = pri
+
+	return &k, nil
+}
+
+func (f *fakeClient) PublicKey(id string) (*rest.PublicKey, error) {
+	der, err := x509.MarshalPKIXPublicKey(f.private[id].Public())
+	if err != nil {
+		return nil, err
+	}
+
+	return &rest.PublicKey{GID: id, PEM: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))}, nil
+}
+
+func (f *fakeClient) Sign(id string, req rest.SignRequest) (*rest.Signature, error) {
+	if req.Mode != sig.ModeOpenSSL {
+		return nil, rest.NewError(400, rest.CodeInvalidRequest, "mode")
+	}
+
+	d, _ := hex.DecodeString(req.Digest)
+
+	if pri, ok := f.private[id].(*rsa.PrivateKey); ok {
+		h, err := crypto.HashID(req.Hash)
+		if err != nil {
+			return nil, rest.NewError(400, rest.CodeInvalidRequest, "hash")
+		}
+
+		s, err := rsa.SignPKCS1v15(rand.Reader, pri, h, d)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rest.Signature{GID: id, Hash: req.Hash, Mode: req.Mode, Signature: base64.StdEncoding.EncodeToString(s)}, nil
+	}
+
+	r, s, err := goecdsa.Sign(rand.Reader, f.ec(id), d)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := (&sig.Signature{R: r, S: s}).SigToDER()
+	if err != nil {
+		return nil, err
+	}
+
+	return &rest.Signature{GID: id, Hash: req.Hash, Mode: req.Mode, Signature: base64.StdEncoding.EncodeToString(der)}, nil
+}
+
+func (f *fakeClient) Verify(id string, req rest.VerifyRequest) (*rest.Verification, error) {
+	d, _ := hex.DecodeString(req.Digest)
+	der, _ := base64.StdEncoding.DecodeString(req.Signature)
+
+	if pri, ok := f.private[id].(*rsa.PrivateKey); ok {
+		h, err := crypto.HashID(req.Hash)
+		if err != nil {
+			return nil, rest.NewError(400, rest.CodeInvalidRequest, "hash")
+		}
+
+		return &rest.Verification{GID: id, Valid: rsa.VerifyPKCS1v15(&pri.PublicKey, h, d, der) == nil}, nil
+	}
+
+	var rs sig.Signature
+	if _, err := asn1.Unmarshal(der, &rs); err != nil {
+		return nil, rest.NewError(400, rest.CodeInvalidRequest, "signature")
+	}
+
+	return &rest.Verification{GID: id, Valid: goecdsa.Verify(&f.ec(id).PublicKey, d, rs.R, rs.S)}, nil
+}
+
+func params(t *testing.T, curve string) []byte {
+	t.Helper()
+
+	der, err := asn1.Marshal(curveOIDs[curve])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return der
+}
+
+func TestSessions(t *testing.T) {
+	f := newFakeClient()
+	tok := NewToken(f)
+
+	_, err := tok.OpenSession(CKF_RW_SESSION)
+	assert.Equal(t, uint(CKR_SESSION_PARALLEL_NOT_SUPPORTED), Code(err))
+
+	ro, err := tok.OpenSession(CKF_SERIAL_SESSION)
+	assert.Nil(t, err)
+	rw, err := tok.OpenSession(CKF_SERIAL_SESSION | CKF_RW_SESSION)
+	assert.Nil(t, err)
+
+	total, rws := tok.Sessions()
+	assert.Equal(t, 2, total)
+	assert.Equal(t, 1, rws)
+
+	// Operator PINs are "<operator>:<pin>"
+	assert.Equal(t, uint(CKR_PIN_INCORRECT), Code(tok.Login(ro, CKU_USER, []byte("alice:0000"))))
+	assert.Equal(t, uint(CKR_PIN_LOCKED), Code(tok.Login(ro, CKU_USER, []byte("locked:1234"))))
+	assert.Equal(t, uint(CKR_USER_TYPE_INVALID), Code(tok.Login(ro, 7, []byte("1234"))))
+	assert.Nil(t, tok.Login(ro, CKU_USER, []byte("alice:1234")))
+	assert.Equal(t, uint(CKR_USER_ALREADY_LOGGED_IN), Code(tok.Login(rw, CKU_USER, []byte("1234"))))
+
+	// The login holds for every session
+	info, err := tok.SessionInfo(rw)
+	if assert.Nil(t, err) {
+		assert.Equal(t, uint(CKS_RW_USER_FUNCTIONS), info.State)
+	}
+
+	// Closing the last session logs out
+	assert.Nil(t, tok.CloseSession(ro))
+	assert.True(t, f.loggedIn)
+	assert.Nil(t, tok.CloseSession(rw))
+	assert.False(t, f.loggedIn)
+	assert.Equal(t, uint(CKR_SESSION_HANDLE_INVALID), Code(tok.CloseSession(rw)))
+}
+
+func TestObjects(t *testing.T) {
+	f := newFakeClient()
+	tok := NewToken(f)
+
+	h, _ := tok.OpenSession(CKF_SERIAL_SESSION | CKF_RW_SESSION)
+
+	// Nothing is found before a login
+	assert.Nil(t, tok.FindObjectsInit(h, nil))
+	found, err := tok.FindObjects(h, 10)
+	assert.Nil(t, err)
+	assert.Empty(t, found)
+	assert.Nil(t, tok.FindObjectsFinal(h))
+
+	_, _, err = tok.GenerateKeyPair(h, CKM_EC_KEY_PAIR_GEN, nil, nil)
+	assert.Equal(t, uint(CKR_USER_NOT_LOGGED_IN), Code(err))
+
+	assert.Nil(t, tok.Login(h, CKU_USER, []byte("1234")))
+
+	public := []Attribute{{CKA_EC_PARAMS, params(t, "prime256v1")}}
+	private := []Attribute{{CKA_LABEL, []byte("signer")}, {CKA_SENSITIVE, Bool(true)}}
+
+	_, _, err = tok.GenerateKeyPair(h, CKM_EC_KEY_PAIR_GEN, public, nil)
+	assert.Equal(t, uint(CKR_TEMPLATE_INCOMPLETE), Code(err))
+	_, _, err = tok.GenerateKeyPair(h, CKM_EC_KEY_PAIR_GEN, public, append(private, Attribute{CKA_EXTRACTABLE, Bool(true)}))
+	assert.Equal(t, uint(CKR_TEMPLATE_INCONSISTENT), Code(err))
+	_, _, err = tok.GenerateKeyPair(h, CKM_EC_KEY_PAIR_GEN, []Attribute{{CKA_EC_PARAMS, []byte{0x06, 0x01, 0x00}}}, private)
+	assert.Equal(t, uint(CKR_ATTRIBUTE_VALUE_INVALID), Code(err))
+	_, _, err = tok.GenerateKeyPair(h, CKM_ECDSA, public, private)
+	assert.Equal(t, uint(CKR_MECHANISM_INVALID), Code(err))
+	_, _, err = tok.GenerateKeyPair(h, CKM_RSA_PKCS_KEY_PAIR_GEN, public, private)
+	assert.Equal(t, uint(CKR_TEMPLATE_INCONSISTENT), Code(err))
+
+	pub, pri, err := tok.GenerateKeyPair(h, CKM_EC_KEY_PAIR_GEN, public, private)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// Keys created elsewhere show too, destroyed ones do not
+	f.CreateKey(rest.CreateKeyRequest{Name: "other", Curve: "secp384r1"})
+	f.CreateKey(rest.CreateKeyRequest{Name: "gone", Curve: "prime256v1"})
+	f.keys[2].Status = dsa.StatusDestroyed
+
+	assert.Nil(t, tok.FindObjectsInit(h, []Attribute{{CKA_CLASS, Ulong(CKO_PRIVATE_KEY)}}))
+	found, _ = tok.FindObjects(h, 1)
+	assert.Equal(t, []uint{pri}, found)
+	found, _ = tok.FindObjects(h, 10)
+	assert.Len(t, found, 1)
+	found, _ = tok.FindObjects(h, 10)
+	assert.Empty(t, found)
+	assert.Nil(t, tok.FindObjectsFinal(h))
+
+	assert.Nil(t, tok.FindObjectsInit(h, []Attribute{{CKA_LABEL, []byte("signer")}, {CKA_ID, []byte("gid-0")}}))
+	found, _ = tok.FindObjects(h, 10)
+	assert.Equal(t, []uint{pub, pri}, found)
+	assert.Nil(t, tok.FindObjectsFinal(h))
+
+	values, err := tok.Attributes(h, pub, []uint{CKA_KEY_TYPE, CKA_EC_PARAMS, CKA_EC_POINT, CKA_VERIFY})
+	if assert.Nil(t, err) {
+		assert.Equal(t, Ulong(CKK_EC), values[0])
+		assert.Equal(t, params(t, "prime256v1"), values[1])
+
+		var point []byte
+		_, err := asn1.Unmarshal(values[2], &point)
+		assert.Nil(t, err)
+
+		x, y := elliptic.Unmarshal(elliptic.P256(), point)
+		assert.Equal(t, f.ec("gid-0").X, x)
+		assert.Equal(t, f.ec("gid-0").Y, y)
+		assert.Equal(t, Bool(true), values[3])
+	}
+
+	// The private half never shows its value
+	values, err = tok.Attributes(h, pri, []uint{CKA_SENSITIVE, CKA_EC_POINT})
+	assert.Equal(t, uint(CKR_ATTRIBUTE_TYPE_INVALID), Code(err))
+	assert.Equal(t, Bool(true), values[0])
+	assert.Nil(t, values[1])
+}
+
+func TestSignVerify(t *testing.T) {
+	f := newFakeClient()
+	tok := NewToken(f)
+
+	h, _ := tok.OpenSession(CKF_SERIAL_SESSION | CKF_RW_SESSION)
+	assert.Nil(t, tok.Login(h, CKU_USER, []byte("1234")))
+
+	pub, pri, err := tok.GenerateKeyPair(h, CKM_EC_KEY_PAIR_GEN,
+		[]Attribute{{CKA_EC_PARAMS, params(t, "secp384r1")}}, []Attribute{{CKA_LABEL, []byte("signer")}})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Equal(t, uint(CKR_KEY_TYPE_INCONSISTENT), Code(tok.SignInit(h, CKM_ECDSA, pub)))
+	assert.Equal(t, uint(CKR_MECHANISM_INVALID), Code(tok.SignInit(h, CKM_EC_KEY_PAIR_GEN, pri)))
+	assert.Equal(t, uint(CKR_KEY_TYPE_INCONSISTENT), Code(tok.SignInit(h, CKM_RSA_PKCS, pri)))
+
+	// CKM_ECDSA signs a digest made by the caller
+	digest := sha256.Sum256([]byte("payload"))
+
+	assert.Nil(t, tok.SignInit(h, CKM_ECDSA, pri))
+	assert.Equal(t, uint(CKR_OPERATION_ACTIVE), Code(tok.SignInit(h, CKM_ECDSA, pri)))
+
+	n, err := tok.SignatureLength(h)
+	assert.Nil(t, err)
+	assert.Equal(t, 96, n)
+
+	signature, err := tok.Sign(h, digest[:])
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Len(t, signature, 96)
+
+	_, err = tok.Sign(h, digest[:])
+	assert.Equal(t, uint(CKR_OPERATION_NOT_INITIALIZED), Code(err))
+
+	assert.Nil(t, tok.VerifyInit(h, CKM_ECDSA, pub))
+	assert.Nil(t, tok.Verify(h, digest[:], signature))
+
+	signature[10] ^= 0xff
+	assert.Nil(t, tok.VerifyInit(h, CKM_ECDSA, pub))
+	assert.Equal(t, uint(CKR_SIGNATURE_INVALID), Code(tok.Verify(h, digest[:], signature)))
+
+	assert.Nil(t, tok.VerifyInit(h, CKM_ECDSA, pub))
+	assert.Equal(t, uint(CKR_SIGNATURE_LEN_RANGE), Code(tok.Verify(h, digest[:], signature[:64])))
+
+	assert.Nil(t, tok.SignInit(h, CKM_ECDSA, pri))
+	_, err = tok.Sign(h, nil)
+	assert.Equal(t, uint(CKR_DATA_LEN_RANGE), Code(err))
+
+	// Digests of any length sign as X9.62 has them, SHA-1 and SHA-512 on
+	// secp384r1 alike
+	for _, d := range [][]byte{sha1Sum([]byte("payload")), sha512Sum([]byte("payload"))} {
+		assert.Nil(t, tok.SignInit(h, CKM_ECDSA, pri))
+
+		signature, err := tok.Sign(h, d)
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		r, s := new(big.Int).SetBytes(signature[:48]), new(big.Int).SetBytes(signature[48:])
+		assert.True(t, goecdsa.Verify(&f.ec(f.keys[0].GID).PublicKey, d, r, s))
+
+		assert.Nil(t, tok.VerifyInit(h, CKM_ECDSA, pub))
+		assert.Nil(t, tok.Verify(h, d, signature))
+	}
+
+	// The hashing mechanisms take the data in parts
+	assert.Nil(t, tok.SignInit(h, CKM_ECDSA_SHA256, pri))
+	assert.Nil(t, tok.SignUpdate(h, []byte("pay")))
+	assert.Nil(t, tok.SignUpdate(h, []byte("load")))
+
+	signature, err = tok.SignFinal(h)
+	assert.Nil(t, err)
+
+	assert.Nil(t, tok.VerifyInit(h, CKM_ECDSA, pub))
+	assert.Nil(t, tok.Verify(h, digest[:], signature))
+
+	assert.Nil(t, tok.VerifyInit(h, CKM_ECDSA_SHA256, pub))
+	assert.Nil(t, tok.Verify(h, []byte("payload"), signature))
+
+	assert.Nil(t, tok.SignInit(h, CKM_ECDSA, pri))
+	assert.Equal(t, uint(CKR_FUNCTION_NOT_SUPPORTED), Code(tok.SignUpdate(h, digest[:])))
+
+	// Keys that may no longer sign are refused
+	f.keys[0].Status = dsa.StatusArchived
+	assert.Nil(t, tok.FindObjectsInit(h, nil))
+	assert.Nil(t, tok.FindObjectsFinal(h))
+	assert.Equal(t, uint(CKR_KEY_FUNCTION_NOT_PERMITTED), Code(tok.SignInit(h, CKM_ECDSA, pri)))
+	assert.Nil(t, tok.VerifyInit(h, CKM_ECDSA, pub))
+
+	// Logging out ends every operation
+	assert.Nil(t, tok.Logout(h))
+	assert.Equal(t, uint(CKR_USER_NOT_LOGGED_IN), Code(tok.Verify(h, digest[:], signature)))
+}
+
+func TestSignVerifyRSA(t *testing.T) {
+	f := newFakeClient()
+	tok := NewToken(f)
+
+	h, _ := tok.OpenSession(CKF_SERIAL_SESSION | CKF_RW_SESSION)
+	assert.Nil(t, tok.Login(h, CKU_USER, []byte("1234")))
+
+	label := []Attribute{{CKA_LABEL, []byte("rsa")}}
+	gen := func(public ...Attribute) error {
+		_, _, err := tok.GenerateKeyPair(h, CKM_RSA_PKCS_KEY_PAIR_GEN, public, label)
+		return err
+	}
+
+	// The daemon makes the keystore's sizes, with the exponent 65537
+	assert.Equal(t, uint(CKR_TEMPLATE_INCOMPLETE), Code(gen()))
+	assert.Equal(t, uint(CKR_ATTRIBUTE_VALUE_INVALID), Code(gen(Attribute{CKA_MODULUS_BITS, Ulong(1024)})))
+	assert.Equal(t, uint(CKR_ATTRIBUTE_VALUE_INVALID), Code(gen(Attribute{CKA_MODULUS_BITS, Ulong(2048)}, Attribute{CKA_PUBLIC_EXPONENT, []byte{3}})))
+	assert.Equal(t, uint(CKR_TEMPLATE_INCONSISTENT), Code(gen(Attribute{CKA_MODULUS_BITS, Ulong(2048)}, Attribute{CKA_KEY_TYPE, Ulong(CKK_EC)})))
+
+	pub, pri, err := tok.GenerateKeyPair(h, CKM_RSA_PKCS_KEY_PAIR_GEN,
+		[]Attribute{{CKA_MODULUS_BITS, Ulong(2048)}, {CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}}}, label)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Equal(t, "rsa2048", f.keys[0].Curve)
+	key := f.private[f.keys[0].GID].(*rsa.PrivateKey)
+
+	values, err := tok.Attributes(h, pub, []uint{CKA_KEY_TYPE, CKA_MODULUS, CKA_MODULUS_BITS, CKA_PUBLIC_EXPONENT})
+	if assert.Nil(t, err) {
+		assert.Equal(t, Ulong(CKK_RSA), values[0])
+		assert.Equal(t, key.N.Bytes(), values[1])
+		assert.Equal(t, Ulong(2048), values[2])
+		assert.Equal(t, []byte{1, 0, 1}, values[3])
+	}
+
+	_, err = tok.Attributes(h, pub, []uint{CKA_EC_POINT})
+	assert.Equal(t, uint(CKR_ATTRIBUTE_TYPE_INVALID), Code(err))
+
+	assert.Equal(t, uint(CKR_KEY_TYPE_INCONSISTENT), Code(tok.SignInit(h, CKM_ECDSA, pri)))
+
+	// The hashing mechanisms take the data in parts
+	assert.Nil(t, tok.SignInit(h, CKM_SHA256_RSA_PKCS, pri))
+
+	n, err := tok.SignatureLength(h)
+	assert.Nil(t, err)
+	assert.Equal(t, 256, n)
+
+	assert.Nil(t, tok.SignUpdate(h, []byte("pay")))
+	assert.Nil(t, tok.SignUpdate(h, []byte("load")))
+
+	signature, err := tok.SignFinal(h)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	digest := sha256.Sum256([]byte("payload"))
+	assert.Nil(t, rsa.VerifyPKCS1v15(&key.PublicKey, gocrypto.SHA256, digest[:], signature))
+
+	assert.Nil(t, tok.VerifyInit(h, CKM_SHA256_RSA_PKCS, pub))
+	assert.Nil(t, tok.Verify(h, []byte("payload"), signature))
+
+	// CKM_RSA_PKCS signs the DigestInfo of a digest made by the caller
+	sum := sha512.Sum384([]byte("payload"))
+	info := digestInfoOf(t, digestInfoOIDs[crypto.SHA384], sum[:])
+
+	assert.Nil(t, tok.SignInit(h, CKM_RSA_PKCS, pri))
+
+	signature, err = tok.Sign(h, info)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Nil(t, rsa.VerifyPKCS1v15(&key.PublicKey, gocrypto.SHA384, sum[:], signature))
+
+	assert.Nil(t, tok.VerifyInit(h, CKM_RSA_PKCS, pub))
+	assert.Nil(t, tok.Verify(h, info, signature))
+
+	signature[10] ^= 0xff
+	assert.Nil(t, tok.VerifyInit(h, CKM_RSA_PKCS, pub))
+	assert.Equal(t, uint(CKR_SIGNATURE_INVALID), Code(tok.Verify(h, info, signature)))
+
+	assert.Nil(t, tok.VerifyInit(h, CKM_RSA_PKCS, pub))
+	assert.Equal(t, uint(CKR_SIGNATURE_LEN_RANGE), Code(tok.Verify(h, info, signature[:128])))
+
+	// Raw data, and digests the daemon cannot name, are refused
+	sha1Info := digestInfoOf(t, asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}, sha1Sum([]byte("payload")))
+
+	for _, data := range [][]byte{digest[:], sha1Info} {
+		assert.Nil(t, tok.SignInit(h, CKM_RSA_PKCS, pri))
+		_, err = tok.Sign(h, data)
+		assert.Equal(t, uint(CKR_DATA_INVALID), Code(err))
+	}
+
+	assert.Nil(t, tok.SignInit(h, CKM_RSA_PKCS, pri))
+	assert.Equal(t, uint(CKR_FUNCTION_NOT_SUPPORTED), Code(tok.SignUpdate(h, info)))
+}
+
+// digestInfoOf is the DER DigestInfo of a digest made by the algorithm oid
+func digestInfoOf(t *testing.T, oid asn1.ObjectIdentifier, sum []byte) []byte {
+	t.Helper()
+
+	der, err := asn1.Marshal(struct {
+		Algorithm pkix.AlgorithmIdentifier
+		Digest    []byte
+	}{pkix.AlgorithmIdentifier{Algorithm: oid, Parameters: asn1.NullRawValue}, sum})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return der
+}
+
+func sha1Sum(data []byte) []byte {
+	sum := sha1.Sum(data)
+	return sum[:]
+}
+
+func sha512Sum(data []byte) []byte {
+	sum := sha512.Sum512(data)
+	return sum[:]
+}
+
+func TestDigest(t *testing.T) {
+	curves := map[string]elliptic.Curve{"secp224r1": elliptic.P224(), "prime256v1": elliptic.P256(), "secp521r1": elliptic.P521()}
+
+	for name, curve := range curves {
+		pri, err := goecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// What the daemon signs verifies against the caller's digest
+		for _, data := range [][]byte{sha1Sum([]byte("payload")), []byte("short"), sha512Sum([]byte("payload"))} {
+			hash, d, err := digest(CKM_ECDSA, name, data)
+			if !assert.Nil(t, err, name) {
+				continue
+			}
+
+			h, _ := crypto.NewHash(hash)
+			assert.Len(t, d, h.Size(), name)
+
+			r, s, err := goecdsa.Sign(rand.Reader, pri, d)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.True(t, goecdsa.Verify(&pri.PublicKey, data, r, s), "%s %x", name, data)
+		}
+	}
+
+	_, _, err := digest(CKM_ECDSA, "secp521r1", make([]byte, 66))
+	assert.Nil(t, err)
+
+	_, _, err = digest(CKM_ECDSA, "secp521r1", append([]byte{0xff}, make([]byte, 65)...))
+	assert.Equal(t, uint(CKR_DATA_LEN_RANGE), Code(err))
+}
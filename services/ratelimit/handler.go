@@ -0,0 +1,178 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/block27/core/services/audit"
+	"github.com/block27/core/services/rest"
+)
+
+// auditWindow is how long the rejections of one client share an audit entry
+const auditWindow = time.Minute
+
+// Handler serves h to clients within their budget, and meters the
+// signatures h makes with each key. It goes behind the handler naming the
+// client. Rejections answer 429 with Retry-After, or 413 when asking for more
+// than the budget ever holds. Those of clients are recorded in the audit log
+// once per client and minute, with a count of the ones that followed; those
+// of keys by the operation they failed.
+func Handler(h http.Handler, l LimiterAPI, log audit.LogAPI) http.Handler {
+	keys := keyLimiter{l}
+	rejected := newRejections(log, time.Now)
+
+	// Counts are written once their minute is over, whether or not another
+	// rejection comes. One that fails to append is kept for the next tick.
+	go func() {
+		for range time.Tick(auditWindow) {
+			rejected.flush()
+		}
+	}()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == rest.Prefix+"/health" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		actor := rest.ActorOf(r)
+
+		if err := l.Take("client:"+actor, 1); err != nil {
+			e := apiError(err)
+
+			if aerr := rejected.record(actor, e.Message); aerr != nil {
+				e = rest.NewError(http.StatusServiceUnavailable, rest.CodeUnavailable, "audit log unavailable")
+			}
+
+			rest.WriteError(w, e)
+			return
+		}
+
+		h.ServeHTTP(w, rest.WithLimiter(r, keys))
+	})
+}
+
+// window is a client's first audited rejection and the count of those since
+type window struct {
+	start time.Time
+	count int
+}
+
+// rejections coalesces the audit entries of client rejections, a flood of
+// requests over budget would otherwise flood the log
+type rejections struct {
+	log audit.LogAPI
+	now func() time.Time
+
+	mu      sync.Mutex
+	windows map[string]*window
+}
+
+func newRejections(log audit.LogAPI, now func() time.Time) *rejections {
+	return &rejections{log: log, now: now, windows: map[string]*window{}}
+}
+
+// record audits the rejection of actor unless one was within auditWindow,
+// then it is only counted. The counts of windows that are over are recorded
+// first, as an entry of their own.
+func (rj *rejections) record(actor string, detail string) error {
+	rj.mu.Lock()
+	defer rj.mu.Unlock()
+
+	now := rj.now()
+
+	if err := rj.expire(now); err != nil {
+		return err
+	}
+
+	if w, ok := rj.windows[actor]; ok {
+		w.count++
+		return nil
+	}
+
+	if _, err := rj.log.Append(audit.Entry{
+		Op:     audit.OpLimit,
+		Actor:  actor,
+		Result: audit.ResultFailed,
+		Detail: detail,
+	}); err != nil {
+		return err
+	}
+
+	rj.windows[actor] = &window{start: now}
+
+	return nil
+}
+
+// flush records the counts of the windows that are over
+func (rj *rejections) flush() error {
+	rj.mu.Lock()
+	defer rj.mu.Unlock()
+
+	return rj.expire(rj.now())
+}
+
+// expire records the count of every window over at now and closes it. The
+// caller holds mu.
+func (rj *rejections) expire(now time.Time) error {
+	for a, w := range rj.windows {
+		if now.Sub(w.start) < auditWindow {
+			continue
+		}
+
+		if w.count > 0 {
+			if _, err := rj.log.Append(audit.Entry{
+				Op:     audit.OpLimit,
+				Actor:  a,
+				Result: audit.ResultFailed,
+				Detail: fmt.Sprintf("%d more rejections in the minute from %s", w.count, w.start.UTC().Format(time.RFC3339)),
+			}); err != nil {
+				return err
+			}
+		}
+
+		delete(rj.windows, a)
+	}
+
+	return nil
+}
+
+// keyLimiter answers the server in API errors
+type keyLimiter struct {
+	l LimiterAPI
+}
+
+func (k keyLimiter) Take(subject string, n int) error {
+	err := k.l.Take(subject, n)
+	if _, ok := err.(*Exceeded); ok {
+		return apiError(err)
+	}
+
+	return err
+}
+
+// apiError maps Exceeded to 429, or 413 when waiting cannot help, anything
+// else is internal
+func apiError(err error) *rest.Error {
+	e, ok := err.(*Exceeded)
+	if !ok {
+		return rest.NewError(http.StatusInternalServerError, rest.CodeInternal, "internal error")
+	}
+
+	if e.Oversized {
+		return rest.NewError(http.StatusRequestEntityTooLarge, rest.CodeTooLarge, "%v", e)
+	}
+
+	code := rest.CodeRateLimited
+	if e.Quota {
+		code = rest.CodeQuotaExceeded
+	}
+
+	re := rest.NewError(http.StatusTooManyRequests, code, "%v", e)
+	re.RetryAfter = int(math.Ceil(e.RetryAfter.Seconds()))
+
+	return re
+}
@@ -0,0 +1,285 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/services/bbolt"
+)
+
+// bucket holding one JSON state per subject, so budgets survive restarts
+const bucket = "ratelimit"
+
+// Limit is a token bucket refilling Rate a minute up to Burst, and a quota
+// of Daily per UTC day. A zero Rate or Daily disables that part.
+type Limit struct {
+	Rate  int `json:"rate"`
+	Burst int `json:"burst"`
+	Daily int `json:"daily"`
+}
+
+// Exceeded is returned for a subject out of budget. Oversized is set when
+// waiting cannot help, N being over the burst or the daily quota, and
+// RetryAfter is zero then.
+type Exceeded struct {
+	Subject    string
+	Quota      bool
+	Oversized  bool
+	N          int
+	Limit      Limit
+	RetryAfter time.Duration
+}
+
+func (e *Exceeded) Error() string {
+	switch {
+	case e.Oversized && e.Limit.Rate > 0 && e.N > e.Limit.Burst:
+		return fmt.Sprintf("%s asked for %d, more than its burst of %d", e.Subject, e.N, e.Limit.Burst)
+	case e.Oversized:
+		return fmt.Sprintf("%s asked for %d, more than its daily quota of %d", e.Subject, e.N, e.Limit.Daily)
+	case e.Quota:
+		return fmt.Sprintf("%s exceeded its daily quota of %d", e.Subject, e.Limit.Daily)
+	}
+
+	return fmt.Sprintf("%s exceeded its rate of %d a minute", e.Subject, e.Limit.Rate)
+}
+
+// LimiterAPI meters subjects, "client:<actor>" for API clients and
+// "key:<gid>" for the signatures of a key
+type LimiterAPI interface {
+	// Take spends n from the subject's budget, *Exceeded when it cannot,
+	// spending nothing
+	Take(subject string, n int) error
+
+	// Limit is what applies to the subject
+	Limit(subject string) Limit
+}
+
+// state is the persisted budget of a subject
+type state struct {
+	Tokens float64   `json:"tokens"`
+	At     time.Time `json:"at"`
+	Day    string    `json:"day"`
+	Used   int       `json:"used"`
+}
+
+// override is a limit for one client or key
+type override struct {
+	subject string
+	limit   Limit
+}
+
+type limiter struct {
+	d         bbolt.Datastore
+	client    Limit
+	key       Limit
+	overrides []override
+
+	now func() time.Time
+}
+
+// NewLimiter returns the LimiterAPI for api.limits.client and
+// api.limits.key, and the api.limits.overrides of single clients and keys,
+// a list of the below, where left out fields keep the default
+//
+//   - client: token:nightly
+//     rate: 60
+//     burst: 10
+//     daily: 10000
+//   - key: 8f14e45fceea167a5a36dedd4bea2543
+//     daily: 1000
+func NewLimiter(c config.Reader, d bbolt.Datastore) (LimiterAPI, error) {
+	l := &limiter{
+		d:      d,
+		client: readLimit(c, "api.limits.client"),
+		key:    readLimit(c, "api.limits.key"),
+		now:    time.Now,
+	}
+
+	if err := l.client.check("api.limits.client"); err != nil {
+		return nil, err
+	}
+
+	if err := l.key.check("api.limits.key"); err != nil {
+		return nil, err
+	}
+
+	raw := c.Get("api.limits.overrides")
+	if raw == nil {
+		return l, nil
+	}
+
+	items, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("api.limits.overrides must be a list")
+	}
+
+	for i, item := range items {
+		m := stringMap(item)
+		if m == nil {
+			return nil, fmt.Errorf("api.limits.overrides[%d] must be a map", i)
+		}
+
+		client, _ := m["client"].(string)
+		key, _ := m["key"].(string)
+
+		o := override{}
+		switch {
+		case client != "" && key == "":
+			o.subject, o.limit = "client:"+client, l.client
+		case key != "" && client == "":
+			o.subject, o.limit = "key:"+key, l.key
+		default:
+			return nil, fmt.Errorf("api.limits.overrides[%d]: pass exactly one of client or key", i)
+		}
+
+		for name, v := range map[string]*int{"rate": &o.limit.Rate, "burst": &o.limit.Burst, "daily": &o.limit.Daily} {
+			if raw, ok := m[name]; ok {
+				n, err := toInt(raw)
+				if err != nil {
+					return nil, fmt.Errorf("api.limits.overrides[%d]: invalid %s: %v", i, name, raw)
+				}
+
+				*v = n
+			}
+		}
+
+		if err := o.limit.check(fmt.Sprintf("api.limits.overrides[%d]", i)); err != nil {
+			return nil, err
+		}
+
+		l.overrides = append(l.overrides, o)
+	}
+
+	return l, nil
+}
+
+func (l *limiter) Limit(subject string) Limit {
+	for _, o := range l.overrides {
+		if strings.EqualFold(o.subject, subject) {
+			return o.limit
+		}
+	}
+
+	if strings.HasPrefix(subject, "key:") {
+		return l.key
+	}
+
+	return l.client
+}
+
+func (l *limiter) Take(subject string, n int) error {
+	limit := l.Limit(subject)
+	if limit.Rate == 0 && limit.Daily == 0 {
+		return nil
+	}
+
+	if limit.Rate > 0 && n > limit.Burst || limit.Daily > 0 && n > limit.Daily {
+		return &Exceeded{Subject: subject, Oversized: true, N: n, Limit: limit}
+	}
+
+	now := l.now().UTC()
+	day := now.Format("2006-01-02")
+
+	return l.d.Write(func(tx bbolt.Tx) error {
+		st := state{Tokens: float64(limit.Burst), At: now, Day: day}
+		if raw := tx.Get(bucket, []byte(subject)); raw != nil {
+			if err := json.Unmarshal(raw, &st); err != nil {
+				return err
+			}
+		}
+
+		if st.Day != day {
+			st.Day, st.Used = day, 0
+		}
+
+		if limit.Daily > 0 && st.Used+n > limit.Daily {
+			midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+			return &Exceeded{Subject: subject, Quota: true, Limit: limit, RetryAfter: midnight.Sub(now)}
+		}
+
+		if limit.Rate > 0 {
+			perSecond := float64(limit.Rate) / 60
+
+			if elapsed := now.Sub(st.At).Seconds(); elapsed > 0 {
+				st.Tokens = math.Min(float64(limit.Burst), st.Tokens+elapsed*perSecond)
+			}
+
+			st.At = now
+
+			if st.Tokens < float64(n) {
+				wait := time.Duration(math.Ceil((float64(n)-st.Tokens)/perSecond)) * time.Second
+				return &Exceeded{Subject: subject, Limit: limit, RetryAfter: wait}
+			}
+
+			st.Tokens -= float64(n)
+		}
+
+		st.Used += n
+
+		data, err := json.Marshal(st)
+		if err != nil {
+			return err
+		}
+
+		return tx.Put(bucket, []byte(subject), data)
+	})
+}
+
+// check refuses limits no request could pass
+func (l Limit) check(name string) error {
+	if l.Rate < 0 || l.Burst < 0 || l.Daily < 0 {
+		return fmt.Errorf("%s: limits cannot be negative", name)
+	}
+
+	if l.Rate > 0 && l.Burst == 0 {
+		return fmt.Errorf("%s: a rate needs a burst of at least 1", name)
+	}
+
+	return nil
+}
+
+// readLimit reads the limit under prefix
+func readLimit(c config.Reader, prefix string) Limit {
+	return Limit{
+		Rate:  c.GetInt(prefix + ".rate"),
+		Burst: c.GetInt(prefix + ".burst"),
+		Daily: c.GetInt(prefix + ".daily"),
+	}
+}
+
+// stringMap accepts the map types YAML, JSON and defaults decode to
+func stringMap(v interface{}) map[string]interface{} {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m
+	case map[interface{}]interface{}:
+		out := map[string]interface{}{}
+		for k, val := range m {
+			out[fmt.Sprint(k)] = val
+		}
+
+		return out
+	}
+
+	return nil
+}
+
+// toInt accepts the number types YAML and JSON decode to
+func toInt(v interface{}) (int, error) {
+	switch n := v.(type) {
+	case int:
+		return n, nil
+	case int64:
+		return int(n), nil
+	case float64:
+		if n == math.Trunc(n) {
+			return int(n), nil
+		}
+	}
+
+	return 0, fmt.Errorf("not an integer: %v", v)
+}
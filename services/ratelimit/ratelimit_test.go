@@ -0,0 +1,335 @@
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/block27/core/backend"
+	"github.com/block27/core/config"
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/services/audit"
+	"github.com/block27/core/services/bbolt"
+	"github.com/block27/core/services/keystore"
+	"github.com/block27/core/services/rest"
+	"github.com/block27/core/test"
+)
+
+var Config config.Reader
+
+func init() {
+	os.Setenv("ENVIRONMENT", "test")
+
+	c, err := config.LoadConfig(config.Defaults)
+	if err != nil {
+		panic(err)
+	}
+
+	if c.GetString("environment") != "test" {
+		panic(fmt.Errorf("test [environment] is not in [test] mode"))
+	}
+
+	// Stands in for HardwareAuthenticate, which needs the device attached
+	if err := crypto.LoadMasterKey([]byte(test.MasterKey), []byte(test.MasterIv)); err != nil {
+		panic(err)
+	}
+
+	Config = c
+}
+
+// limitsReader keeps the keystore under a directory of its own and sets
+// small limits
+type limitsReader struct {
+	config.Reader
+	keys      string
+	limits    map[string]int
+	overrides []interface{}
+}
+
+func (l limitsReader) GetString(key string) string {
+	switch key {
+	case "keystore.backend":
+		return keystore.FS
+	case "paths.keys":
+		return l.keys
+	}
+
+	return l.Reader.GetString(key)
+}
+
+func (l limitsReader) GetInt(key string) int {
+	if v, ok := l.limits[key]; ok {
+		return v
+	}
+
+	return l.Reader.GetInt(key)
+}
+
+func (l limitsReader) Get(key string) interface{} {
+	if key == "api.limits.overrides" {
+		return l.overrides
+	}
+
+	return l.Reader.Get(key)
+}
+
+func newTestDB(t *testing.T) (bbolt.Datastore, string, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "ratelimit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := bbolt.NewDB(filepath.Join(dir, "botldb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d, dir, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	d, _, done := newTestDB(t)
+	defer done()
+
+	c := limitsReader{Reader: Config, limits: map[string]int{
+		"api.limits.client.rate":  60,
+		"api.limits.client.burst": 2,
+		"api.limits.client.daily": 4,
+	}, overrides: []interface{}{
+		map[interface{}]interface{}{"client": "token:nightly", "daily": 0},
+		map[string]interface{}{"key": "abc", "rate": float64(0), "daily": float64(1)},
+	}}
+
+	now := time.Date(2020, 1, 1, 23, 59, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	l, err := NewLimiter(c, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.(*limiter).now = clock
+
+	assert.Nil(t, l.Take("client:ci", 1))
+	assert.Nil(t, l.Take("client:ci", 1))
+
+	// The bucket refills a token a second
+	err = l.Take("client:ci", 1)
+	if assert.IsType(t, &Exceeded{}, err) {
+		assert.False(t, err.(*Exceeded).Quota)
+		assert.Equal(t, time.Second, err.(*Exceeded).RetryAfter)
+	}
+
+	// Asking for more than the burst or the quota cannot be waited out
+	err = l.Take("client:ci", 3)
+	if assert.IsType(t, &Exceeded{}, err) {
+		assert.True(t, err.(*Exceeded).Oversized)
+		assert.Equal(t, time.Duration(0), err.(*Exceeded).RetryAfter)
+		assert.Contains(t, err.Error(), "burst of 2")
+	}
+
+	// Budgets survive a restart
+	now = now.Add(2 * time.Second)
+
+	l, err = NewLimiter(c, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.(*limiter).now = clock
+
+	assert.Nil(t, l.Take("client:ci", 2))
+
+	// The daily quota ends at midnight UTC
+	now = now.Add(10 * time.Second)
+
+	err = l.Take("client:ci", 1)
+	if assert.IsType(t, &Exceeded{}, err) {
+		assert.True(t, err.(*Exceeded).Quota)
+		assert.Equal(t, 48*time.Second, err.(*Exceeded).RetryAfter)
+	}
+
+	now = now.Add(time.Minute)
+	assert.Nil(t, l.Take("client:ci", 2))
+
+	// Overrides replace only the fields they set
+	assert.Equal(t, Limit{Rate: 60, Burst: 2}, l.Limit("client:token:nightly"))
+	assert.Equal(t, Limit{Rate: 0, Burst: 100, Daily: 1}, l.Limit("key:abc"))
+	assert.Equal(t, Limit{Rate: 300, Burst: 100}, l.Limit("key:def"))
+
+	err = l.Take("key:abc", 2)
+	if assert.IsType(t, &Exceeded{}, err) {
+		assert.True(t, err.(*Exceeded).Oversized)
+		assert.Contains(t, err.Error(), "daily quota of 1")
+	}
+
+	assert.Nil(t, l.Take("key:abc", 1))
+	assert.NotNil(t, l.Take("key:abc", 1))
+
+	for _, o := range [][]interface{}{
+		{"not a map"},
+		{map[string]interface{}{"client": "a", "key": "b"}},
+		{map[string]interface{}{"client": "a", "rate": 1.5}},
+		{map[string]interface{}{"client": "a", "rate": 10, "burst": 0}},
+		{map[string]interface{}{"key": "a", "daily": -1}},
+	} {
+		_, err := NewLimiter(limitsReader{Reader: Config, overrides: o}, d)
+		assert.NotNil(t, err, "%v", o)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	d, dir, done := newTestDB(t)
+	defer done()
+
+	var c config.Reader = limitsReader{Reader: Config, keys: filepath.Join(dir, "keys"), limits: map[string]int{
+		"api.limits.client.rate":  60,
+		"api.limits.client.burst": 4,
+		"api.limits.key.rate":     60,
+		"api.limits.key.burst":    1,
+	}}
+
+	l, err := NewLimiter(c, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lg := logrus.New()
+	lg.SetOutput(ioutil.Discard)
+
+	log := audit.NewLog(c, d)
+	h := Handler(rest.NewServer(&backend.Backend{C: &c, D: d, L: lg}, nil), l, log)
+
+	call := func(method string, path string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, rest.WithActor(req, "cert:CN=ci"))
+
+		return rec
+	}
+
+	assert.Equal(t, http.StatusCreated, call("POST", "/api/v1/keys", `{"name":"signer"}`).Code)
+
+	digest := sha256.Sum256([]byte("payload"))
+	body := fmt.Sprintf(`{"digest":"%x","hash":"sha256"}`, digest[:])
+
+	// The key's budget runs out before the client's
+	assert.Equal(t, http.StatusOK, call("POST", "/api/v1/keys/signer/sign", body).Code)
+
+	rec := call("POST", "/api/v1/keys/signer/sign", body)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	assert.Contains(t, rec.Body.String(), rest.CodeRateLimited)
+
+	// Then the client's, the health route excepted
+	rec = call("GET", "/api/v1/keys", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = call("GET", "/api/v1/keys", "")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+
+	assert.Equal(t, http.StatusOK, call("GET", "/api/v1/health", "").Code)
+
+	// A batch over the key's burst could never be signed, it is too large
+	// rather than limited
+	batch := fmt.Sprintf(`{"identifier":"signer","items":[{"digest":"%x"},{"digest":"%x"}]}`, digest[:], digest[:])
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/v1/dsa/batch", strings.NewReader(batch))
+	req.Header.Set("Content-Type", "application/json")
+	Handler(rest.NewServer(&backend.Backend{C: &c, D: d, L: lg}, nil), l, log).ServeHTTP(rec, rest.WithActor(req, "cert:CN=batch"))
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Empty(t, rec.Header().Get("Retry-After"))
+	assert.Contains(t, rec.Body.String(), rest.CodeTooLarge)
+
+	// Rejections of the same client within a minute share an entry
+	assert.Equal(t, http.StatusTooManyRequests, call("GET", "/api/v1/keys", "").Code)
+
+	// Both rejections are audited
+	entries, err := log.Entries(audit.Filter{Op: audit.OpLimit})
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "cert:CN=ci", entries[0].Actor)
+		assert.Equal(t, audit.ResultFailed, entries[0].Result)
+	}
+
+	entries, err = log.Entries(audit.Filter{Op: audit.OpSign})
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 3) {
+		assert.Equal(t, audit.ResultFailed, entries[1].Result)
+		assert.Contains(t, entries[1].Detail, "rate")
+		assert.Contains(t, entries[2].Detail, "burst")
+	}
+}
+
+func TestRejections(t *testing.T) {
+	d, _, done := newTestDB(t)
+	defer done()
+
+	log := audit.NewLog(Config, d)
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	rj := newRejections(log, func() time.Time { return now })
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, rj.record("ci", "rate"))
+		now = now.Add(time.Second)
+	}
+
+	assert.Nil(t, rj.record("other", "rate"))
+
+	entries, err := log.Entries(audit.Filter{Op: audit.OpLimit})
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+
+	// Once the window is over its count is recorded, and the next
+	// rejection opens another
+	now = now.Add(time.Minute)
+	assert.Nil(t, rj.record("ci", "rate"))
+
+	entries, err = log.Entries(audit.Filter{Op: audit.OpLimit})
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 4) {
+		assert.Equal(t, "ci", entries[2].Actor)
+		assert.Contains(t, entries[2].Detail, "4 more rejections")
+		assert.Equal(t, "rate", entries[3].Detail)
+	}
+
+	// A window is also closed without any further rejection
+	now = now.Add(time.Second)
+	assert.Nil(t, rj.record("ci", "rate"))
+	assert.Nil(t, rj.flush())
+
+	entries, err = log.Entries(audit.Filter{Op: audit.OpLimit})
+	assert.Nil(t, err)
+	assert.Len(t, entries, 4)
+
+	now = now.Add(time.Minute)
+	assert.Nil(t, rj.flush())
+
+	entries, err = log.Entries(audit.Filter{Op: audit.OpLimit})
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 5) {
+		assert.Equal(t, "ci", entries[4].Actor)
+		assert.Contains(t, entries[4].Detail, "1 more rejections")
+	}
+}
@@ -0,0 +1,188 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/block27/core/services/audit"
+	"github.com/block27/core/services/dsa/alias"
+	"github.com/block27/core/services/dsa/ecdsa"
+)
+
+// AliasList holds every alias the client may see, ordered by name
+type AliasList struct {
+	Aliases []*alias.Alias `json:"aliases"`
+}
+
+// aliases serves the collection
+func (s *server) aliases(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.listAliases(w, r)
+	case http.MethodPost:
+		s.createAlias(w, r)
+	default:
+		s.methodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+	}
+}
+
+// alias serves a single alias and its rotation
+func (s *server) alias(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, Prefix+"/aliases/"), "/", 2)
+
+	name, action := parts[0], ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+
+	switch {
+	case name == "":
+		s.writeError(w, r, invalid("missing alias name"))
+	case action == "" && r.Method == http.MethodGet:
+		s.getAlias(w, r, name)
+	case action == "rotate" && r.Method == http.MethodPost:
+		s.rotateAlias(w, r, name)
+	case action == "":
+		s.methodNotAllowed(w, r, http.MethodGet)
+	case action == "rotate":
+		s.methodNotAllowed(w, r, http.MethodPost)
+	default:
+		s.writeError(w, r, newError(http.StatusNotFound, CodeNotFound, "no route %s", r.URL.Path))
+	}
+}
+
+// permitAlias checks the request's scope covers every version of the alias
+func (s *server) permitAlias(r *http.Request, a *alias.Alias) error {
+	gids, err := s.scopedKeys(r)
+	if err != nil || gids == nil {
+		return err
+	}
+
+	for _, v := range a.Versions {
+		if !contains(gids, v.GID) {
+			return newError(http.StatusForbidden, CodeForbidden, "alias %s is not permitted", a.Name)
+		}
+	}
+
+	return nil
+}
+
+// permitAliases refuses clients limited to keys, which cannot create or
+// rotate aliases
+func (s *server) permitAliases(r *http.Request) error {
+	if err := s.permit(r, PermCreate); err != nil {
+		return err
+	}
+
+	if sc := scopeOf(r); sc != nil && len(sc.Keys) > 0 {
+		return newError(http.StatusForbidden, CodeForbidden, "clients limited to keys cannot create or rotate aliases")
+	}
+
+	return nil
+}
+
+func (s *server) listAliases(w http.ResponseWriter, r *http.Request) {
+	if err := s.permit(r, PermRead); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	all, err := alias.List(s.d)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	list := AliasList{Aliases: []*alias.Alias{}}
+
+	for _, a := range all {
+		if err := s.permitAlias(r, a); err == nil {
+			list.Aliases = append(list.Aliases, a)
+		} else if _, ok := err.(*Error); !ok {
+			s.writeError(w, r, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *server) getAlias(w http.ResponseWriter, r *http.Request, name string) {
+	if err := s.permit(r, PermRead); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	a, err := alias.Must(s.d, name)
+	if err == nil {
+		err = s.permitAlias(r, a)
+	}
+
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a)
+}
+
+func (s *server) createAlias(w http.ResponseWriter, r *http.Request) {
+	var req CreateAliasRequest
+	if err := decode(w, r, &req, maxJSONRequest); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	if req.Curve == "" {
+		req.Curve = "prime256v1"
+	}
+
+	if err := alias.CheckName(req.Name); err != nil {
+		s.writeError(w, r, invalid("%v", err))
+		return
+	}
+
+	if !contains(ecdsa.KeyTypes, req.Curve) {
+		s.writeError(w, r, invalid("invalid curve: %s, usage: [%s]", req.Curve, strings.Join(ecdsa.KeyTypes, ", ")))
+		return
+	}
+
+	op := s.audited(r, audit.OpCreate, "")
+	op.Detail = fmt.Sprintf("alias %s", req.Name)
+
+	if err := s.permitAliases(r); err != nil {
+		s.respond(w, r, op, 0, nil, err)
+		return
+	}
+
+	a, err := alias.Create(s.c, s.d, req.Name, req.Curve)
+	if err != nil {
+		s.respond(w, r, op, 0, nil, err)
+		return
+	}
+
+	op.Key, op.Detail = a.Version(a.Primary).GID, fmt.Sprintf("alias %s v%d", a.Name, a.Primary)
+
+	s.respond(w, r, op, http.StatusCreated, a, nil)
+}
+
+func (s *server) rotateAlias(w http.ResponseWriter, r *http.Request, name string) {
+	op := s.audited(r, audit.OpLifecycle, "")
+	op.Detail = fmt.Sprintf("alias %s rotate", name)
+
+	if err := s.permitAliases(r); err != nil {
+		s.respond(w, r, op, 0, nil, err)
+		return
+	}
+
+	a, err := alias.Rotate(s.c, s.d, name)
+	if err != nil {
+		s.respond(w, r, op, 0, nil, err)
+		return
+	}
+
+	op.Key, op.Detail = a.Version(a.Primary).GID, fmt.Sprintf("alias %s rotated to v%d", a.Name, a.Primary)
+
+	s.respond(w, r, op, http.StatusOK, a, nil)
+}
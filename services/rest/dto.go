@@ -0,0 +1,248 @@
+package rest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/block27/core/services/dsa/ecdsa"
+	"github.com/block27/core/services/dsa/policy"
+)
+
+// Key is a key as the API shows it, never carrying private material
+type Key struct {
+	GID            string            `json:"gid"`
+	Name           string            `json:"name"`
+	Slug           string            `json:"slug"`
+	Curve          string            `json:"curve"`
+	Status         string            `json:"status"`
+	Labels         []string          `json:"labels"`
+	Tags           map[string]string `json:"tags"`
+	FingerprintSHA string            `json:"fingerprint_sha256"`
+	FingerprintMD5 string            `json:"fingerprint_md5"`
+	Policy         Policy            `json:"policy"`
+	Signatures     int               `json:"signatures"`
+	CreatedAt      time.Time         `json:"created_at"`
+}
+
+// Policy is the usage policy of a key, in requests and responses
+type Policy struct {
+	Operations    []string   `json:"operations,omitempty"`
+	NotBefore     *time.Time `json:"not_before,omitempty"`
+	NotAfter      *time.Time `json:"not_after,omitempty"`
+	MaxSignatures int        `json:"max_signatures,omitempty"`
+	Hashes        []string   `json:"hashes,omitempty"`
+}
+
+// KeyList is a page of keys, Total counting every match
+type KeyList struct {
+	Keys   []Key `json:"keys"`
+	Total  int   `json:"total"`
+	Offset int   `json:"offset"`
+	Limit  int   `json:"limit"`
+}
+
+// PublicKey is an exported public key in PEM
+type PublicKey struct {
+	GID            string `json:"gid"`
+	Curve          string `json:"curve"`
+	FingerprintSHA string `json:"fingerprint_sha256"`
+	PEM            string `json:"pem"`
+}
+
+// CreateKeyRequest is the body of POST /api/v1/keys
+type CreateKeyRequest struct {
+	Name   string            `json:"name"`
+	Curve  string            `json:"curve"`
+	Labels []string          `json:"labels,omitempty"`
+	Tags   map[string]string `json:"tags,omitempty"`
+	Policy *Policy           `json:"policy,omitempty"`
+}
+
+// RevokedToken answers POST /api/v1/tokens/{id}/revoke
+type RevokedToken struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+// ArchiveRequest is the optional body of POST /api/v1/keys/{id}/archive
+type ArchiveRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// StatusRequest is the body of POST /api/v1/keys/{id}/status. Destroying a
+// key takes the Approvals of a quorum once operators are enrolled.
+type StatusRequest struct {
+	Status    string     `json:"status"`
+	Reason    string     `json:"reason,omitempty"`
+	Approvals *Approvals `json:"approvals,omitempty"`
+}
+
+// Approvals are the consent of security officers to an action, given with
+// their PINs or as signed approval tokens
+type Approvals struct {
+	Officers []Officer         `json:"officers,omitempty"`
+	Tokens   []json.RawMessage `json:"tokens,omitempty"`
+}
+
+// Officer is a security officer approving with their PIN
+type Officer struct {
+	Name string `json:"name"`
+	Pin  string `json:"pin"`
+}
+
+// LabelRequest is the body of POST /api/v1/keys/{id}/labels
+type LabelRequest struct {
+	Add    []string `json:"add,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+}
+
+// TagRequest is the body of POST /api/v1/keys/{id}/tags
+type TagRequest struct {
+	Set   map[string]string `json:"set,omitempty"`
+	Unset []string          `json:"unset,omitempty"`
+}
+
+// BatchRequest is the body of POST /api/v1/dsa/batch, the key is named by
+// exactly one of Identifier and Alias
+type BatchRequest struct {
+	Identifier string            `json:"identifier,omitempty"`
+	Alias      string            `json:"alias,omitempty"`
+	Mode       string            `json:"mode,omitempty"`
+	Items      []ecdsa.BatchItem `json:"items"`
+}
+
+// BatchResponse holds the results of a batch in the order of its items,
+// Version is the alias version of the key when signing by alias
+type BatchResponse struct {
+	Key     string              `json:"key"`
+	Version int                 `json:"version,omitempty"`
+	Results []ecdsa.BatchResult `json:"results"`
+}
+
+// Reindexed answers POST /api/v1/dsa/reindex
+type Reindexed struct {
+	Keys int `json:"keys"`
+}
+
+// CreateAliasRequest is the body of POST /api/v1/aliases
+type CreateAliasRequest struct {
+	Name  string `json:"name"`
+	Curve string `json:"curve"`
+}
+
+// SignRequest is the body of POST /api/v1/keys/{id}/sign. Digest is hex,
+// Hash names the algorithm that produced it and Mode defaults to
+// signature.mode.
+type SignRequest struct {
+	Digest string `json:"digest"`
+	Hash   string `json:"hash"`
+	Mode   string `json:"mode,omitempty"`
+}
+
+// Signature is a base64 ASN.1 DER signature, PKCS #1 v1.5 for RSA keys, and
+// how it was made
+type Signature struct {
+	GID       string `json:"gid"`
+	Hash      string `json:"hash"`
+	Mode      string `json:"mode"`
+	Signature string `json:"signature"`
+}
+
+// VerifyRequest is the body of POST /api/v1/keys/{id}/verify
+type VerifyRequest struct {
+	Digest    string `json:"digest"`
+	Hash      string `json:"hash"`
+	Mode      string `json:"mode,omitempty"`
+	Signature string `json:"signature"`
+}
+
+// Verification is the outcome of a verify request
+type Verification struct {
+	GID   string `json:"gid"`
+	Valid bool   `json:"valid"`
+}
+
+// Health is the body of GET /api/v1/health
+type Health struct {
+	Status  string `json:"status"`
+	Version string `json:"version,omitempty"`
+	TSA     bool   `json:"tsa"`
+}
+
+// newKey copies the public fields of a stored key
+func newKey(k ecdsa.KeyAPI) Key {
+	s := k.Struct()
+
+	dto := Key{
+		GID:            k.FilePointer(),
+		Name:           s.Name,
+		Slug:           s.Slug,
+		Curve:          s.Curve(),
+		Status:         s.Status,
+		Labels:         s.Labels,
+		Tags:           s.Tags,
+		FingerprintSHA: s.FingerprintSHA,
+		FingerprintMD5: s.FingerprintMD5,
+		Policy:         newPolicy(s.Policy),
+		Signatures:     s.Signatures,
+		CreatedAt:      s.CreatedAt,
+	}
+
+	if dto.Labels == nil {
+		dto.Labels = []string{}
+	}
+
+	if dto.Tags == nil {
+		dto.Tags = map[string]string{}
+	}
+
+	return dto
+}
+
+func newPolicy(p policy.Policy) Policy {
+	dto := Policy{Operations: p.Operations, MaxSignatures: p.MaxSignatures, Hashes: p.Hashes}
+
+	if !p.NotBefore.IsZero() {
+		dto.NotBefore = &p.NotBefore
+	}
+
+	if !p.NotAfter.IsZero() {
+		dto.NotAfter = &p.NotAfter
+	}
+
+	return dto
+}
+
+// policy validates a requested policy
+func (p *Policy) policy() (policy.Policy, error) {
+	if p == nil {
+		return policy.Policy{}, nil
+	}
+
+	var notBefore, notAfter time.Time
+	if p.NotBefore != nil {
+		notBefore = *p.NotBefore
+	}
+
+	if p.NotAfter != nil {
+		notAfter = *p.NotAfter
+	}
+
+	return policy.New(p.Operations, notBefore, notAfter, p.MaxSignatures, p.Hashes)
+}
+
+func newPublicKey(k ecdsa.KeyAPI) (PublicKey, error) {
+	pem, err := base64.StdEncoding.DecodeString(k.Struct().PublicKeyB64)
+	if err != nil {
+		return PublicKey{}, err
+	}
+
+	return PublicKey{
+		GID:            k.FilePointer(),
+		Curve:          k.Struct().Curve(),
+		FingerprintSHA: k.Struct().FingerprintSHA,
+		PEM:            string(pem),
+	}, nil
+}
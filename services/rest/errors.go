@@ -0,0 +1,128 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	eer "github.com/block27/core/services/dsa/errors"
+)
+
+// Error codes, stable identifiers clients can branch on
+const (
+	CodeInvalidRequest   = "invalid_request"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeAmbiguous        = "ambiguous_reference"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeConflict         = "conflict"
+	CodeKeyState         = "key_state"
+	CodePolicy           = "policy_violation"
+	CodeTooLarge         = "request_too_large"
+	CodeUnsupportedMedia = "unsupported_media_type"
+	CodeUnavailable      = "unavailable"
+	CodeRateLimited      = "rate_limited"
+	CodeQuotaExceeded    = "quota_exceeded"
+	CodeIntegrity        = "integrity_failure"
+	CodeInternal         = "internal_error"
+)
+
+// Error is the body of every failed request. RetryAfter, in seconds, is
+// also sent as the Retry-After header.
+type Error struct {
+	Status     int    `json:"-"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// errorBody wraps Error, leaving room beside it for details later
+type errorBody struct {
+	Error *Error `json:"error"`
+}
+
+// ansi matches the colour escapes helpers adds to messages meant for a
+// terminal
+var ansi = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// NewError returns an API error, for handlers wrapping the server
+func NewError(status int, code string, format string, args ...interface{}) *Error {
+	return newError(status, code, format, args...)
+}
+
+// WriteError sends an API error as JSON
+func WriteError(w http.ResponseWriter, e *Error) {
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(e.RetryAfter))
+	}
+
+	writeJSON(w, e.Status, errorBody{Error: e})
+}
+
+func newError(status int, code string, format string, args ...interface{}) *Error {
+	return &Error{Status: status, Code: code, Message: ansi.ReplaceAllString(fmt.Sprintf(format, args...), "")}
+}
+
+// methodNotAllowed answers a method the route does not serve
+func (s *server) methodNotAllowed(w http.ResponseWriter, r *http.Request, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	s.writeError(w, r, newError(http.StatusMethodNotAllowed, CodeMethodNotAllowed, "%s not allowed", r.Method))
+}
+
+func invalid(format string, args ...interface{}) *Error {
+	return newError(http.StatusBadRequest, CodeInvalidRequest, format, args...)
+}
+
+// classify maps errors of the key services to API errors, anything unknown
+// is internal and its message is not shown to the client
+func classify(err error) *Error {
+	switch e := err.(type) {
+	case *Error:
+		return e
+	case *eer.KeyPath:
+		return newError(http.StatusNotFound, CodeNotFound, "%s", e.Message)
+	case *eer.KeyAmbiguous:
+		return newError(http.StatusBadRequest, CodeAmbiguous, "%s", e.Message)
+	case *eer.KeyConflict:
+		return newError(http.StatusConflict, CodeConflict, "%s", e.Message)
+	case *eer.KeyStatus:
+		return newError(http.StatusConflict, CodeKeyState, "%s", e.Message)
+	case *eer.KeyPolicy:
+		return newError(http.StatusForbidden, CodePolicy, "%s", e.Message)
+	case *eer.KeyIntegrity:
+		return newError(http.StatusInternalServerError, CodeIntegrity, "%s", e.Message)
+	}
+
+	return newError(http.StatusInternalServerError, CodeInternal, "internal error")
+}
+
+// writeError sends err as JSON, logging those the client is not told about
+func (s *server) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	e := classify(err)
+	if e.Status >= http.StatusInternalServerError {
+		s.b.L.Errorf("%s %s: %v", r.Method, r.URL.Path, err)
+	}
+
+	WriteError(w, e)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		data = []byte(`{"error":{"code":"internal_error","message":"internal error"}}`)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(data)
+}
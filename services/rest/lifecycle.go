@@ -0,0 +1,152 @@
+package rest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/block27/core/services/audit"
+	api "github.com/block27/core/services/dsa"
+)
+
+// Quorum checks the approvals of security officers for handlers holding the
+// operators in front of the server. Destroy answers an *Error of status 403
+// when the approvals fall short of destroying the key gid.
+type Quorum interface {
+	Destroy(gid string, a Approvals) error
+}
+
+const quorumKey contextKey = 4
+
+// WithQuorum checks the key destructions of a request with q, keys cannot be
+// destroyed through requests without one
+func WithQuorum(r *http.Request, q Quorum) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), quorumKey, q))
+}
+
+// statuses are the states a request may move a key to
+var statuses = []string{api.StatusActive, api.StatusArchived, api.StatusCompromised, api.StatusDestroyed}
+
+func (s *server) status(w http.ResponseWriter, r *http.Request, ref string) {
+	var req StatusRequest
+	if err := decode(w, r, &req, maxJSONRequest); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	if !contains(statuses, req.Status) {
+		s.writeError(w, r, invalid("invalid status: %s, usage: [%s]", req.Status, strings.Join(statuses, ", ")))
+		return
+	}
+
+	if req.Reason == "" {
+		req.Reason = "changed through the API"
+	}
+
+	s.setStatus(w, r, ref, req)
+}
+
+// setStatus applies a lifecycle transition, once the quorum of the request
+// approves when it destroys the key
+func (s *server) setStatus(w http.ResponseWriter, r *http.Request, ref string, req StatusRequest) {
+	op := s.audited(r, audit.OpLifecycle, ref)
+
+	key, err := s.resolve(r, ref, PermArchive)
+	if err != nil {
+		s.respond(w, r, op, 0, nil, err)
+		return
+	}
+
+	from := key.Struct().Status
+	op.Key, op.Detail = key.FilePointer(), fmt.Sprintf("%s -> %s: %s", from, req.Status, req.Reason)
+
+	if err := api.CheckTransition(from, req.Status); err != nil {
+		s.respond(w, r, op, 0, nil, newError(http.StatusConflict, CodeKeyState, "%v", err))
+		return
+	}
+
+	if req.Status == api.StatusDestroyed {
+		q, _ := r.Context().Value(quorumKey).(Quorum)
+		if q == nil {
+			s.respond(w, r, op, 0, nil, newError(http.StatusForbidden, CodeForbidden, "keys cannot be destroyed through this API"))
+			return
+		}
+
+		var a Approvals
+		if req.Approvals != nil {
+			a = *req.Approvals
+		}
+
+		if err := q.Destroy(key.FilePointer(), a); err != nil {
+			s.respond(w, r, op, 0, nil, err)
+			return
+		}
+	}
+
+	if err := key.SetStatus(s.c, req.Status, req.Reason); err != nil {
+		s.respond(w, r, op, 0, nil, err)
+		return
+	}
+
+	s.respond(w, r, op, http.StatusOK, newKey(key), nil)
+}
+
+func (s *server) labels(w http.ResponseWriter, r *http.Request, ref string) {
+	var req LabelRequest
+	if err := decode(w, r, &req, maxJSONRequest); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	for _, l := range append(req.Add, req.Remove...) {
+		if strings.TrimSpace(l) == "" {
+			s.writeError(w, r, invalid("labels cannot be empty"))
+			return
+		}
+	}
+
+	key, err := s.resolve(r, ref, PermCreate)
+	if err == nil {
+		err = key.Label(s.c, req.Add, req.Remove)
+	}
+
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newKey(key))
+}
+
+func (s *server) tags(w http.ResponseWriter, r *http.Request, ref string) {
+	var req TagRequest
+	if err := decode(w, r, &req, maxJSONRequest); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	names := req.Unset
+	for name := range req.Set {
+		names = append(names, name)
+	}
+
+	for _, name := range names {
+		if strings.TrimSpace(name) == "" || strings.Contains(name, "=") {
+			s.writeError(w, r, invalid("invalid tag name: %q", name))
+			return
+		}
+	}
+
+	key, err := s.resolve(r, ref, PermCreate)
+	if err == nil {
+		err = key.Tag(s.c, req.Set, req.Unset)
+	}
+
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newKey(key))
+}
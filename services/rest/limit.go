@@ -0,0 +1,39 @@
+package rest
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/block27/core/services/dsa/ecdsa"
+)
+
+// Limiter meters signatures by key for handlers rate limiting clients in
+// front of the server. Take answers an *Error of status 429 once the key
+// has run out, 413 when n is more than its budget ever holds.
+type Limiter interface {
+	Take(subject string, n int) error
+}
+
+const limiterKey contextKey = 2
+
+// WithLimiter meters the signatures of a request with l
+func WithLimiter(r *http.Request, l Limiter) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), limiterKey, l))
+}
+
+// ActorOf returns the client WithActor or WithScope named, empty when none
+func ActorOf(r *http.Request) string {
+	actor, _ := r.Context().Value(actorKey).(string)
+	return actor
+}
+
+// limit takes n signatures from the key's budget, when the request is
+// metered
+func (s *server) limit(r *http.Request, key ecdsa.KeyAPI, n int) error {
+	l, _ := r.Context().Value(limiterKey).(Limiter)
+	if l == nil {
+		return nil
+	}
+
+	return l.Take("key:"+key.FilePointer(), n)
+}
@@ -0,0 +1,102 @@
+package rest
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/block27/core/services/dsa/alias"
+	"github.com/block27/core/services/dsa/ecdsa"
+)
+
+// Permissions a Scope grants
+const (
+	PermRead      = "read"      // list and get keys, export public keys
+	PermCreate    = "create"    // create keys and aliases, label, tag and reindex keys
+	PermArchive   = "archive"   // archive keys, or move them to any other status
+	PermSign      = "sign"      // sign digests, one at a time or in batches
+	PermVerify    = "verify"    // verify signatures
+	PermTimestamp = "timestamp" // time-stamp through the TSA
+	PermTokens    = "tokens"    // revoke API tokens, security officers only
+)
+
+// Permissions lists every permission a token can be minted with, PermTokens
+// is left to security officers
+var Permissions = []string{PermRead, PermCreate, PermArchive, PermSign, PermVerify, PermTimestamp}
+
+// Scope is what an authenticated client may do. Keys restrict the key routes
+// to the keys named, by anything `dsa get -i` accepts or an alias covering
+// every version; clients limited to keys cannot create new ones.
+type Scope struct {
+	Actor       string   // names the client in audit entries
+	Permissions []string // see Perm*
+	Keys        []string // any key when empty
+}
+
+const scopeKey contextKey = 1
+
+// WithScope limits a request to the scope, requests without one are
+// unrestricted
+func WithScope(r *http.Request, s *Scope) *http.Request {
+	if s.Actor != "" {
+		r = WithActor(r, s.Actor)
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), scopeKey, s))
+}
+
+func scopeOf(r *http.Request) *Scope {
+	s, _ := r.Context().Value(scopeKey).(*Scope)
+	return s
+}
+
+// permit checks the request's scope grants the permission
+func (s *server) permit(r *http.Request, perm string) error {
+	sc := scopeOf(r)
+	if sc == nil || contains(sc.Permissions, perm) {
+		return nil
+	}
+
+	return newError(http.StatusForbidden, CodeForbidden, "%s is not permitted", perm)
+}
+
+// permitKey checks the request's scope covers the key
+func (s *server) permitKey(r *http.Request, key ecdsa.KeyAPI) error {
+	gids, err := s.scopedKeys(r)
+	if err != nil || gids == nil || contains(gids, key.FilePointer()) {
+		return err
+	}
+
+	return newError(http.StatusForbidden, CodeForbidden, "key %s is not permitted", key.FilePointer())
+}
+
+// scopedKeys resolves the keys of the request's scope to GIDs, nil when
+// any key is allowed. Names that no longer resolve are skipped.
+func (s *server) scopedKeys(r *http.Request) ([]string, error) {
+	sc := scopeOf(r)
+	if sc == nil || len(sc.Keys) == 0 {
+		return nil, nil
+	}
+
+	gids := []string{}
+
+	for _, ref := range sc.Keys {
+		a, err := alias.Get(s.d, ref)
+		if err != nil {
+			return nil, err
+		}
+
+		if a != nil {
+			for _, v := range a.Versions {
+				gids = append(gids, v.GID)
+			}
+
+			continue
+		}
+
+		if key, err := ecdsa.ResolveECDSA(s.c, ref); err == nil {
+			gids = append(gids, key.FilePointer())
+		}
+	}
+
+	return gids, nil
+}
@@ -0,0 +1,848 @@
+package rest
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/block27/core/backend"
+	"github.com/block27/core/config"
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/services/audit"
+	"github.com/block27/core/services/bbolt"
+	api "github.com/block27/core/services/dsa"
+	"github.com/block27/core/services/dsa/alias"
+	"github.com/block27/core/services/dsa/ecdsa"
+	"github.com/block27/core/services/dsa/policy"
+	sig "github.com/block27/core/services/dsa/signature"
+	"github.com/block27/core/services/tsa"
+)
+
+// Request body limits
+const (
+	// maxJSONRequest bounds the body of single key requests
+	maxJSONRequest = 64 << 10
+
+	// maxBatchRequest bounds the JSON body of a batch signing request
+	maxBatchRequest = 8 << 20
+
+	// maxTSARequest bounds the size of a TimeStampReq body, real requests
+	// are a few hundred bytes at most
+	maxTSARequest = 16 << 10
+)
+
+// Prefix every route lives under
+const Prefix = "/api/v1"
+
+// Route groups, each with access lists of its own
+const (
+	GroupAdmin  = "admin"  // creates and archives keys, revokes tokens
+	GroupCrypto = "crypto" // every other route
+)
+
+type server struct {
+	b   *backend.Backend
+	c   config.Reader
+	d   bbolt.Datastore
+	t   tsa.TimestampAPI
+	mux *http.ServeMux
+}
+
+// NewServer returns the versioned REST API over the backend's keys. The
+// time-stamping authority is optional, its route answers 503 when t is nil.
+//
+//	GET  /api/v1/health
+//	GET  /api/v1/keys                   list, filtered and paged
+//	POST /api/v1/keys                   create
+//	GET  /api/v1/keys/{id}
+//	POST /api/v1/keys/{id}/archive
+//	POST /api/v1/keys/{id}/status       destroying needs a quorum
+//	POST /api/v1/keys/{id}/labels
+//	POST /api/v1/keys/{id}/tags
+//	POST /api/v1/keys/{id}/sign
+//	POST /api/v1/keys/{id}/verify
+//	GET  /api/v1/keys/{id}/public
+//	POST /api/v1/dsa/batch
+//	POST /api/v1/dsa/reindex
+//	GET  /api/v1/aliases
+//	POST /api/v1/aliases                create
+//	GET  /api/v1/aliases/{name}
+//	POST /api/v1/aliases/{name}/rotate
+//	POST /api/v1/tsa
+//	POST /api/v1/tokens/{id}/revoke     security officers only
+//
+// {id} is anything `dsa get -i` accepts. Errors are JSON bodies holding a
+// code and a message.
+func NewServer(b *backend.Backend, t tsa.TimestampAPI) http.Handler {
+	s := &server{b: b, c: *b.C, d: b.D, t: t, mux: http.NewServeMux()}
+
+	s.mux.HandleFunc(Prefix+"/health", s.health)
+	s.mux.HandleFunc(Prefix+"/keys", s.keys)
+	s.mux.HandleFunc(Prefix+"/keys/", s.key)
+	s.mux.HandleFunc(Prefix+"/dsa/batch", s.batch)
+	s.mux.HandleFunc(Prefix+"/dsa/reindex", s.reindex)
+	s.mux.HandleFunc(Prefix+"/aliases", s.aliases)
+	s.mux.HandleFunc(Prefix+"/aliases/", s.alias)
+	s.mux.HandleFunc(Prefix+"/tsa", s.tsaReply)
+	s.mux.HandleFunc(Prefix+"/tokens/", s.token)
+	s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		s.writeError(w, r, newError(http.StatusNotFound, CodeNotFound, "no route %s", r.URL.Path))
+	})
+
+	return s
+}
+
+// ServeHTTP answers panics with an internal error instead of dropping the
+// connection
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			s.writeError(w, r, fmt.Errorf("panic: %v", rec))
+		}
+	}()
+
+	s.mux.ServeHTTP(w, r)
+}
+
+// operation is the audit entry of a request, see respond
+type operation struct {
+	audit.Entry
+}
+
+type contextKey int
+
+const actorKey contextKey = 0
+
+// WithActor names the client of a request in its audit entries, for
+// handlers authenticating clients in front of the server
+func WithActor(r *http.Request, actor string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), actorKey, actor))
+}
+
+// audited starts the audit entry of a request, the actor is the client
+// address unless WithActor named it
+func (s *server) audited(r *http.Request, op string, key string) *operation {
+	actor := ActorOf(r)
+	if actor == "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+
+		actor = "api@" + host
+	}
+
+	return &operation{Entry: audit.Entry{Op: op, Key: key, Actor: actor}}
+}
+
+// respond records the operation, failed with the reason if err is set, then
+// writes body or the error. An operation that cannot be recorded fails.
+func (s *server) respond(w http.ResponseWriter, r *http.Request, op *operation, status int, body interface{}, err error) {
+	if op != nil {
+		if err != nil {
+			op.Result = audit.ResultFailed
+
+			if op.Detail == "" {
+				op.Detail = classify(err).Message
+			} else {
+				op.Detail = fmt.Sprintf("%s: %s", op.Detail, classify(err).Message)
+			}
+		}
+
+		if _, aerr := audit.NewLog(s.c, s.d).Append(op.Entry); aerr != nil && err == nil {
+			err = fmt.Errorf("audit log unavailable: %v", aerr)
+		}
+	}
+
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, status, body)
+}
+
+// decode reads a JSON body into v, refusing unknown fields, other media
+// types and bodies over max bytes
+func decode(w http.ResponseWriter, r *http.Request, v interface{}, max int64) error {
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		if mt, _, err := mime.ParseMediaType(ct); err != nil || mt != "application/json" {
+			return newError(http.StatusUnsupportedMediaType, CodeUnsupportedMedia, "expected application/json")
+		}
+	}
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, max))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(v); err != nil {
+		if strings.Contains(err.Error(), "request body too large") {
+			return newError(http.StatusRequestEntityTooLarge, CodeTooLarge, "request exceeds %d bytes", max)
+		}
+
+		return invalid("malformed JSON body: %v", err)
+	}
+
+	if dec.More() {
+		return invalid("malformed JSON body: trailing data")
+	}
+
+	return nil
+}
+
+func (s *server) health(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	if err := s.d.Read(func(tx bbolt.Tx) error { return nil }); err != nil {
+		s.writeError(w, r, newError(http.StatusServiceUnavailable, CodeUnavailable, "datastore unavailable"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Health{Status: "ok", TSA: s.t != nil})
+}
+
+// Group returns the route group of a request, from the groups of the routes
+// below
+func Group(r *http.Request) string {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+
+	switch {
+	case path == Prefix+"/keys":
+		if g, ok := keysGroups[r.Method]; ok {
+			return g
+		}
+	case strings.HasPrefix(path, Prefix+"/keys/"):
+		parts := strings.SplitN(strings.TrimPrefix(path, Prefix+"/keys/"), "/", 2)
+		if len(parts) == 2 {
+			if route, ok := keyRoutes[parts[1]]; ok {
+				return route.group
+			}
+		}
+	case path == Prefix+"/aliases":
+		if g, ok := keysGroups[r.Method]; ok {
+			return g
+		}
+	case strings.HasPrefix(path, Prefix+"/aliases/"):
+		if strings.HasSuffix(path, "/rotate") {
+			return GroupAdmin
+		}
+	case path == Prefix+"/dsa/reindex", strings.HasPrefix(path, Prefix+"/tokens/"):
+		return GroupAdmin
+	}
+
+	return GroupCrypto
+}
+
+// keysGroups are the groups of the methods of the key and alias collections
+var keysGroups = map[string]string{
+	http.MethodGet:  GroupCrypto,
+	http.MethodPost: GroupAdmin,
+}
+
+// keys serves the collection
+func (s *server) keys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.list(w, r)
+	case http.MethodPost:
+		s.create(w, r)
+	default:
+		s.methodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+	}
+}
+
+// keyRoutes are the actions of a single key, with their group
+var keyRoutes = map[string]struct {
+	method string
+	group  string
+	fn     func(*server, http.ResponseWriter, *http.Request, string)
+}{
+	"":        {http.MethodGet, GroupCrypto, (*server).get},
+	"archive": {http.MethodPost, GroupAdmin, (*server).archive},
+	"status":  {http.MethodPost, GroupAdmin, (*server).status},
+	"labels":  {http.MethodPost, GroupAdmin, (*server).labels},
+	"tags":    {http.MethodPost, GroupAdmin, (*server).tags},
+	"sign":    {http.MethodPost, GroupCrypto, (*server).sign},
+	"verify":  {http.MethodPost, GroupCrypto, (*server).verify},
+	"public":  {http.MethodGet, GroupCrypto, (*server).public},
+}
+
+// key serves a single key and its actions
+func (s *server) key(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, Prefix+"/keys/"), "/", 2)
+
+	ref, action := parts[0], ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+
+	if ref == "" {
+		s.writeError(w, r, invalid("missing key identifier"))
+		return
+	}
+
+	route, ok := keyRoutes[action]
+	if !ok {
+		s.writeError(w, r, newError(http.StatusNotFound, CodeNotFound, "no route %s", r.URL.Path))
+		return
+	}
+
+	if r.Method != route.method {
+		s.methodNotAllowed(w, r, route.method)
+		return
+	}
+
+	route.fn(s, w, r, ref)
+}
+
+// listOptions reads the filters, sort and page of GET /api/v1/keys, e.g.
+// ?status=active&tag=env=prod&sort=name&order=desc&offset=20&limit=10
+func (s *server) listOptions(r *http.Request) (ecdsa.ListOptions, error) {
+	q := r.URL.Query()
+
+	o := ecdsa.ListOptions{
+		Name:        q.Get("name"),
+		Slug:        q.Get("slug"),
+		Curve:       q.Get("curve"),
+		Status:      q.Get("status"),
+		Label:       q.Get("label"),
+		Fingerprint: q.Get("fingerprint"),
+		Sort:        q.Get("sort"),
+		Desc:        q.Get("order") == "desc",
+		Limit:       s.c.GetInt("api.page_size"),
+	}
+
+	if order := q.Get("order"); order != "" && order != "asc" && order != "desc" {
+		return o, invalid("invalid order: %s, usage: [asc, desc]", order)
+	}
+
+	if sorts := []string{ecdsa.SortCreated, ecdsa.SortName, ecdsa.SortStatus, ecdsa.SortCurve}; o.Sort != "" && !contains(sorts, o.Sort) {
+		return o, invalid("invalid sort: %s, usage: [%s]", o.Sort, strings.Join(sorts, ", "))
+	}
+
+	var err error
+
+	if o.Tags, err = ecdsa.ParseTags(q["tag"]); err != nil {
+		return o, invalid("%v", err)
+	}
+
+	if o.CreatedAfter, err = policy.ParseTime(q.Get("created_after")); err != nil {
+		return o, invalid("%v", err)
+	}
+
+	if o.CreatedBefore, err = policy.ParseTime(q.Get("created_before")); err != nil {
+		return o, invalid("%v", err)
+	}
+
+	for name, dst := range map[string]*int{"offset": &o.Offset, "limit": &o.Limit} {
+		if v := q.Get(name); v != "" {
+			if *dst, err = strconv.Atoi(v); err != nil || *dst < 0 {
+				return o, invalid("invalid %s: %s", name, v)
+			}
+		}
+	}
+
+	if max := s.c.GetInt("api.max_page_size"); o.Limit == 0 || o.Limit > max {
+		return o, invalid("limit must be 1 to %d", max)
+	}
+
+	return o, nil
+}
+
+func (s *server) list(w http.ResponseWriter, r *http.Request) {
+	if err := s.permit(r, PermRead); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	o, err := s.listOptions(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	if o.GIDs, err = s.scopedKeys(r); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	keys, total, err := ecdsa.ListECDSAWith(s.c, o)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	page := KeyList{Keys: []Key{}, Total: total, Offset: o.Offset, Limit: o.Limit}
+	for _, k := range keys {
+		page.Keys = append(page.Keys, newKey(k))
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (s *server) create(w http.ResponseWriter, r *http.Request) {
+	var req CreateKeyRequest
+	if err := decode(w, r, &req, maxJSONRequest); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	if req.Curve == "" {
+		req.Curve = "prime256v1"
+	}
+
+	if err := validateCreate(req); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	p, err := req.Policy.policy()
+	if err != nil {
+		s.writeError(w, r, invalid("%v", err))
+		return
+	}
+
+	op := s.audited(r, audit.OpCreate, "")
+	op.Detail = fmt.Sprintf("%s %s", req.Name, req.Curve)
+
+	if err := s.permit(r, PermCreate); err != nil {
+		s.respond(w, r, op, 0, nil, err)
+		return
+	}
+
+	if sc := scopeOf(r); sc != nil && len(sc.Keys) > 0 {
+		s.respond(w, r, op, 0, nil, newError(http.StatusForbidden, CodeForbidden, "clients limited to keys cannot create keys"))
+		return
+	}
+
+	key, err := ecdsa.NewECDSAWithPolicy(s.c, req.Name, req.Curve, p)
+	if err == nil {
+		op.Key = key.FilePointer()
+
+		if len(req.Labels) > 0 {
+			err = key.Label(s.c, req.Labels, nil)
+		}
+
+		if err == nil && len(req.Tags) > 0 {
+			err = key.Tag(s.c, req.Tags, nil)
+		}
+	}
+
+	if err != nil {
+		s.respond(w, r, op, 0, nil, err)
+		return
+	}
+
+	s.respond(w, r, op, http.StatusCreated, newKey(key), nil)
+}
+
+func validateCreate(req CreateKeyRequest) error {
+	if strings.TrimSpace(req.Name) == "" || len(req.Name) > 128 {
+		return invalid("name must be 1 to 128 characters")
+	}
+
+	if !contains(ecdsa.KeyTypes, req.Curve) {
+		return invalid("invalid curve: %s, usage: [%s]", req.Curve, strings.Join(ecdsa.KeyTypes, ", "))
+	}
+
+	for _, l := range req.Labels {
+		if strings.TrimSpace(l) == "" {
+			return invalid("labels cannot be empty")
+		}
+	}
+
+	for name := range req.Tags {
+		if strings.TrimSpace(name) == "" || strings.Contains(name, "=") {
+			return invalid("invalid tag name: %q", name)
+		}
+	}
+
+	return nil
+}
+
+// resolve loads a key once the request's scope permits the operation on it
+func (s *server) resolve(r *http.Request, ref string, perm string) (ecdsa.KeyAPI, error) {
+	if err := s.permit(r, perm); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.ResolveECDSA(s.c, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, s.permitKey(r, key)
+}
+
+func (s *server) get(w http.ResponseWriter, r *http.Request, ref string) {
+	if err := s.permit(r, PermRead); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	key, err := ecdsa.ResolveECDSA(s.c, ref)
+	if err == nil {
+		err = s.permitKey(r, key)
+	}
+
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newKey(key))
+}
+
+func (s *server) archive(w http.ResponseWriter, r *http.Request, ref string) {
+	var req ArchiveRequest
+	if r.ContentLength != 0 {
+		if err := decode(w, r, &req, maxJSONRequest); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+	}
+
+	if req.Reason == "" {
+		req.Reason = "archived through the API"
+	}
+
+	s.setStatus(w, r, ref, StatusRequest{Status: api.StatusArchived, Reason: req.Reason})
+}
+
+func (s *server) sign(w http.ResponseWriter, r *http.Request, ref string) {
+	var req SignRequest
+	if err := decode(w, r, &req, maxJSONRequest); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	if req.Mode == "" {
+		req.Mode = s.c.GetString("signature.mode")
+	}
+
+	if err := validateDigest(req.Digest, req.Hash, req.Mode); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	op := s.audited(r, audit.OpSign, ref)
+	op.Detail = fmt.Sprintf("%s digest %.16s", req.Hash, req.Digest)
+
+	key, err := s.resolve(r, ref, PermSign)
+	if err != nil {
+		s.respond(w, r, op, 0, nil, err)
+		return
+	}
+
+	op.Key = key.FilePointer()
+
+	if err := s.limit(r, key, 1); err != nil {
+		s.respond(w, r, op, 0, nil, err)
+		return
+	}
+
+	bits, err := key.BitSize()
+	if err == nil {
+		if herr := crypto.CheckHashStrength(req.Hash, bits); herr != nil {
+			err = invalid("%v", herr)
+		} else if merr := ecdsa.CheckMode(key.Struct().Curve(), req.Mode); merr != nil {
+			err = invalid("%v", merr)
+		} else if kerr := ecdsa.CheckHash(key.Struct().Curve(), req.Hash); kerr != nil {
+			err = invalid("%v", kerr)
+		}
+	}
+
+	if err != nil {
+		s.respond(w, r, op, 0, nil, err)
+		return
+	}
+
+	der, err := ecdsa.SignDigest(key, ecdsa.BatchItem{Digest: req.Digest, Hash: req.Hash}, req.Mode)
+	if err != nil {
+		s.respond(w, r, op, 0, nil, err)
+		return
+	}
+
+	s.respond(w, r, op, http.StatusOK, Signature{
+		GID:       key.FilePointer(),
+		Hash:      req.Hash,
+		Mode:      req.Mode,
+		Signature: base64.StdEncoding.EncodeToString(der),
+	}, nil)
+}
+
+func (s *server) verify(w http.ResponseWriter, r *http.Request, ref string) {
+	var req VerifyRequest
+	if err := decode(w, r, &req, maxJSONRequest); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	if req.Mode == "" {
+		req.Mode = s.c.GetString("signature.mode")
+	}
+
+	if err := validateDigest(req.Digest, req.Hash, req.Mode); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	der, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil || len(der) == 0 {
+		s.writeError(w, r, invalid("signature must be base64"))
+		return
+	}
+
+	op := s.audited(r, audit.OpVerify, ref)
+
+	key, err := s.resolve(r, ref, PermVerify)
+	if err != nil {
+		s.respond(w, r, op, 0, nil, err)
+		return
+	}
+
+	op.Key = key.FilePointer()
+
+	valid, err := ecdsa.VerifyDigest(key, ecdsa.BatchItem{Digest: req.Digest, Hash: req.Hash}, req.Mode, der)
+	if err != nil {
+		s.respond(w, r, op, 0, nil, invalid("%v", err))
+		return
+	}
+
+	if op.Detail = "verified"; !valid {
+		op.Result, op.Detail = audit.ResultFailed, "does not verify"
+	}
+
+	s.respond(w, r, op, http.StatusOK, Verification{GID: key.FilePointer(), Valid: valid}, nil)
+}
+
+func (s *server) public(w http.ResponseWriter, r *http.Request, ref string) {
+	op := s.audited(r, audit.OpExport, ref)
+	op.Detail = "public key"
+
+	key, err := s.resolve(r, ref, PermRead)
+	if err != nil {
+		s.respond(w, r, op, 0, nil, err)
+		return
+	}
+
+	op.Key = key.FilePointer()
+
+	if err := key.Authorize(policy.OpExport, ""); err != nil {
+		s.respond(w, r, op, 0, nil, err)
+		return
+	}
+
+	pub, err := newPublicKey(key)
+	s.respond(w, r, op, http.StatusOK, pub, err)
+}
+
+func (s *server) batch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+
+	var req BatchRequest
+	if err := decode(w, r, &req, maxBatchRequest); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	if (req.Identifier == "") == (req.Alias == "") {
+		s.writeError(w, r, invalid("pass exactly one of identifier or alias"))
+		return
+	}
+
+	if max := s.c.GetInt("batch.max_items"); len(req.Items) > max {
+		s.writeError(w, r, newError(http.StatusRequestEntityTooLarge, CodeTooLarge, "batch exceeds %d items", max))
+		return
+	}
+
+	op := s.audited(r, audit.OpSign, req.Identifier+req.Alias)
+
+	var key ecdsa.KeyAPI
+	var version int
+
+	err := s.permit(r, PermSign)
+	if err == nil {
+		if req.Alias != "" {
+			key, version, err = alias.PrimaryKey(s.c, s.d, req.Alias)
+		} else {
+			key, err = ecdsa.ResolveECDSA(s.c, req.Identifier)
+		}
+	}
+
+	if err == nil {
+		err = s.permitKey(r, key)
+	}
+
+	if err != nil {
+		s.respond(w, r, op, 0, nil, err)
+		return
+	}
+
+	op.Key = key.FilePointer()
+
+	if err := s.limit(r, key, len(req.Items)); err != nil {
+		s.respond(w, r, op, 0, nil, err)
+		return
+	}
+
+	mode := req.Mode
+	if mode == "" {
+		mode = s.c.GetString("signature.mode")
+	}
+
+	if err := ecdsa.CheckMode(key.Struct().Curve(), mode); err != nil {
+		s.respond(w, r, op, 0, nil, invalid("%v", err))
+		return
+	}
+
+	results, err := ecdsa.SignBatch(key, req.Items, mode, s.c.GetInt("batch.workers"))
+	if err != nil {
+		s.respond(w, r, op, 0, nil, err)
+		return
+	}
+
+	signed := 0
+	for _, res := range results {
+		if res.Error == "" {
+			signed++
+		}
+	}
+
+	op.Detail = fmt.Sprintf("batch of %d, %d signed", len(results), signed)
+
+	s.respond(w, r, op, http.StatusOK, BatchResponse{Key: key.FilePointer(), Version: version, Results: results}, nil)
+}
+
+// reindex rebuilds the key lookup index, clients limited to keys cannot
+func (s *server) reindex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+
+	err := s.permit(r, PermCreate)
+	if sc := scopeOf(r); err == nil && sc != nil && len(sc.Keys) > 0 {
+		err = newError(http.StatusForbidden, CodeForbidden, "clients limited to keys cannot reindex")
+	}
+
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	n, err := ecdsa.RebuildIndex(s.c)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Reindexed{Keys: n})
+}
+
+func (s *server) tsaReply(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+
+	if s.t == nil {
+		s.writeError(w, r, newError(http.StatusServiceUnavailable, CodeUnavailable, "tsa is not configured"))
+		return
+	}
+
+	ct, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || ct != tsa.ContentTypeQuery {
+		s.writeError(w, r, newError(http.StatusUnsupportedMediaType, CodeUnsupportedMedia, "expected %s", tsa.ContentTypeQuery))
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxTSARequest+1))
+	if err != nil {
+		s.writeError(w, r, invalid("%v", err))
+		return
+	}
+
+	if len(body) > maxTSARequest {
+		s.writeError(w, r, newError(http.StatusRequestEntityTooLarge, CodeTooLarge, "request exceeds %d bytes", maxTSARequest))
+		return
+	}
+
+	op := s.audited(r, audit.OpSign, "")
+	op.Detail = "tsa reply"
+
+	var resp []byte
+
+	err = s.permit(r, PermTimestamp)
+	if err == nil {
+		resp, err = s.t.Respond(body)
+	}
+
+	if err != nil {
+		op.Result, op.Detail = audit.ResultFailed, fmt.Sprintf("%s: %v", op.Detail, err)
+	}
+
+	if _, aerr := audit.NewLog(s.c, s.d).Append(op.Entry); aerr != nil && err == nil {
+		err = fmt.Errorf("audit log unavailable: %v", aerr)
+	}
+
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", tsa.ContentTypeReply)
+	w.Write(resp)
+}
+
+// validateDigest checks a hex digest has the length of its hash and the
+// signature mode is known
+func validateDigest(digest string, hash string, mode string) error {
+	if digest == "" || hash == "" {
+		return invalid("digest and hash are required")
+	}
+
+	d, err := hex.DecodeString(digest)
+	if err != nil {
+		return invalid("digest must be hex")
+	}
+
+	h, err := crypto.NewHash(hash)
+	if err != nil {
+		return invalid("%v", err)
+	}
+
+	if len(d) != h.Size() {
+		return invalid("digest length %d does not match %s", len(d), hash)
+	}
+
+	if _, err := sig.Payload(d, mode); err != nil {
+		return invalid("%v", err)
+	}
+
+	return nil
+}
+
+func contains(values []string, v string) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+
+	return false
+}
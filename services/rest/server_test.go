@@ -0,0 +1,489 @@
+package rest
+
+import (
+	"bytes"
+	gocrypto "crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/block27/core/backend"
+	"github.com/block27/core/config"
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/services/audit"
+	"github.com/block27/core/services/bbolt"
+	"github.com/block27/core/services/keystore"
+	"github.com/block27/core/test"
+)
+
+var Config config.Reader
+
+func init() {
+	os.Setenv("ENVIRONMENT", "test")
+
+	c, err := config.LoadConfig(config.Defaults)
+	if err != nil {
+		panic(err)
+	}
+
+	if c.GetString("environment") != "test" {
+		panic(fmt.Errorf("test [environment] is not in [test] mode"))
+	}
+
+	// Stands in for HardwareAuthenticate, which needs the device attached
+	if err := crypto.LoadMasterKey([]byte(test.MasterKey), []byte(test.MasterIv)); err != nil {
+		panic(err)
+	}
+
+	Config = c
+}
+
+// deviceReader keeps the keystore under a directory of its own
+type deviceReader struct {
+	config.Reader
+	keys string
+}
+
+func (d deviceReader) GetString(key string) string {
+	switch key {
+	case "keystore.backend":
+		return keystore.FS
+	case "paths.keys":
+		return d.keys
+	}
+
+	return d.Reader.GetString(key)
+}
+
+func newTestServer(t *testing.T) (http.Handler, bbolt.Datastore, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "rest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := bbolt.NewDB(filepath.Join(dir, "botldb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var c config.Reader = deviceReader{Reader: Config, keys: filepath.Join(dir, "keys")}
+
+	l := logrus.New()
+	l.SetOutput(ioutil.Discard)
+
+	return NewServer(&backend.Backend{C: &c, D: d, L: l}, nil), d, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// call sends a request, decoding a JSON response into v when set
+func call(t *testing.T, h http.Handler, method string, path string, body string, v interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	if v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: %v: %s", method, path, err, rec.Body.String())
+		}
+	}
+
+	return rec
+}
+
+func errorCode(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	var body errorBody
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error == nil {
+		t.Fatalf("not an error body: %s", rec.Body.String())
+	}
+
+	return body.Error.Code
+}
+
+func TestKeys(t *testing.T) {
+	h, _, done := newTestServer(t)
+	defer done()
+
+	var health Health
+	assert.Equal(t, http.StatusOK, call(t, h, "GET", "/api/v1/health", "", &health).Code)
+	assert.Equal(t, "ok", health.Status)
+	assert.False(t, health.TSA)
+
+	var created Key
+	rec := call(t, h, "POST", "/api/v1/keys",
+		`{"name":"api-key","labels":["ci"],"tags":{"env":"prod"},"policy":{"hashes":["sha256"]}}`, &created)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "prime256v1", created.Curve)
+	assert.Equal(t, []string{"ci"}, created.Labels)
+	assert.Equal(t, "prod", created.Tags["env"])
+	assert.Equal(t, []string{"sha256"}, created.Policy.Hashes)
+
+	// Private material never reaches the client
+	assert.NotContains(t, strings.ToLower(rec.Body.String()), "private")
+
+	for i := 0; i < 3; i++ {
+		call(t, h, "POST", "/api/v1/keys", fmt.Sprintf(`{"name":"other-%d","curve":"secp384r1"}`, i), nil)
+	}
+
+	rec = call(t, h, "POST", "/api/v1/keys", `{"name":"api-key"}`, nil)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Equal(t, CodeConflict, errorCode(t, rec))
+
+	var got Key
+	assert.Equal(t, http.StatusOK, call(t, h, "GET", "/api/v1/keys/api-key", "", &got).Code)
+	assert.Equal(t, created.GID, got.GID)
+
+	rec = call(t, h, "GET", "/api/v1/keys/missing", "", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, CodeNotFound, errorCode(t, rec))
+
+	var page KeyList
+	call(t, h, "GET", "/api/v1/keys?sort=name&limit=2&offset=1", "", &page)
+	assert.Equal(t, 4, page.Total)
+	assert.Equal(t, 2, len(page.Keys))
+	assert.Equal(t, "other-0", page.Keys[0].Name)
+
+	call(t, h, "GET", "/api/v1/keys?curve=secp384r1&limit=10", "", &page)
+	assert.Equal(t, 3, page.Total)
+
+	var pub PublicKey
+	call(t, h, "GET", "/api/v1/keys/"+created.GID+"/public", "", &pub)
+	assert.Contains(t, pub.PEM, "PUBLIC KEY")
+
+	var archived Key
+	assert.Equal(t, http.StatusOK, call(t, h, "POST", "/api/v1/keys/api-key/archive", `{"reason":"done"}`, &archived).Code)
+	assert.Equal(t, "archive", archived.Status)
+
+	rec = call(t, h, "POST", "/api/v1/keys/api-key/archive", "", nil)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Equal(t, CodeKeyState, errorCode(t, rec))
+}
+
+func TestSignVerify(t *testing.T) {
+	h, d, done := newTestServer(t)
+	defer done()
+
+	var key Key
+	call(t, h, "POST", "/api/v1/keys", `{"name":"signer"}`, &key)
+
+	digest := sha256.Sum256([]byte("payload"))
+	body := fmt.Sprintf(`{"digest":"%x","hash":"sha256"}`, digest[:])
+
+	var s Signature
+	rec := call(t, h, "POST", "/api/v1/keys/signer/sign", body, &s)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotEmpty(t, s.Signature)
+	assert.Equal(t, Config.GetString("signature.mode"), s.Mode)
+
+	var v Verification
+	call(t, h, "POST", "/api/v1/keys/signer/verify",
+		fmt.Sprintf(`{"digest":"%x","hash":"sha256","signature":"%s"}`, digest[:], s.Signature), &v)
+	assert.True(t, v.Valid)
+
+	other := sha256.Sum256([]byte("other"))
+	call(t, h, "POST", "/api/v1/keys/signer/verify",
+		fmt.Sprintf(`{"digest":"%x","hash":"sha256","signature":"%s"}`, other[:], s.Signature), &v)
+	assert.False(t, v.Valid)
+
+	// Requests are validated before any key is touched
+	for _, bad := range []string{
+		`{"digest":"zz","hash":"sha256"}`,
+		`{"digest":"abcd","hash":"sha256"}`,
+		fmt.Sprintf(`{"digest":"%x"}`, digest[:]),
+		fmt.Sprintf(`{"digest":"%x","hash":"sha256","mode":"raw"}`, digest[:]),
+		fmt.Sprintf(`{"digest":"%x","hash":"sha256","extra":1}`, digest[:]),
+		`{"digest":`,
+	} {
+		rec := call(t, h, "POST", "/api/v1/keys/signer/sign", bad, nil)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, bad)
+		assert.Equal(t, CodeInvalidRequest, errorCode(t, rec), bad)
+	}
+
+	rec = call(t, h, "GET", "/api/v1/keys/signer/sign", "", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, http.MethodPost, rec.Header().Get("Allow"))
+
+	req := httptest.NewRequest("POST", "/api/v1/keys/signer/sign", bytes.NewReader([]byte(body)))
+	req.Header.Set("Content-Type", "text/plain")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+
+	// Archived keys refuse to sign
+	call(t, h, "POST", "/api/v1/keys/signer/archive", "", nil)
+	rec = call(t, h, "POST", "/api/v1/keys/signer/sign", body, nil)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Equal(t, CodeKeyState, errorCode(t, rec))
+
+	// Operations are audited, failures included
+	entries, err := audit.NewLog(Config, d).Entries(audit.Filter{Op: audit.OpSign})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, audit.ResultOK, entries[0].Result)
+	assert.Equal(t, audit.ResultFailed, entries[1].Result)
+	assert.True(t, strings.HasPrefix(entries[0].Actor, "api@"))
+}
+
+func TestSignVerifyRSA(t *testing.T) {
+	h, _, done := newTestServer(t)
+	defer done()
+
+	var key Key
+	rec := call(t, h, "POST", "/api/v1/keys", `{"name":"rsa","curve":"rsa2048"}`, &key)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "rsa2048", key.Curve)
+
+	digest := sha256.Sum256([]byte("payload"))
+	body := fmt.Sprintf(`{"digest":"%x","hash":"sha256","mode":"openssl"}`, digest[:])
+
+	var s Signature
+	rec = call(t, h, "POST", "/api/v1/keys/rsa/sign", body, &s)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var pub PublicKey
+	call(t, h, "GET", "/api/v1/keys/rsa/public", "", &pub)
+
+	block, _ := pem.Decode([]byte(pub.PEM))
+	generic, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _ := base64.StdEncoding.DecodeString(s.Signature)
+	assert.Nil(t, rsa.VerifyPKCS1v15(generic.(*rsa.PublicKey), gocrypto.SHA256, digest[:], raw))
+
+	var v Verification
+	call(t, h, "POST", "/api/v1/keys/rsa/verify",
+		fmt.Sprintf(`{"digest":"%x","hash":"sha256","mode":"openssl","signature":"%s"}`, digest[:], s.Signature), &v)
+	assert.True(t, v.Valid)
+
+	// RSA signs the raw digest of a hash it can name
+	for _, bad := range []string{
+		fmt.Sprintf(`{"digest":"%x","hash":"sha256","mode":"legacy"}`, digest[:]),
+		fmt.Sprintf(`{"digest":"%x","hash":"sha3-256","mode":"openssl"}`, digest[:]),
+	} {
+		rec := call(t, h, "POST", "/api/v1/keys/rsa/sign", bad, nil)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, bad)
+	}
+
+	rec = call(t, h, "POST", "/api/v1/keys", `{"name":"rsa1024","curve":"rsa1024"}`, nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestScope(t *testing.T) {
+	h, d, done := newTestServer(t)
+	defer done()
+
+	call(t, h, "POST", "/api/v1/keys", `{"name":"allowed"}`, nil)
+	call(t, h, "POST", "/api/v1/keys", `{"name":"other"}`, nil)
+
+	scoped := func(s *Scope, method string, path string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, WithScope(req, s))
+
+		return rec
+	}
+
+	s := &Scope{Actor: "ci", Permissions: []string{PermRead, PermSign}, Keys: []string{"allowed"}}
+
+	// Listing only shows the keys of the scope
+	var page KeyList
+	rec := scoped(s, "GET", "/api/v1/keys?limit=10", "")
+	json.Unmarshal(rec.Body.Bytes(), &page)
+	assert.Equal(t, 1, page.Total)
+	assert.Equal(t, "allowed", page.Keys[0].Name)
+
+	assert.Equal(t, http.StatusOK, scoped(s, "GET", "/api/v1/keys/allowed", "").Code)
+
+	rec = scoped(s, "GET", "/api/v1/keys/other", "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, CodeForbidden, errorCode(t, rec))
+
+	digest := sha256.Sum256([]byte("payload"))
+	body := fmt.Sprintf(`{"digest":"%x","hash":"sha256"}`, digest[:])
+
+	assert.Equal(t, http.StatusOK, scoped(s, "POST", "/api/v1/keys/allowed/sign", body).Code)
+	assert.Equal(t, http.StatusForbidden, scoped(s, "POST", "/api/v1/keys/other/sign", body).Code)
+
+	// Permissions not granted are refused, and clients limited to keys
+	// cannot create more
+	assert.Equal(t, http.StatusForbidden, scoped(s, "POST", "/api/v1/keys/allowed/archive", "").Code)
+	assert.Equal(t, http.StatusForbidden, scoped(s, "POST", "/api/v1/keys", `{"name":"new"}`).Code)
+
+	s.Permissions = append(s.Permissions, PermCreate)
+	assert.Equal(t, http.StatusForbidden, scoped(s, "POST", "/api/v1/keys", `{"name":"new"}`).Code)
+
+	// Refusals are audited under the scope's actor
+	entries, err := audit.NewLog(Config, d).Entries(audit.Filter{Op: audit.OpSign})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "ci", entries[1].Actor)
+	assert.Equal(t, audit.ResultFailed, entries[1].Result)
+}
+
+// approveAll stands in for the quorum of a daemon, approving every destroy
+// that carries a token
+type approveAll struct{}
+
+func (approveAll) Destroy(gid string, a Approvals) error {
+	if len(a.Tokens) == 0 {
+		return newError(http.StatusForbidden, CodeForbidden, "no approvals")
+	}
+
+	return nil
+}
+
+func TestLifecycle(t *testing.T) {
+	h, _, done := newTestServer(t)
+	defer done()
+
+	var key Key
+	call(t, h, "POST", "/api/v1/keys", `{"name":"cycled","labels":["old"]}`, &key)
+
+	call(t, h, "POST", "/api/v1/keys/cycled/labels", `{"add":["new"],"remove":["old"]}`, &key)
+	assert.Equal(t, []string{"new"}, key.Labels)
+
+	call(t, h, "POST", "/api/v1/keys/cycled/tags", `{"set":{"env":"prod"}}`, &key)
+	assert.Equal(t, "prod", key.Tags["env"])
+
+	rec := call(t, h, "POST", "/api/v1/keys/cycled/tags", `{"set":{"a=b":"c"}}`, nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	var n Reindexed
+	assert.Equal(t, http.StatusOK, call(t, h, "POST", "/api/v1/dsa/reindex", "", &n).Code)
+	assert.Equal(t, 1, n.Keys)
+
+	for _, status := range []string{"archive", "active", "compromised"} {
+		rec := call(t, h, "POST", "/api/v1/keys/cycled/status", fmt.Sprintf(`{"status":%q}`, status), &key)
+		assert.Equal(t, http.StatusOK, rec.Code, status)
+		assert.Equal(t, status, key.Status)
+	}
+
+	rec = call(t, h, "POST", "/api/v1/keys/cycled/status", `{"status":"active"}`, nil)
+	assert.Equal(t, CodeKeyState, errorCode(t, rec))
+
+	rec = call(t, h, "POST", "/api/v1/keys/cycled/status", `{"status":"gone"}`, nil)
+	assert.Equal(t, CodeInvalidRequest, errorCode(t, rec))
+
+	// Destroying takes the quorum of a handler in front of the server
+	destroy := func(body string, q Quorum) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/keys/cycled/status", strings.NewReader(body))
+		if q != nil {
+			req = WithQuorum(req, q)
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	assert.Equal(t, http.StatusForbidden, destroy(`{"status":"destroyed"}`, nil).Code)
+	assert.Equal(t, http.StatusForbidden, destroy(`{"status":"destroyed"}`, approveAll{}).Code)
+
+	rec = destroy(`{"status":"destroyed","approvals":{"tokens":[{}]}}`, approveAll{})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	json.Unmarshal(rec.Body.Bytes(), &key)
+	assert.Equal(t, "destroyed", key.Status)
+}
+
+func TestAliases(t *testing.T) {
+	h, _, done := newTestServer(t)
+	defer done()
+
+	var a struct {
+		Name     string `json:"name"`
+		Primary  int    `json:"primary"`
+		Versions []struct {
+			GID string `json:"gid"`
+		} `json:"versions"`
+	}
+
+	assert.Equal(t, http.StatusCreated, call(t, h, "POST", "/api/v1/aliases", `{"name":"release"}`, &a).Code)
+	assert.Equal(t, 1, a.Primary)
+
+	rec := call(t, h, "POST", "/api/v1/aliases", `{"name":"release"}`, nil)
+	assert.Equal(t, CodeConflict, errorCode(t, rec))
+
+	rec = call(t, h, "POST", "/api/v1/aliases", `{"name":"Bad Name"}`, nil)
+	assert.Equal(t, CodeInvalidRequest, errorCode(t, rec))
+
+	assert.Equal(t, http.StatusOK, call(t, h, "POST", "/api/v1/aliases/release/rotate", "", &a).Code)
+	assert.Equal(t, 2, a.Primary)
+	assert.Equal(t, 2, len(a.Versions))
+
+	var list AliasList
+	call(t, h, "GET", "/api/v1/aliases", "", &list)
+	assert.Equal(t, 1, len(list.Aliases))
+
+	rec = call(t, h, "GET", "/api/v1/aliases/missing", "", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// Batches by alias sign with the primary version
+	digest := sha256.Sum256([]byte("payload"))
+
+	var res BatchResponse
+	call(t, h, "POST", "/api/v1/dsa/batch",
+		fmt.Sprintf(`{"alias":"release","items":[{"id":"1","digest":"%x","hash":"sha256"}]}`, digest[:]), &res)
+	assert.Equal(t, a.Versions[1].GID, res.Key)
+	assert.Equal(t, 2, res.Version)
+
+	// Clients limited to keys only see the aliases they cover, and cannot
+	// create or rotate any
+	s := &Scope{Actor: "ci", Permissions: []string{PermRead, PermCreate}, Keys: []string{a.Versions[1].GID}}
+
+	req := httptest.NewRequest("GET", "/api/v1/aliases/release", nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, WithScope(req, s))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	s.Keys = []string{"release"}
+
+	req = httptest.NewRequest("GET", "/api/v1/aliases/release", nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, WithScope(req, s))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	req = httptest.NewRequest("POST", "/api/v1/aliases/release/rotate", nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, WithScope(req, s))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
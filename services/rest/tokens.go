@@ -0,0 +1,56 @@
+package rest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/block27/core/services/audit"
+)
+
+// Revoker revokes API tokens for handlers authenticating them in front of
+// the server. Revoke answers an *Error of status 404 for unknown IDs.
+type Revoker interface {
+	Revoke(id string) (*RevokedToken, error)
+}
+
+const revokerKey contextKey = 3
+
+// WithRevoker serves the token routes of a request with rv, they answer 404
+// without one
+func WithRevoker(r *http.Request, rv Revoker) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), revokerKey, rv))
+}
+
+// token serves POST /api/v1/tokens/{id}/revoke to scopes holding PermTokens
+func (s *server) token(w http.ResponseWriter, r *http.Request) {
+	rv, _ := r.Context().Value(revokerKey).(Revoker)
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, Prefix+"/tokens/"), "/", 2)
+	if rv == nil || len(parts) != 2 || parts[0] == "" || parts[1] != "revoke" {
+		s.writeError(w, r, newError(http.StatusNotFound, CodeNotFound, "no route %s", r.URL.Path))
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		s.methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+
+	op := s.audited(r, audit.OpAuth, "")
+	op.Detail = fmt.Sprintf("token revoke %s", parts[0])
+
+	if err := s.permit(r, PermTokens); err != nil {
+		s.respond(w, r, op, 0, nil, err)
+		return
+	}
+
+	t, err := rv.Revoke(parts[0])
+	if err != nil {
+		s.respond(w, r, op, 0, nil, err)
+		return
+	}
+
+	s.respond(w, r, op, http.StatusOK, t, nil)
+}
@@ -0,0 +1,120 @@
+package tsa
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/block27/core/crypto"
+)
+
+// Token is the decoded outcome of a TimeStampResp
+type Token struct {
+	Status       int
+	StatusString []string
+	FailInfo     asn1.BitString
+
+	Info *TSTInfo
+}
+
+// NewRequest builds a DER encoded TimeStampReq for a digest computed with alg.
+// A random 64 bit nonce is attached, the policy is optional.
+func NewRequest(digest []byte, alg string, policy asn1.ObjectIdentifier, certReq bool) ([]byte, *big.Int, error) {
+	oid, ok := hashOIDs[alg]
+	if !ok {
+		return nil, nil, fmt.Errorf("tsa: unsupported message imprint algorithm %s", alg)
+	}
+
+	nb := make([]byte, 8)
+	if _, err := io.ReadFull(crypto.Reader, nb); err != nil {
+		return nil, nil, err
+	}
+
+	nonce := new(big.Int).SetBytes(nb)
+
+	der, err := asn1.Marshal(Request{
+		Version: 1,
+		MessageImprint: MessageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oid},
+			HashedMessage: digest,
+		},
+		ReqPolicy: policy,
+		Nonce:     nonce,
+		CertReq:   certReq,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return der, nonce, nil
+}
+
+// ParseResponse decodes a TimeStampResp and, when granted, the TSTInfo found
+// inside its token. The token signature is not verified here.
+func ParseResponse(der []byte) (*Token, error) {
+	var resp response
+	if _, err := asn1.Unmarshal(der, &resp); err != nil {
+		return nil, err
+	}
+
+	t := &Token{
+		Status:   resp.Status.Status,
+		FailInfo: resp.Status.FailInfo,
+	}
+
+	for _, s := range resp.Status.StatusString {
+		t.StatusString = append(t.StatusString, string(s.Bytes))
+	}
+
+	if len(resp.TimeStampToken.FullBytes) == 0 {
+		return t, nil
+	}
+
+	info, err := tokenInfo(resp.TimeStampToken.FullBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Info = info
+
+	return t, nil
+}
+
+// GenTime is a helper returning the token time or the zero time
+func (t *Token) GenTime() time.Time {
+	if t.Info == nil {
+		return time.Time{}
+	}
+
+	return t.Info.GenTime
+}
+
+func tokenInfo(token []byte) (*TSTInfo, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(token, &ci); err != nil {
+		return nil, err
+	}
+
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("tsa: token is not CMS SignedData")
+	}
+
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, err
+	}
+
+	if !sd.EncapContentInfo.EContentType.Equal(oidTSTInfo) {
+		return nil, fmt.Errorf("tsa: token does not carry a TSTInfo")
+	}
+
+	var info TSTInfo
+	if _, err := asn1.Unmarshal(sd.EncapContentInfo.EContent, &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
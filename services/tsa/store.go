@@ -0,0 +1,162 @@
+package tsa
+
+import (
+	gocrypto "crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/helpers"
+	"github.com/block27/core/services/bbolt"
+	"github.com/block27/core/services/dsa/ecdsa"
+)
+
+var (
+	keyPointer  = []byte("key")
+	certPointer = []byte("cert")
+
+	// ErrNoPolicy is returned when tsa.policy is not configured
+	ErrNoPolicy = fmt.Errorf("tsa: tsa.policy is not configured, set the policy OID of this TSA in config.yaml")
+)
+
+// CreateCertificate issues a self-signed TSA certificate for the signer. The
+// extended key usage is restricted to timeStamping and marked critical as
+// required by RFC 3161 section 2.3.
+func CreateCertificate(s gocrypto.Signer, commonName string, validity time.Duration) (*x509.Certificate, error) {
+	sb := make([]byte, 16)
+	if _, err := io.ReadFull(crypto.Reader, sb); err != nil {
+		return nil, err
+	}
+
+	eku, err := asn1.Marshal([]asn1.ObjectIdentifier{oidTimeStamping})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	tmpl := &x509.Certificate{
+		SerialNumber: new(big.Int).SetBytes(sb),
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: []string{"Block27"},
+		},
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(validity),
+		KeyUsage:  x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment,
+		ExtraExtensions: []pkix.Extension{{
+			Id:       oidExtKeyUsage,
+			Critical: true,
+			Value:    eku,
+		}},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(crypto.Reader, tmpl, tmpl, s.Public(), s)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+// Setup creates the dedicated TSA key in the ECDSA keystore along with its
+// certificate, and records both in the datastore for Load
+func Setup(c config.Reader, d bbolt.Datastore, name string, curve string, commonName string) (TimestampAPI, error) {
+	if c.GetString("tsa.policy") == "" {
+		return nil, ErrNoPolicy
+	}
+
+	key, err := ecdsa.NewECDSA(c, name, curve)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := ecdsa.NewSigner(key)
+	if err != nil {
+		return nil, err
+	}
+
+	years := c.GetInt("tsa.validity_years")
+	cert, err := CreateCertificate(s, commonName, time.Duration(years)*365*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.Put(bucket, certPointer, cert.Raw); err != nil {
+		return nil, err
+	}
+
+	if err := d.Put(bucket, keyPointer, []byte(key.FilePointer())); err != nil {
+		return nil, err
+	}
+
+	return newFromConfig(c, d, s, cert)
+}
+
+// Load returns the TimestampAPI configured by a previous Setup
+func Load(c config.Reader, d bbolt.Datastore) (TimestampAPI, error) {
+	gid, err := d.Get(bucket, keyPointer)
+	if err != nil {
+		return nil, err
+	}
+
+	if gid == nil {
+		return nil, fmt.Errorf("%s", helpers.RFgB("tsa is not configured, run `tsa setup`"))
+	}
+
+	key, err := ecdsa.GetECDSA(c, string(gid))
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := ecdsa.NewSigner(key)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := d.Get(bucket, certPointer)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return newFromConfig(c, d, s, cert)
+}
+
+// newFromConfig reads the default and accepted policies from config.yaml.
+// The default policy is the operator's own, an unset tsa.policy is an error
+// rather than a made up OID in every token issued
+func newFromConfig(c config.Reader, d bbolt.Datastore, s gocrypto.Signer, cert *x509.Certificate) (TimestampAPI, error) {
+	if c.GetString("tsa.policy") == "" {
+		return nil, ErrNoPolicy
+	}
+
+	policy, err := ParseOID(c.GetString("tsa.policy"))
+	if err != nil {
+		return nil, err
+	}
+
+	var policies []asn1.ObjectIdentifier
+
+	for _, p := range c.GetStringSlice("tsa.policies") {
+		oid, err := ParseOID(p)
+		if err != nil {
+			return nil, err
+		}
+
+		policies = append(policies, oid)
+	}
+
+	return NewAuthority(d, s, cert, policy, policies)
+}
@@ -0,0 +1,415 @@
+package tsa
+
+import (
+	"bytes"
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/block27/core/crypto"
+	"github.com/block27/core/services/bbolt"
+)
+
+const (
+	// ContentTypeQuery is the media type of a DER encoded TimeStampReq
+	ContentTypeQuery = "application/timestamp-query"
+
+	// ContentTypeReply is the media type of a DER encoded TimeStampResp
+	ContentTypeReply = "application/timestamp-reply"
+
+	// bucket holding the TSA key pointer, certificate and serial counter
+	bucket = "tsa"
+
+	// bucket holding a record of every token issued, keyed by serial
+	serialsBucket = "tsa.serials"
+)
+
+// TimestampAPI main api for issuing RFC 3161 time-stamp tokens
+type TimestampAPI interface {
+	Certificate() *x509.Certificate
+	Policy() asn1.ObjectIdentifier
+
+	Respond([]byte) ([]byte, error)
+}
+
+// Issued is the record persisted for every serial number handed out
+type Issued struct {
+	Serial  string    `json:"serial"`
+	GenTime time.Time `json:"gen_time"`
+	Policy  string    `json:"policy"`
+	Hash    string    `json:"hash"`
+	Imprint []byte    `json:"imprint"`
+	Nonce   string    `json:"nonce,omitempty"`
+}
+
+// authority holds the signing material and policy of the TSA
+type authority struct {
+	d      bbolt.Datastore
+	signer gocrypto.Signer
+	cert   *x509.Certificate
+
+	policy   asn1.ObjectIdentifier
+	policies []asn1.ObjectIdentifier
+}
+
+// NewAuthority returns a TimestampAPI signing with the signer passed, whose
+// public key must match the certificate. The default policy is used when a
+// request does not ask for one, any of the extra policies may be requested.
+func NewAuthority(d bbolt.Datastore, s gocrypto.Signer, cert *x509.Certificate,
+	policy asn1.ObjectIdentifier, policies []asn1.ObjectIdentifier) (TimestampAPI, error) {
+	if _, ok := s.Public().(*ecdsa.PublicKey); !ok {
+		return nil, fmt.Errorf("tsa: only ECDSA signing keys are supported")
+	}
+
+	if len(policy) == 0 {
+		return nil, fmt.Errorf("tsa: a default policy OID is required")
+	}
+
+	return &authority{
+		d:        d,
+		signer:   s,
+		cert:     cert,
+		policy:   policy,
+		policies: policies,
+	}, nil
+}
+
+// Certificate returns the TSA signing certificate
+func (a *authority) Certificate() *x509.Certificate {
+	return a.cert
+}
+
+// Policy returns the default policy OID stamped on tokens
+func (a *authority) Policy() asn1.ObjectIdentifier {
+	return a.policy
+}
+
+// Respond takes a DER encoded TimeStampReq and always produces a DER encoded
+// TimeStampResp, malformed or unacceptable requests result in a rejection
+// carrying the matching PKIFailureInfo. An error is returned only when the
+// response itself could not be encoded.
+func (a *authority) Respond(der []byte) ([]byte, error) {
+	var req Request
+
+	rest, err := asn1.Unmarshal(der, &req)
+	if err != nil || len(rest) != 0 {
+		return reject(FailBadDataFormat, "malformed TimeStampReq")
+	}
+
+	if req.Version != 1 {
+		return reject(FailBadRequest, "unsupported request version")
+	}
+
+	alg, ok := hashName(req.MessageImprint.HashAlgorithm.Algorithm)
+	if !ok {
+		return reject(FailBadAlg, "unsupported message imprint algorithm")
+	}
+
+	h, _ := crypto.NewHash(alg)
+	if len(req.MessageImprint.HashedMessage) != h.Size() {
+		return reject(FailBadDataFormat, "message imprint length does not match algorithm")
+	}
+
+	if len(req.Extensions) != 0 {
+		return reject(FailUnacceptedExtension, "request extensions are not supported")
+	}
+
+	policy := a.policy
+	if len(req.ReqPolicy) != 0 {
+		if !a.accepts(req.ReqPolicy) {
+			return reject(FailUnacceptedPolicy, "requested policy is not supported")
+		}
+
+		policy = req.ReqPolicy
+	}
+
+	serial, err := a.d.NextSequence(serialsBucket)
+	if err != nil {
+		return reject(FailSystemFailure, "serial number unavailable")
+	}
+
+	info := TSTInfo{
+		Version:        1,
+		Policy:         policy,
+		MessageImprint: req.MessageImprint,
+		SerialNumber:   new(big.Int).SetUint64(serial),
+		GenTime:        time.Now().UTC().Truncate(time.Second),
+		Accuracy:       accuracy{Seconds: 1},
+		Nonce:          req.Nonce,
+	}
+
+	if a.cert != nil {
+		name, err := generalName(a.cert.RawSubject)
+		if err != nil {
+			return reject(FailSystemFailure, "invalid TSA name")
+		}
+
+		info.TSA = name
+	}
+
+	token, err := a.sign(info, req.CertReq)
+	if err != nil {
+		return reject(FailSystemFailure, "failed to sign token")
+	}
+
+	if err := a.record(info, alg); err != nil {
+		return reject(FailSystemFailure, "failed to record serial number")
+	}
+
+	return asn1.Marshal(response{
+		Status:         pkiStatusInfo{Status: StatusGranted},
+		TimeStampToken: asn1.RawValue{FullBytes: token},
+	})
+}
+
+func (a *authority) accepts(oid asn1.ObjectIdentifier) bool {
+	if oid.Equal(a.policy) {
+		return true
+	}
+
+	for _, p := range a.policies {
+		if oid.Equal(p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// record persists the issued token details under its serial number
+func (a *authority) record(info TSTInfo, alg string) error {
+	issued := Issued{
+		Serial:  info.SerialNumber.String(),
+		GenTime: info.GenTime,
+		Policy:  info.Policy.String(),
+		Hash:    alg,
+		Imprint: info.MessageImprint.HashedMessage,
+	}
+
+	if info.Nonce != nil {
+		issued.Nonce = info.Nonce.String()
+	}
+
+	data, err := json.Marshal(issued)
+	if err != nil {
+		return err
+	}
+
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, info.SerialNumber.Uint64())
+
+	return a.d.Put(serialsBucket, key, data)
+}
+
+// sign wraps the TSTInfo in a CMS SignedData, RFC 3161 section 2.4.2
+func (a *authority) sign(info TSTInfo, certReq bool) ([]byte, error) {
+	content, err := asn1.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+
+	alg := crypto.HashForCurve(a.signer.Public().(*ecdsa.PublicKey).Params().BitSize)
+	digestAlg := pkix.AlgorithmIdentifier{Algorithm: hashOIDs[alg]}
+
+	attrs, err := a.signedAttributes(content, alg)
+	if err != nil {
+		return nil, err
+	}
+
+	// The signature covers the attributes encoded as an explicit SET OF
+	toSign, err := asn1.Marshal(asn1.RawValue{
+		Class:      asn1.ClassUniversal,
+		Tag:        asn1.TagSet,
+		IsCompound: true,
+		Bytes:      attrs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	h, _ := crypto.NewHash(alg)
+	h.Write(toSign)
+
+	sig, err := a.signer.Sign(crypto.Reader, h.Sum(nil), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	sd := signedData{
+		Version:          3,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{digestAlg},
+		EncapContentInfo: encapContentInfo{
+			EContentType: oidTSTInfo,
+			EContent:     content,
+		},
+		SignerInfos: []signerInfo{{
+			Version: 1,
+			SID: issuerAndSerial{
+				Issuer: asn1.RawValue{FullBytes: a.cert.RawIssuer},
+				Serial: a.cert.SerialNumber,
+			},
+			DigestAlgorithm: digestAlg,
+			SignedAttrs: asn1.RawValue{
+				Class:      asn1.ClassContextSpecific,
+				Tag:        0,
+				IsCompound: true,
+				Bytes:      attrs,
+			},
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: signatureOIDs[alg]},
+			Signature:          sig,
+		}},
+	}
+
+	if certReq {
+		sd.Certificates = asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      a.cert.Raw,
+		}
+	}
+
+	sdDER, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      sdDER,
+		},
+	})
+}
+
+// signedAttributes returns the DER sorted content of the signed attributes:
+// content type, message digest and the ESS signing certificate
+func (a *authority) signedAttributes(content []byte, alg string) ([]byte, error) {
+	h, _ := crypto.NewHash(alg)
+	h.Write(content)
+
+	certHash, err := crypto.DigestReader(bytes.NewReader(a.cert.Raw), crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	values := []struct {
+		oid asn1.ObjectIdentifier
+		val interface{}
+	}{
+		{oidContentType, oidTSTInfo},
+		{oidMessageDigest, h.Sum(nil)},
+		{oidSigningCertificateV2, signingCertificateV2{
+			Certs: []essCertIDv2{{CertHash: certHash}},
+		}},
+	}
+
+	var encoded [][]byte
+
+	for _, v := range values {
+		val, err := asn1.Marshal(v.val)
+		if err != nil {
+			return nil, err
+		}
+
+		attr, err := asn1.Marshal(attribute{
+			Type:   v.oid,
+			Values: []asn1.RawValue{{FullBytes: val}},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		encoded = append(encoded, attr)
+	}
+
+	// DER requires the members of a SET OF in ascending encoded order
+	sort.Slice(encoded, func(i, j int) bool {
+		return bytes.Compare(encoded[i], encoded[j]) < 0
+	})
+
+	return bytes.Join(encoded, nil), nil
+}
+
+// reject builds a TimeStampResp with status rejection and a single failure bit
+func reject(bit int, reason string) ([]byte, error) {
+	fail := asn1.BitString{
+		Bytes:     make([]byte, bit/8+1),
+		BitLength: bit + 1,
+	}
+	fail.Bytes[bit/8] |= 0x80 >> uint(bit%8)
+
+	return asn1.Marshal(response{
+		Status: pkiStatusInfo{
+			Status: StatusRejection,
+			StatusString: []asn1.RawValue{{
+				Tag:   asn1.TagUTF8String,
+				Bytes: []byte(reason),
+			}},
+			FailInfo: fail,
+		},
+	})
+}
+
+// generalName wraps a raw subject as a [0] directoryName GeneralName
+func generalName(rawSubject []byte) (asn1.RawValue, error) {
+	dn, err := asn1.Marshal(asn1.RawValue{
+		Class:      asn1.ClassContextSpecific,
+		Tag:        4,
+		IsCompound: true,
+		Bytes:      rawSubject,
+	})
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+
+	return asn1.RawValue{
+		Class:      asn1.ClassContextSpecific,
+		Tag:        0,
+		IsCompound: true,
+		Bytes:      dn,
+	}, nil
+}
+
+func hashName(oid asn1.ObjectIdentifier) (string, bool) {
+	for name, o := range hashOIDs {
+		if o.Equal(oid) {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// ParseOID parses a dotted decimal object identifier such as 1.2.3.4.1
+func ParseOID(s string) (asn1.ObjectIdentifier, error) {
+	var oid asn1.ObjectIdentifier
+
+	for _, p := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid OID: %s", s)
+		}
+
+		oid = append(oid, n)
+	}
+
+	if len(oid) < 2 {
+		return nil, fmt.Errorf("invalid OID: %s", s)
+	}
+
+	return oid, nil
+}
@@ -0,0 +1,241 @@
+package tsa
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/block27/core/config"
+	"github.com/block27/core/services/bbolt"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testPolicy  = asn1.ObjectIdentifier{1, 2, 3, 4, 1}
+	extraPolicy = asn1.ObjectIdentifier{1, 2, 3, 4, 2}
+)
+
+func newTestAuthority(t *testing.T) (TimestampAPI, bbolt.Datastore, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "tsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := bbolt.NewDB(filepath.Join(dir, "tsa.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pri, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := CreateCertificate(pri, "Test TSA", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewAuthority(d, pri, cert, testPolicy, []asn1.ObjectIdentifier{extraPolicy})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a, d, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// verifyToken checks the CMS signature over the signed attributes and that
+// the message digest attribute matches the encapsulated TSTInfo
+func verifyToken(t *testing.T, a TimestampAPI, resp []byte) {
+	t.Helper()
+
+	var r response
+	if _, err := asn1.Unmarshal(resp, &r); err != nil {
+		t.Fatal(err)
+	}
+
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(r.TimeStampToken.FullBytes, &ci); err != nil {
+		t.Fatal(err)
+	}
+
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		t.Fatal(err)
+	}
+
+	si := sd.SignerInfos[0]
+	signed, _ := asn1.Marshal(asn1.RawValue{
+		Tag:        asn1.TagSet,
+		IsCompound: true,
+		Bytes:      si.SignedAttrs.Bytes,
+	})
+
+	digest := sha256.Sum256(signed)
+	rs := struct{ R, S *big.Int }{}
+	if _, err := asn1.Unmarshal(si.Signature, &rs); err != nil {
+		t.Fatal(err)
+	}
+
+	pub := a.Certificate().PublicKey.(*ecdsa.PublicKey)
+	if !ecdsa.Verify(pub, digest[:], rs.R, rs.S) {
+		t.Fatal("token signature did not verify")
+	}
+
+	content := sha256.Sum256(sd.EncapContentInfo.EContent)
+	assert.Contains(t, string(si.SignedAttrs.Bytes), string(content[:]))
+}
+
+func TestCreateCertificate(t *testing.T) {
+	a, _, done := newTestAuthority(t)
+	defer done()
+
+	cert := a.Certificate()
+	found := false
+
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidExtKeyUsage) {
+			found = ext.Critical
+		}
+	}
+
+	if !found {
+		t.Fatal("extended key usage must be present and critical")
+	}
+}
+
+func TestRespondGranted(t *testing.T) {
+	a, _, done := newTestAuthority(t)
+	defer done()
+
+	digest := sha256.Sum256([]byte("hello"))
+
+	req, nonce, err := NewRequest(digest[:], "sha256", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := a.Respond(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok, err := ParseResponse(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, StatusGranted, tok.Status)
+	assert.Equal(t, 0, tok.Info.Nonce.Cmp(nonce))
+	assert.True(t, tok.Info.Policy.Equal(testPolicy))
+	assert.Equal(t, digest[:], tok.Info.MessageImprint.HashedMessage)
+	assert.Equal(t, int64(1), tok.Info.SerialNumber.Int64())
+
+	verifyToken(t, a, resp)
+
+	// Serial numbers must never repeat
+	resp, _ = a.Respond(req)
+	tok, _ = ParseResponse(resp)
+	assert.Equal(t, int64(2), tok.Info.SerialNumber.Int64())
+}
+
+func TestRespondPolicy(t *testing.T) {
+	a, _, done := newTestAuthority(t)
+	defer done()
+
+	digest := sha256.Sum256([]byte("hello"))
+
+	req, _, _ := NewRequest(digest[:], "sha256", extraPolicy, false)
+	resp, _ := a.Respond(req)
+	tok, _ := ParseResponse(resp)
+
+	assert.Equal(t, StatusGranted, tok.Status)
+	assert.True(t, tok.Info.Policy.Equal(extraPolicy))
+
+	req, _, _ = NewRequest(digest[:], "sha256", asn1.ObjectIdentifier{1, 9, 9}, false)
+	resp, _ = a.Respond(req)
+	tok, _ = ParseResponse(resp)
+
+	assert.Equal(t, StatusRejection, tok.Status)
+	assert.Equal(t, 1, tok.FailInfo.At(FailUnacceptedPolicy))
+}
+
+func TestRespondRejections(t *testing.T) {
+	a, _, done := newTestAuthority(t)
+	defer done()
+
+	// Garbage in
+	resp, err := a.Respond([]byte("junk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok, _ := ParseResponse(resp)
+	assert.Equal(t, StatusRejection, tok.Status)
+	assert.Equal(t, 1, tok.FailInfo.At(FailBadDataFormat))
+
+	// Imprint length does not match the algorithm
+	req, _, _ := NewRequest([]byte("short"), "sha256", nil, false)
+	resp, _ = a.Respond(req)
+	tok, _ = ParseResponse(resp)
+	assert.Equal(t, 1, tok.FailInfo.At(FailBadDataFormat))
+
+	if _, _, err := NewRequest([]byte("short"), "md5", nil, false); err == nil {
+		t.Fatal("unsupported imprint algorithm accepted")
+	}
+}
+
+func TestParseOID(t *testing.T) {
+	oid, err := ParseOID("1.2.3.4.1")
+	if err != nil || !oid.Equal(testPolicy) {
+		t.Fatal("failed to parse OID")
+	}
+
+	for _, bad := range []string{"", "1", "1.a.3", "1.-2"} {
+		if _, err := ParseOID(bad); err == nil {
+			t.Fatalf("invalid OID %q accepted", bad)
+		}
+	}
+}
+
+func TestNewFromConfigPolicy(t *testing.T) {
+	pri, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := CreateCertificate(pri, "Test TSA", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := viper.New()
+	config.Defaults(c)
+
+	if _, err := newFromConfig(c, nil, pri, cert); err != ErrNoPolicy {
+		t.Fatalf("TSA started without a policy: %v", err)
+	}
+
+	c.Set("tsa.policy", testPolicy.String())
+
+	a, err := newFromConfig(c, nil, pri, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, a.Policy().Equal(testPolicy))
+}
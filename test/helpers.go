@@ -24,3 +24,9 @@ func ByteEq(t *testing.T, a, b []byte) bool {
 
 	return true
 }
+
+// MasterKey and MasterIv stand in for the hardware master key/iv in tests
+const (
+	MasterKey = "c7xkq2m9w4t6hz8p3nbd5vjf1gr0ys2a"
+	MasterIv  = "u4e8n2k6p9w3r7tz"
+)
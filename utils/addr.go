@@ -19,6 +19,20 @@ func EnsureAddrIPPort(a string) error {
 	return nil
 }
 
+// LocalNetworks returns the networks that are not globally routable,
+// except the IPv4 mapped range, which net.IPNet takes for every IPv4
+// address.
+func LocalNetworks() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, n := range unsuitableNetworks {
+		if n.IP.To4() != nil && len(n.Mask) == net.IPv6len {
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
 // GetExternalIPv4Address attempts to guess an external IPv4 address by
 // interface enumeration.
 func GetExternalIPv4Address() (net.IP, error) {
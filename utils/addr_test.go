@@ -1,6 +1,9 @@
 package utils
 
-import "testing"
+import (
+	"net"
+	"testing"
+)
 
 func TestEnsureAddrIPPort(t *testing.T) {
 	if EnsureAddrIPPort("192.168.100.104") == nil {
@@ -15,3 +18,28 @@ func TestEnsureAddrIPPort(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestLocalNetworks(t *testing.T) {
+	local := func(ip string) bool {
+		for _, n := range LocalNetworks() {
+			if n.Contains(net.ParseIP(ip)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !local("127.0.0.1") || !local("10.1.2.3") || !local("fe80::1") {
+		t.Fail()
+	}
+
+	if local("8.8.8.8") || local("2001:4860:4860::8888") {
+		t.Fail()
+	}
+
+	// Callers cannot alter the list
+	LocalNetworks()[0] = nil
+	if LocalNetworks()[0] == nil {
+		t.Fail()
+	}
+}